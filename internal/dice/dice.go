@@ -0,0 +1,145 @@
+// Package dice parses standard tabletop dice notation such as "2d6+3",
+// "4d6kh3", "1d20 adv", "3d6!" or "1d8+2d6" and evaluates it with a supplied
+// random number generator.
+//
+// An expression is a sum of signed terms. Each term is either a constant or a
+// pool of identical dice with optional modifiers:
+//
+//	NdS     roll N dice with S sides (N defaults to 1, "d%" is a d100)
+//	!       explode: every die showing its maximum adds another die
+//	khN     keep the highest N dice (kN is shorthand)
+//	klN     keep the lowest N dice
+//	dhN     drop the highest N dice
+//	dlN     drop the lowest N dice
+//	adv     roll a single die twice and keep the highest
+//	dis     roll a single die twice and keep the lowest
+package dice
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Limits applied while parsing, so an expression cannot make the evaluator do
+// unbounded work.
+const (
+	MaxDice       = 1000
+	MaxSides      = 1000
+	MaxTerms      = 20
+	MaxConstant   = 1000000
+	MaxLength     = 256
+	MaxExplosions = 100
+)
+
+// Selection chooses which dice of a pool count towards its subtotal.
+type Selection int
+
+const (
+	KeepAll Selection = iota
+	KeepHighest
+	KeepLowest
+	DropHighest
+	DropLowest
+)
+
+var selectionNotation = map[Selection]string{
+	KeepHighest: "kh",
+	KeepLowest:  "kl",
+	DropHighest: "dh",
+	DropLowest:  "dl",
+}
+
+// Expression is the parsed form of a dice expression.
+type Expression struct {
+	Terms []Term
+}
+
+// Term is one signed summand of an expression. Dice terms have Sides > 0;
+// constant terms carry their value in Constant.
+type Term struct {
+	Negative bool
+	Count    int
+	Sides    int
+	Constant int
+	Explode  bool
+	Select   Selection
+	SelectN  int
+}
+
+// IsDice reports whether the term rolls dice rather than adding a constant.
+func (t Term) IsDice() bool {
+	return t.Sides > 0
+}
+
+// String returns the canonical notation of the term without its sign.
+func (t Term) String() string {
+	if !t.IsDice() {
+		return strconv.Itoa(t.Constant)
+	}
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(t.Count))
+	b.WriteByte('d')
+	b.WriteString(strconv.Itoa(t.Sides))
+	if t.Explode {
+		b.WriteByte('!')
+	}
+	if t.Select != KeepAll {
+		b.WriteString(selectionNotation[t.Select])
+		b.WriteString(strconv.Itoa(t.SelectN))
+	}
+	return b.String()
+}
+
+// String returns the canonical notation of the expression, e.g. "2d20kh1+5"
+// for "1d20 adv + 5".
+func (e Expression) String() string {
+	var b strings.Builder
+	for i, term := range e.Terms {
+		switch {
+		case term.Negative:
+			b.WriteByte('-')
+		case i > 0:
+			b.WriteByte('+')
+		}
+		b.WriteString(term.String())
+	}
+	return b.String()
+}
+
+// DiceCount returns the number of dice rolled before any explosions.
+func (e Expression) DiceCount() int {
+	count := 0
+	for _, term := range e.Terms {
+		if term.IsDice() {
+			count += term.Count
+		}
+	}
+	return count
+}
+
+// Bounds returns the lowest and highest total the expression can roll. It
+// reports false for exploding dice, whose total has no practical maximum.
+func (e Expression) Bounds() (lo, hi int, ok bool) {
+	for _, term := range e.Terms {
+		termLo, termHi := term.Constant, term.Constant
+		if term.IsDice() {
+			if term.Explode {
+				return 0, 0, false
+			}
+			kept := term.Count
+			switch term.Select {
+			case KeepHighest, KeepLowest:
+				kept = min(term.SelectN, term.Count)
+			case DropHighest, DropLowest:
+				kept = max(term.Count-term.SelectN, 0)
+			}
+			termLo, termHi = kept, kept*term.Sides
+		}
+		if term.Negative {
+			termLo, termHi = -termHi, -termLo
+		}
+		lo += termLo
+		hi += termHi
+	}
+	return lo, hi, true
+}
@@ -0,0 +1,181 @@
+package dice
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// sequence replays fixed face values for a die with the given sides.
+type sequence struct {
+	sides  int
+	values []int
+}
+
+func (s *sequence) Float64() float64 {
+	if len(s.values) == 0 {
+		panic("sequence exhausted")
+	}
+	v := s.values[0]
+	s.values = s.values[1:]
+	return (float64(v) - 0.5) / float64(s.sides)
+}
+
+func TestParseCanonicalForm(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: "2d6+3", want: "2d6+3"},
+		{src: "d20", want: "1d20"},
+		{src: "4d6kh3", want: "4d6kh3"},
+		{src: "4d6k3", want: "4d6kh3"},
+		{src: "4D6DL1", want: "4d6dl1"},
+		{src: "1d20 adv", want: "2d20kh1"},
+		{src: "1d20dis + 2", want: "2d20kl1+2"},
+		{src: "1d20+5 adv", want: "2d20kh1+5"},
+		{src: "3d6!", want: "3d6!"},
+		{src: "1d8 + 2d6 - 1", want: "1d8+2d6-1"},
+		{src: "-1+d%", want: "-1+1d100"},
+	}
+	for _, tt := range tests {
+		expr, err := Parse(tt.src)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.src, err)
+			continue
+		}
+		if got := expr.String(); got != tt.want {
+			t.Errorf("Parse(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExpressionBounds(t *testing.T) {
+	tests := []struct {
+		src    string
+		lo, hi int
+		ok     bool
+	}{
+		{src: "1d100", lo: 1, hi: 100, ok: true},
+		{src: "2d6+3", lo: 5, hi: 15, ok: true},
+		{src: "4d6kh3", lo: 3, hi: 18, ok: true},
+		{src: "1d8-1d4", lo: -3, hi: 7, ok: true},
+		{src: "3d6!", ok: false},
+	}
+	for _, tt := range tests {
+		expr, err := Parse(tt.src)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.src, err)
+		}
+		if lo, hi, ok := expr.Bounds(); lo != tt.lo || hi != tt.hi || ok != tt.ok {
+			t.Errorf("Bounds(%q) = %d, %d, %v, want %d, %d, %v", tt.src, lo, hi, ok, tt.lo, tt.hi, tt.ok)
+		}
+	}
+}
+
+func TestParseRejectsInvalidExpressions(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"d",
+		"2d",
+		"2d1",
+		"0d6",
+		"1001d6",
+		"1d1001",
+		"2d6+",
+		"2d6 3",
+		"4d6kh5",
+		"4d6dl4",
+		"4d6kh1kl1",
+		"2d20 adv",
+		"1d20+1d8+1 adv",
+		"5 adv",
+		"600d6+600d6",
+		"2d6*2",
+	} {
+		_, err := Parse(src)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%q) = %v, want a SyntaxError", src, err)
+		}
+	}
+}
+
+func TestEvaluateBreakdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		sides int
+		rolls []int
+		total int
+		kept  [][]bool
+	}{
+		{name: "modifier", src: "2d6+3", sides: 6, rolls: []int{2, 5}, total: 10, kept: [][]bool{{true, true}, nil}},
+		{name: "keep highest", src: "4d6kh3", sides: 6, rolls: []int{3, 1, 6, 3}, total: 12, kept: [][]bool{{true, false, true, true}}},
+		{name: "drop lowest ties", src: "3d6dl1", sides: 6, rolls: []int{2, 2, 4}, total: 6, kept: [][]bool{{false, true, true}}},
+		{name: "advantage", src: "1d20 adv", sides: 20, rolls: []int{7, 15}, total: 15, kept: [][]bool{{false, true}}},
+		{name: "disadvantage", src: "d20 dis - 1", sides: 20, rolls: []int{7, 15}, total: 6, kept: [][]bool{{true, false}, nil}},
+		{name: "explode", src: "2d6!", sides: 6, rolls: []int{6, 6, 2, 4}, total: 18, kept: [][]bool{{true, true, true, true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := Parse(tt.src)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			result := Evaluate(expr, &sequence{sides: tt.sides, values: append([]int{}, tt.rolls...)})
+			if result.Total != tt.total {
+				t.Fatalf("total = %d, want %d (%+v)", result.Total, tt.total, result)
+			}
+			if !reflect.DeepEqual(result.Values(), tt.rolls) {
+				t.Fatalf("values = %v, want %v", result.Values(), tt.rolls)
+			}
+			for i, term := range result.Terms {
+				var kept []bool
+				for _, die := range term.Dice {
+					kept = append(kept, !die.Dropped)
+				}
+				if !reflect.DeepEqual(kept, tt.kept[i]) {
+					t.Fatalf("term %d kept = %v, want %v", i, kept, tt.kept[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateExplodingDiceMarksTriggers(t *testing.T) {
+	expr, err := Parse("1d4!")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	result := Evaluate(expr, &sequence{sides: 4, values: []int{4, 4, 1}})
+	want := []Die{{Value: 4, Exploded: true}, {Value: 4, Exploded: true}, {Value: 1}}
+	if !reflect.DeepEqual(result.Terms[0].Dice, want) {
+		t.Fatalf("dice = %+v, want %+v", result.Terms[0].Dice, want)
+	}
+}
+
+func TestEvaluateMixedPools(t *testing.T) {
+	expr, err := Parse("1d8+2d6-2")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	// 0.55 maps to 5 on a d8 and 4 on a d6.
+	result := Evaluate(expr, constant(0.55))
+	if result.Total != 5+4+4-2 {
+		t.Fatalf("total = %d, breakdown %+v", result.Total, result)
+	}
+	if len(result.Terms) != 3 || result.Terms[0].Sides != 8 || result.Terms[1].Sides != 6 || !result.Terms[2].Negative {
+		t.Fatalf("unexpected breakdown: %+v", result.Terms)
+	}
+	if sides := result.Sides(); !reflect.DeepEqual(sides, []int{8, 6, 6}) {
+		t.Fatalf("sides = %v", sides)
+	}
+	if result.Modifier() != -2 {
+		t.Fatalf("modifier = %d, want -2", result.Modifier())
+	}
+}
+
+type constant float64
+
+func (c constant) Float64() float64 { return float64(c) }
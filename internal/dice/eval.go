@@ -0,0 +1,153 @@
+package dice
+
+import "sort"
+
+// RNG supplies the randomness for Evaluate. Float64 returns values in [0, 1);
+// *math/rand.Rand satisfies it, as does any seeded generator whose sequence
+// can be replayed to verify a roll.
+type RNG interface {
+	Float64() float64
+}
+
+// Result is the outcome of evaluating an expression.
+type Result struct {
+	Expression string       `json:"expression"`
+	Terms      []TermResult `json:"terms"`
+	Total      int          `json:"total"`
+}
+
+// TermResult is the breakdown of a single term. Subtotal is the value of the
+// term before its sign is applied.
+type TermResult struct {
+	Notation string `json:"notation"`
+	Negative bool   `json:"negative,omitempty"`
+	Sides    int    `json:"sides,omitempty"`
+	Dice     []Die  `json:"dice,omitempty"`
+	Subtotal int    `json:"subtotal"`
+}
+
+// Die is one rolled die. Exploded marks a die that rolled its maximum and
+// triggered the die after it; Dropped marks a die excluded by keep/drop.
+type Die struct {
+	Value    int  `json:"value"`
+	Exploded bool `json:"exploded,omitempty"`
+	Dropped  bool `json:"dropped,omitempty"`
+}
+
+// Evaluate rolls every dice term of expr in order using rng.
+func Evaluate(expr Expression, rng RNG) Result {
+	result := Result{
+		Expression: expr.String(),
+		Terms:      make([]TermResult, 0, len(expr.Terms)),
+	}
+	for _, term := range expr.Terms {
+		tr := TermResult{Notation: term.String(), Negative: term.Negative}
+		if term.IsDice() {
+			tr.Sides = term.Sides
+			tr.Dice = rollTerm(term, rng)
+			for _, die := range tr.Dice {
+				if !die.Dropped {
+					tr.Subtotal += die.Value
+				}
+			}
+		} else {
+			tr.Subtotal = term.Constant
+		}
+		if term.Negative {
+			result.Total -= tr.Subtotal
+		} else {
+			result.Total += tr.Subtotal
+		}
+		result.Terms = append(result.Terms, tr)
+	}
+	return result
+}
+
+// Values returns the face value of every die rolled, in roll order, including
+// dropped and exploded dice.
+func (r Result) Values() []int {
+	values := make([]int, 0)
+	for _, term := range r.Terms {
+		for _, die := range term.Dice {
+			values = append(values, die.Value)
+		}
+	}
+	return values
+}
+
+// Sides returns the number of sides of every die rolled, aligned with Values.
+func (r Result) Sides() []int {
+	sides := make([]int, 0)
+	for _, term := range r.Terms {
+		for range term.Dice {
+			sides = append(sides, term.Sides)
+		}
+	}
+	return sides
+}
+
+// Modifier returns the signed sum of the constant terms.
+func (r Result) Modifier() int {
+	modifier := 0
+	for _, term := range r.Terms {
+		if term.Sides > 0 {
+			continue
+		}
+		if term.Negative {
+			modifier -= term.Subtotal
+		} else {
+			modifier += term.Subtotal
+		}
+	}
+	return modifier
+}
+
+func rollTerm(term Term, rng RNG) []Die {
+	dice := make([]Die, 0, term.Count)
+	explosions := 0
+	for i := 0; i < term.Count; i++ {
+		value := rollDie(rng, term.Sides)
+		for term.Explode && value == term.Sides && explosions < MaxExplosions {
+			dice = append(dice, Die{Value: value, Exploded: true})
+			explosions++
+			value = rollDie(rng, term.Sides)
+		}
+		dice = append(dice, Die{Value: value})
+	}
+	if term.Select == KeepAll {
+		return dice
+	}
+
+	// Order the dice by value, lowest first, keeping roll order for ties.
+	order := make([]int, len(dice))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return dice[order[a]].Value < dice[order[b]].Value
+	})
+
+	var drop []int
+	switch term.Select {
+	case KeepHighest:
+		drop = order[:max(len(order)-term.SelectN, 0)]
+	case KeepLowest:
+		drop = order[min(term.SelectN, len(order)):]
+	case DropHighest:
+		drop = order[max(len(order)-term.SelectN, 0):]
+	case DropLowest:
+		drop = order[:min(term.SelectN, len(order))]
+	}
+	for _, i := range drop {
+		dice[i].Dropped = true
+	}
+	return dice
+}
+
+func rollDie(rng RNG, sides int) int {
+	value := int(rng.Float64()*float64(sides)) + 1
+	if value > sides {
+		value = sides
+	}
+	return value
+}
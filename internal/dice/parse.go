@@ -0,0 +1,309 @@
+package dice
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SyntaxError describes why an expression could not be parsed.
+type SyntaxError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("dice: %s at offset %d", e.Msg, e.Offset)
+}
+
+type parser struct {
+	src string
+	pos int
+}
+
+// Parse parses a dice expression. Notation is case-insensitive and may contain
+// spaces between terms and before "adv"/"dis".
+func Parse(src string) (Expression, error) {
+	if len(src) > MaxLength {
+		return Expression{}, &SyntaxError{Offset: MaxLength, Msg: "expression too long"}
+	}
+	p := &parser{src: strings.ToLower(src)}
+	expr, err := p.parse()
+	if err != nil {
+		return Expression{}, err
+	}
+	return expr, nil
+}
+
+func (p *parser) parse() (Expression, error) {
+	var expr Expression
+	p.skipSpace()
+	if p.eof() {
+		return expr, p.errorf("empty expression")
+	}
+
+	negative := false
+	if p.peek() == '+' || p.peek() == '-' {
+		negative = p.next() == '-'
+		p.skipSpace()
+	}
+	for {
+		term, err := p.parseTerm()
+		if err != nil {
+			return Expression{}, err
+		}
+		term.Negative = negative
+		expr.Terms = append(expr.Terms, term)
+		if len(expr.Terms) > MaxTerms {
+			return Expression{}, p.errorf("too many terms")
+		}
+
+		p.skipSpace()
+		if p.eof() {
+			break
+		}
+		if p.hasKeyword("adv") || p.hasKeyword("dis") {
+			// A trailing "adv" after a modifier, as in "1d20+5 adv", applies
+			// to the expression's only dice term.
+			if err := p.applyTrailingAdvantage(&expr); err != nil {
+				return Expression{}, err
+			}
+			p.skipSpace()
+			if !p.eof() {
+				return Expression{}, p.errorf("unexpected %q", p.peek())
+			}
+			break
+		}
+		switch p.peek() {
+		case '+', '-':
+			negative = p.next() == '-'
+			p.skipSpace()
+		default:
+			return Expression{}, p.errorf("unexpected %q", p.peek())
+		}
+	}
+
+	if expr.DiceCount() > MaxDice {
+		return Expression{}, &SyntaxError{Offset: 0, Msg: fmt.Sprintf("too many dice (max %d)", MaxDice)}
+	}
+	return expr, nil
+}
+
+func (p *parser) parseTerm() (Term, error) {
+	start := p.pos
+	count, hasCount, err := p.parseNumber()
+	if err != nil {
+		return Term{}, err
+	}
+	if p.eof() || p.peek() != 'd' {
+		if !hasCount {
+			if p.eof() {
+				return Term{}, p.errorf("expected a term")
+			}
+			return Term{}, p.errorf("unexpected %q", p.peek())
+		}
+		if count > MaxConstant {
+			return Term{}, &SyntaxError{Offset: start, Msg: fmt.Sprintf("constant exceeds %d", MaxConstant)}
+		}
+		return Term{Constant: count}, nil
+	}
+
+	if !hasCount {
+		count = 1
+	}
+	if count < 1 || count > MaxDice {
+		return Term{}, &SyntaxError{Offset: start, Msg: fmt.Sprintf("dice count must be between 1 and %d", MaxDice)}
+	}
+	p.pos++ // 'd'
+
+	sidesAt := p.pos
+	var sides int
+	if !p.eof() && p.peek() == '%' {
+		p.pos++
+		sides = 100
+	} else {
+		var ok bool
+		if sides, ok, err = p.parseNumber(); err != nil {
+			return Term{}, err
+		}
+		if !ok {
+			return Term{}, p.errorf("expected number of sides")
+		}
+	}
+	if sides < 2 || sides > MaxSides {
+		return Term{}, &SyntaxError{Offset: sidesAt, Msg: fmt.Sprintf("dice sides must be between 2 and %d", MaxSides)}
+	}
+
+	term := Term{Count: count, Sides: sides}
+	if err := p.parseModifiers(&term); err != nil {
+		return Term{}, err
+	}
+	return term, nil
+}
+
+func (p *parser) parseModifiers(term *Term) error {
+	for !p.eof() {
+		at := p.pos
+		switch {
+		case p.peek() == '!':
+			if term.Explode {
+				return p.errorf("duplicate explode modifier")
+			}
+			p.pos++
+			term.Explode = true
+		case p.hasPrefix("kh"), p.hasPrefix("kl"), p.hasPrefix("dh"), p.hasPrefix("dl"), p.peek() == 'k':
+			selection := KeepHighest
+			switch {
+			case p.hasPrefix("kh"):
+				p.pos += 2
+			case p.hasPrefix("kl"):
+				selection = KeepLowest
+				p.pos += 2
+			case p.hasPrefix("dh"):
+				selection = DropHighest
+				p.pos += 2
+			case p.hasPrefix("dl"):
+				selection = DropLowest
+				p.pos += 2
+			default:
+				p.pos++
+			}
+			n, ok, err := p.parseNumber()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return p.errorf("expected number of dice to keep or drop")
+			}
+			if err := setSelection(term, selection, n, at); err != nil {
+				return err
+			}
+		default:
+			save := p.pos
+			p.skipSpace()
+			if p.hasKeyword("adv") || p.hasKeyword("dis") {
+				selection := KeepHighest
+				if p.hasKeyword("dis") {
+					selection = KeepLowest
+				}
+				if err := setAdvantage(term, selection, p.pos); err != nil {
+					return err
+				}
+				p.pos += 3
+				continue
+			}
+			p.pos = save
+			return nil
+		}
+	}
+	return nil
+}
+
+func (p *parser) applyTrailingAdvantage(expr *Expression) error {
+	selection := KeepHighest
+	if p.hasKeyword("dis") {
+		selection = KeepLowest
+	}
+	at := p.pos
+	var target *Term
+	for i := range expr.Terms {
+		if !expr.Terms[i].IsDice() {
+			continue
+		}
+		if target != nil {
+			return &SyntaxError{Offset: at, Msg: "advantage is ambiguous with several dice terms"}
+		}
+		target = &expr.Terms[i]
+	}
+	if target == nil {
+		return &SyntaxError{Offset: at, Msg: "advantage requires a die"}
+	}
+	if err := setAdvantage(target, selection, at); err != nil {
+		return err
+	}
+	p.pos += 3
+	return nil
+}
+
+func setSelection(term *Term, selection Selection, n, at int) error {
+	if term.Select != KeepAll {
+		return &SyntaxError{Offset: at, Msg: "only one keep or drop modifier is allowed"}
+	}
+	switch selection {
+	case KeepHighest, KeepLowest:
+		if n < 1 || n > term.Count {
+			return &SyntaxError{Offset: at, Msg: fmt.Sprintf("can keep between 1 and %d dice", term.Count)}
+		}
+	default:
+		if n < 1 || n >= term.Count {
+			return &SyntaxError{Offset: at, Msg: fmt.Sprintf("can drop between 1 and %d dice", term.Count-1)}
+		}
+	}
+	term.Select = selection
+	term.SelectN = n
+	return nil
+}
+
+// setAdvantage turns a single die into two dice keeping the highest (or the
+// lowest for disadvantage).
+func setAdvantage(term *Term, selection Selection, at int) error {
+	if term.Count != 1 || term.Select != KeepAll {
+		return &SyntaxError{Offset: at, Msg: "advantage applies to a single die"}
+	}
+	term.Count = 2
+	term.Select = selection
+	term.SelectN = 1
+	return nil
+}
+
+// parseNumber reads an unsigned decimal number. ok is false when no digits
+// were found.
+func (p *parser) parseNumber() (int, bool, error) {
+	start := p.pos
+	n := 0
+	for !p.eof() && p.peek() >= '0' && p.peek() <= '9' {
+		n = n*10 + int(p.peek()-'0')
+		if n > MaxConstant {
+			return 0, false, &SyntaxError{Offset: start, Msg: "number too large"}
+		}
+		p.pos++
+	}
+	return n, p.pos > start, nil
+}
+
+// hasKeyword reports whether word starts at the current position and is not
+// followed by another letter.
+func (p *parser) hasKeyword(word string) bool {
+	if !p.hasPrefix(word) {
+		return false
+	}
+	end := p.pos + len(word)
+	return end == len(p.src) || p.src[end] < 'a' || p.src[end] > 'z'
+}
+
+func (p *parser) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(p.src[p.pos:], prefix)
+}
+
+func (p *parser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) peek() byte {
+	return p.src[p.pos]
+}
+
+func (p *parser) next() byte {
+	c := p.src[p.pos]
+	p.pos++
+	return c
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return &SyntaxError{Offset: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
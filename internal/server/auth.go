@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+type playerContextKey struct{}
+
+// withPlayer returns a copy of ctx carrying the authenticated player.
+func withPlayer(ctx context.Context, player Player) context.Context {
+	return context.WithValue(ctx, playerContextKey{}, player)
+}
+
+// playerFromContext returns the player attached by authenticatePlayer, if any.
+func playerFromContext(ctx context.Context) (Player, bool) {
+	player, ok := ctx.Value(playerContextKey{}).(Player)
+	return player, ok
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// authenticatePlayer resolves the bearer token on r against the players table
+// and returns a request whose context carries the player. It writes a 401 when
+// the token is missing or unknown and a 403 when it belongs to another room.
+func (s *Server) authenticatePlayer(w http.ResponseWriter, r *http.Request, roomID string) (*http.Request, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return r, false
+	}
+
+	player, ok, err := s.getPlayerByToken(token)
+	if err != nil {
+		s.logger.Error("lookup player token", slog.String("error", err.Error()))
+		http.Error(w, "failed to authenticate", http.StatusInternalServerError)
+		return r, false
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return r, false
+	}
+	if player.RoomID != roomID {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return r, false
+	}
+
+	return r.WithContext(withPlayer(r.Context(), player)), true
+}
+
+// optionalPlayer resolves the bearer token on r for endpoints that anyone may
+// read but whose response depends on the caller's role. A missing or unknown
+// token, or one issued for another room, yields no player.
+func (s *Server) optionalPlayer(r *http.Request, roomID string) (Player, bool, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return Player{}, false, nil
+	}
+	player, ok, err := s.getPlayerByToken(token)
+	if err != nil || !ok || player.RoomID != roomID {
+		return Player{}, false, err
+	}
+	return player, true, nil
+}
+
+// requirePlayer returns the player attached to r, writing a 401 when the
+// request was not authenticated.
+func requirePlayer(w http.ResponseWriter, r *http.Request, roomID string) (Player, bool) {
+	player, ok := playerFromContext(r.Context())
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return Player{}, false
+	}
+	if player.RoomID != roomID {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return Player{}, false
+	}
+	return player, true
+}
+
+// authenticateWebsocket resolves the player token for a WebSocket upgrade. The
+// token is read from the "token" query parameter or, since browsers cannot set
+// headers on WebSocket requests, from an offered Sec-WebSocket-Protocol value.
+// When the token came from a subprotocol, that value is returned so the
+// handshake can echo it back.
+func (s *Server) authenticateWebsocket(r *http.Request) (Player, string, bool, error) {
+	if token := strings.TrimSpace(r.URL.Query().Get("token")); token != "" {
+		player, ok, err := s.getPlayerByToken(token)
+		return player, "", ok, err
+	}
+
+	for _, protocol := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		protocol = strings.TrimSpace(protocol)
+		if protocol == "" {
+			continue
+		}
+		player, ok, err := s.getPlayerByToken(protocol)
+		if err != nil {
+			return Player{}, "", false, err
+		}
+		if ok {
+			return player, protocol, true, nil
+		}
+	}
+
+	return Player{}, "", false, nil
+}
+
+func (s *Server) getPlayerByToken(token string) (Player, bool, error) {
+	var player Player
+	err := s.db.QueryRow(`SELECT id, room_id, name, token, role, created_at FROM players WHERE token = ?`, token).
+		Scan(&player.ID, &player.RoomID, &player.Name, &player.Token, &player.Role, &player.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Player{}, false, nil
+	}
+	if err != nil {
+		return Player{}, false, err
+	}
+	player.CreatedAt = player.CreatedAt.UTC()
+	return player, true, nil
+}
+
+func (s *Server) getPlayer(roomID, playerID string) (Player, bool, error) {
+	var player Player
+	err := s.db.QueryRow(`SELECT id, room_id, name, token, role, created_at FROM players WHERE id = ? AND room_id = ?`, playerID, roomID).
+		Scan(&player.ID, &player.RoomID, &player.Name, &player.Token, &player.Role, &player.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Player{}, false, nil
+	}
+	if err != nil {
+		return Player{}, false, err
+	}
+	player.CreatedAt = player.CreatedAt.UTC()
+	return player, true, nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoomMutationsRequirePlayerToken(t *testing.T) {
+	srv := newTestServerWithConfig(t, t.TempDir(), func(cfg *Config) {
+		cfg.LegacyDiceResults = true
+	})
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+
+	otherBody, _ := json.Marshal(map[string]string{"name": "Other", "createdBy": "Someone Else"})
+	otherReq := httptest.NewRequest(http.MethodPost, "/rooms", bytes.NewReader(otherBody))
+	otherW := httptest.NewRecorder()
+	router.ServeHTTP(otherW, otherReq)
+	var otherRoom Room
+	_ = json.NewDecoder(otherW.Body).Decode(&otherRoom)
+	outsider := joinRoomForTest(t, router, otherRoom, "Outsider", RolePlayer)
+
+	imgBody, _ := json.Marshal(map[string]string{"url": "https://example.com/map.png"})
+	createReq := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/images", bytes.NewReader(imgBody))
+	createReq.Header.Set("Content-Type", "application/json")
+	authorize(createReq, gm)
+	createW := httptest.NewRecorder()
+	router.ServeHTTP(createW, createReq)
+	if createW.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for authorized image create, got %d: %s", createW.Code, createW.Body.String())
+	}
+	var img imageResponse
+	_ = json.NewDecoder(createW.Body).Decode(&img)
+
+	requests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+	}{
+		{name: "create image", method: http.MethodPost, path: "/rooms/" + room.ID + "/images", body: map[string]string{"url": "https://example.com/a.png"}},
+		{name: "update image", method: http.MethodPatch, path: "/rooms/" + room.ID + "/images/" + img.ID, body: map[string]float64{"x": 10}},
+		{name: "delete image", method: http.MethodDelete, path: "/rooms/" + room.ID + "/images/" + img.ID},
+		{name: "update theme", method: http.MethodPatch, path: "/rooms/" + room.ID, body: map[string]string{"theme": "nord"}},
+		{name: "create dice log", method: http.MethodPost, path: "/rooms/" + room.ID + "/dice", body: map[string]any{"seed": 1, "count": 1, "results": []int{3}}},
+		{name: "roll dice", method: http.MethodPost, path: "/rooms/" + room.ID + "/dice/roll", body: map[string]int{"count": 1, "sides": 6}},
+	}
+
+	newRequest := func(method, path string, body any) *http.Request {
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	for _, tt := range requests {
+		t.Run(tt.name+" without token", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, newRequest(tt.method, tt.path, tt.body))
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+
+		t.Run(tt.name+" with unknown token", func(t *testing.T) {
+			req := newRequest(tt.method, tt.path, tt.body)
+			req.Header.Set("Authorization", "Bearer not-a-token")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+
+		t.Run(tt.name+" with token from another room", func(t *testing.T) {
+			req := newRequest(tt.method, tt.path, tt.body)
+			authorize(req, outsider)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("expected 403, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("dice log records the authenticated player", func(t *testing.T) {
+		req := newRequest(http.MethodPost, "/rooms/"+room.ID+"/dice", map[string]any{
+			"seed":        7,
+			"count":       1,
+			"results":     []int{4},
+			"triggeredBy": "Impostor",
+		})
+		authorize(req, gm)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var entry diceLogEntry
+		_ = json.NewDecoder(w.Body).Decode(&entry)
+		if entry.TriggeredBy != gm.Name {
+			t.Fatalf("expected triggeredBy %q, got %q", gm.Name, entry.TriggeredBy)
+		}
+	})
+}
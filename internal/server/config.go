@@ -4,6 +4,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Config holds runtime configuration loaded from environment variables.
@@ -16,6 +17,12 @@ type Config struct {
 	UploadDir         string
 	DBPath            string
 	AdminToken        string
+	// LegacyDiceResults re-enables POST /rooms/{id}/dice with client-computed
+	// results and plain relaying of client DiceRoll messages.
+	LegacyDiceResults bool
+	// IdempotencyKeyTTL is how long an Idempotency-Key (or WebSocket roll ID)
+	// keeps replaying its original response.
+	IdempotencyKeyTTL time.Duration
 }
 
 const (
@@ -26,6 +33,7 @@ const (
 	defaultFrontendDir       = "dist"
 	defaultUploadDir         = "uploads"
 	defaultDBPath            = "data/vtrpg.db"
+	defaultIdempotencyKeyTTL = 24 * time.Hour
 )
 
 // LoadConfig builds a Config instance using environment variables when present.
@@ -39,6 +47,7 @@ func LoadConfig() Config {
 		UploadDir:         getEnv("UPLOAD_DIR", defaultUploadDir),
 		DBPath:            getEnv("DB_PATH", defaultDBPath),
 		AdminToken:        getEnv("ADMIN_TOKEN", "admin"),
+		IdempotencyKeyTTL: defaultIdempotencyKeyTTL,
 	}
 
 	if rawMax := os.Getenv("MAX_UPLOAD_SIZE"); rawMax != "" {
@@ -53,6 +62,18 @@ func LoadConfig() Config {
 		}
 	}
 
+	if rawLegacy := os.Getenv("LEGACY_DICE_RESULTS"); rawLegacy != "" {
+		if v, err := strconv.ParseBool(rawLegacy); err == nil {
+			cfg.LegacyDiceResults = v
+		}
+	}
+
+	if rawTTL := os.Getenv("IDEMPOTENCY_KEY_TTL"); rawTTL != "" {
+		if v, err := time.ParseDuration(rawTTL); err == nil && v > 0 {
+			cfg.IdempotencyKeyTTL = v
+		}
+	}
+
 	return cfg
 }
 
@@ -17,7 +17,8 @@ func (s *Server) withCORS(next http.Handler) http.Handler {
 				w.Header().Set("Access-Control-Allow-Credentials", "true")
 			}
 			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,Idempotency-Key")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Next-Cursor,Idempotent-Replayed")
 		}
 
 		// Add security headers
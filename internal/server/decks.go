@@ -0,0 +1,1072 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	deckKindStandard = "standard"
+	deckKindTarot    = "tarot"
+	deckKindCustom   = "custom"
+
+	cardZoneDraw    = "draw"
+	cardZoneHand    = "hand"
+	cardZoneTable   = "table"
+	cardZoneDiscard = "discard"
+
+	maxDeckNameLength = 100
+	maxDeckCards      = 200
+	maxDrawCount      = 20
+
+	// Played cards are placed on the canvas at this size.
+	cardWidth  = 120
+	cardHeight = 168
+)
+
+var deckKinds = []string{deckKindStandard, deckKindTarot, deckKindCustom}
+
+// cardDefinition is a card of a built-in deck.
+type cardDefinition struct {
+	Code string
+	Name string
+}
+
+var (
+	standardRanks = []cardDefinition{
+		{"A", "Ace"}, {"2", "Two"}, {"3", "Three"}, {"4", "Four"}, {"5", "Five"}, {"6", "Six"}, {"7", "Seven"},
+		{"8", "Eight"}, {"9", "Nine"}, {"10", "Ten"}, {"J", "Jack"}, {"Q", "Queen"}, {"K", "King"},
+	}
+	standardSuits  = []cardDefinition{{"S", "Spades"}, {"H", "Hearts"}, {"D", "Diamonds"}, {"C", "Clubs"}}
+	standardJokers = []cardDefinition{{"RJ", "Red Joker"}, {"BJ", "Black Joker"}}
+
+	tarotMajors = []string{
+		"The Fool", "The Magician", "The High Priestess", "The Empress", "The Emperor", "The Hierophant",
+		"The Lovers", "The Chariot", "Strength", "The Hermit", "Wheel of Fortune", "Justice", "The Hanged Man",
+		"Death", "Temperance", "The Devil", "The Tower", "The Star", "The Moon", "The Sun", "Judgement", "The World",
+	}
+	tarotRanks = []cardDefinition{
+		{"A", "Ace"}, {"2", "Two"}, {"3", "Three"}, {"4", "Four"}, {"5", "Five"}, {"6", "Six"}, {"7", "Seven"},
+		{"8", "Eight"}, {"9", "Nine"}, {"10", "Ten"}, {"P", "Page"}, {"N", "Knight"}, {"Q", "Queen"}, {"K", "King"},
+	}
+	tarotSuits = []cardDefinition{{"W", "Wands"}, {"C", "Cups"}, {"S", "Swords"}, {"P", "Pentacles"}}
+
+	suitSymbols = map[string]string{"S": "♠", "H": "♥", "D": "♦", "C": "♣"}
+)
+
+// builtinCards lists the cards of a standard or tarot deck in order. Standard
+// decks have the two jokers Savage Worlds initiative uses when jokers is set.
+func builtinCards(kind string, jokers bool) []cardDefinition {
+	var cards []cardDefinition
+	switch kind {
+	case deckKindStandard:
+		for _, suit := range standardSuits {
+			for _, rank := range standardRanks {
+				cards = append(cards, cardDefinition{rank.Code + suit.Code, rank.Name + " of " + suit.Name})
+			}
+		}
+		if jokers {
+			cards = append(cards, standardJokers...)
+		}
+	case deckKindTarot:
+		for i, name := range tarotMajors {
+			cards = append(cards, cardDefinition{fmt.Sprintf("M%02d", i), name})
+		}
+		for _, suit := range tarotSuits {
+			for _, rank := range tarotRanks {
+				cards = append(cards, cardDefinition{rank.Code + suit.Code, rank.Name + " of " + suit.Name})
+			}
+		}
+	}
+	return cards
+}
+
+func cardFaceURL(kind, code string) string {
+	return "/cards/" + kind + "/" + code + ".svg"
+}
+
+// handleCardFace serves GET /cards/{kind}/{code}.svg, the generated face of a
+// built-in card.
+func (s *Server) handleCardFace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/cards/"), "/")
+	if len(parts) != 2 || !strings.HasSuffix(parts[1], ".svg") {
+		http.NotFound(w, r)
+		return
+	}
+	code := strings.TrimSuffix(parts[1], ".svg")
+	// Both jokers are included so either can be looked up.
+	for _, card := range builtinCards(parts[0], true) {
+		if card.Code == code {
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+			_, _ = w.Write(cardFaceSVG(parts[0], card))
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func cardFaceSVG(kind string, card cardDefinition) []byte {
+	color := "#1f2933"
+	corner := card.Code
+	if kind == deckKindStandard {
+		switch {
+		case strings.HasSuffix(card.Code, "J"):
+			corner = "★"
+			if card.Code == "RJ" {
+				color = "#c62828"
+			}
+		default:
+			suit := card.Code[len(card.Code)-1:]
+			corner = card.Code[:len(card.Code)-1] + suitSymbols[suit]
+			if suit == "H" || suit == "D" {
+				color = "#c62828"
+			}
+		}
+	}
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="240" height="336" viewBox="0 0 240 336">`+
+		`<rect x="4" y="4" width="232" height="328" rx="16" fill="#fffdf7" stroke="#1f2933" stroke-width="4"/>`+
+		`<text x="20" y="56" font-family="serif" font-size="40" fill="%[1]s">%[2]s</text>`+
+		`<text x="220" y="312" font-family="serif" font-size="40" fill="%[1]s" text-anchor="end">%[2]s</text>`+
+		`<text x="120" y="176" font-family="serif" font-size="20" fill="%[1]s" text-anchor="middle">%[3]s</text>`+
+		`</svg>`, color, html.EscapeString(corner), html.EscapeString(card.Name)))
+}
+
+// cardName validates and trims the name of a deck or card.
+func cardName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("name is required")
+	}
+	if utf8.RuneCountInString(name) > maxDeckNameLength {
+		return "", fmt.Errorf("name is longer than %d characters", maxDeckNameLength)
+	}
+	return name, nil
+}
+
+const cardColumns = `id, deck_id, name, code, image_url, zone, holder_id, image_id`
+
+func scanCard(row rowScanner) (Card, error) {
+	var card Card
+	err := row.Scan(&card.ID, &card.DeckID, &card.Name, &card.Code, &card.ImageURL, &card.Zone, &card.HolderID, &card.ImageID)
+	return card, err
+}
+
+func (s *Server) queryCards(query string, args ...any) ([]Card, error) {
+	rows, err := s.db.Query(`SELECT `+cardColumns+` FROM deck_cards WHERE `+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cards := make([]Card, 0)
+	for rows.Next() {
+		card, err := scanCard(rows)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
+
+func (s *Server) getCard(roomID, cardID string) (Card, bool, error) {
+	card, err := scanCard(s.db.QueryRow(`SELECT `+cardColumns+` FROM deck_cards WHERE id = ? AND room_id = ?`, cardID, roomID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Card{}, false, nil
+	}
+	if err != nil {
+		return Card{}, false, err
+	}
+	return card, true, nil
+}
+
+// playerHand returns the cards a player holds across the room's decks.
+func (s *Server) playerHand(roomID, playerID string) ([]Card, error) {
+	return s.queryCards(`room_id = ? AND zone = ? AND holder_id = ? ORDER BY position, id`, roomID, cardZoneHand, playerID)
+}
+
+// cardFaceInUse reports whether a deck still uses url as a card face.
+func (s *Server) cardFaceInUse(url string) (bool, error) {
+	var used bool
+	err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM deck_cards WHERE image_url = ?)`, url).Scan(&used)
+	return used, err
+}
+
+func (s *Server) getDeck(roomID, deckID string) (Deck, bool, error) {
+	deck := Deck{RoomID: roomID}
+	err := s.db.QueryRow(`SELECT id, name, kind, created_at FROM decks WHERE id = ? AND room_id = ?`, deckID, roomID).
+		Scan(&deck.ID, &deck.Name, &deck.Kind, &deck.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Deck{}, false, nil
+	}
+	if err != nil {
+		return Deck{}, false, err
+	}
+	if err := s.loadDeckCards(&deck); err != nil {
+		return Deck{}, false, err
+	}
+	return deck, true, nil
+}
+
+func (s *Server) listDecks(roomID string) ([]Deck, error) {
+	rows, err := s.db.Query(`SELECT id, name, kind, created_at FROM decks WHERE room_id = ? ORDER BY created_at, id`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	decks := make([]Deck, 0)
+	for rows.Next() {
+		deck := Deck{RoomID: roomID}
+		if err := rows.Scan(&deck.ID, &deck.Name, &deck.Kind, &deck.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		decks = append(decks, deck)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range decks {
+		if err := s.loadDeckCards(&decks[i]); err != nil {
+			return nil, err
+		}
+	}
+	return decks, nil
+}
+
+// loadDeckCards fills in the public parts of a deck: the size of the draw
+// pile, the face-up cards and how many cards each player holds.
+func (s *Server) loadDeckCards(deck *Deck) error {
+	deck.CreatedAt = deck.CreatedAt.UTC()
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM deck_cards WHERE deck_id = ? AND zone = ?`, deck.ID, cardZoneDraw).Scan(&deck.Remaining); err != nil {
+		return err
+	}
+	var err error
+	if deck.Discard, err = s.queryCards(`deck_id = ? AND zone = ? ORDER BY position, id`, deck.ID, cardZoneDiscard); err != nil {
+		return err
+	}
+	if deck.Table, err = s.queryCards(`deck_id = ? AND zone = ? ORDER BY position, id`, deck.ID, cardZoneTable); err != nil {
+		return err
+	}
+	rows, err := s.db.Query(`SELECT holder_id, COUNT(*) FROM deck_cards WHERE deck_id = ? AND zone = ? GROUP BY holder_id`, deck.ID, cardZoneHand)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	deck.Hands = make(map[string]int)
+	for rows.Next() {
+		var holder string
+		var count int
+		if err := rows.Scan(&holder, &count); err != nil {
+			return err
+		}
+		deck.Hands[holder] = count
+	}
+	return rows.Err()
+}
+
+// createDeck stores a new deck with its cards shuffled into the draw pile.
+func (s *Server) createDeck(roomID, name, kind string, cards []Card) (Deck, error) {
+	deckID := s.newID()
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return Deck{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(`INSERT INTO decks (id, room_id, name, kind, created_at) VALUES (?, ?, ?, ?, ?)`, deckID, roomID, name, kind, time.Now().UTC()); err != nil {
+		return Deck{}, err
+	}
+	if err := insertCards(tx, roomID, deckID, deckID, cards); err != nil {
+		return Deck{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Deck{}, err
+	}
+	deck, _, err := s.getDeck(roomID, deckID)
+	return deck, err
+}
+
+// insertCards adds cards to the draw pile at random positions. Their IDs are
+// prefix followed by their index, since newID can repeat within a loop.
+func insertCards(tx *sql.Tx, roomID, deckID, prefix string, cards []Card) error {
+	var top int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(position), -1) + 1 FROM deck_cards WHERE deck_id = ? AND zone = ?`, deckID, cardZoneDraw).Scan(&top); err != nil {
+		return err
+	}
+	for i, pos := range rand.Perm(len(cards)) {
+		card := cards[i]
+		if _, err := tx.Exec(
+			`INSERT INTO deck_cards (id, deck_id, room_id, name, code, image_url, zone, position) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			fmt.Sprintf("%s-%d", prefix, i), deckID, roomID, card.Name, card.Code, card.ImageURL, cardZoneDraw, top+pos,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addDeckCards adds cards to a deck and shuffles its draw pile.
+func (s *Server) addDeckCards(roomID, deckID string, cards []Card) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := insertCards(tx, roomID, deckID, s.newID(), cards); err != nil {
+		return err
+	}
+	if err := shuffleDrawPile(tx, deckID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func shuffleDrawPile(tx *sql.Tx, deckID string) error {
+	rows, err := tx.Query(`SELECT id FROM deck_cards WHERE deck_id = ? AND zone = ?`, deckID, cardZoneDraw)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	for pos, id := range ids {
+		if _, err := tx.Exec(`UPDATE deck_cards SET position = ? WHERE id = ?`, pos, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recalledCards are the cards a shuffle or delete took out of play: the
+// canvas images of played cards and the players whose hands changed.
+type recalledCards struct {
+	imageIDs []string
+	holders  []string
+}
+
+func collectRecalled(tx *sql.Tx, deckID string) (recalledCards, error) {
+	var recalled recalledCards
+	rows, err := tx.Query(`SELECT zone, holder_id, image_id FROM deck_cards WHERE deck_id = ? AND zone IN (?, ?)`, deckID, cardZoneHand, cardZoneTable)
+	if err != nil {
+		return recalledCards{}, err
+	}
+	defer rows.Close()
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var zone, holder, imageID string
+		if err := rows.Scan(&zone, &holder, &imageID); err != nil {
+			return recalledCards{}, err
+		}
+		if zone == cardZoneTable && imageID != "" {
+			recalled.imageIDs = append(recalled.imageIDs, imageID)
+		}
+		if zone == cardZoneHand && !seen[holder] {
+			seen[holder] = true
+			recalled.holders = append(recalled.holders, holder)
+		}
+	}
+	return recalled, rows.Err()
+}
+
+// shuffleDeck returns the discard pile to the draw pile and shuffles it. With
+// recall, cards in hands and on the table are returned as well.
+func (s *Server) shuffleDeck(deckID string, recall bool) (recalledCards, error) {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return recalledCards{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var recalled recalledCards
+	zones := []any{cardZoneDiscard}
+	if recall {
+		if recalled, err = collectRecalled(tx, deckID); err != nil {
+			return recalledCards{}, err
+		}
+		zones = append(zones, cardZoneHand, cardZoneTable)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(zones)), ", ")
+	args := append([]any{cardZoneDraw, deckID}, zones...)
+	if _, err := tx.Exec(`UPDATE deck_cards SET zone = ?, holder_id = '', image_id = '' WHERE deck_id = ? AND zone IN (`+placeholders+`)`, args...); err != nil {
+		return recalledCards{}, err
+	}
+	if err := shuffleDrawPile(tx, deckID); err != nil {
+		return recalledCards{}, err
+	}
+	return recalled, tx.Commit()
+}
+
+// drawCards moves count cards from the top of the draw pile into a player's
+// hand. Nothing is drawn when fewer than count cards are left.
+func (s *Server) drawCards(deckID, playerID string, count int) ([]Card, error) {
+	rows, err := s.db.Query(
+		`UPDATE deck_cards SET zone = ?, holder_id = ?, position = ? + position
+		WHERE id IN (SELECT id FROM deck_cards WHERE deck_id = ? AND zone = ? ORDER BY position LIMIT ?)
+		AND (SELECT COUNT(*) FROM deck_cards WHERE deck_id = ? AND zone = ?) >= ?
+		RETURNING `+cardColumns+`, position`,
+		cardZoneHand, playerID, time.Now().UnixNano(), deckID, cardZoneDraw, count, deckID, cardZoneDraw, count,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type drawnCard struct {
+		card     Card
+		position int64
+	}
+	var drawn []drawnCard
+	for rows.Next() {
+		var d drawnCard
+		c := &d.card
+		if err := rows.Scan(&c.ID, &c.DeckID, &c.Name, &c.Code, &c.ImageURL, &c.Zone, &c.HolderID, &c.ImageID, &d.position); err != nil {
+			return nil, err
+		}
+		drawn = append(drawn, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(drawn, func(i, j int) bool { return drawn[i].position < drawn[j].position })
+	cards := make([]Card, len(drawn))
+	for i, d := range drawn {
+		cards[i] = d.card
+	}
+	return cards, nil
+}
+
+// playCard puts a card from a player's hand onto a scene's canvas.
+func (s *Server) playCard(roomID, sceneID, playerID string, card Card, x, y float64) (imageResponse, bool, error) {
+	img, err := s.storeImage(roomID, imageResponse{
+		ID:      s.newID(),
+		SceneID: sceneID,
+		URL:     card.ImageURL,
+		X:       x,
+		Y:       y,
+		Width:   cardWidth,
+		Height:  cardHeight,
+	})
+	if err != nil {
+		return imageResponse{}, false, err
+	}
+	result, err := s.db.Exec(
+		`UPDATE deck_cards SET zone = ?, image_id = ?, position = ? WHERE id = ? AND room_id = ? AND zone = ? AND holder_id = ?`,
+		cardZoneTable, img.ID, time.Now().UnixNano(), card.ID, roomID, cardZoneHand, playerID,
+	)
+	if err == nil {
+		var affected int64
+		if affected, err = result.RowsAffected(); err == nil && affected == 1 {
+			return img, true, nil
+		}
+	}
+	// The card left the hand in the meantime.
+	if _, _, delErr := s.deleteImage(roomID, img.ID, true); delErr != nil {
+		s.logger.Error("delete played card image", slog.String("error", delErr.Error()))
+	}
+	return imageResponse{}, false, err
+}
+
+// discardCard moves a card from the given zone and holder to the discard pile.
+func (s *Server) discardCard(roomID string, card Card) (bool, error) {
+	result, err := s.db.Exec(
+		`UPDATE deck_cards SET zone = ?, holder_id = '', image_id = '', position = ? WHERE id = ? AND room_id = ? AND zone = ? AND holder_id = ?`,
+		cardZoneDiscard, time.Now().UnixNano(), card.ID, roomID, card.Zone, card.HolderID,
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// deleteDeck removes a deck and its cards. It returns what was in play and the
+// uploaded faces the deck used.
+func (s *Server) deleteDeck(roomID, deckID string) (recalledCards, []string, error) {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return recalledCards{}, nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	recalled, err := collectRecalled(tx, deckID)
+	if err != nil {
+		return recalledCards{}, nil, err
+	}
+	rows, err := tx.Query(`SELECT DISTINCT image_url FROM deck_cards WHERE deck_id = ? AND image_url LIKE '/uploads/%'`, deckID)
+	if err != nil {
+		return recalledCards{}, nil, err
+	}
+	var uploads []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			rows.Close()
+			return recalledCards{}, nil, err
+		}
+		uploads = append(uploads, url)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return recalledCards{}, nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM decks WHERE id = ? AND room_id = ?`, deckID, roomID); err != nil {
+		return recalledCards{}, nil, err
+	}
+	return recalled, uploads, tx.Commit()
+}
+
+// removeRecalled deletes the canvas images of recalled cards and sends the
+// affected players their new hands.
+func (s *Server) removeRecalled(roomID string, recalled recalledCards) {
+	for _, imageID := range recalled.imageIDs {
+		if img, ok, err := s.deleteImage(roomID, imageID, true); err != nil {
+			s.logger.Error("delete played card image", slog.String("error", err.Error()))
+		} else if ok {
+			s.broadcastImageDeleted(roomID, img)
+		}
+	}
+	for _, holder := range recalled.holders {
+		s.sendHand(roomID, holder)
+	}
+}
+
+// broadcastDeck sends a deck's public state to the whole room.
+func (s *Server) broadcastDeck(roomID, deckID string) {
+	deck, ok, err := s.getDeck(roomID, deckID)
+	if err != nil {
+		s.logger.Error("load deck", slog.String("error", err.Error()))
+		return
+	}
+	if !ok {
+		return
+	}
+	payload, err := json.Marshal(map[string]any{
+		"type":    "DeckUpdate",
+		"payload": deck,
+	})
+	if err != nil {
+		s.logger.Error("marshal deck", slog.String("error", err.Error()))
+		return
+	}
+	s.broadcast(roomID, payload)
+}
+
+// sendHand sends a player's hand to that player's sockets only.
+func (s *Server) sendHand(roomID, playerID string) {
+	cards, err := s.playerHand(roomID, playerID)
+	if err != nil {
+		s.logger.Error("load hand", slog.String("error", err.Error()))
+		return
+	}
+	payload, err := json.Marshal(map[string]any{
+		"type":    "Hand",
+		"payload": map[string]any{"cards": cards},
+	})
+	if err != nil {
+		s.logger.Error("marshal hand", slog.String("error", err.Error()))
+		return
+	}
+	s.sendToPlayer(roomID, playerID, payload)
+}
+
+// handleDecks serves /rooms/{id}/decks. Anyone in the room can list decks and
+// draw; creating, adding cards, shuffling and deleting are for the GM.
+func (s *Server) handleDecks(w http.ResponseWriter, r *http.Request, roomID string, rest []string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	isGM := player.Role == RoleGM
+
+	if len(rest) == 0 || rest[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			decks, err := s.listDecks(roomID)
+			if err != nil {
+				s.logger.Error("list decks", slog.String("error", err.Error()))
+				http.Error(w, "failed to load decks", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, decks)
+		case http.MethodPost:
+			if !isGM {
+				http.Error(w, "only the GM can create decks", http.StatusForbidden)
+				return
+			}
+			s.handleDeckCreate(w, r, roomID)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	action := ""
+	if len(rest) > 1 {
+		action = rest[1]
+	}
+	switch {
+	case action == "" && (r.Method == http.MethodGet || r.Method == http.MethodDelete):
+	case (action == "cards" || action == "shuffle" || action == "draw") && r.Method == http.MethodPost:
+	case action != "" && action != "cards" && action != "shuffle" && action != "draw":
+		http.NotFound(w, r)
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method != http.MethodGet && action != "draw" && !isGM {
+		http.Error(w, "only the GM can change decks", http.StatusForbidden)
+		return
+	}
+	deck, found, err := s.getDeck(roomID, rest[0])
+	if err != nil {
+		s.logger.Error("get deck", slog.String("error", err.Error()))
+		http.Error(w, "failed to load deck", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, deck)
+	case r.Method == http.MethodDelete:
+		s.handleDeckDelete(w, roomID, deck)
+	case action == "cards":
+		s.handleDeckCards(w, r, roomID, deck)
+	case action == "shuffle":
+		s.handleDeckShuffle(w, r, roomID, deck)
+	case action == "draw":
+		s.handleDeckDraw(w, r, roomID, player, deck)
+	}
+}
+
+// newCard validates a custom card given by name and image URL.
+func newCard(name, imageURL string) (Card, error) {
+	name, err := cardName(name)
+	if err != nil {
+		return Card{}, fmt.Errorf("card %s", err)
+	}
+	if !isValidImageURL(imageURL) {
+		return Card{}, errors.New("invalid card image URL")
+	}
+	return Card{Name: name, ImageURL: imageURL}, nil
+}
+
+type cardRequest struct {
+	Name     string `json:"name"`
+	ImageURL string `json:"imageUrl"`
+}
+
+func (s *Server) handleDeckCreate(w http.ResponseWriter, r *http.Request, roomID string) {
+	var payload struct {
+		Name   string        `json:"name"`
+		Kind   string        `json:"kind"`
+		Jokers bool          `json:"jokers"`
+		Cards  []cardRequest `json:"cards"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	name, err := cardName(payload.Name)
+	if err != nil {
+		http.Error(w, "deck "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var cards []Card
+	switch payload.Kind {
+	case deckKindStandard, deckKindTarot:
+		if len(payload.Cards) > 0 {
+			http.Error(w, "only custom decks take cards", http.StatusBadRequest)
+			return
+		}
+		for _, def := range builtinCards(payload.Kind, payload.Jokers) {
+			cards = append(cards, Card{Name: def.Name, Code: def.Code, ImageURL: cardFaceURL(payload.Kind, def.Code)})
+		}
+	case deckKindCustom:
+		if len(payload.Cards) > maxDeckCards {
+			http.Error(w, fmt.Sprintf("a deck has at most %d cards", maxDeckCards), http.StatusBadRequest)
+			return
+		}
+		for _, c := range payload.Cards {
+			card, err := newCard(c.Name, c.ImageURL)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			cards = append(cards, card)
+		}
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid deck kind", "validKinds": deckKinds})
+		return
+	}
+
+	deck, err := s.createDeck(roomID, name, payload.Kind, cards)
+	if err != nil {
+		s.logger.Error("create deck", slog.String("error", err.Error()))
+		http.Error(w, "failed to create deck", http.StatusInternalServerError)
+		return
+	}
+	s.broadcastDeck(roomID, deck.ID)
+	writeJSON(w, http.StatusCreated, deck)
+}
+
+// handleDeckCards adds cards to a custom deck, either as uploaded face images
+// named after their files or as JSON {name, imageUrl} entries.
+func (s *Server) handleDeckCards(w http.ResponseWriter, r *http.Request, roomID string, deck Deck) {
+	if deck.Kind != deckKindCustom {
+		http.Error(w, "only custom decks take cards", http.StatusBadRequest)
+		return
+	}
+	var cards []Card
+	var uploadedPaths []string
+	stored := false
+	defer func() {
+		if !stored {
+			for _, path := range uploadedPaths {
+				_ = os.Remove(path)
+			}
+		}
+	}()
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var payload []cardRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || len(payload) == 0 {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		for _, c := range payload {
+			card, err := newCard(c.Name, c.ImageURL)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			cards = append(cards, card)
+		}
+	} else {
+		if err := r.ParseMultipartForm(s.cfg.MaxUploadSize); err != nil {
+			http.Error(w, "failed to parse upload", http.StatusBadRequest)
+			return
+		}
+		files := r.MultipartForm.File["file"]
+		if len(files) == 0 {
+			http.Error(w, "file not found in request", http.StatusBadRequest)
+			return
+		}
+		if deck.cardCount()+len(files) > maxDeckCards {
+			http.Error(w, fmt.Sprintf("a deck has at most %d cards", maxDeckCards), http.StatusBadRequest)
+			return
+		}
+		for _, fh := range files {
+			name, err := cardName(strings.TrimSuffix(filepath.Base(fh.Filename), filepath.Ext(fh.Filename)))
+			if err != nil {
+				http.Error(w, "card "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			file, err := fh.Open()
+			if err != nil {
+				http.Error(w, "unable to open file", http.StatusBadRequest)
+				return
+			}
+			url, destPath, err := s.saveUpload(fh.Filename, file)
+			file.Close()
+			if err != nil {
+				if errors.Is(err, errUploadUndetected) || errors.Is(err, errUploadType) {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				s.logger.Error("save card face", slog.String("error", err.Error()))
+				http.Error(w, "unable to save file", http.StatusInternalServerError)
+				return
+			}
+			uploadedPaths = append(uploadedPaths, destPath)
+			cards = append(cards, Card{Name: name, ImageURL: url})
+		}
+	}
+	if deck.cardCount()+len(cards) > maxDeckCards {
+		http.Error(w, fmt.Sprintf("a deck has at most %d cards", maxDeckCards), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.addDeckCards(roomID, deck.ID, cards); err != nil {
+		s.logger.Error("add deck cards", slog.String("error", err.Error()))
+		http.Error(w, "failed to add cards", http.StatusInternalServerError)
+		return
+	}
+	stored = true
+	s.respondDeck(w, roomID, deck.ID, http.StatusCreated)
+}
+
+// cardCount is how many cards the deck has in all zones.
+func (d Deck) cardCount() int {
+	count := d.Remaining + len(d.Discard) + len(d.Table)
+	for _, held := range d.Hands {
+		count += held
+	}
+	return count
+}
+
+// respondDeck broadcasts a deck's new state and writes it as the response.
+func (s *Server) respondDeck(w http.ResponseWriter, roomID, deckID string, status int) {
+	deck, _, err := s.getDeck(roomID, deckID)
+	if err != nil {
+		s.logger.Error("get deck", slog.String("error", err.Error()))
+		http.Error(w, "failed to load deck", http.StatusInternalServerError)
+		return
+	}
+	s.broadcastDeck(roomID, deckID)
+	writeJSON(w, status, deck)
+}
+
+func (s *Server) handleDeckShuffle(w http.ResponseWriter, r *http.Request, roomID string, deck Deck) {
+	var payload struct {
+		Recall bool `json:"recall"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	recalled, err := s.shuffleDeck(deck.ID, payload.Recall)
+	if err != nil {
+		s.logger.Error("shuffle deck", slog.String("error", err.Error()))
+		http.Error(w, "failed to shuffle deck", http.StatusInternalServerError)
+		return
+	}
+	s.removeRecalled(roomID, recalled)
+	s.respondDeck(w, roomID, deck.ID, http.StatusOK)
+}
+
+// handleDeckDraw draws cards into the caller's hand. The GM can deal to another
+// player with playerId; the dealt cards are then only sent to that player.
+func (s *Server) handleDeckDraw(w http.ResponseWriter, r *http.Request, roomID string, player Player, deck Deck) {
+	var payload struct {
+		Count    int    `json:"count"`
+		PlayerID string `json:"playerId"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	if payload.Count == 0 {
+		payload.Count = 1
+	}
+	if payload.Count < 1 || payload.Count > maxDrawCount {
+		http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxDrawCount), http.StatusBadRequest)
+		return
+	}
+	holderID := player.ID
+	if payload.PlayerID != "" && payload.PlayerID != player.ID {
+		if player.Role != RoleGM {
+			http.Error(w, "only the GM can deal to other players", http.StatusForbidden)
+			return
+		}
+		_, found, err := s.getPlayer(roomID, payload.PlayerID)
+		if err != nil {
+			s.logger.Error("get player", slog.String("error", err.Error()))
+			http.Error(w, "failed to draw cards", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "player not found", http.StatusBadRequest)
+			return
+		}
+		holderID = payload.PlayerID
+	}
+
+	cards, err := s.drawCards(deck.ID, holderID, payload.Count)
+	if err != nil {
+		s.logger.Error("draw cards", slog.String("error", err.Error()))
+		http.Error(w, "failed to draw cards", http.StatusInternalServerError)
+		return
+	}
+	if len(cards) == 0 {
+		http.Error(w, "not enough cards left in the deck", http.StatusConflict)
+		return
+	}
+	s.sendHand(roomID, holderID)
+	s.broadcastDeck(roomID, deck.ID)
+	deck, _, err = s.getDeck(roomID, deck.ID)
+	if err != nil {
+		s.logger.Error("get deck", slog.String("error", err.Error()))
+		http.Error(w, "failed to load deck", http.StatusInternalServerError)
+		return
+	}
+	response := map[string]any{"deck": deck}
+	if holderID == player.ID {
+		response["cards"] = cards
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleDeckDelete(w http.ResponseWriter, roomID string, deck Deck) {
+	recalled, uploads, err := s.deleteDeck(roomID, deck.ID)
+	if err != nil {
+		s.logger.Error("delete deck", slog.String("error", err.Error()))
+		http.Error(w, "failed to delete deck", http.StatusInternalServerError)
+		return
+	}
+	s.removeRecalled(roomID, recalled)
+	for _, url := range uploads {
+		var used bool
+		if err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM images WHERE url = ?)`, url).Scan(&used); err != nil {
+			s.logger.Error("check card faces", slog.String("error", err.Error()))
+			continue
+		}
+		if inDeck, err := s.cardFaceInUse(url); err != nil || used || inDeck {
+			continue
+		}
+		_ = os.Remove(filepath.Join(s.cfg.UploadDir, filepath.Base(url)))
+	}
+	payload, err := json.Marshal(map[string]any{
+		"type":    "DeckDeleted",
+		"payload": map[string]string{"id": deck.ID},
+	})
+	if err != nil {
+		s.logger.Error("marshal deck delete", slog.String("error", err.Error()))
+	} else {
+		s.broadcast(roomID, payload)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleHand serves /rooms/{id}/hand: the caller's cards, and playing a held
+// card onto the canvas or discarding it.
+func (s *Server) handleHand(w http.ResponseWriter, r *http.Request, roomID string, rest []string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	if len(rest) == 0 || rest[0] == "" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		cards, err := s.playerHand(roomID, player.ID)
+		if err != nil {
+			s.logger.Error("load hand", slog.String("error", err.Error()))
+			http.Error(w, "failed to load hand", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, cards)
+		return
+	}
+	if len(rest) != 2 || (rest[1] != "play" && rest[1] != "discard") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	card, found, err := s.getCard(roomID, rest[0])
+	if err != nil {
+		s.logger.Error("get card", slog.String("error", err.Error()))
+		http.Error(w, "failed to load card", http.StatusInternalServerError)
+		return
+	}
+	// Other players' cards are reported as missing so hands stay private.
+	held := found && card.Zone == cardZoneHand && card.HolderID == player.ID
+	played := found && card.Zone == cardZoneTable && (card.HolderID == player.ID || player.Role == RoleGM)
+	if !held && (rest[1] == "play" || !played) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if rest[1] == "play" {
+		var payload struct {
+			X *float64 `json:"x"`
+			Y *float64 `json:"y"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+		scene, err := s.getActiveScene(roomID)
+		if err != nil {
+			s.logger.Error("get active scene", slog.String("error", err.Error()))
+			http.Error(w, "failed to play card", http.StatusInternalServerError)
+			return
+		}
+		var x, y float64
+		if payload.X != nil && payload.Y != nil {
+			x, y = *payload.X, *payload.Y
+		} else if x, y, err = s.nextPosition(scene.ID); err != nil {
+			s.logger.Error("next position", slog.String("error", err.Error()))
+			http.Error(w, "failed to play card", http.StatusInternalServerError)
+			return
+		}
+		if !isValidPosition(x, y) {
+			http.Error(w, "invalid position", http.StatusBadRequest)
+			return
+		}
+		img, ok, err := s.playCard(roomID, scene.ID, player.ID, card, x, y)
+		if err != nil {
+			s.logger.Error("play card", slog.String("error", err.Error()))
+			http.Error(w, "failed to play card", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.broadcastSharedImage(roomID, img)
+		s.sendHand(roomID, player.ID)
+		s.broadcastDeck(roomID, card.DeckID)
+		writeJSON(w, http.StatusOK, img)
+		return
+	}
+
+	ok, err = s.discardCard(roomID, card)
+	if err != nil {
+		s.logger.Error("discard card", slog.String("error", err.Error()))
+		http.Error(w, "failed to discard card", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if card.ImageID != "" {
+		s.removeRecalled(roomID, recalledCards{imageIDs: []string{card.ImageID}})
+	}
+	if card.Zone == cardZoneHand {
+		s.sendHand(roomID, player.ID)
+	}
+	s.broadcastDeck(roomID, card.DeckID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecks(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+	bob := joinRoomForTest(t, router, room, "Bob", RolePlayer)
+
+	do := func(method, path string, player Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		if payload != nil {
+			_ = json.NewEncoder(&body).Encode(payload)
+		}
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, &body)
+		req.Header.Set("Content-Type", "application/json")
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	connect := func(player Player) net.Conn {
+		conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(player.Token), nil)
+		readWSMessageForTest(t, conn, "RosterUpdate")
+		return conn
+	}
+	aliceConn := connect(alice)
+	defer aliceConn.Close()
+	bobConn := connect(bob)
+	defer bobConn.Close()
+
+	savage := map[string]any{"name": "Action Deck", "kind": "standard", "jokers": true}
+	if w := do(http.MethodPost, "/decks", alice, savage); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not create decks, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/decks", gm, map[string]any{"name": "Bad", "kind": "uno"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown kind, got %d", w.Code)
+	}
+	w := do(http.MethodPost, "/decks", gm, savage)
+	var deck Deck
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&deck) != nil || deck.Remaining != 54 {
+		t.Fatalf("create deck: %d %s", w.Code, w.Body.String())
+	}
+
+	w = do(http.MethodPost, "/decks/"+deck.ID+"/draw", alice, map[string]int{"count": 2})
+	var drawn struct {
+		Deck  Deck   `json:"deck"`
+		Cards []Card `json:"cards"`
+	}
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&drawn) != nil || len(drawn.Cards) != 2 {
+		t.Fatalf("draw: %d %s", w.Code, w.Body.String())
+	}
+	if drawn.Deck.Remaining != 52 || drawn.Deck.Hands[alice.ID] != 2 {
+		t.Fatalf("unexpected deck after draw: %+v", drawn.Deck)
+	}
+	var hand struct {
+		Cards []Card `json:"cards"`
+	}
+	if err := json.Unmarshal(readWSMessageForTest(t, aliceConn, "Hand"), &hand); err != nil || len(hand.Cards) != 2 {
+		t.Fatalf("alice's socket did not get her hand: %+v %v", hand, err)
+	}
+	// The hand is sent before the deck update, so Bob would have seen it by now.
+	for _, msgType := range readWSTypesUntil(t, bobConn, "DeckUpdate") {
+		if msgType == "Hand" {
+			t.Fatal("another player's hand was sent to bob")
+		}
+	}
+
+	w = do(http.MethodPost, "/decks/"+deck.ID+"/draw", gm, map[string]any{"count": 1, "playerId": bob.ID})
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"cards"`) {
+		t.Fatalf("dealing must not show the GM the cards: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPost, "/decks/"+deck.ID+"/draw", alice, map[string]any{"playerId": bob.ID}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not deal, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/decks/"+deck.ID+"/draw", alice, map[string]int{"count": 20}); w.Code != http.StatusOK {
+		t.Fatalf("draw 20: %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/decks/"+deck.ID+"/draw", alice, map[string]int{"count": 20}); w.Code != http.StatusOK {
+		t.Fatalf("draw 20: %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/decks/"+deck.ID+"/draw", alice, map[string]int{"count": 12}); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 with 11 cards left, got %d", w.Code)
+	}
+
+	card := drawn.Cards[0]
+	if w := do(http.MethodPost, "/hand/"+card.ID+"/play", bob, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("bob must not play alice's card, got %d", w.Code)
+	}
+	w = do(http.MethodPost, "/hand/"+card.ID+"/play", alice, map[string]float64{"x": 40, "y": 60})
+	var img imageResponse
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&img) != nil || img.URL != card.ImageURL || img.X != 40 {
+		t.Fatalf("play card: %d %s", w.Code, w.Body.String())
+	}
+	var shared imageResponse
+	if err := json.Unmarshal(readWSMessageForTest(t, bobConn, "SharedImage"), &shared); err != nil || shared.ID != img.ID {
+		t.Fatalf("played card was not shared: %+v %v", shared, err)
+	}
+	w = do(http.MethodGet, "/decks/"+deck.ID, bob, nil)
+	if json.NewDecoder(w.Body).Decode(&deck) != nil || len(deck.Table) != 1 || deck.Table[0].ImageID != img.ID {
+		t.Fatalf("played card is not on the table: %s", w.Body.String())
+	}
+
+	w = do(http.MethodGet, "/hand", alice, nil)
+	var held []Card
+	if json.NewDecoder(w.Body).Decode(&held) != nil || len(held) != 41 {
+		t.Fatalf("unexpected hand: %s", w.Body.String())
+	}
+	if w := do(http.MethodPost, "/hand/"+held[0].ID+"/discard", alice, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("discard held card: %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/hand/"+card.ID+"/discard", gm, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("GM discard played card: %d", w.Code)
+	}
+	readWSMessageForTest(t, bobConn, "SharedImageDeleted")
+	images, err := srv.getImages(room.ID, room.ActiveSceneID, true)
+	if err != nil || len(images) != 0 {
+		t.Fatalf("discarded card stayed on the canvas: %+v %v", images, err)
+	}
+
+	w = do(http.MethodPost, "/decks/"+deck.ID+"/shuffle", gm, nil)
+	if json.NewDecoder(w.Body).Decode(&deck) != nil || deck.Remaining != 13 || len(deck.Discard) != 0 {
+		t.Fatalf("shuffle: %d %s", w.Code, w.Body.String())
+	}
+	w = do(http.MethodPost, "/decks/"+deck.ID+"/shuffle", gm, map[string]bool{"recall": true})
+	var recalled Deck
+	if json.NewDecoder(w.Body).Decode(&recalled) != nil || recalled.Remaining != 54 || len(recalled.Hands) != 0 {
+		t.Fatalf("shuffle with recall: %d %s", w.Code, w.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, card.ImageURL, nil)
+	face := httptest.NewRecorder()
+	router.ServeHTTP(face, req)
+	if face.Code != http.StatusOK || face.Header().Get("Content-Type") != "image/svg+xml" || !strings.Contains(face.Body.String(), card.Name) {
+		t.Fatalf("card face: %d %s", face.Code, face.Body.String())
+	}
+	face = httptest.NewRecorder()
+	router.ServeHTTP(face, httptest.NewRequest(http.MethodGet, "/cards/standard/ZZ.svg", nil))
+	if face.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown card, got %d", face.Code)
+	}
+
+	if w := do(http.MethodDelete, "/decks/"+deck.ID, gm, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete deck: %d", w.Code)
+	}
+	readWSMessageForTest(t, bobConn, "DeckDeleted")
+}
+
+func TestCustomDeckUploads(t *testing.T) {
+	uploadDir := t.TempDir()
+	srv := newTestServer(t, uploadDir)
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+
+	body, _ := json.Marshal(map[string]any{"name": "Omens", "kind": "custom"})
+	req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/decks", bytes.NewReader(body))
+	authorize(req, gm)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var deck Deck
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&deck) != nil || deck.Remaining != 0 {
+		t.Fatalf("create custom deck: %d %s", w.Code, w.Body.String())
+	}
+
+	upload := &bytes.Buffer{}
+	mw := multipart.NewWriter(upload)
+	for _, name := range []string{"Raven.png", "Comet.png"} {
+		part, _ := mw.CreateFormFile("file", name)
+		_, _ = part.Write([]byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a})
+	}
+	mw.Close()
+	req = httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/decks/"+deck.ID+"/cards", upload)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	authorize(req, gm)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&deck) != nil || deck.Remaining != 2 {
+		t.Fatalf("upload card faces: %d %s", w.Code, w.Body.String())
+	}
+	usage, err := srv.calculateRoomDiskUsage(room.ID)
+	if err != nil || usage == 0 {
+		t.Fatalf("card faces must count towards disk usage: %d %v", usage, err)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/rooms/"+room.ID+"/decks/"+deck.ID, nil)
+	authorize(req, gm)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete deck: %d", w.Code)
+	}
+	if faces, err := filepath.Glob(filepath.Join(uploadDir, "*.png")); err != nil || len(faces) != 0 {
+		t.Fatalf("deleted deck left its faces behind: %v %v", faces, err)
+	}
+}
+
+// readWSTypesUntil returns the types of the messages read up to and including
+// the first of type last.
+func readWSTypesUntil(t *testing.T, conn net.Conn, last string) []string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var types []string
+	for {
+		opcode, payload, err := readFrame(conn)
+		if err != nil {
+			t.Fatalf("read %s: %v", last, err)
+		}
+		if opcode != 0x1 {
+			continue
+		}
+		var envelope struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(payload, &envelope); err != nil {
+			t.Fatalf("decode %s: %v", last, err)
+		}
+		types = append(types, envelope.Type)
+		if envelope.Type == last {
+			return types
+		}
+	}
+}
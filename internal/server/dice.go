@@ -0,0 +1,430 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"vtrpg/internal/dice"
+)
+
+const (
+	maxDiceCount = dice.MaxDice
+	maxDiceSides = dice.MaxSides
+)
+
+// diceRNG is the mulberry32 generator that turns a roll's seed into its
+// results. The seed is logged with the roll, so the results can be replayed
+// from it when the roll is verified.
+type diceRNG struct {
+	state uint32
+}
+
+func newDiceRNG(seed uint32) *diceRNG {
+	return &diceRNG{state: seed + 0x6d2b79f5}
+}
+
+// Float64 returns the next value in [0, 1).
+func (r *diceRNG) Float64() float64 {
+	t := r.state
+	t = (t ^ (t >> 15)) * (t | 1)
+	t ^= t + (t^(t>>7))*(t|61)
+	r.state = t
+	return float64(t^(t>>14)) / 4294967296
+}
+
+const maxDiceLabelLength = 100
+
+var errInvalidRoll = errors.New("invalid roll")
+
+// normalizeDiceLabel trims a roll label such as "Stealth check" and reports
+// whether it fits in maxDiceLabelLength characters.
+func normalizeDiceLabel(label string) (string, bool) {
+	label = strings.TrimSpace(label)
+	return label, utf8.RuneCountInString(label) <= maxDiceLabelLength
+}
+
+// diceRollRequest is the body of POST /rooms/{id}/dice/roll and the payload
+// of the RollDice WebSocket command. Expression takes precedence over the
+// older count/sides pair.
+type diceRollRequest struct {
+	Expression string         `json:"expression"`
+	Count      int            `json:"count"`
+	Sides      int            `json:"sides"`
+	Visibility DiceVisibility `json:"visibility"`
+	WhisperTo  []string       `json:"whisperTo"`
+	Label      string         `json:"label"`
+	// RollID is an optional client-generated ID that makes a WebSocket roll
+	// idempotent; REST clients send an Idempotency-Key header instead.
+	RollID string `json:"rollId"`
+	// ClientSeed is mixed into the committed server seed. Commitment, when
+	// set, must be the roller's pending commitment.
+	ClientSeed string `json:"clientSeed"`
+	Commitment string `json:"commitment"`
+	// RequestID answers a GM roll request; the request decides the
+	// expression, label and visibility.
+	RequestID string `json:"requestId"`
+	// Spec is rolled with the room's rule system instead of the expression.
+	Spec *RollSpec `json:"spec"`
+	// Push is the ID of one of the roller's earlier rolls to push or reroll.
+	Push string `json:"push"`
+	// Dice rolls the room's custom dice, given by type ID and count.
+	Dice []CustomDice `json:"dice"`
+	// Table is the ID of a random table to draw from.
+	Table string `json:"table"`
+}
+
+func (req diceRollRequest) notation() string {
+	if strings.TrimSpace(req.Expression) != "" {
+		return req.Expression
+	}
+	return fmt.Sprintf("%dd%d", req.Count, req.Sides)
+}
+
+// rollDice plans the requested roll, derives the seed from the roller's
+// committed server seed and their client seed, rolls it with the rule system,
+// stores the log entry and sends both the animation payload and the log entry
+// to everyone allowed to see the roll. The roller then gets the commitment for
+// their next roll. Parse failures are returned as *dice.SyntaxError; invalid
+// specs, visibility settings, pushes and answers to roll requests that are
+// not open for the roller wrap errInvalidRoll.
+func (s *Server) rollDice(roomID string, roller clientProfile, req diceRollRequest) (entry diceLogEntry, err error) {
+	if req.RequestID != "" {
+		if req.Push != "" {
+			return diceLogEntry{}, fmt.Errorf("%w: an answer to a roll request cannot be a push", errInvalidRoll)
+		}
+		var request rollRequestPrompt
+		if request, err = s.claimRollRequest(roomID, req.RequestID, roller.ID); err != nil {
+			return diceLogEntry{}, err
+		}
+		req.Expression, req.Label, req.Visibility, req.WhisperTo = request.Expression, request.Label, request.Visibility, nil
+		req.Spec, req.Dice, req.Table = nil, nil, ""
+		defer func() {
+			if err != nil {
+				s.releaseRollRequest(req.RequestID, roller.ID)
+			} else {
+				s.answerRollRequest(req.RequestID, roller.ID, entry)
+			}
+		}()
+	}
+	plan, err := s.planRoll(roomID, roller, req)
+	if err != nil {
+		return diceLogEntry{}, err
+	}
+	if !validClientSeed(req.ClientSeed) {
+		return diceLogEntry{}, fmt.Errorf("%w: client seed must be at most %d bytes", errInvalidRoll, maxClientSeedLength)
+	}
+	serverSeed, commitment, committed, err := s.takeDiceCommitment(roomID, roller.ID, req.Commitment)
+	if err != nil {
+		return diceLogEntry{}, err
+	}
+	seed, err := deriveDiceSeed(serverSeed, req.ClientSeed)
+	if err != nil {
+		return diceLogEntry{}, err
+	}
+	result := plan.roll(newDiceRNG(seed))
+
+	record := diceLogEntry{
+		Seed:        seed,
+		Count:       len(result.Dice),
+		Results:     result.Values(),
+		TriggeredBy: roller.Name,
+		Timestamp:   time.Now().UTC(),
+		Expression:  result.Notation,
+		Total:       result.Total,
+		Breakdown:   result.Breakdown,
+		Visibility:  plan.visibility,
+		Recipients:  plan.recipients,
+		Sides:       result.Sides(),
+		Label:       plan.label,
+		RollerID:    roller.ID,
+		Commitment:  commitment,
+		ServerSeed:  serverSeed,
+		ClientSeed:  req.ClientSeed,
+		Committed:   committed,
+		RequestID:   req.RequestID,
+		System:      plan.system.Name(),
+		Faces:       result.Faces(),
+	}
+	if result.Breakdown != nil {
+		record.Modifier = result.Breakdown.Modifier()
+	}
+	if plan.system.Name() != defaultRuleSystem {
+		record.Spec = &plan.spec
+		record.Rule = &result
+	}
+	if plan.parent != nil {
+		record.ParentID = plan.parent.ID
+	}
+	if entry, err = s.storeDiceLog(roomID, record); err != nil {
+		return diceLogEntry{}, err
+	}
+
+	s.broadcastDiceRoll(roomID, DiceRollPayload{
+		Seed:        seed,
+		Count:       entry.Count,
+		DieSides:    entry.Sides,
+		TriggeredBy: entry.TriggeredBy,
+		Results:     entry.Results,
+		Expression:  entry.Expression,
+		Breakdown:   entry.Breakdown,
+		Visibility:  entry.Visibility,
+		Label:       entry.Label,
+		Faces:       entry.Faces,
+	}, entry.visibleTo)
+	s.broadcastDiceLog(roomID, entry)
+	s.sendDiceCommitment(roomID, roller.ID)
+	return entry, nil
+}
+
+// rollPlan is a validated roll, ready to draw its dice.
+type rollPlan struct {
+	system     RuleSystem
+	spec       RollSpec
+	parent     *diceLogEntry
+	previous   RuleResult
+	visibility DiceVisibility
+	recipients []string
+	label      string
+}
+
+func (p rollPlan) roll(rng dice.RNG) RuleResult {
+	if p.parent != nil {
+		return p.system.Push(p.spec, p.previous, rng)
+	}
+	return p.system.Roll(p.spec, rng)
+}
+
+// planRoll validates a roll request. Custom dice and tables are rolled by
+// their own systems and rolls with a spec by the room's rule system; plain
+// expressions are always generic.
+func (s *Server) planRoll(roomID string, roller clientProfile, req diceRollRequest) (rollPlan, error) {
+	if req.Push != "" {
+		return s.planPush(roomID, roller, req.Push)
+	}
+	label, ok := normalizeDiceLabel(req.Label)
+	if !ok {
+		return rollPlan{}, fmt.Errorf("%w: label must be at most %d characters", errInvalidRoll, maxDiceLabelLength)
+	}
+	plan := rollPlan{system: genericSystem{}, spec: RollSpec{Expression: req.notation()}, label: label}
+	switch {
+	case req.Table != "":
+		tables, gmOnly, err := s.resolveRandomTables(roomID, isGMProfile(roller), req.Table)
+		if err != nil {
+			return rollPlan{}, err
+		}
+		plan.system, plan.spec = tableSystem{}, RollSpec{Tables: tables}
+		if plan.label == "" {
+			plan.label = tables[0].Name
+		}
+		if gmOnly {
+			req.Visibility, req.WhisperTo = DiceVisibilityGM, nil
+		}
+	case len(req.Dice) > 0:
+		resolved, err := s.resolveCustomDice(roomID, req.Dice)
+		if err != nil {
+			return rollPlan{}, err
+		}
+		plan.system, plan.spec = customDiceSystem{}, RollSpec{Dice: resolved}
+	case req.Spec != nil:
+		room, err := s.getRoomByID(roomID)
+		if err != nil {
+			return rollPlan{}, err
+		}
+		system, ok := ruleSystemByName(room.RuleSystem)
+		if !ok {
+			return rollPlan{}, fmt.Errorf("room uses unknown rule system %q", room.RuleSystem)
+		}
+		plan.system, plan.spec = system, *req.Spec
+	}
+	if err := plan.system.Validate(plan.spec); err != nil {
+		return rollPlan{}, err
+	}
+	var err error
+	if plan.visibility, plan.recipients, err = s.rollAudience(roomID, roller, req.Visibility, req.WhisperTo); err != nil {
+		return rollPlan{}, err
+	}
+	return plan, nil
+}
+
+// planPush validates pushing or rerolling one of the roller's own rolls with
+// the system that made it. The new roll keeps the original's label and
+// audience.
+func (s *Server) planPush(roomID string, roller clientProfile, parentID string) (rollPlan, error) {
+	parent, ok, err := s.getDiceLog(roomID, roller, parentID)
+	if err != nil {
+		return rollPlan{}, err
+	}
+	if !ok || parent.RollerID != roller.ID {
+		return rollPlan{}, fmt.Errorf("%w: you have no roll %q to push", errInvalidRoll, parentID)
+	}
+	system, ok := ruleSystemByName(parent.System)
+	if !ok {
+		return rollPlan{}, fmt.Errorf("%w: roll was made with unknown rule system %q", errInvalidRoll, parent.System)
+	}
+	plan := rollPlan{
+		system:     system,
+		spec:       RollSpec{Expression: parent.Expression},
+		parent:     &parent,
+		visibility: parent.Visibility,
+		recipients: parent.Recipients,
+		label:      parent.Label,
+	}
+	if parent.Spec != nil {
+		plan.spec = *parent.Spec
+	}
+	if parent.Rule != nil {
+		plan.previous = *parent.Rule
+	}
+	if err := system.Validate(plan.spec); err != nil {
+		return rollPlan{}, fmt.Errorf("%w: roll cannot be rerolled", errInvalidRoll)
+	}
+	if err := system.CanPush(plan.previous); err != nil {
+		return rollPlan{}, err
+	}
+	return plan, nil
+}
+
+// rollAudience validates the requested visibility and returns the player IDs
+// besides the GM that may see the roll.
+func (s *Server) rollAudience(roomID string, roller clientProfile, visibility DiceVisibility, whisperTo []string) (DiceVisibility, []string, error) {
+	switch visibility {
+	case "", DiceVisibilityPublic:
+		return DiceVisibilityPublic, nil, nil
+	case DiceVisibilityGM:
+		return visibility, []string{roller.ID}, nil
+	case DiceVisibilityBlind:
+		return visibility, nil, nil
+	case DiceVisibilityWhisper:
+		if len(whisperTo) == 0 {
+			return "", nil, fmt.Errorf("%w: whisper needs at least one recipient", errInvalidRoll)
+		}
+		recipients := []string{roller.ID}
+		for _, id := range whisperTo {
+			player, ok, err := s.getPlayer(roomID, id)
+			if err != nil {
+				return "", nil, err
+			}
+			if !ok {
+				return "", nil, fmt.Errorf("%w: unknown whisper recipient %q", errInvalidRoll, id)
+			}
+			if !slices.Contains(recipients, player.ID) {
+				recipients = append(recipients, player.ID)
+			}
+		}
+		return visibility, recipients, nil
+	default:
+		return "", nil, fmt.Errorf("%w: unknown visibility %q", errInvalidRoll, visibility)
+	}
+}
+
+// handleDiceRoll serves POST /rooms/{id}/dice/roll, the REST equivalent of the
+// RollDice WebSocket command.
+func (s *Server) handleDiceRoll(w http.ResponseWriter, r *http.Request, roomID string) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+
+	var payload diceRollRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	roller := clientProfile{ID: player.ID, Name: player.Name, Role: string(player.Role)}
+	entry, err := s.rollDice(roomID, roller, payload)
+	var syntaxErr *dice.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		http.Error(w, "invalid dice: "+syntaxErr.Msg, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errInvalidRoll) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.logger.Error("roll dice", slog.String("error", err.Error()))
+		http.Error(w, "failed to roll dice", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, entry.visibleFor(roller))
+}
+
+const (
+	defaultDiceLogLimit = 50
+	maxDiceLogLimit     = 200
+)
+
+// diceLogPage selects a page of dice history for getDiceLogs.
+type diceLogPage struct {
+	Before      *diceLogCursor
+	Limit       int
+	TriggeredBy string
+}
+
+// diceLogCursor is the keyset position of the last entry on a page. It follows
+// the (timestamp, id) order of idx_dice_logs_room_timestamp.
+type diceLogCursor struct {
+	Timestamp time.Time
+	ID        string
+}
+
+// String encodes the cursor as an opaque token for the before parameter.
+func (c diceLogCursor) String() string {
+	raw := c.Timestamp.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseDiceLogCursor(token string) (diceLogCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return diceLogCursor{}, errors.New("invalid cursor")
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return diceLogCursor{}, errors.New("invalid cursor")
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return diceLogCursor{}, errors.New("invalid cursor")
+	}
+	return diceLogCursor{Timestamp: timestamp.UTC(), ID: id}, nil
+}
+
+// parseDiceLogPage reads the before, limit and triggeredBy query parameters of
+// GET /rooms/{id}/dice.
+func parseDiceLogPage(query url.Values) (diceLogPage, error) {
+	page := diceLogPage{
+		Limit:       defaultDiceLogLimit,
+		TriggeredBy: strings.TrimSpace(query.Get("triggeredBy")),
+	}
+	if before := query.Get("before"); before != "" {
+		cursor, err := parseDiceLogCursor(before)
+		if err != nil {
+			return diceLogPage{}, err
+		}
+		page.Before = &cursor
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxDiceLogLimit {
+			return diceLogPage{}, fmt.Errorf("limit must be between 1 and %d", maxDiceLogLimit)
+		}
+		page.Limit = n
+	}
+	return page, nil
+}
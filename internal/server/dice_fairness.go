@@ -0,0 +1,292 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+	"unicode/utf8"
+)
+
+// Rolls are provably fair through commit-reveal. Each player has a pending
+// server seed whose SHA-256 commitment is published before they roll. The
+// roll mixes in a client seed chosen by the player, so neither side alone
+// decides the outcome:
+//
+//	seed = first 4 bytes (big-endian) of HMAC-SHA256(key: serverSeed, msg: clientSeed)
+//
+// and the dice are drawn from mulberry32(seed) exactly like the overlay does.
+// The log entry reveals the server seed, and a new commitment is issued for
+// the player's next roll.
+
+const maxClientSeedLength = 128
+
+// diceCommitment is the published half of a pending server seed.
+type diceCommitment struct {
+	Commitment string    `json:"commitment"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// newServerSeed returns 32 random bytes, hex encoded.
+func newServerSeed() (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// commitServerSeed returns the hex SHA-256 of the decoded server seed.
+func commitServerSeed(serverSeed string) (string, error) {
+	raw, err := hex.DecodeString(serverSeed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// deriveDiceSeed mixes the server and client seeds into the mulberry32 seed.
+func deriveDiceSeed(serverSeed, clientSeed string) (uint32, error) {
+	key, err := hex.DecodeString(serverSeed)
+	if err != nil {
+		return 0, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(clientSeed))
+	return binary.BigEndian.Uint32(mac.Sum(nil)[:4]), nil
+}
+
+// pendingDiceCommitment returns the player's current commitment, drawing a new
+// server seed if they have none.
+func (s *Server) pendingDiceCommitment(roomID, playerID string) (diceCommitment, error) {
+	serverSeed, err := newServerSeed()
+	if err != nil {
+		return diceCommitment{}, err
+	}
+	commitment, err := commitServerSeed(serverSeed)
+	if err != nil {
+		return diceCommitment{}, err
+	}
+	if _, err := s.db.Exec(
+		`INSERT OR IGNORE INTO dice_commitments (room_id, player_id, server_seed, commitment, created_at) VALUES (?, ?, ?, ?, ?)`,
+		roomID, playerID, serverSeed, commitment, time.Now().UTC(),
+	); err != nil {
+		return diceCommitment{}, err
+	}
+
+	var pending diceCommitment
+	if err := s.db.QueryRow(
+		`SELECT commitment, created_at FROM dice_commitments WHERE room_id = ? AND player_id = ?`, roomID, playerID,
+	).Scan(&pending.Commitment, &pending.CreatedAt); err != nil {
+		return diceCommitment{}, err
+	}
+	pending.CreatedAt = pending.CreatedAt.UTC()
+	return pending, nil
+}
+
+// takeDiceCommitment consumes the player's pending server seed so it is used
+// for exactly one roll. When expected is set it must match the pending
+// commitment, which lets a client insist on the commitment it has seen.
+// committed reports whether the seed was committed to before the roll.
+func (s *Server) takeDiceCommitment(roomID, playerID, expected string) (serverSeed, commitment string, committed bool, err error) {
+	query := `DELETE FROM dice_commitments WHERE room_id = ? AND player_id = ?`
+	args := []any{roomID, playerID}
+	if expected != "" {
+		query += ` AND commitment = ?`
+		args = append(args, expected)
+	}
+	err = s.db.QueryRow(query+` RETURNING server_seed, commitment`, args...).Scan(&serverSeed, &commitment)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) && expected != "":
+		return "", "", false, fmt.Errorf("%w: commitment %q is not pending", errInvalidRoll, expected)
+	case errors.Is(err, sql.ErrNoRows):
+		// The player rolled without a pending commitment; the roll is still
+		// reproducible, just not committed to in advance.
+		if serverSeed, err = newServerSeed(); err != nil {
+			return "", "", false, err
+		}
+		commitment, err = commitServerSeed(serverSeed)
+		return serverSeed, commitment, false, err
+	default:
+		return serverSeed, commitment, err == nil, err
+	}
+}
+
+// sendDiceCommitment pushes the player's pending commitment to their sockets.
+func (s *Server) sendDiceCommitment(roomID, playerID string) {
+	pending, err := s.pendingDiceCommitment(roomID, playerID)
+	if err != nil {
+		s.logger.Error("issue dice commitment", slog.String("error", err.Error()))
+		return
+	}
+	payload, err := json.Marshal(map[string]any{
+		"type":    "DiceCommitment",
+		"payload": pending,
+	})
+	if err != nil {
+		s.logger.Error("marshal dice commitment", slog.String("error", err.Error()))
+		return
+	}
+	s.sendToPlayer(roomID, playerID, payload)
+}
+
+// handleDiceCommitment serves GET /rooms/{id}/dice/commitment, the caller's
+// commitment for their next roll.
+func (s *Server) handleDiceCommitment(w http.ResponseWriter, r *http.Request, roomID string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	pending, err := s.pendingDiceCommitment(roomID, player.ID)
+	if err != nil {
+		s.logger.Error("issue dice commitment", slog.String("error", err.Error()))
+		http.Error(w, "failed to issue commitment", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, pending)
+}
+
+// diceVerification is the response of GET /rooms/{id}/dice/{rollId}/verify.
+type diceVerification struct {
+	RollID          string `json:"rollId"`
+	Expression      string `json:"expression"`
+	Commitment      string `json:"commitment"`
+	ServerSeed      string `json:"serverSeed"`
+	ClientSeed      string `json:"clientSeed"`
+	Seed            uint32 `json:"seed"`
+	DerivedSeed     uint32 `json:"derivedSeed"`
+	Results         []int  `json:"results"`
+	ReplayedResults []int  `json:"replayedResults"`
+	Committed       bool   `json:"committed"`
+	CommitmentValid bool   `json:"commitmentValid"`
+	SeedValid       bool   `json:"seedValid"`
+	ResultsValid    bool   `json:"resultsValid"`
+	Verified        bool   `json:"verified"`
+}
+
+// verifyDiceLog replays the derivation of a committed roll with the rule
+// system that made it. parent is the roll a push rerolled, nil otherwise. A
+// roll whose commitment was not published in advance never verifies.
+func verifyDiceLog(entry diceLogEntry, parent *diceLogEntry) (diceVerification, error) {
+	v := diceVerification{
+		RollID:     entry.ID,
+		Expression: entry.Expression,
+		Commitment: entry.Commitment,
+		ServerSeed: entry.ServerSeed,
+		ClientSeed: entry.ClientSeed,
+		Seed:       entry.Seed,
+		Results:    entry.Results,
+		Committed:  entry.Committed,
+	}
+	commitment, err := commitServerSeed(entry.ServerSeed)
+	if err != nil {
+		return diceVerification{}, err
+	}
+	v.CommitmentValid = commitment == entry.Commitment
+	if v.DerivedSeed, err = deriveDiceSeed(entry.ServerSeed, entry.ClientSeed); err != nil {
+		return diceVerification{}, err
+	}
+	v.SeedValid = v.DerivedSeed == entry.Seed
+
+	system, ok := ruleSystemByName(entry.System)
+	if !ok {
+		return diceVerification{}, fmt.Errorf("unknown rule system %q", entry.System)
+	}
+	plan := rollPlan{system: system, spec: RollSpec{Expression: entry.Expression}, parent: parent}
+	if entry.Spec != nil {
+		plan.spec = *entry.Spec
+	}
+	if parent != nil && parent.Rule != nil {
+		plan.previous = *parent.Rule
+	}
+	if err := system.Validate(plan.spec); err != nil {
+		return diceVerification{}, err
+	}
+	v.ReplayedResults = plan.roll(newDiceRNG(v.DerivedSeed)).Values()
+	v.ResultsValid = slices.Equal(v.ReplayedResults, entry.Results)
+	v.Verified = v.Committed && v.CommitmentValid && v.SeedValid && v.ResultsValid
+	return v, nil
+}
+
+// getDiceLog loads one roll if viewer may see it.
+func (s *Server) getDiceLog(roomID string, viewer clientProfile, id string) (diceLogEntry, bool, error) {
+	query, args := visibleDiceLogsQuery(roomID, viewer)
+	entry, err := scanDiceLog(s.db.QueryRow(query+` AND id = ?`, append(args, id)...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return diceLogEntry{}, false, nil
+	}
+	if err != nil {
+		return diceLogEntry{}, false, err
+	}
+	return entry, true, nil
+}
+
+// handleDiceVerify serves GET /rooms/{id}/dice/{rollId}/verify.
+func (s *Server) handleDiceVerify(w http.ResponseWriter, r *http.Request, roomID, rollID string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	player, _, err := s.optionalPlayer(r, roomID)
+	if err != nil {
+		s.logger.Error("lookup player for dice verify", slog.String("error", err.Error()))
+		http.Error(w, "failed to verify roll", http.StatusInternalServerError)
+		return
+	}
+	viewer := clientProfile{ID: player.ID, Name: player.Name, Role: string(player.Role)}
+	entry, ok, err := s.getDiceLog(roomID, viewer, rollID)
+	if err != nil {
+		s.logger.Error("get dice log", slog.String("error", err.Error()))
+		http.Error(w, "failed to verify roll", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if entry.ServerSeed == "" {
+		http.Error(w, "roll was not made with a committed seed", http.StatusUnprocessableEntity)
+		return
+	}
+	var parent *diceLogEntry
+	if entry.ParentID != "" && entry.Rule != nil {
+		// Generic rerolls replay without their parent; other pushes keep dice
+		// from it.
+		loaded, ok, err := s.getDiceLog(roomID, clientProfile{Role: string(RoleGM)}, entry.ParentID)
+		if err != nil {
+			s.logger.Error("get pushed dice log", slog.String("error", err.Error()))
+			http.Error(w, "failed to verify roll", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "the roll this one rerolled is no longer logged", http.StatusUnprocessableEntity)
+			return
+		}
+		parent = &loaded
+	}
+	verification, err := verifyDiceLog(entry, parent)
+	if err != nil {
+		s.logger.Error("verify dice log", slog.String("error", err.Error()))
+		http.Error(w, "failed to verify roll", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, verification)
+}
+
+func validClientSeed(clientSeed string) bool {
+	return utf8.ValidString(clientSeed) && len(clientSeed) <= maxClientSeedLength
+}
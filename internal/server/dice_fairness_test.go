@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCommitRevealDice(t *testing.T) {
+	srv := newTestServerWithConfig(t, t.TempDir(), func(cfg *Config) {
+		cfg.LegacyDiceResults = true
+	})
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+	bob := joinRoomForTest(t, router, room, "Bob", RolePlayer)
+
+	do := func(method, path string, player *Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		if payload != nil {
+			_ = json.NewEncoder(&body).Encode(payload)
+		}
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, &body)
+		if player != nil {
+			authorize(req, *player)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	commitment := func(player Player) string {
+		t.Helper()
+		w := do(http.MethodGet, "/dice/commitment", &player, nil)
+		var pending diceCommitment
+		if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&pending) != nil || len(pending.Commitment) != 64 {
+			t.Fatalf("get commitment: %d %s", w.Code, w.Body.String())
+		}
+		return pending.Commitment
+	}
+
+	committed := commitment(alice)
+	if again := commitment(alice); again != committed {
+		t.Fatalf("pending commitment changed between requests: %s vs %s", committed, again)
+	}
+
+	w := do(http.MethodPost, "/dice/roll", &alice, map[string]string{"expression": "4d6kh3", "clientSeed": "alice-nonce", "commitment": committed})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("roll: %d %s", w.Code, w.Body.String())
+	}
+	var entry diceLogEntry
+	_ = json.NewDecoder(w.Body).Decode(&entry)
+	raw, _ := hex.DecodeString(entry.ServerSeed)
+	sum := sha256.Sum256(raw)
+	if entry.Commitment != committed || hex.EncodeToString(sum[:]) != committed || entry.ClientSeed != "alice-nonce" || !entry.Committed {
+		t.Fatalf("roll does not reveal the committed seed: %+v", entry)
+	}
+	if next := commitment(alice); next == committed {
+		t.Fatalf("commitment must be replaced after a roll")
+	}
+
+	t.Run("verify", func(t *testing.T) {
+		w := do(http.MethodGet, "/dice/"+entry.ID+"/verify", nil, nil)
+		var v diceVerification
+		if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&v) != nil {
+			t.Fatalf("verify: %d %s", w.Code, w.Body.String())
+		}
+		if !v.Verified || v.DerivedSeed != entry.Seed || len(v.ReplayedResults) != 4 {
+			t.Fatalf("expected a verified roll: %+v", v)
+		}
+
+		if _, err := srv.db.Exec(`UPDATE dice_logs SET results = '[6,6,6,6]' WHERE id = ?`, entry.ID); err != nil {
+			t.Fatalf("tamper: %v", err)
+		}
+		w = do(http.MethodGet, "/dice/"+entry.ID+"/verify", nil, nil)
+		v = diceVerification{}
+		_ = json.NewDecoder(w.Body).Decode(&v)
+		if v.Verified || v.ResultsValid || !v.CommitmentValid || !v.SeedValid {
+			t.Fatalf("tampered results must fail verification: %+v", v)
+		}
+	})
+
+	t.Run("uncommitted roll", func(t *testing.T) {
+		// Bob rolls without a pending commitment, so his seed is drawn at
+		// roll time and the roll cannot count as verified.
+		w := do(http.MethodPost, "/dice/roll", &bob, map[string]string{"expression": "1d20"})
+		var uncommitted diceLogEntry
+		if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&uncommitted) != nil || uncommitted.Committed {
+			t.Fatalf("roll: %d %s", w.Code, w.Body.String())
+		}
+		w = do(http.MethodGet, "/dice/"+uncommitted.ID+"/verify", nil, nil)
+		var v diceVerification
+		if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&v) != nil || v.Committed || v.Verified || !v.SeedValid || !v.ResultsValid {
+			t.Fatalf("an uncommitted roll must not verify: %d %+v", w.Code, v)
+		}
+	})
+
+	t.Run("stale commitment", func(t *testing.T) {
+		w := do(http.MethodPost, "/dice/roll", &alice, map[string]string{"expression": "1d20", "commitment": committed})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for a used commitment, got %d", w.Code)
+		}
+	})
+
+	t.Run("hidden rolls", func(t *testing.T) {
+		w := do(http.MethodPost, "/dice/roll", &alice, map[string]string{"expression": "1d20", "visibility": "gm"})
+		var hidden diceLogEntry
+		_ = json.NewDecoder(w.Body).Decode(&hidden)
+		if w := do(http.MethodGet, "/dice/"+hidden.ID+"/verify", &bob, nil); w.Code != http.StatusNotFound {
+			t.Fatalf("expected 404 for a roll Bob cannot see, got %d", w.Code)
+		}
+		if w := do(http.MethodGet, "/dice/"+hidden.ID+"/verify", &alice, nil); w.Code != http.StatusOK {
+			t.Fatalf("expected the roller to verify, got %d", w.Code)
+		}
+	})
+
+	t.Run("legacy rolls", func(t *testing.T) {
+		w := do(http.MethodPost, "/dice", &alice, map[string]any{"seed": 7, "count": 1, "results": []int{3}})
+		var legacy diceLogEntry
+		_ = json.NewDecoder(w.Body).Decode(&legacy)
+		if w := do(http.MethodGet, "/dice/"+legacy.ID+"/verify", nil, nil); w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422 for an uncommitted roll, got %d", w.Code)
+		}
+	})
+}
+
+func TestDiceCommitmentOverWebsocket(t *testing.T) {
+	app := newTestServer(t, t.TempDir())
+	router := app.Router()
+	room := createRoomForTest(t, router)
+	player := joinRoomForTest(t, router, room, "Player One", RolePlayer)
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(player.Token), nil)
+
+	request, _ := json.Marshal(map[string]any{"type": "RequestDiceCommitment"})
+	if err := writeFrame(conn, 0x1, request); err != nil {
+		t.Fatalf("request commitment: %v", err)
+	}
+	var pending diceCommitment
+	_ = json.Unmarshal(readWSMessageForTest(t, conn, "DiceCommitment"), &pending)
+
+	roll, _ := json.Marshal(map[string]any{
+		"type":    "RollDice",
+		"payload": map[string]any{"expression": "1d20", "clientSeed": "ws-nonce"},
+	})
+	if err := writeFrame(conn, 0x1, roll); err != nil {
+		t.Fatalf("send roll: %v", err)
+	}
+	var entry diceLogEntry
+	_ = json.Unmarshal(readWSMessageForTest(t, conn, "DiceLogEntry"), &entry)
+	if entry.Commitment != pending.Commitment || entry.ClientSeed != "ws-nonce" {
+		t.Fatalf("roll did not use the published commitment: %+v", entry)
+	}
+
+	var next diceCommitment
+	_ = json.Unmarshal(readWSMessageForTest(t, conn, "DiceCommitment"), &next)
+	if next.Commitment == "" || next.Commitment == pending.Commitment {
+		t.Fatalf("expected a fresh commitment after the roll, got %+v", next)
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// diceStats is the response of GET /rooms/{id}/dice/stats.
+type diceStats struct {
+	Since   *time.Time        `json:"since,omitempty"`
+	Until   *time.Time        `json:"until,omitempty"`
+	Rolls   int               `json:"rolls"`
+	Dice    []dieTypeStats    `json:"dice"`
+	Players []playerDiceStats `json:"players"`
+}
+
+// playerDiceStats aggregates one roller's dice. Rolls are grouped by player
+// ID, or by name for rolls logged without one.
+type playerDiceStats struct {
+	RollerID string         `json:"rollerId,omitempty"`
+	Name     string         `json:"name"`
+	Rolls    int            `json:"rolls"`
+	Dice     []dieTypeStats `json:"dice"`
+	bySides  map[int]*dieTypeStats
+}
+
+// dieTypeStats aggregates every die with the same number of sides.
+// Distribution[i] counts the dice that showed face i+1. Streaks count
+// consecutive dice of this type showing a natural 1 or the maximum face.
+type dieTypeStats struct {
+	Sides               int     `json:"sides"`
+	Count               int     `json:"count"`
+	Mean                float64 `json:"mean"`
+	Distribution        []int   `json:"distribution"`
+	Nat1                int     `json:"nat1"`
+	NatMax              int     `json:"natMax"`
+	LongestNat1Streak   int     `json:"longestNat1Streak"`
+	LongestNatMaxStreak int     `json:"longestNatMaxStreak"`
+	sum                 int
+	nat1Streak          int
+	natMaxStreak        int
+}
+
+func (d *dieTypeStats) add(value int) {
+	if value < 1 || value > d.Sides {
+		return
+	}
+	d.Count++
+	d.sum += value
+	d.Distribution[value-1]++
+
+	if value == 1 {
+		d.Nat1++
+		d.nat1Streak++
+		d.LongestNat1Streak = max(d.LongestNat1Streak, d.nat1Streak)
+	} else {
+		d.nat1Streak = 0
+	}
+	if value == d.Sides {
+		d.NatMax++
+		d.natMaxStreak++
+		d.LongestNatMaxStreak = max(d.LongestNatMaxStreak, d.natMaxStreak)
+	} else {
+		d.natMaxStreak = 0
+	}
+	d.Mean = float64(d.sum) / float64(d.Count)
+}
+
+func dieStatsFor(bySides map[int]*dieTypeStats, sides int) *dieTypeStats {
+	stats, ok := bySides[sides]
+	if !ok {
+		stats = &dieTypeStats{Sides: sides, Distribution: make([]int, sides)}
+		bySides[sides] = stats
+	}
+	return stats
+}
+
+func sortedDieStats(bySides map[int]*dieTypeStats) []dieTypeStats {
+	out := make([]dieTypeStats, 0, len(bySides))
+	for _, stats := range bySides {
+		out = append(out, *stats)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Sides < out[j].Sides })
+	return out
+}
+
+// getDiceStats aggregates the rolls viewer may see in [since, until). Dice
+// logged without their sides cannot be attributed to a die type and are
+// skipped.
+func (s *Server) getDiceStats(roomID string, viewer clientProfile, since, until *time.Time) (diceStats, error) {
+	query, args := visibleDiceLogsQuery(roomID, viewer)
+	if since != nil {
+		query += ` AND timestamp >= ?`
+		args = append(args, *since)
+	}
+	if until != nil {
+		query += ` AND timestamp < ?`
+		args = append(args, *until)
+	}
+	rows, err := s.db.Query(query+` ORDER BY timestamp ASC, id ASC`, args...)
+	if err != nil {
+		return diceStats{}, err
+	}
+	defer rows.Close()
+
+	stats := diceStats{Since: since, Until: until}
+	byKey := make(map[string]*playerDiceStats)
+	roomDice := make(map[int]*dieTypeStats)
+	var order []string
+	for rows.Next() {
+		entry, err := scanDiceLog(rows)
+		if err != nil {
+			return diceStats{}, err
+		}
+		// Custom dice have no numbered faces to count.
+		if len(entry.Sides) != len(entry.Results) || len(entry.Faces) > 0 {
+			continue
+		}
+
+		key := entry.RollerID
+		if key == "" {
+			key = "name:" + entry.TriggeredBy
+		}
+		player, ok := byKey[key]
+		if !ok {
+			player = &playerDiceStats{RollerID: entry.RollerID, Name: entry.TriggeredBy, bySides: make(map[int]*dieTypeStats)}
+			byKey[key] = player
+			order = append(order, key)
+		}
+		player.Name = entry.TriggeredBy
+		player.Rolls++
+		stats.Rolls++
+		for i, value := range entry.Results {
+			dieStatsFor(player.bySides, entry.Sides[i]).add(value)
+			dieStatsFor(roomDice, entry.Sides[i]).add(value)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return diceStats{}, err
+	}
+
+	stats.Dice = sortedDieStats(roomDice)
+	stats.Players = make([]playerDiceStats, 0, len(order))
+	for _, key := range order {
+		player := byKey[key]
+		player.Dice = sortedDieStats(player.bySides)
+		stats.Players = append(stats.Players, *player)
+	}
+	return stats, nil
+}
+
+// parseStatsWindow reads the optional RFC 3339 since and until parameters.
+func parseStatsWindow(query url.Values) (*time.Time, *time.Time, bool) {
+	parse := func(name string) (*time.Time, bool) {
+		raw := query.Get(name)
+		if raw == "" {
+			return nil, true
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return nil, false
+		}
+		t = t.UTC()
+		return &t, true
+	}
+	since, ok := parse("since")
+	if !ok {
+		return nil, nil, false
+	}
+	until, ok := parse("until")
+	if !ok {
+		return nil, nil, false
+	}
+	if since != nil && until != nil && !since.Before(*until) {
+		return nil, nil, false
+	}
+	return since, until, true
+}
+
+// handleDiceStats serves GET /rooms/{id}/dice/stats. Like the history, the
+// statistics only cover the rolls the caller may see.
+func (s *Server) handleDiceStats(w http.ResponseWriter, r *http.Request, roomID string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	since, until, ok := parseStatsWindow(r.URL.Query())
+	if !ok {
+		http.Error(w, "since and until must be RFC 3339 timestamps with since before until", http.StatusBadRequest)
+		return
+	}
+	player, _, err := s.optionalPlayer(r, roomID)
+	if err != nil {
+		s.logger.Error("lookup player for dice stats", slog.String("error", err.Error()))
+		http.Error(w, "failed to load dice stats", http.StatusInternalServerError)
+		return
+	}
+
+	viewer := clientProfile{ID: player.ID, Name: player.Name, Role: string(player.Role)}
+	stats, err := s.getDiceStats(roomID, viewer, since, until)
+	if err != nil {
+		s.logger.Error("get dice stats", slog.String("error", err.Error()))
+		http.Error(w, "failed to load dice stats", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,639 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiceRNGReferenceValues(t *testing.T) {
+	// Reference values produced by mulberry32, so that stored seeds keep
+	// replaying to the results they were logged with.
+	tests := []struct {
+		seed uint32
+		want []int
+	}{
+		{seed: 1, want: []int{13, 20, 5, 18, 3}},
+		{seed: 12345, want: []int{20, 7, 14, 8, 17}},
+		{seed: 4294967295, want: []int{18, 4, 17, 20, 14}},
+	}
+	for _, tt := range tests {
+		if got := rollFaces(tt.seed, 5, 20); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rollFaces(%d) = %v, want %v", tt.seed, got, tt.want)
+		}
+	}
+}
+
+// rollFaces derives count face values for dice with the given sides from seed.
+func rollFaces(seed uint32, count, sides int) []int {
+	rng := newDiceRNG(seed)
+	results := make([]int, count)
+	for i := range results {
+		results[i] = int(rng.Float64()*float64(sides)) + 1
+	}
+	return results
+}
+
+func TestDiceRollEndpoint(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	player := joinRoomForTest(t, router, room, "Player One", RolePlayer)
+
+	roll := func(payload any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/dice/roll", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("server computes results", func(t *testing.T) {
+		w := roll(map[string]int{"count": 3, "sides": 8})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var entry diceLogEntry
+		_ = json.NewDecoder(w.Body).Decode(&entry)
+		if entry.TriggeredBy != player.Name || entry.Count != 3 {
+			t.Fatalf("unexpected entry: %+v", entry)
+		}
+		if want := rollFaces(entry.Seed, 3, 8); !reflect.DeepEqual(entry.Results, want) {
+			t.Fatalf("results %v do not derive from seed %d (want %v)", entry.Results, entry.Seed, want)
+		}
+
+		logs, _, err := srv.getDiceLogs(room.ID, clientProfile{Role: string(RoleGM)}, diceLogPage{})
+		if err != nil {
+			t.Fatalf("get dice logs: %v", err)
+		}
+		if len(logs) != 1 || logs[0].ID != entry.ID {
+			t.Fatalf("expected the roll to be logged, got %+v", logs)
+		}
+	})
+
+	t.Run("expression breakdown is stored", func(t *testing.T) {
+		w := roll(map[string]string{"expression": "4d6kh3 + 2"})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var entry diceLogEntry
+		_ = json.NewDecoder(w.Body).Decode(&entry)
+		if entry.Expression != "4d6kh3+2" || entry.Breakdown == nil || len(entry.Breakdown.Terms) != 2 {
+			t.Fatalf("unexpected entry: %+v", entry)
+		}
+		if want := rollFaces(entry.Seed, 4, 6); !reflect.DeepEqual(entry.Results, want) {
+			t.Fatalf("results %v do not derive from seed %d (want %v)", entry.Results, entry.Seed, want)
+		}
+		kept := 0
+		for _, die := range entry.Breakdown.Terms[0].Dice {
+			if !die.Dropped {
+				kept += die.Value
+			}
+		}
+		if entry.Total != kept+2 || entry.Breakdown.Total != entry.Total {
+			t.Fatalf("total %d does not match kept dice %d + 2", entry.Total, kept)
+		}
+
+		logs, _, err := srv.getDiceLogs(room.ID, clientProfile{Role: string(RoleGM)}, diceLogPage{})
+		if err != nil {
+			t.Fatalf("get dice logs: %v", err)
+		}
+		if len(logs) == 0 || logs[0].ID != entry.ID || !reflect.DeepEqual(logs[0].Breakdown, entry.Breakdown) {
+			t.Fatalf("expected stored breakdown %+v, got %+v", entry.Breakdown, logs)
+		}
+	})
+
+	t.Run("rejects invalid dice", func(t *testing.T) {
+		if w := roll(map[string]string{"expression": "2d6 *"}); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for invalid expression, got %d", w.Code)
+		}
+		for _, payload := range []map[string]int{
+			{"count": 0, "sides": 6},
+			{"count": maxDiceCount + 1, "sides": 6},
+			{"count": 1, "sides": 1},
+			{"count": 1, "sides": maxDiceSides + 1},
+		} {
+			if w := roll(payload); w.Code != http.StatusBadRequest {
+				t.Errorf("expected 400 for %v, got %d", payload, w.Code)
+			}
+		}
+	})
+
+	t.Run("client results are rejected without the legacy flag", func(t *testing.T) {
+		body, _ := json.Marshal(map[string]any{"seed": 1, "count": 1, "results": []int{20}})
+		req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/dice", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("expected 403, got %d", w.Code)
+		}
+	})
+}
+
+func TestRollDiceOverWebsocket(t *testing.T) {
+	app := newTestServer(t, t.TempDir())
+	router := app.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	player := joinRoomForTest(t, router, room, "Player One", RolePlayer)
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	gmConn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(gm.Token), nil)
+	playerConn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(player.Token), nil)
+
+	// The client-chosen seed must be ignored.
+	message, _ := json.Marshal(map[string]any{
+		"type":    "RollDice",
+		"payload": map[string]any{"seed": 1, "count": 2, "sides": 20, "triggeredBy": "Test Creator"},
+	})
+	if err := writeFrame(playerConn, 0x1, message); err != nil {
+		t.Fatalf("send roll: %v", err)
+	}
+
+	var roll DiceRollPayload
+	_ = json.Unmarshal(readWSMessageForTest(t, gmConn, "DiceRoll"), &roll)
+	if roll.TriggeredBy != player.Name || roll.Count != 2 || !reflect.DeepEqual(roll.DieSides, []int{20, 20}) {
+		t.Fatalf("unexpected dice roll payload: %+v", roll)
+	}
+	if !reflect.DeepEqual(roll.Results, rollFaces(roll.Seed, 2, 20)) {
+		t.Fatalf("results %v do not derive from seed %d", roll.Results, roll.Seed)
+	}
+
+	var entry diceLogEntry
+	_ = json.Unmarshal(readWSMessageForTest(t, gmConn, "DiceLogEntry"), &entry)
+	if entry.Seed != roll.Seed || !reflect.DeepEqual(entry.Results, roll.Results) {
+		t.Fatalf("log entry %+v does not match roll %+v", entry, roll)
+	}
+
+	// Mixed pools animate each die with its own sides.
+	message, _ = json.Marshal(map[string]any{"type": "RollDice", "payload": map[string]any{"expression": "1d20+2d6"}})
+	if err := writeFrame(playerConn, 0x1, message); err != nil {
+		t.Fatalf("send roll: %v", err)
+	}
+	roll = DiceRollPayload{}
+	_ = json.Unmarshal(readWSMessageForTest(t, gmConn, "DiceRoll"), &roll)
+	if !reflect.DeepEqual(roll.DieSides, []int{20, 6, 6}) || len(roll.Results) != 3 {
+		t.Fatalf("unexpected sides for a mixed roll: %+v", roll)
+	}
+}
+
+func TestPrivateRolls(t *testing.T) {
+	app := newTestServer(t, t.TempDir())
+	router := app.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+	bob := joinRoomForTest(t, router, room, "Bob", RolePlayer)
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	gmConn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(gm.Token), nil)
+	bobConn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(bob.Token), nil)
+
+	roll := func(player Player, payload any) diceLogEntry {
+		t.Helper()
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/dice/roll", bytes.NewReader(body))
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("roll %v: expected 201, got %d: %s", payload, w.Code, w.Body.String())
+		}
+		var entry diceLogEntry
+		_ = json.NewDecoder(w.Body).Decode(&entry)
+		return entry
+	}
+	visibleIDs := func(player Player) map[string]bool {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+room.ID+"/dice", nil)
+		if player.Token != "" {
+			authorize(req, player)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var logs []diceLogEntry
+		_ = json.NewDecoder(w.Body).Decode(&logs)
+		ids := make(map[string]bool)
+		for _, entry := range logs {
+			ids[entry.ID] = true
+		}
+		return ids
+	}
+	nextLogEntry := func(conn net.Conn) diceLogEntry {
+		t.Helper()
+		var entry diceLogEntry
+		_ = json.Unmarshal(readWSMessageForTest(t, conn, "DiceLogEntry"), &entry)
+		return entry
+	}
+
+	hidden := roll(gm, map[string]any{"expression": "1d20", "visibility": "gm"})
+	blind := roll(alice, map[string]any{"expression": "1d20", "visibility": "blind"})
+	if blind.ID == "" || len(blind.Results) != 0 || blind.Total != 0 || blind.Breakdown != nil || blind.Expression != "" || blind.ServerSeed != "" {
+		t.Fatalf("a blind roll must not show the roller its result: %+v", blind)
+	}
+	whisper := roll(alice, map[string]any{"expression": "1d20", "visibility": "whisper", "whisperTo": []string{bob.ID}})
+	public := roll(alice, map[string]any{"expression": "1d20"})
+
+	tests := []struct {
+		name    string
+		viewer  Player
+		visible []diceLogEntry
+		hidden  []diceLogEntry
+	}{
+		{name: "gm", viewer: gm, visible: []diceLogEntry{hidden, blind, whisper, public}},
+		{name: "roller", viewer: alice, visible: []diceLogEntry{whisper, public}, hidden: []diceLogEntry{hidden, blind}},
+		{name: "whisper recipient", viewer: bob, visible: []diceLogEntry{whisper, public}, hidden: []diceLogEntry{hidden, blind}},
+		{name: "anonymous", visible: []diceLogEntry{public}, hidden: []diceLogEntry{hidden, blind, whisper}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" history", func(t *testing.T) {
+			ids := visibleIDs(tt.viewer)
+			for _, entry := range tt.visible {
+				if !ids[entry.ID] {
+					t.Errorf("expected %s roll to be visible", entry.Visibility)
+				}
+			}
+			for _, entry := range tt.hidden {
+				if ids[entry.ID] {
+					t.Errorf("expected %s roll to be hidden", entry.Visibility)
+				}
+			}
+		})
+	}
+
+	t.Run("websocket delivery", func(t *testing.T) {
+		for _, want := range []diceLogEntry{hidden, blind, whisper, public} {
+			if got := nextLogEntry(gmConn); got.ID != want.ID {
+				t.Fatalf("GM expected %s roll %s, got %+v", want.Visibility, want.ID, got)
+			}
+		}
+		for _, want := range []diceLogEntry{whisper, public} {
+			if got := nextLogEntry(bobConn); got.ID != want.ID {
+				t.Fatalf("Bob expected %s roll %s, got %+v", want.Visibility, want.ID, got)
+			}
+		}
+	})
+
+	t.Run("rejects invalid audiences", func(t *testing.T) {
+		for _, payload := range []map[string]any{
+			{"expression": "1d20", "visibility": "secret"},
+			{"expression": "1d20", "visibility": "whisper"},
+			{"expression": "1d20", "visibility": "whisper", "whisperTo": []string{"nobody"}},
+		} {
+			body, _ := json.Marshal(payload)
+			req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/dice/roll", bytes.NewReader(body))
+			authorize(req, alice)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected 400 for %v, got %d", payload, w.Code)
+			}
+		}
+	})
+}
+
+func TestDiceLogPagination(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var stored []diceLogEntry
+	for i := 0; i < 7; i++ {
+		roller := "Alice"
+		if i%2 == 1 {
+			roller = "Bob"
+		}
+		// Entries 3 and 4 share a timestamp to exercise the id tie-break.
+		ts := base.Add(time.Duration(min(i, 3)+max(i-4, 0)) * time.Minute)
+		entry, err := srv.storeDiceLog(room.ID, diceLogEntry{
+			Seed: uint32(i + 1), Count: 1, Results: []int{i + 1}, TriggeredBy: roller, Timestamp: ts,
+		})
+		if err != nil {
+			t.Fatalf("store dice log: %v", err)
+		}
+		stored = append(stored, entry)
+	}
+
+	get := func(query string) ([]diceLogEntry, string, int) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+room.ID+"/dice"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var logs []diceLogEntry
+		_ = json.NewDecoder(w.Body).Decode(&logs)
+		return logs, w.Header().Get("X-Next-Cursor"), w.Code
+	}
+
+	t.Run("walks the full history", func(t *testing.T) {
+		var seen []diceLogEntry
+		query := "?limit=3"
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("pagination did not terminate")
+			}
+			logs, next, code := get(query)
+			if code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", code)
+			}
+			seen = append(seen, logs...)
+			if next == "" {
+				break
+			}
+			query = "?limit=3&before=" + url.QueryEscape(next)
+		}
+		if len(seen) != len(stored) {
+			t.Fatalf("expected %d entries, got %d", len(stored), len(seen))
+		}
+		ids := make(map[string]bool)
+		for i, entry := range seen {
+			if ids[entry.ID] {
+				t.Fatalf("entry %s returned twice", entry.ID)
+			}
+			ids[entry.ID] = true
+			if i > 0 && entry.Timestamp.After(seen[i-1].Timestamp) {
+				t.Fatalf("entries out of order at %d", i)
+			}
+		}
+	})
+
+	t.Run("filters by roller", func(t *testing.T) {
+		logs, _, _ := get("?triggeredBy=Bob")
+		if len(logs) != 3 {
+			t.Fatalf("expected 3 rolls by Bob, got %d", len(logs))
+		}
+		for _, entry := range logs {
+			if entry.TriggeredBy != "Bob" {
+				t.Fatalf("unexpected roller %q", entry.TriggeredBy)
+			}
+		}
+	})
+
+	t.Run("rejects bad parameters", func(t *testing.T) {
+		for _, query := range []string{"?limit=0", "?limit=1000", "?limit=x", "?before=not-a-cursor"} {
+			if _, _, code := get(query); code != http.StatusBadRequest {
+				t.Errorf("expected 400 for %s, got %d", query, code)
+			}
+		}
+	})
+}
+
+func TestDiceRetention(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	player := joinRoomForTest(t, router, room, "Player One", RolePlayer)
+
+	now := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		// Two rolls are older than a week.
+		ts := now.Add(-time.Duration(i) * time.Hour)
+		if i >= 3 {
+			ts = now.AddDate(0, 0, -10-i)
+		}
+		if _, err := srv.storeDiceLog(room.ID, diceLogEntry{Seed: uint32(i + 1), Count: 1, Results: []int{1}, Timestamp: ts}); err != nil {
+			t.Fatalf("store dice log: %v", err)
+		}
+	}
+	countLogs := func() int {
+		var n int
+		if err := srv.db.QueryRow(`SELECT COUNT(1) FROM dice_logs WHERE room_id = ?`, room.ID).Scan(&n); err != nil {
+			t.Fatalf("count dice logs: %v", err)
+		}
+		return n
+	}
+	if n := countLogs(); n != 5 {
+		t.Fatalf("history should be unlimited by default, got %d entries", n)
+	}
+
+	patch := func(player Player, retention DiceRetention) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{"diceRetention": retention})
+		req := httptest.NewRequest(http.MethodPatch, "/rooms/"+room.ID, bytes.NewReader(body))
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := patch(player, DiceRetention{MaxEntries: 1}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for player, got %d", w.Code)
+	}
+	if w := patch(gm, DiceRetention{MaxEntries: -1}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for negative retention, got %d", w.Code)
+	}
+
+	w := patch(gm, DiceRetention{MaxAgeDays: 7})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var updated Room
+	_ = json.NewDecoder(w.Body).Decode(&updated)
+	if updated.DiceRetention.MaxAgeDays != 7 || updated.Theme == "" {
+		t.Fatalf("unexpected room after update: %+v", updated)
+	}
+	if n := countLogs(); n != 3 {
+		t.Fatalf("expected age retention to keep 3 entries, got %d", n)
+	}
+
+	if w := patch(gm, DiceRetention{MaxEntries: 2}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if _, err := srv.storeDiceLog(room.ID, diceLogEntry{Seed: 99, Count: 1, Results: []int{1}, Timestamp: now}); err != nil {
+		t.Fatalf("store dice log: %v", err)
+	}
+	if n := countLogs(); n != 2 {
+		t.Fatalf("expected count retention to keep 2 entries, got %d", n)
+	}
+}
+
+func TestDiceRollMetadata(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	player := joinRoomForTest(t, router, room, "Player One", RolePlayer)
+
+	body, _ := json.Marshal(map[string]string{"expression": "2d6+1d20-3", "label": "  Stealth check "})
+	req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/dice/roll", bytes.NewReader(body))
+	authorize(req, player)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	logs, _, err := srv.getDiceLogs(room.ID, clientProfile{Role: string(RoleGM)}, diceLogPage{})
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("get dice logs: %v (%d entries)", err, len(logs))
+	}
+	entry := logs[0]
+	if !reflect.DeepEqual(entry.Sides, []int{6, 6, 20}) {
+		t.Fatalf("sides = %v", entry.Sides)
+	}
+	if entry.Label != "Stealth check" || entry.RollerID != player.ID || entry.Modifier != -3 || entry.Expression != "2d6+1d20-3" {
+		t.Fatalf("unexpected metadata: %+v", entry)
+	}
+
+	long, _ := json.Marshal(map[string]string{"expression": "1d6", "label": strings.Repeat("x", maxDiceLabelLength+1)})
+	req = httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/dice/roll", bytes.NewReader(long))
+	authorize(req, player)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for long label, got %d", w.Code)
+	}
+}
+
+func TestDiceLogMetadataBackfill(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open old database: %v", err)
+	}
+	now := time.Now().UTC()
+	for _, stmt := range []string{
+		`CREATE TABLE rooms (id TEXT PRIMARY KEY, slug TEXT NOT NULL UNIQUE, name TEXT NOT NULL, theme TEXT NOT NULL DEFAULT 'default', created_by TEXT, created_at TIMESTAMP NOT NULL)`,
+		`CREATE TABLE players (id TEXT PRIMARY KEY, room_id TEXT NOT NULL, name TEXT NOT NULL, token TEXT NOT NULL UNIQUE, role TEXT NOT NULL, created_at TIMESTAMP NOT NULL)`,
+		`CREATE TABLE dice_logs (id TEXT PRIMARY KEY, room_id TEXT NOT NULL, seed INTEGER NOT NULL, count INTEGER NOT NULL, results TEXT NOT NULL, triggered_by TEXT NOT NULL, timestamp TIMESTAMP NOT NULL, expression TEXT NOT NULL DEFAULT '', total INTEGER NOT NULL DEFAULT 0, breakdown TEXT)`,
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatalf("create old schema: %v", err)
+		}
+	}
+	breakdown := `{"expression":"1d8+2","terms":[{"notation":"1d8","sides":8,"dice":[{"value":5}],"subtotal":5},{"notation":"2","subtotal":2}],"total":7}`
+	for _, exec := range []struct {
+		query string
+		args  []any
+	}{
+		{`INSERT INTO rooms (id, slug, name, created_at) VALUES ('r1', 'room', 'Room', ?)`, []any{now}},
+		{`INSERT INTO players (id, room_id, name, token, role, created_at) VALUES ('p1', 'r1', 'Alice', 'tok', 'player', ?)`, []any{now}},
+		{`INSERT INTO dice_logs (id, room_id, seed, count, results, triggered_by, timestamp, total, breakdown) VALUES ('d1', 'r1', 1, 1, '[5]', 'Alice', ?, 7, ?)`, []any{now, breakdown}},
+		{`INSERT INTO dice_logs (id, room_id, seed, count, results, triggered_by, timestamp) VALUES ('d2', 'r1', 2, 2, '[3,4]', 'Stranger', ?)`, []any{now}},
+	} {
+		if _, err := old.Exec(exec.query, exec.args...); err != nil {
+			t.Fatalf("seed old database: %v", err)
+		}
+	}
+	old.Close()
+
+	db, err := openDatabase(path)
+	if err != nil {
+		t.Fatalf("migrate database: %v", err)
+	}
+	defer db.Close()
+
+	load := func(id string) diceLogEntry {
+		t.Helper()
+		entry, err := scanDiceLog(db.QueryRow(`SELECT `+diceLogColumns+` FROM dice_logs WHERE id = ?`, id))
+		if err != nil {
+			t.Fatalf("load %s: %v", id, err)
+		}
+		return entry
+	}
+
+	withBreakdown := load("d1")
+	if !reflect.DeepEqual(withBreakdown.Sides, []int{8}) || withBreakdown.Modifier != 2 || withBreakdown.Expression != "1d8+2" || withBreakdown.RollerID != "p1" {
+		t.Fatalf("unexpected backfill: %+v", withBreakdown)
+	}
+	legacy := load("d2")
+	if len(legacy.Sides) != 0 || legacy.RollerID != "" || legacy.Visibility != DiceVisibilityPublic {
+		t.Fatalf("unexpected legacy backfill: %+v", legacy)
+	}
+}
+
+func TestDiceStats(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+	bob := joinRoomForTest(t, router, room, "Bob", RolePlayer)
+
+	base := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	for i, roll := range []struct {
+		roller     Player
+		results    []int
+		sides      []int
+		visibility DiceVisibility
+	}{
+		{alice, []int{20, 20}, []int{20, 20}, DiceVisibilityPublic},
+		{alice, []int{1, 4}, []int{20, 6}, DiceVisibilityPublic},
+		{alice, []int{1}, []int{20}, DiceVisibilityPublic},
+		{bob, []int{6}, []int{6}, DiceVisibilityGM},
+		{bob, []int{3}, nil, DiceVisibilityPublic},
+	} {
+		if _, err := srv.storeDiceLog(room.ID, diceLogEntry{
+			Seed: uint32(i + 1), Count: len(roll.results), Results: roll.results, Sides: roll.sides,
+			TriggeredBy: roll.roller.Name, RollerID: roll.roller.ID, Visibility: roll.visibility,
+			Timestamp: base.Add(time.Duration(i) * time.Minute),
+		}); err != nil {
+			t.Fatalf("store roll %d: %v", i, err)
+		}
+	}
+
+	fetch := func(player *Player, query string) diceStats {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+room.ID+"/dice/stats"+query, nil)
+		if player != nil {
+			authorize(req, *player)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var stats diceStats
+		if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+			t.Fatalf("decode stats: %v", err)
+		}
+		return stats
+	}
+
+	stats := fetch(&alice, "")
+	if stats.Rolls != 3 || len(stats.Players) != 1 {
+		t.Fatalf("Alice should only see her own public rolls: %+v", stats)
+	}
+	d20 := stats.Players[0].Dice[1]
+	if d20.Sides != 20 || d20.Count != 4 || d20.Nat1 != 2 || d20.NatMax != 2 || d20.LongestNatMaxStreak != 2 || d20.LongestNat1Streak != 2 {
+		t.Fatalf("unexpected d20 stats: %+v", d20)
+	}
+	if d20.Mean != 10.5 || d20.Distribution[0] != 2 || d20.Distribution[19] != 2 {
+		t.Fatalf("unexpected d20 mean or distribution: %+v", d20)
+	}
+
+	// The GM also sees Bob's GM-only roll; the roll without sides is skipped.
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	stats = fetch(&gm, "")
+	if stats.Rolls != 4 || len(stats.Players) != 2 || stats.Players[1].RollerID != bob.ID {
+		t.Fatalf("unexpected GM stats: %+v", stats)
+	}
+	if d6 := stats.Dice[0]; d6.Sides != 6 || d6.Count != 2 || d6.NatMax != 1 {
+		t.Fatalf("unexpected room d6 stats: %+v", d6)
+	}
+
+	window := "?since=" + url.QueryEscape(base.Add(time.Minute).Format(time.RFC3339)) + "&until=" + url.QueryEscape(base.Add(2*time.Minute).Format(time.RFC3339))
+	if stats = fetch(&gm, window); stats.Rolls != 1 || stats.Dice[0].Count != 1 || stats.Dice[1].Nat1 != 1 {
+		t.Fatalf("unexpected windowed stats: %+v", stats)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/rooms/"+room.ID+"/dice/stats?since=yesterday", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad window, got %d", w.Code)
+	}
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"vtrpg/internal/dice"
+)
+
+const (
+	maxDiceTypeNameLength  = 100
+	maxDiceFaces           = 100
+	maxDiceFaceLabelLength = 32
+	maxDiceFaceValue       = 1000
+)
+
+const diceTypeColumns = `id, room_id, name, faces, created_at, updated_at`
+
+func scanDiceType(row rowScanner) (DiceType, error) {
+	var diceType DiceType
+	var faces string
+	if err := row.Scan(&diceType.ID, &diceType.RoomID, &diceType.Name, &faces, &diceType.CreatedAt, &diceType.UpdatedAt); err != nil {
+		return DiceType{}, err
+	}
+	if err := json.Unmarshal([]byte(faces), &diceType.Faces); err != nil {
+		return DiceType{}, err
+	}
+	diceType.CreatedAt = diceType.CreatedAt.UTC()
+	diceType.UpdatedAt = diceType.UpdatedAt.UTC()
+	return diceType, nil
+}
+
+// diceTypeFields validates the name and faces of a custom die. Faces sharing
+// an ID must be identical, so a face ID always means the same thing.
+func diceTypeFields(name string, faces []DiceFace) (string, []DiceFace, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxDiceTypeNameLength {
+		return "", nil, fmt.Errorf("name must be 1-%d characters", maxDiceTypeNameLength)
+	}
+	if len(faces) < 2 || len(faces) > maxDiceFaces {
+		return "", nil, fmt.Errorf("a die needs 2-%d faces", maxDiceFaces)
+	}
+	byID := make(map[string]DiceFace, len(faces))
+	cleaned := make([]DiceFace, len(faces))
+	for i, face := range faces {
+		face.ID = strings.TrimSpace(face.ID)
+		face.Label = strings.TrimSpace(face.Label)
+		if face.ID == "" || len(face.ID) > maxDiceFaceLabelLength {
+			return "", nil, fmt.Errorf("face %d: id must be 1-%d bytes", i+1, maxDiceFaceLabelLength)
+		}
+		if face.Label == "" {
+			face.Label = face.ID
+		}
+		if utf8.RuneCountInString(face.Label) > maxDiceFaceLabelLength {
+			return "", nil, fmt.Errorf("face %q: label must be at most %d characters", face.ID, maxDiceFaceLabelLength)
+		}
+		if face.Value < -maxDiceFaceValue || face.Value > maxDiceFaceValue {
+			return "", nil, fmt.Errorf("face %q: value must be between -%d and %d", face.ID, maxDiceFaceValue, maxDiceFaceValue)
+		}
+		for symbol, count := range face.Symbols {
+			if symbol == "" || len(symbol) > maxDiceFaceLabelLength || count < 1 || count > maxDiceFaces {
+				return "", nil, fmt.Errorf("face %q: symbols need a 1-%d byte name and a count of 1-%d", face.ID, maxDiceFaceLabelLength, maxDiceFaces)
+			}
+		}
+		if len(face.Symbols) == 0 {
+			face.Symbols = nil
+		}
+		if seen, ok := byID[face.ID]; ok {
+			if seen.Label != face.Label || seen.Value != face.Value || !maps.Equal(seen.Symbols, face.Symbols) {
+				return "", nil, fmt.Errorf("faces with id %q differ", face.ID)
+			}
+		}
+		byID[face.ID] = face
+		cleaned[i] = face
+	}
+	return name, cleaned, nil
+}
+
+func (s *Server) listDiceTypes(roomID string) ([]DiceType, error) {
+	rows, err := s.db.Query(`SELECT `+diceTypeColumns+` FROM dice_types WHERE room_id = ? ORDER BY name COLLATE NOCASE, id`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := make([]DiceType, 0)
+	for rows.Next() {
+		diceType, err := scanDiceType(rows)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, diceType)
+	}
+	return types, rows.Err()
+}
+
+func (s *Server) getDiceType(roomID, typeID string) (DiceType, bool, error) {
+	diceType, err := scanDiceType(s.db.QueryRow(`SELECT `+diceTypeColumns+` FROM dice_types WHERE room_id = ? AND id = ?`, roomID, typeID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return DiceType{}, false, nil
+	}
+	if err != nil {
+		return DiceType{}, false, err
+	}
+	return diceType, true, nil
+}
+
+// diceTypeNameTaken reports whether another die in the room has the name,
+// ignoring case.
+func (s *Server) diceTypeNameTaken(roomID, name, exceptID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM dice_types WHERE room_id = ? AND name = ? COLLATE NOCASE AND id != ?)`,
+		roomID, name, exceptID,
+	).Scan(&exists)
+	return exists, err
+}
+
+func (s *Server) storeDiceType(diceType DiceType) (DiceType, error) {
+	faces, err := json.Marshal(diceType.Faces)
+	if err != nil {
+		return DiceType{}, err
+	}
+	now := time.Now().UTC()
+	diceType.ID = s.newID()
+	diceType.CreatedAt = now
+	diceType.UpdatedAt = now
+	if _, err := s.db.Exec(
+		`INSERT INTO dice_types (id, room_id, name, faces, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		diceType.ID, diceType.RoomID, diceType.Name, string(faces), diceType.CreatedAt, diceType.UpdatedAt,
+	); err != nil {
+		return DiceType{}, err
+	}
+	return diceType, nil
+}
+
+func (s *Server) updateDiceType(diceType DiceType) (DiceType, error) {
+	faces, err := json.Marshal(diceType.Faces)
+	if err != nil {
+		return DiceType{}, err
+	}
+	diceType.UpdatedAt = time.Now().UTC()
+	if _, err := s.db.Exec(
+		`UPDATE dice_types SET name = ?, faces = ?, updated_at = ? WHERE room_id = ? AND id = ?`,
+		diceType.Name, string(faces), diceType.UpdatedAt, diceType.RoomID, diceType.ID,
+	); err != nil {
+		return DiceType{}, err
+	}
+	return diceType, nil
+}
+
+func (s *Server) deleteDiceType(roomID, typeID string) error {
+	_, err := s.db.Exec(`DELETE FROM dice_types WHERE room_id = ? AND id = ?`, roomID, typeID)
+	return err
+}
+
+// handleDiceTypes serves /rooms/{id}/dice/types and
+// /rooms/{id}/dice/types/{typeId}. Anyone in the room can read the custom
+// dice; only the GM defines them.
+func (s *Server) handleDiceTypes(w http.ResponseWriter, r *http.Request, roomID, typeID string) {
+	if r.Method == http.MethodGet {
+		if typeID == "" {
+			types, err := s.listDiceTypes(roomID)
+			if err != nil {
+				s.logger.Error("list dice types", slog.String("error", err.Error()))
+				http.Error(w, "failed to load dice types", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, types)
+			return
+		}
+		diceType, found, err := s.getDiceType(roomID, typeID)
+		if err != nil {
+			s.logger.Error("get dice type", slog.String("error", err.Error()))
+			http.Error(w, "failed to load dice type", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, diceType)
+		return
+	}
+
+	switch {
+	case typeID == "" && r.Method == http.MethodPost:
+	case typeID != "" && (r.Method == http.MethodPatch || r.Method == http.MethodDelete):
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	if player.Role != RoleGM {
+		http.Error(w, "only the GM can define dice", http.StatusForbidden)
+		return
+	}
+
+	diceType := DiceType{RoomID: roomID}
+	if typeID != "" {
+		var found bool
+		var err error
+		if diceType, found, err = s.getDiceType(roomID, typeID); err != nil {
+			s.logger.Error("get dice type", slog.String("error", err.Error()))
+			http.Error(w, "failed to load dice type", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if r.Method == http.MethodDelete {
+		if err := s.deleteDiceType(roomID, typeID); err != nil {
+			s.logger.Error("delete dice type", slog.String("error", err.Error()))
+			http.Error(w, "failed to delete dice type", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var payload struct {
+		Name  *string    `json:"name"`
+		Faces []DiceFace `json:"faces"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if payload.Name == nil && payload.Faces == nil {
+		http.Error(w, "missing fields", http.StatusBadRequest)
+		return
+	}
+	if payload.Name != nil {
+		diceType.Name = *payload.Name
+	}
+	if payload.Faces != nil {
+		diceType.Faces = payload.Faces
+	}
+	name, faces, err := diceTypeFields(diceType.Name, diceType.Faces)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	diceType.Name, diceType.Faces = name, faces
+	taken, err := s.diceTypeNameTaken(roomID, name, typeID)
+	if err != nil {
+		s.logger.Error("check dice type name", slog.String("error", err.Error()))
+		http.Error(w, "failed to save dice type", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "a die with that name already exists", http.StatusConflict)
+		return
+	}
+
+	status := http.StatusOK
+	if typeID == "" {
+		diceType, err = s.storeDiceType(diceType)
+		status = http.StatusCreated
+	} else {
+		diceType, err = s.updateDiceType(diceType)
+	}
+	if err != nil {
+		s.logger.Error("save dice type", slog.String("error", err.Error()))
+		http.Error(w, "failed to save dice type", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, diceType)
+}
+
+// CustomDice asks a roll for Count dice of the room's dice type Type. Name and
+// Faces are filled in from the type when the roll is made, and the faces are
+// what the dice are rolled on from then on.
+type CustomDice struct {
+	Type  string     `json:"type"`
+	Name  string     `json:"name,omitempty"`
+	Count int        `json:"count"`
+	Faces []DiceFace `json:"faces,omitempty"`
+}
+
+// resolveCustomDice looks up the requested dice types and copies their
+// definitions into the spec. Errors wrap errInvalidRoll unless the lookup
+// fails.
+func (s *Server) resolveCustomDice(roomID string, requested []CustomDice) ([]CustomDice, error) {
+	resolved := make([]CustomDice, len(requested))
+	for i, term := range requested {
+		diceType, found, err := s.getDiceType(roomID, term.Type)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: unknown dice type %q", errInvalidRoll, term.Type)
+		}
+		resolved[i] = CustomDice{Type: diceType.ID, Name: diceType.Name, Count: term.Count, Faces: diceType.Faces}
+	}
+	return resolved, nil
+}
+
+const customDiceSystemName = "custom"
+
+// customDiceSystem rolls the room's custom dice. The total sums the values of
+// the rolled faces and Symbols counts their symbols. A reroll rolls every die
+// again.
+type customDiceSystem struct{}
+
+func (customDiceSystem) Name() string { return customDiceSystemName }
+
+func (customDiceSystem) Validate(spec RollSpec) error {
+	if len(spec.Dice) == 0 {
+		return fmt.Errorf("%w: no dice to roll", errInvalidRoll)
+	}
+	total := 0
+	for _, term := range spec.Dice {
+		if term.Count < 1 {
+			return fmt.Errorf("%w: dice counts must be positive", errInvalidRoll)
+		}
+		if len(term.Faces) < 2 {
+			return fmt.Errorf("%w: dice type %q has no faces", errInvalidRoll, term.Type)
+		}
+		total += term.Count
+	}
+	if total > maxDiceCount {
+		return fmt.Errorf("%w: at most %d dice can be rolled at once", errInvalidRoll, maxDiceCount)
+	}
+	return nil
+}
+
+func (customDiceSystem) Roll(spec RollSpec, rng dice.RNG) RuleResult {
+	result := RuleResult{Dice: []RuleDie{}}
+	notation := make([]string, len(spec.Dice))
+	for i, term := range spec.Dice {
+		notation[i] = fmt.Sprintf("%dd[%s]", term.Count, term.Name)
+		for range term.Count {
+			face := term.Faces[rollRuleDie(rng, len(term.Faces))-1]
+			result.Dice = append(result.Dice, RuleDie{Pool: term.Name, Sides: len(term.Faces), Value: face.Value, Face: face.ID})
+			result.Total += face.Value
+			for symbol, count := range face.Symbols {
+				if result.Symbols == nil {
+					result.Symbols = make(map[string]int)
+				}
+				result.Symbols[symbol] += count
+			}
+		}
+	}
+	result.Notation = strings.Join(notation, "+")
+	return result
+}
+
+func (customDiceSystem) CanPush(RuleResult) error { return nil }
+
+func (c customDiceSystem) Push(spec RollSpec, _ RuleResult, rng dice.RNG) RuleResult {
+	result := c.Roll(spec, rng)
+	for i := range result.Dice {
+		result.Dice[i].Rerolled = true
+	}
+	result.Pushed = true
+	return result
+}
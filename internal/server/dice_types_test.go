@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiceTypes(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+
+	do := func(method, path string, player *Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		if payload != nil {
+			_ = json.NewEncoder(&body).Encode(payload)
+		}
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, &body)
+		if player != nil {
+			authorize(req, *player)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	minus := DiceFace{ID: "minus", Label: "-", Value: -1}
+	blank := DiceFace{ID: "blank", Label: "0"}
+	plus := DiceFace{ID: "plus", Label: "+", Value: 1}
+	fate := map[string]any{"name": "Fate", "faces": []DiceFace{minus, minus, blank, blank, plus, plus}}
+
+	if w := do(http.MethodPost, "/dice/types", &alice, fate); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not define dice, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/dice/types", &gm, map[string]any{"name": "Coin", "faces": []DiceFace{plus}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a one-faced die, got %d", w.Code)
+	}
+	mismatched := map[string]any{"name": "Odd", "faces": []DiceFace{plus, {ID: "plus", Value: 2}}}
+	if w := do(http.MethodPost, "/dice/types", &gm, mismatched); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for differing faces with one id, got %d", w.Code)
+	}
+	w := do(http.MethodPost, "/dice/types", &gm, fate)
+	var fateType DiceType
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&fateType) != nil || len(fateType.Faces) != 6 {
+		t.Fatalf("create fate die: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPost, "/dice/types", &gm, map[string]any{"name": "fate", "faces": []DiceFace{minus, plus}}); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a duplicate name, got %d", w.Code)
+	}
+
+	success := DiceFace{ID: "success", Label: "Success", Symbols: map[string]int{"success": 1}}
+	double := DiceFace{ID: "success-advantage", Label: "Success + Advantage", Symbols: map[string]int{"success": 1, "advantage": 1}}
+	w = do(http.MethodPost, "/dice/types", &gm, map[string]any{"name": "Ability", "faces": []DiceFace{blank, success, double}})
+	var ability DiceType
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&ability) != nil {
+		t.Fatalf("create ability die: %d %s", w.Code, w.Body.String())
+	}
+
+	w = do(http.MethodGet, "/dice/types", nil, nil)
+	var listed []DiceType
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&listed) != nil || len(listed) != 2 || listed[0].Name != "Ability" {
+		t.Fatalf("list dice types: %d %s", w.Code, w.Body.String())
+	}
+
+	// Only rolls made after fetching a commitment verify.
+	do(http.MethodGet, "/dice/commitment", &alice, nil)
+	w = do(http.MethodPost, "/dice/roll", &alice, map[string]any{"dice": []CustomDice{{Type: fateType.ID, Count: 4}, {Type: ability.ID, Count: 2}}})
+	var entry diceLogEntry
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&entry) != nil {
+		t.Fatalf("roll custom dice: %d %s", w.Code, w.Body.String())
+	}
+	if entry.System != customDiceSystemName || entry.Expression != "4d[Fate]+2d[Ability]" || len(entry.Faces) != 6 || entry.Sides[0] != 6 || entry.Sides[5] != 3 {
+		t.Fatalf("unexpected custom roll: %+v", entry)
+	}
+	total, successes := 0, 0
+	for i, face := range entry.Faces {
+		total += entry.Results[i]
+		if face == "success" || face == "success-advantage" {
+			successes++
+		}
+	}
+	if entry.Total != total || entry.Rule.Symbols["success"] != successes {
+		t.Fatalf("totals do not match the faces: %+v %+v", entry, entry.Rule)
+	}
+
+	// Deleting the die does not break verifying or rerolling rolls made with it.
+	if w := do(http.MethodDelete, "/dice/types/"+fateType.ID, &gm, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete dice type: %d", w.Code)
+	}
+	w = do(http.MethodGet, "/dice/"+entry.ID+"/verify", nil, nil)
+	var v diceVerification
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&v) != nil || !v.Verified {
+		t.Fatalf("verify custom roll: %d %s", w.Code, w.Body.String())
+	}
+	w = do(http.MethodPost, "/dice/roll", &alice, map[string]any{"push": entry.ID})
+	var reroll diceLogEntry
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&reroll) != nil || len(reroll.Faces) != 6 || reroll.ParentID != entry.ID {
+		t.Fatalf("reroll custom dice: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPost, "/dice/roll", &alice, map[string]any{"dice": []CustomDice{{Type: fateType.ID, Count: 1}}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a deleted die, got %d", w.Code)
+	}
+
+	w = do(http.MethodGet, "/dice/stats", nil, nil)
+	var stats diceStats
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&stats) != nil || stats.Rolls != 0 {
+		t.Fatalf("custom dice must not count towards numbered dice stats: %d %s", w.Code, w.Body.String())
+	}
+}
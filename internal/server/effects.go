@@ -0,0 +1,413 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	effectTargetImage      = "image"
+	effectTargetInitiative = "initiative"
+
+	effectUnitRounds = "rounds"
+	effectUnitTurns  = "turns"
+
+	maxEffectNameLength = 100
+	maxEffectDuration   = 1000
+)
+
+const effectColumns = `id, room_id, target_type, target_id, name, source, unit, duration, remaining, created_at`
+
+func scanEffect(row rowScanner) (Effect, error) {
+	var effect Effect
+	if err := row.Scan(&effect.ID, &effect.RoomID, &effect.TargetType, &effect.TargetID, &effect.Name, &effect.Source,
+		&effect.Unit, &effect.Duration, &effect.Remaining, &effect.CreatedAt); err != nil {
+		return Effect{}, err
+	}
+	effect.CreatedAt = effect.CreatedAt.UTC()
+	return effect, nil
+}
+
+// hiddenEffectTarget matches effects whose target is hidden from players.
+const hiddenEffectTarget = `(
+	(target_type = 'image' AND EXISTS (SELECT 1 FROM images WHERE images.id = effects.target_id AND images.hidden = 1))
+	OR (target_type = 'initiative' AND EXISTS (SELECT 1 FROM initiative_entries WHERE initiative_entries.id = effects.target_id AND initiative_entries.hidden = 1))
+)`
+
+// listEffects returns a room's effects, optionally only those on one target.
+// Effects on hidden images and entries are left out unless includeHidden;
+// visibleEffects further narrows the list down to what a player sees.
+func (s *Server) listEffects(roomID string, includeHidden bool, targetType, targetID string) ([]Effect, error) {
+	query := `SELECT ` + effectColumns + ` FROM effects WHERE room_id = ?`
+	args := []any{roomID}
+	if targetType != "" {
+		query += ` AND target_type = ? AND target_id = ?`
+		args = append(args, targetType, targetID)
+	}
+	if !includeHidden {
+		query += ` AND NOT ` + hiddenEffectTarget
+	}
+	rows, err := s.db.Query(query+` ORDER BY created_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	effects := make([]Effect, 0)
+	for rows.Next() {
+		effect, err := scanEffect(rows)
+		if err != nil {
+			return nil, err
+		}
+		effects = append(effects, effect)
+	}
+	return effects, rows.Err()
+}
+
+// visibleEffects filters a list of effects down to those a player can see:
+// effects on images follow the image into fog, vision and inactive scenes.
+func (s *Server) visibleEffects(roomID, playerID string, effects []Effect) ([]Effect, error) {
+	view, err := s.loadPlayerView(roomID)
+	if err != nil {
+		return nil, err
+	}
+	images, err := s.getImages(roomID, view.scene, false)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(images))
+	for _, img := range view.visibleImages(playerID, images) {
+		seen[img.ID] = true
+	}
+	visible := make([]Effect, 0, len(effects))
+	for _, effect := range effects {
+		if effect.TargetType != effectTargetImage || seen[effect.TargetID] {
+			visible = append(visible, effect)
+		}
+	}
+	return visible, nil
+}
+
+func (s *Server) getEffect(roomID, effectID string) (Effect, bool, error) {
+	effect, err := scanEffect(s.db.QueryRow(`SELECT `+effectColumns+` FROM effects WHERE id = ? AND room_id = ?`, effectID, roomID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Effect{}, false, nil
+	}
+	if err != nil {
+		return Effect{}, false, err
+	}
+	return effect, true, nil
+}
+
+// effectTargetHidden reports whether an effect's target exists and whether it
+// is hidden from players.
+func (s *Server) effectTargetHidden(roomID, targetType, targetID string) (hidden, found bool, err error) {
+	var query string
+	switch targetType {
+	case effectTargetImage:
+		query = `SELECT hidden FROM images WHERE id = ? AND room_id = ?`
+	case effectTargetInitiative:
+		query = `SELECT hidden FROM initiative_entries WHERE id = ? AND room_id = ?`
+	default:
+		return false, false, nil
+	}
+	err = s.db.QueryRow(query, targetID, roomID).Scan(&hidden)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, false, nil
+	}
+	return hidden, err == nil, err
+}
+
+func (s *Server) storeEffect(effect Effect) (Effect, error) {
+	effect.ID = s.newID()
+	effect.CreatedAt = time.Now().UTC()
+	_, err := s.db.Exec(
+		`INSERT INTO effects (`+effectColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		effect.ID, effect.RoomID, effect.TargetType, effect.TargetID, effect.Name, effect.Source,
+		effect.Unit, effect.Duration, effect.Remaining, effect.CreatedAt,
+	)
+	return effect, err
+}
+
+func (s *Server) updateEffect(effect Effect) error {
+	_, err := s.db.Exec(
+		`UPDATE effects SET name = ?, source = ?, unit = ?, duration = ?, remaining = ? WHERE id = ? AND room_id = ?`,
+		effect.Name, effect.Source, effect.Unit, effect.Duration, effect.Remaining, effect.ID, effect.RoomID,
+	)
+	return err
+}
+
+// deleteTargetEffects removes the effects on a deleted image or initiative
+// entry and announces them as EffectDeleted to the target's former audience,
+// or to the whole room when audience is nil.
+func (s *Server) deleteTargetEffects(roomID, targetType, targetID string, audience func(clientProfile) bool) {
+	rows, err := s.db.Query(`DELETE FROM effects WHERE room_id = ? AND target_type = ? AND target_id = ? RETURNING `+effectColumns, roomID, targetType, targetID)
+	if err != nil {
+		s.logger.Error("delete target effects", slog.String("error", err.Error()))
+		return
+	}
+	var deleted []Effect
+	for rows.Next() {
+		effect, err := scanEffect(rows)
+		if err != nil {
+			s.logger.Error("delete target effects", slog.String("error", err.Error()))
+			break
+		}
+		deleted = append(deleted, effect)
+	}
+	rows.Close()
+	for _, effect := range deleted {
+		s.sendEffect(roomID, "EffectDeleted", effect, audience)
+	}
+}
+
+// advanceEffects counts down effects after the initiative turn advanced:
+// turn effects when the turn of the entry they are on, or of the entry of the
+// image they are on, ended, and round effects when a new round started.
+// Effects that run out are deleted and announced as EffectExpired.
+func (s *Server) advanceEffects(roomID string, ended InitiativeEntry, newRound bool) {
+	rows, err := s.db.Query(
+		`UPDATE effects SET remaining = remaining - 1 WHERE room_id = ? AND (
+			(unit = ? AND ((target_type = ? AND target_id = ?) OR (target_type = ? AND target_id = ?)))
+			OR (unit = ? AND ?)
+		) RETURNING `+effectColumns,
+		roomID, effectUnitTurns, effectTargetInitiative, ended.ID, effectTargetImage, ended.ImageID, effectUnitRounds, newRound,
+	)
+	if err != nil {
+		s.logger.Error("advance effects", slog.String("error", err.Error()))
+		return
+	}
+	var changed []Effect
+	for rows.Next() {
+		effect, err := scanEffect(rows)
+		if err != nil {
+			rows.Close()
+			s.logger.Error("advance effects", slog.String("error", err.Error()))
+			return
+		}
+		changed = append(changed, effect)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		s.logger.Error("advance effects", slog.String("error", err.Error()))
+		return
+	}
+
+	for _, effect := range changed {
+		msgType := "EffectUpdate"
+		if effect.Remaining <= 0 {
+			if _, err := s.db.Exec(`DELETE FROM effects WHERE id = ? AND room_id = ?`, effect.ID, roomID); err != nil {
+				s.logger.Error("expire effect", slog.String("error", err.Error()))
+				continue
+			}
+			effect.Remaining = 0
+			msgType = "EffectExpired"
+		}
+		s.broadcastEffect(roomID, msgType, effect)
+	}
+}
+
+// broadcastEffect sends an effect message to those who see the effect's
+// target: the GM alone for hidden entries, and the audience of the image for
+// effects on images.
+func (s *Server) broadcastEffect(roomID, msgType string, effect Effect) {
+	s.sendEffect(roomID, msgType, effect, s.effectAudience(roomID, effect))
+}
+
+// effectAudience returns which sockets may receive an effect, or nil when the
+// whole room may.
+func (s *Server) effectAudience(roomID string, effect Effect) func(clientProfile) bool {
+	if effect.TargetType == effectTargetImage {
+		img, found, err := s.getImage(roomID, effect.TargetID, true)
+		if err != nil {
+			s.logger.Error("check effect target", slog.String("error", err.Error()))
+			return isGMProfile
+		}
+		if !found {
+			return isGMProfile
+		}
+		return s.imageAudience(roomID, img)
+	}
+	hidden, found, err := s.effectTargetHidden(roomID, effect.TargetType, effect.TargetID)
+	if err != nil {
+		s.logger.Error("check effect target", slog.String("error", err.Error()))
+		return isGMProfile
+	}
+	if hidden || !found {
+		return isGMProfile
+	}
+	return nil
+}
+
+func (s *Server) sendEffect(roomID, msgType string, effect Effect, audience func(clientProfile) bool) {
+	payload, err := json.Marshal(map[string]any{
+		"type":    msgType,
+		"payload": effect,
+	})
+	if err != nil {
+		s.logger.Error("marshal effect", slog.String("error", err.Error()))
+		return
+	}
+	if audience == nil {
+		s.broadcast(roomID, payload)
+		return
+	}
+	s.broadcastWhere(roomID, payload, audience)
+}
+
+// handleEffects serves /rooms/{id}/effects. Everyone can list the effects they
+// can see, filtered with targetType and targetId; the GM manages them.
+func (s *Server) handleEffects(w http.ResponseWriter, r *http.Request, roomID, effectID string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	isGM := player.Role == RoleGM
+
+	switch {
+	case effectID == "" && r.Method == http.MethodGet:
+		query := r.URL.Query()
+		targetType, targetID := query.Get("targetType"), query.Get("targetId")
+		if (targetType == "") != (targetID == "") {
+			http.Error(w, "targetType and targetId go together", http.StatusBadRequest)
+			return
+		}
+		effects, err := s.listEffects(roomID, isGM, targetType, targetID)
+		if err == nil && !isGM {
+			effects, err = s.visibleEffects(roomID, player.ID, effects)
+		}
+		if err != nil {
+			s.logger.Error("list effects", slog.String("error", err.Error()))
+			http.Error(w, "failed to load effects", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, effects)
+		return
+	case effectID == "" && r.Method == http.MethodPost:
+	case effectID != "" && (r.Method == http.MethodPatch || r.Method == http.MethodDelete):
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isGM {
+		http.Error(w, "only the GM can change effects", http.StatusForbidden)
+		return
+	}
+
+	effect := Effect{RoomID: roomID, Unit: effectUnitRounds}
+	if effectID != "" {
+		var found bool
+		var err error
+		if effect, found, err = s.getEffect(roomID, effectID); err != nil {
+			s.logger.Error("get effect", slog.String("error", err.Error()))
+			http.Error(w, "failed to load effect", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if r.Method == http.MethodDelete {
+		if _, err := s.db.Exec(`DELETE FROM effects WHERE id = ? AND room_id = ?`, effectID, roomID); err != nil {
+			s.logger.Error("delete effect", slog.String("error", err.Error()))
+			http.Error(w, "failed to delete effect", http.StatusInternalServerError)
+			return
+		}
+		s.broadcastEffect(roomID, "EffectDeleted", effect)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var payload struct {
+		TargetType string  `json:"targetType"`
+		TargetID   string  `json:"targetId"`
+		Name       *string `json:"name"`
+		Source     *string `json:"source"`
+		Unit       *string `json:"unit"`
+		Duration   *int    `json:"duration"`
+		Remaining  *int    `json:"remaining"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if effectID == "" {
+		_, found, err := s.effectTargetHidden(roomID, payload.TargetType, payload.TargetID)
+		if err != nil {
+			s.logger.Error("check effect target", slog.String("error", err.Error()))
+			http.Error(w, "failed to save effect", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "target must be an image or initiative entry of this room", http.StatusBadRequest)
+			return
+		}
+		if payload.Name == nil || payload.Duration == nil {
+			http.Error(w, "name and duration are required", http.StatusBadRequest)
+			return
+		}
+		effect.TargetType, effect.TargetID = payload.TargetType, payload.TargetID
+	}
+	if payload.Name != nil {
+		effect.Name = strings.TrimSpace(*payload.Name)
+	}
+	if payload.Source != nil {
+		effect.Source = strings.TrimSpace(*payload.Source)
+	}
+	if payload.Unit != nil {
+		effect.Unit = *payload.Unit
+	}
+	if payload.Duration != nil {
+		effect.Duration = *payload.Duration
+		effect.Remaining = *payload.Duration
+	}
+	if payload.Remaining != nil {
+		effect.Remaining = *payload.Remaining
+	}
+	if err := validateEffect(effect); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	var err error
+	if effectID == "" {
+		effect, err = s.storeEffect(effect)
+		status = http.StatusCreated
+	} else {
+		err = s.updateEffect(effect)
+	}
+	if err != nil {
+		s.logger.Error("save effect", slog.String("error", err.Error()))
+		http.Error(w, "failed to save effect", http.StatusInternalServerError)
+		return
+	}
+	s.broadcastEffect(roomID, "EffectUpdate", effect)
+	writeJSON(w, status, effect)
+}
+
+func validateEffect(effect Effect) error {
+	if effect.Name == "" || utf8.RuneCountInString(effect.Name) > maxEffectNameLength {
+		return fmt.Errorf("name must be 1-%d characters", maxEffectNameLength)
+	}
+	if utf8.RuneCountInString(effect.Source) > maxEffectNameLength {
+		return fmt.Errorf("source must be at most %d characters", maxEffectNameLength)
+	}
+	if effect.Unit != effectUnitRounds && effect.Unit != effectUnitTurns {
+		return fmt.Errorf("unit must be %q or %q", effectUnitRounds, effectUnitTurns)
+	}
+	if effect.Duration < 1 || effect.Duration > maxEffectDuration {
+		return fmt.Errorf("duration must be 1-%d", maxEffectDuration)
+	}
+	if effect.Remaining < 1 || effect.Remaining > effect.Duration {
+		return fmt.Errorf("remaining must be 1-%d", effect.Duration)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestEffects(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+
+	do := func(method, path string, player Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		if payload != nil {
+			_ = json.NewEncoder(&body).Encode(payload)
+		}
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, &body)
+		req.Header.Set("Content-Type", "application/json")
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	addEffect := func(payload map[string]any) Effect {
+		t.Helper()
+		w := do(http.MethodPost, "/effects", gm, payload)
+		var effect Effect
+		if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&effect) != nil {
+			t.Fatalf("add effect: %d %s", w.Code, w.Body.String())
+		}
+		return effect
+	}
+	listEffects := func(player Player, query string) []Effect {
+		t.Helper()
+		var effects []Effect
+		_ = json.NewDecoder(do(http.MethodGet, "/effects"+query, player, nil).Body).Decode(&effects)
+		return effects
+	}
+
+	var img imageResponse
+	_ = json.NewDecoder(do(http.MethodPost, "/images", gm, map[string]string{"url": "https://example.com/ogre.png"}).Body).Decode(&img)
+	do(http.MethodPost, "/initiative/entries", gm, map[string]any{"name": "Alice", "playerId": alice.ID, "imageId": img.ID})
+	w := do(http.MethodPost, "/initiative/entries", gm, map[string]any{"name": "Spy", "hidden": true})
+	var tracker InitiativeTracker
+	_ = json.NewDecoder(w.Body).Decode(&tracker)
+	aliceEntry, spyEntry := tracker.Entries[0].ID, tracker.Entries[1].ID
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(alice.Token), nil)
+	defer conn.Close()
+	readWSMessageForTest(t, conn, "RosterUpdate")
+
+	burning := map[string]any{"targetType": "image", "targetId": img.ID, "name": "Burning", "duration": 1, "unit": "turns"}
+	if w := do(http.MethodPost, "/effects", alice, burning); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not add effects, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/effects", gm, map[string]any{"targetType": "image", "targetId": "missing", "name": "Prone", "duration": 1}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a missing target, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/effects", gm, map[string]any{"targetType": "image", "targetId": img.ID, "name": "Prone", "duration": 1, "unit": "minutes"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown unit, got %d", w.Code)
+	}
+	addEffect(burning)
+	blessed := addEffect(map[string]any{"targetType": "initiative", "targetId": aliceEntry, "name": "Blessed", "source": "Cleric", "duration": 1})
+	if blessed.Unit != effectUnitRounds || blessed.Remaining != 1 {
+		t.Fatalf("effects default to rounds: %+v", blessed)
+	}
+	invisible := addEffect(map[string]any{"targetType": "initiative", "targetId": spyEntry, "name": "Invisible", "duration": 5})
+	slowed := addEffect(map[string]any{"targetType": "initiative", "targetId": spyEntry, "name": "Slowed", "duration": 2, "unit": "turns"})
+
+	if got := listEffects(alice, ""); len(got) != 2 {
+		t.Fatalf("players must not see effects on hidden entries: %+v", got)
+	}
+	if got := listEffects(gm, ""); len(got) != 4 {
+		t.Fatalf("the GM sees every effect: %+v", got)
+	}
+	if got := listEffects(gm, "?targetType=initiative&targetId="+aliceEntry); len(got) != 1 || got[0].Name != "Blessed" {
+		t.Fatalf("filter by target: %+v", got)
+	}
+
+	// Starting combat does not count down; Alice's turn ending does, but only
+	// for the effects on her entry and on its image.
+	do(http.MethodPost, "/initiative/next", gm, nil)
+	do(http.MethodPost, "/initiative/next", alice, nil)
+	var expired Effect
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "EffectExpired"), &expired); err != nil || expired.Name != "Burning" {
+		t.Fatalf("expected burning to expire: %+v %v", expired, err)
+	}
+	if got := listEffects(gm, ""); len(got) != 3 || got[0].Remaining != 1 {
+		t.Fatalf("round effects must wait for the next round: %+v", got)
+	}
+	if got := listEffects(gm, "?targetType=initiative&targetId="+spyEntry); len(got) != 2 || got[1].ID != slowed.ID || got[1].Remaining != 2 {
+		t.Fatalf("turn effects must wait for their own entry's turn: %+v", got)
+	}
+
+	// The spy's turn ends and round 2 starts.
+	do(http.MethodPost, "/initiative/next", gm, nil)
+	for _, msgType := range readWSTypesUntil(t, conn, "EffectExpired") {
+		if msgType == "EffectUpdate" {
+			t.Fatal("the countdown of a hidden entry's effect was sent to a player")
+		}
+	}
+	got := listEffects(gm, "")
+	if len(got) != 2 || got[0].ID != invisible.ID || got[0].Remaining != 4 || got[1].ID != slowed.ID || got[1].Remaining != 1 {
+		t.Fatalf("unexpected effects in round 2: %+v", got)
+	}
+
+	if w := do(http.MethodPatch, "/effects/"+invisible.ID, gm, map[string]int{"remaining": 9}); w.Code != http.StatusBadRequest {
+		t.Fatalf("remaining must not exceed the duration, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/initiative/entries/"+spyEntry, gm, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete entry: %d", w.Code)
+	}
+	if got := listEffects(gm, ""); len(got) != 0 {
+		t.Fatalf("effects of a deleted entry must go with it: %+v", got)
+	}
+
+	// Effects on images the players cannot see, such as those of a scene the
+	// GM is still preparing, stay with the GM.
+	var cave Scene
+	_ = json.NewDecoder(do(http.MethodPost, "/scenes", gm, map[string]string{"name": "Cave"}).Body).Decode(&cave)
+	var bat imageResponse
+	_ = json.NewDecoder(do(http.MethodPost, "/images", gm, map[string]string{"url": "https://example.com/bat.png", "sceneId": cave.ID}).Body).Decode(&bat)
+	addEffect(map[string]any{"targetType": "image", "targetId": bat.ID, "name": "Flying", "duration": 3})
+	addEffect(map[string]any{"targetType": "image", "targetId": img.ID, "name": "Prone", "duration": 3})
+	var update Effect
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "EffectUpdate"), &update); err != nil || update.Name != "Prone" {
+		t.Fatalf("an effect on an image in another scene was sent to a player: %+v %v", update, err)
+	}
+	if got := listEffects(alice, ""); len(got) != 1 || got[0].Name != "Prone" {
+		t.Fatalf("players must not see effects on images they cannot see: %+v", got)
+	}
+	if got := listEffects(gm, ""); len(got) != 2 {
+		t.Fatalf("the GM sees effects in every scene: %+v", got)
+	}
+}
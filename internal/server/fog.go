@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+)
+
+// maxFogCells limits how many cells one fog command may change.
+const maxFogCells = 100000
+
+var errInvalidFog = errors.New("invalid fog")
+
+// fogRequest is the payload of the RevealFog and CoverFog commands. Cells are
+// listed as [column, row] pairs or given as a polygon of [x, y] canvas points,
+// which selects every cell whose centre lies inside it. All covers every cell.
+// The commands change the active scene's fog unless SceneID names another.
+type fogRequest struct {
+	SceneID string       `json:"sceneId"`
+	Cells   [][2]int     `json:"cells"`
+	Polygon [][2]float64 `json:"polygon"`
+	All     bool         `json:"all"`
+}
+
+func (s *Server) listFogCells(sceneID string) ([][2]int, error) {
+	rows, err := s.db.Query(`SELECT col, row FROM scene_fog_cells WHERE scene_id = ? ORDER BY row, col`, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cells := make([][2]int, 0)
+	for rows.Next() {
+		var cell [2]int
+		if err := rows.Scan(&cell[0], &cell[1]); err != nil {
+			return nil, err
+		}
+		cells = append(cells, cell)
+	}
+	return cells, rows.Err()
+}
+
+func (s *Server) getFog(sceneID string) (Fog, error) {
+	fog := Fog{SceneID: sceneID}
+	if err := s.db.QueryRow(`SELECT fog_enabled FROM scenes WHERE id = ?`, sceneID).Scan(&fog.Enabled); err != nil {
+		return Fog{}, err
+	}
+	cells, err := s.listFogCells(sceneID)
+	if err != nil {
+		return Fog{}, err
+	}
+	fog.Revealed = cells
+	return fog, nil
+}
+
+// storeFogCells reveals or covers cells in one transaction.
+func (s *Server) storeFogCells(sceneID string, cells [][2]int, reveal bool) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	query := `DELETE FROM scene_fog_cells WHERE scene_id = ? AND col = ? AND row = ?`
+	if reveal {
+		query = `INSERT OR IGNORE INTO scene_fog_cells (scene_id, col, row) VALUES (?, ?, ?)`
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, cell := range cells {
+		if _, err := stmt.Exec(sceneID, cell[0], cell[1]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// fogRequestCells returns the cells a fog command selects on the grid.
+func fogRequestCells(grid Grid, req fogRequest) ([][2]int, error) {
+	if len(req.Cells) > maxFogCells {
+		return nil, fmt.Errorf("%w: at most %d cells at once", errInvalidFog, maxFogCells)
+	}
+	cells := append([][2]int(nil), req.Cells...)
+	if len(req.Polygon) == 0 {
+		return cells, nil
+	}
+	if len(req.Polygon) < 3 {
+		return nil, fmt.Errorf("%w: a polygon needs at least 3 points", errInvalidFog)
+	}
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, p := range req.Polygon {
+		if !isValidPosition(p[0], p[1]) {
+			return nil, fmt.Errorf("%w: invalid polygon point", errInvalidFog)
+		}
+		minX, minY, maxX, maxY = math.Min(minX, p[0]), math.Min(minY, p[1]), math.Max(maxX, p[0]), math.Max(maxY, p[1])
+	}
+	minCol, minRow, maxCol, maxRow := grid.cellRange(minX, minY, maxX, maxY)
+	if float64(maxCol-minCol+1)*float64(maxRow-minRow+1) > maxFogCells {
+		return nil, fmt.Errorf("%w: the polygon spans more than %d cells", errInvalidFog, maxFogCells)
+	}
+	for row := minRow; row <= maxRow; row++ {
+		for col := minCol; col <= maxCol; col++ {
+			if x, y := grid.cellCenter(col, row); pointInPolygon(x, y, req.Polygon) {
+				cells = append(cells, [2]int{col, row})
+			}
+		}
+	}
+	return cells, nil
+}
+
+// pointInPolygon reports whether x, y lies inside a polygon by the even-odd
+// rule.
+func pointInPolygon(x, y float64, polygon [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a[1] > y) != (b[1] > y) && x < (b[0]-a[0])*(y-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// changeFog applies a change to a scene's fog, broadcasts the new fog and
+// updates what each player sees.
+func (s *Server) changeFog(roomID, sceneID string, change func() error) error {
+	defer s.beginViewChange(roomID)()
+	if err := change(); err != nil {
+		return err
+	}
+	fog, err := s.getFog(sceneID)
+	if err != nil {
+		return err
+	}
+	s.broadcastScene(roomID, sceneID, "FogUpdate", fog)
+	return nil
+}
+
+// handleFogCommand runs the GM's SetFog, RevealFog and CoverFog WebSocket
+// commands. Errors go to the log.
+func (s *Server) handleFogCommand(roomID string, sender *wsConn, msgType string, payload json.RawMessage) error {
+	if !isGMProfile(sender.profile) {
+		return errors.New("only the GM can change the fog")
+	}
+	if msgType == "SetFog" {
+		var req struct {
+			SceneID string `json:"sceneId"`
+			Enabled bool   `json:"enabled"`
+		}
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return err
+		}
+		scene, err := s.resolveScene(roomID, req.SceneID, true)
+		if err != nil {
+			return err
+		}
+		return s.changeFog(roomID, scene.ID, func() error {
+			_, err := s.db.Exec(`UPDATE scenes SET fog_enabled = ? WHERE id = ?`, req.Enabled, scene.ID)
+			return err
+		})
+	}
+
+	var req fogRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	reveal := msgType == "RevealFog"
+	if req.All && reveal {
+		return fmt.Errorf("%w: disable the fog to reveal everything", errInvalidFog)
+	}
+	scene, err := s.resolveScene(roomID, req.SceneID, true)
+	if err != nil {
+		return err
+	}
+	return s.changeFog(roomID, scene.ID, func() error {
+		if req.All {
+			_, err := s.db.Exec(`DELETE FROM scene_fog_cells WHERE scene_id = ?`, scene.ID)
+			return err
+		}
+		cells, err := fogRequestCells(scene.Grid, req)
+		if err != nil {
+			return err
+		}
+		return s.storeFogCells(scene.ID, cells, reveal)
+	})
+}
+
+// handleFog serves GET /rooms/{id}/fog, the active scene's fog or, for the GM,
+// that of the scene given as ?scene=. Players get the same fog as the GM: it
+// only lists revealed cells.
+func (s *Server) handleFog(w http.ResponseWriter, r *http.Request, roomID string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	scene, err := s.resolveScene(roomID, r.URL.Query().Get("scene"), player.Role == RoleGM)
+	if !s.writeSceneError(w, r, err) {
+		return
+	}
+	fog, err := s.getFog(scene.ID)
+	if err != nil {
+		s.logger.Error("get fog", slog.String("error", err.Error()))
+		http.Error(w, "failed to load fog", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, fog)
+}
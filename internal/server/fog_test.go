@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestFogRequestCells(t *testing.T) {
+	grid := Grid{Type: gridSquare, CellSize: 50}
+	cells, err := fogRequestCells(grid, fogRequest{
+		Cells:   [][2]int{{9, 9}},
+		Polygon: [][2]float64{{0, 0}, {100, 0}, {100, 60}, {0, 60}},
+	})
+	if err != nil {
+		t.Fatalf("cells: %v", err)
+	}
+	want := [][2]int{{9, 9}, {0, 0}, {1, 0}}
+	if len(cells) != len(want) {
+		t.Fatalf("expected %v, got %v", want, cells)
+	}
+	for i := range want {
+		if cells[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, cells)
+		}
+	}
+	if _, err := fogRequestCells(grid, fogRequest{Polygon: [][2]float64{{0, 0}, {1e9, 0}, {0, 1e9}}}); err == nil {
+		t.Fatal("expected an error for a polygon spanning too many cells")
+	}
+
+	hex := Grid{Type: gridHexRow, CellSize: 50}
+	x, y := hex.cellCenter(0, 1)
+	cells, err = fogRequestCells(hex, fogRequest{Polygon: [][2]float64{{x - 5, y - 5}, {x + 5, y - 5}, {x, y + 5}}})
+	if err != nil || len(cells) != 1 || cells[0] != [2]int{0, 1} {
+		t.Fatalf("expected the hex cell around the polygon, got %v %v", cells, err)
+	}
+}
+
+func TestFogOfWar(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+
+	do := func(method, path string, player Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		if payload != nil {
+			_ = json.NewEncoder(&body).Encode(payload)
+		}
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, &body)
+		req.Header.Set("Content-Type", "application/json")
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	send := func(conn net.Conn, msgType string, payload any) {
+		t.Helper()
+		msg, _ := json.Marshal(map[string]any{"type": msgType, "payload": payload})
+		if err := writeFrame(conn, 0x1, msg); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	readID := func(conn net.Conn, msgType string) string {
+		t.Helper()
+		var payload struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(readWSMessageForTest(t, conn, msgType), &payload); err != nil {
+			t.Fatalf("decode %s: %v", msgType, err)
+		}
+		return payload.ID
+	}
+	imageIDs := func(player Player) map[string]bool {
+		t.Helper()
+		var images []imageResponse
+		_ = json.NewDecoder(do(http.MethodGet, "/images", player, nil).Body).Decode(&images)
+		ids := make(map[string]bool)
+		for _, img := range images {
+			ids[img.ID] = true
+		}
+		return ids
+	}
+
+	// A 10x10 cell map, a goblin in cell 5,5 and Alice's hero in cell 0,0.
+	var mapImage imageResponse
+	_ = json.NewDecoder(do(http.MethodPost, "/images", gm, map[string]string{"url": "https://example.com/map.png"}).Body).Decode(&mapImage)
+	do(http.MethodPatch, "/images/"+mapImage.ID, gm, map[string]float64{"x": 0, "y": 0, "width": 700, "height": 700})
+	var goblin, hero Token
+	_ = json.NewDecoder(do(http.MethodPost, "/tokens", gm, map[string]any{"url": "https://example.com/goblin.png", "name": "Goblin", "x": 350, "y": 350}).Body).Decode(&goblin)
+	_ = json.NewDecoder(do(http.MethodPost, "/tokens", alice, map[string]any{"url": "https://example.com/hero.png", "name": "Hero", "x": 0, "y": 0}).Body).Decode(&hero)
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	gmConn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(gm.Token), nil)
+	defer gmConn.Close()
+	readWSMessageForTest(t, gmConn, "RosterUpdate")
+	conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(alice.Token), nil)
+	defer conn.Close()
+	readWSMessageForTest(t, conn, "RosterUpdate")
+
+	// Players cannot lift the fog.
+	send(conn, "SetFog", map[string]bool{"enabled": true})
+	send(gmConn, "SetFog", map[string]bool{"enabled": true})
+	var fog Fog
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "FogUpdate"), &fog); err != nil || !fog.Enabled || len(fog.Revealed) != 0 {
+		t.Fatalf("unexpected fog: %+v %v", fog, err)
+	}
+	send(conn, "RevealFog", fogRequest{Cells: [][2]int{{5, 5}}})
+	dropped := map[string]bool{readID(conn, "SharedImageDeleted"): true, readID(conn, "SharedImageDeleted"): true}
+	if !dropped[mapImage.ID] || !dropped[goblin.ID] {
+		t.Fatalf("the map and the goblin must be dropped under fog: %v", dropped)
+	}
+	if id := readID(conn, "TokenDeleted"); id != goblin.ID {
+		t.Fatalf("expected the goblin token to be dropped, got %s", id)
+	}
+	if ids := imageIDs(alice); len(ids) != 1 || !ids[hero.ID] {
+		t.Fatalf("players keep only their own token under fog: %v", ids)
+	}
+	if ids := imageIDs(gm); len(ids) != 3 {
+		t.Fatalf("the GM sees everything: %v", ids)
+	}
+	if w := do(http.MethodGet, "/tokens/"+goblin.ID, alice, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a fogged token, got %d", w.Code)
+	}
+
+	// Revealing the top-left corner shows the map, but not the goblin.
+	send(gmConn, "RevealFog", fogRequest{Polygon: [][2]float64{{0, 0}, {140, 0}, {140, 140}, {0, 140}}})
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "FogUpdate"), &fog); err != nil || len(fog.Revealed) != 4 {
+		t.Fatalf("expected four revealed cells: %+v %v", fog, err)
+	}
+	if id := readID(conn, "SharedImage"); id != mapImage.ID {
+		t.Fatalf("expected the map to be shown, got %s", id)
+	}
+	if w := do(http.MethodPost, "/tokens", alice, map[string]any{"url": "https://example.com/scout.png", "name": "Scout", "x": 560, "y": 560}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not place tokens under fog, got %d", w.Code)
+	}
+
+	send(gmConn, "RevealFog", fogRequest{Cells: [][2]int{{5, 5}}})
+	if id := readID(conn, "TokenUpdate"); id != goblin.ID {
+		t.Fatalf("expected the goblin to be shown, got %s", id)
+	}
+
+	// The goblin sneaks back into the fog.
+	do(http.MethodPatch, "/tokens/"+goblin.ID, gm, map[string]float64{"x": 560})
+	if id := readID(conn, "TokenDeleted"); id != goblin.ID {
+		t.Fatalf("expected the goblin to be dropped, got %s", id)
+	}
+
+	send(gmConn, "CoverFog", fogRequest{All: true})
+	if id := readID(conn, "SharedImageDeleted"); id != mapImage.ID {
+		t.Fatalf("expected the map to be dropped, got %s", id)
+	}
+	w := do(http.MethodGet, "/fog", alice, nil)
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&fog) != nil || !fog.Enabled || len(fog.Revealed) != 0 {
+		t.Fatalf("unexpected fog: %d %+v", w.Code, fog)
+	}
+
+	send(gmConn, "SetFog", map[string]bool{"enabled": false})
+	readWSMessageForTest(t, conn, "FogUpdate")
+	if ids := imageIDs(alice); len(ids) != 3 {
+		t.Fatalf("without fog players see every visible image: %v", ids)
+	}
+}
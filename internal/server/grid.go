@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	gridSquare    = "square"
+	gridHexRow    = "hex-row"
+	gridHexColumn = "hex-column"
+
+	// defaultCellSize is the canvas size of a grid cell in pixels.
+	defaultCellSize = 70
+	minCellSize     = 8
+	maxCellSize     = 1000
+	maxUnitsPerCell = 1000000
+	maxGridUnit     = 16
+)
+
+var errInvalidGrid = errors.New("invalid grid")
+
+func defaultGrid() Grid {
+	return Grid{Type: gridSquare, CellSize: defaultCellSize, UnitsPerCell: 5, Unit: "ft"}
+}
+
+func (g Grid) validate() error {
+	switch g.Type {
+	case gridSquare, gridHexRow, gridHexColumn:
+	default:
+		return fmt.Errorf("%w: type must be %s, %s or %s", errInvalidGrid, gridSquare, gridHexRow, gridHexColumn)
+	}
+	if !isValidCoordinate(g.CellSize) || g.CellSize < minCellSize || g.CellSize > maxCellSize {
+		return fmt.Errorf("%w: cell size must be %d-%d", errInvalidGrid, minCellSize, maxCellSize)
+	}
+	if !isValidPosition(g.OffsetX, g.OffsetY) {
+		return fmt.Errorf("%w: invalid offset", errInvalidGrid)
+	}
+	if !isValidCoordinate(g.UnitsPerCell) || g.UnitsPerCell <= 0 || g.UnitsPerCell > maxUnitsPerCell {
+		return fmt.Errorf("%w: units per cell must be positive", errInvalidGrid)
+	}
+	if utf8.RuneCountInString(g.Unit) > maxGridUnit {
+		return fmt.Errorf("%w: unit must be at most %d characters", errInvalidGrid, maxGridUnit)
+	}
+	return nil
+}
+
+// snap aligns an image of the given size at x, y to the grid. On square grids
+// its top-left corner goes to the nearest grid corner; on hex grids its centre
+// goes to the nearest cell centre.
+func (g Grid) snap(x, y, width, height float64) (float64, float64) {
+	size := g.CellSize
+	switch g.Type {
+	case gridHexRow:
+		// The first cell's bounding box starts at the offset.
+		originX, originY := g.OffsetX+size/2, g.OffsetY+size/math.Sqrt(3)
+		cx, cy := nearestHexCenter(x+width/2-originX, y+height/2-originY, size)
+		return cx + originX - width/2, cy + originY - height/2
+	case gridHexColumn:
+		// A flat-topped grid is a pointy-topped one with the axes swapped.
+		originX, originY := g.OffsetX+size/math.Sqrt(3), g.OffsetY+size/2
+		cy, cx := nearestHexCenter(y+height/2-originY, x+width/2-originX, size)
+		return cx + originX - width/2, cy + originY - height/2
+	default:
+		return math.Round((x-g.OffsetX)/size)*size + g.OffsetX, math.Round((y-g.OffsetY)/size)*size + g.OffsetY
+	}
+}
+
+// nearestHexCenter returns the centre closest to x, y on a pointy-topped hex
+// grid with a centre at the origin and every odd row shifted right by half a
+// cell. The closest centre is always in one of the two rows around y.
+func nearestHexCenter(x, y, size float64) (float64, float64) {
+	rowStep := size * math.Sqrt(3) / 2
+	first := math.Floor(y / rowStep)
+	bestX, bestY, best := 0.0, 0.0, math.Inf(1)
+	for row := first; row <= first+1; row++ {
+		shift := 0.0
+		if math.Mod(row, 2) != 0 {
+			shift = size / 2
+		}
+		cx := math.Round((x-shift)/size)*size + shift
+		cy := row * rowStep
+		if d := (cx-x)*(cx-x) + (cy-y)*(cy-y); d < best {
+			bestX, bestY, best = cx, cy, d
+		}
+	}
+	return bestX, bestY
+}
+
+// getSceneGrid returns a scene's grid, or the active scene's when sceneID is
+// empty.
+func (s *Server) getSceneGrid(roomID, sceneID string) (Grid, error) {
+	scene, err := s.resolveScene(roomID, sceneID, true)
+	if err != nil {
+		return Grid{}, err
+	}
+	return scene.Grid, nil
+}
+
+// parseGridUpdate applies the fields present in a grid update to a scene's
+// current grid and validates the result.
+func parseGridUpdate(current Grid, raw json.RawMessage) (Grid, error) {
+	grid := current
+	if err := json.Unmarshal(raw, &grid); err != nil {
+		return Grid{}, fmt.Errorf("%w: %v", errInvalidGrid, err)
+	}
+	grid.Unit = strings.TrimSpace(grid.Unit)
+	if err := grid.validate(); err != nil {
+		return Grid{}, err
+	}
+	return grid, nil
+}
+
+func (s *Server) broadcastGrid(roomID string, grid Grid) {
+	payload, err := json.Marshal(map[string]any{
+		"type":    "GridUpdate",
+		"payload": grid,
+	})
+	if err != nil {
+		s.logger.Error("marshal grid", slog.String("error", err.Error()))
+		return
+	}
+	s.broadcast(roomID, payload)
+}
+
+// cellStep returns the distance between neighbouring cell centres along each
+// axis, counting a hex grid's offset rows or columns as one step.
+func (g Grid) cellStep() (float64, float64) {
+	switch g.Type {
+	case gridHexRow:
+		return g.CellSize, g.CellSize * math.Sqrt(3) / 2
+	case gridHexColumn:
+		return g.CellSize * math.Sqrt(3) / 2, g.CellSize
+	default:
+		return g.CellSize, g.CellSize
+	}
+}
+
+// cellCenter returns the canvas position of a cell's centre. Hex cells are
+// numbered by column and row with every odd row (hex-row) or column
+// (hex-column) shifted by half a cell.
+func (g Grid) cellCenter(col, row int) (float64, float64) {
+	size := g.CellSize
+	stepX, stepY := g.cellStep()
+	switch g.Type {
+	case gridHexRow:
+		x := g.OffsetX + size/2 + float64(col)*stepX
+		if row%2 != 0 {
+			x += size / 2
+		}
+		return x, g.OffsetY + size/math.Sqrt(3) + float64(row)*stepY
+	case gridHexColumn:
+		y := g.OffsetY + size/2 + float64(row)*stepY
+		if col%2 != 0 {
+			y += size / 2
+		}
+		return g.OffsetX + size/math.Sqrt(3) + float64(col)*stepX, y
+	default:
+		return g.OffsetX + (float64(col)+0.5)*size, g.OffsetY + (float64(row)+0.5)*size
+	}
+}
+
+// cellBounds returns the bounding box of a cell.
+func (g Grid) cellBounds(col, row int) (minX, minY, maxX, maxY float64) {
+	x, y := g.cellCenter(col, row)
+	halfW, halfH := g.CellSize/2, g.CellSize/2
+	switch g.Type {
+	case gridHexRow:
+		halfH = g.CellSize / math.Sqrt(3)
+	case gridHexColumn:
+		halfW = g.CellSize / math.Sqrt(3)
+	}
+	return x - halfW, y - halfH, x + halfW, y + halfH
+}
+
+// cellRange returns the columns and rows of the cells whose centres may lie
+// within the given rectangle, with a margin of one cell.
+func (g Grid) cellRange(minX, minY, maxX, maxY float64) (minCol, minRow, maxCol, maxRow int) {
+	stepX, stepY := g.cellStep()
+	minCol = int(math.Floor((minX-g.OffsetX)/stepX)) - 1
+	maxCol = int(math.Ceil((maxX-g.OffsetX)/stepX)) + 1
+	minRow = int(math.Floor((minY-g.OffsetY)/stepY)) - 1
+	maxRow = int(math.Ceil((maxY-g.OffsetY)/stepY)) + 1
+	return minCol, minRow, maxCol, maxRow
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGridSnap(t *testing.T) {
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	tests := []struct {
+		name       string
+		grid       Grid
+		x, y, w, h float64
+		wantX      float64
+		wantY      float64
+	}{
+		{"square", Grid{Type: gridSquare, CellSize: 50}, 74, 26, 50, 50, 50, 50},
+		{"square offset", Grid{Type: gridSquare, CellSize: 50, OffsetX: 10, OffsetY: -5}, 74, 26, 100, 100, 60, 45},
+		// Row 0 centres sit at (25, 50/√3), row 1 is shifted half a cell.
+		{"hex row first cell", Grid{Type: gridHexRow, CellSize: 50}, 3, 2, 50, 50, 0, 50/math.Sqrt(3) - 25},
+		{"hex row odd row", Grid{Type: gridHexRow, CellSize: 50}, 30, 40, 50, 50, 25, 50/math.Sqrt(3) + 25*math.Sqrt(3) - 25},
+		{"hex column odd column", Grid{Type: gridHexColumn, CellSize: 50}, 40, 30, 50, 50, 50/math.Sqrt(3) + 25*math.Sqrt(3) - 25, 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, y := tt.grid.snap(tt.x, tt.y, tt.w, tt.h)
+			if !near(x, tt.wantX) || !near(y, tt.wantY) {
+				t.Fatalf("snap(%v, %v) = %v, %v; want %v, %v", tt.x, tt.y, x, y, tt.wantX, tt.wantY)
+			}
+			if x2, y2 := tt.grid.snap(x, y, tt.w, tt.h); !near(x, x2) || !near(y, y2) {
+				t.Fatalf("snapping is not stable: %v, %v then %v, %v", x, y, x2, y2)
+			}
+		})
+	}
+}
+
+func TestRoomGrid(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+
+	do := func(method, path string, player Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		if payload != nil {
+			_ = json.NewEncoder(&body).Encode(payload)
+		}
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, &body)
+		req.Header.Set("Content-Type", "application/json")
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if room.Grid != defaultGrid() {
+		t.Fatalf("new rooms get the default grid: %+v", room.Grid)
+	}
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(alice.Token), nil)
+	defer conn.Close()
+	readWSMessageForTest(t, conn, "RosterUpdate")
+
+	if w := do(http.MethodPatch, "", alice, map[string]any{"grid": map[string]any{"snap": true}}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not change the grid, got %d", w.Code)
+	}
+	if w := do(http.MethodPatch, "", gm, map[string]any{"grid": map[string]any{"type": "triangle"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown grid type, got %d", w.Code)
+	}
+	if w := do(http.MethodPatch, "", gm, map[string]any{"grid": map[string]any{"cellSize": 0}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a zero cell size, got %d", w.Code)
+	}
+
+	w := do(http.MethodPatch, "", gm, map[string]any{"grid": map[string]any{"cellSize": 50, "offsetX": 10, "snap": true}})
+	var updated Room
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&updated) != nil {
+		t.Fatalf("update grid: %d %s", w.Code, w.Body.String())
+	}
+	want := Grid{Type: gridSquare, CellSize: 50, OffsetX: 10, UnitsPerCell: 5, Unit: "ft", Snap: true}
+	if updated.Grid != want {
+		t.Fatalf("fields left out must keep their value: %+v", updated.Grid)
+	}
+	var broadcast Grid
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "GridUpdate"), &broadcast); err != nil || broadcast != want {
+		t.Fatalf("unexpected grid update: %+v %v", broadcast, err)
+	}
+
+	var img imageResponse
+	_ = json.NewDecoder(do(http.MethodPost, "/images", alice, map[string]string{"url": "https://example.com/map.png"}).Body).Decode(&img)
+	if err := json.NewDecoder(do(http.MethodPatch, "/images/"+img.ID, alice, map[string]float64{"x": 94, "y": 26}).Body).Decode(&img); err != nil {
+		t.Fatalf("move image: %v", err)
+	}
+	if img.X != 110 || img.Y != 50 {
+		t.Fatalf("image moves must snap to the grid: %+v", img)
+	}
+
+	w = do(http.MethodPost, "/tokens", gm, map[string]any{"url": "https://example.com/hero.png", "name": "Hero", "size": "large", "x": 43, "y": 74, "ownerId": alice.ID})
+	var token Token
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&token) != nil {
+		t.Fatalf("create token: %d %s", w.Code, w.Body.String())
+	}
+	if token.Width != 100 || token.X != 60 || token.Y != 50 {
+		t.Fatalf("tokens must be sized and snapped to the grid: %+v", token)
+	}
+	_ = json.NewDecoder(do(http.MethodPatch, "/tokens/"+token.ID, alice, map[string]float64{"x": 140}).Body).Decode(&token)
+	if token.X != 160 || token.Y != 50 {
+		t.Fatalf("token moves must snap to the grid: %+v", token)
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxIdempotencyKeyLength = 255
+
+var (
+	errIdempotencyInProgress = errors.New("a request with this idempotency key is still in progress")
+	errIdempotencyMismatch   = errors.New("idempotency key was already used for a different request")
+)
+
+// idempotentResponse is the stored outcome of a request, replayed when the
+// same key is sent again.
+type idempotentResponse struct {
+	Status int
+	Body   []byte
+}
+
+// reserveIdempotencyKey claims key for the player. If the key was already
+// used for a completed request, its stored response is returned with replay
+// set. Keys older than the configured TTL are purged first.
+func (s *Server) reserveIdempotencyKey(roomID, playerID, key, scope string) (idempotentResponse, bool, error) {
+	now := time.Now().UTC()
+	if _, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, now.Add(-s.cfg.IdempotencyKeyTTL)); err != nil {
+		return idempotentResponse{}, false, err
+	}
+
+	result, err := s.db.Exec(
+		`INSERT OR IGNORE INTO idempotency_keys (room_id, player_id, key, scope, created_at) VALUES (?, ?, ?, ?, ?)`,
+		roomID, playerID, key, scope, now,
+	)
+	if err != nil {
+		return idempotentResponse{}, false, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return idempotentResponse{}, false, err
+	} else if inserted == 1 {
+		return idempotentResponse{}, false, nil
+	}
+
+	var storedScope, body string
+	var stored idempotentResponse
+	if err := s.db.QueryRow(
+		`SELECT scope, status, response FROM idempotency_keys WHERE room_id = ? AND player_id = ? AND key = ?`,
+		roomID, playerID, key,
+	).Scan(&storedScope, &stored.Status, &body); err != nil {
+		return idempotentResponse{}, false, err
+	}
+	if storedScope != scope {
+		return idempotentResponse{}, false, errIdempotencyMismatch
+	}
+	if stored.Status == 0 {
+		return idempotentResponse{}, false, errIdempotencyInProgress
+	}
+	stored.Body = []byte(body)
+	return stored, true, nil
+}
+
+// completeIdempotencyKey stores the response for a reserved key.
+func (s *Server) completeIdempotencyKey(roomID, playerID, key string, status int, body []byte) error {
+	_, err := s.db.Exec(
+		`UPDATE idempotency_keys SET status = ?, response = ? WHERE room_id = ? AND player_id = ? AND key = ?`,
+		status, string(body), roomID, playerID, key,
+	)
+	return err
+}
+
+// releaseIdempotencyKey forgets a reserved key so a failed request can be
+// retried with it.
+func (s *Server) releaseIdempotencyKey(roomID, playerID, key string) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE room_id = ? AND player_id = ? AND key = ?`, roomID, playerID, key)
+	return err
+}
+
+// withIdempotencyKey runs handle unless the request repeats an
+// Idempotency-Key the player already used for scope, in which case the
+// original response is replayed without running handle again. Only 2xx
+// responses are remembered, so failed requests can be retried with the same
+// key. Requests without the header run unchanged.
+func (s *Server) withIdempotencyKey(w http.ResponseWriter, r *http.Request, roomID, scope string, handle func(http.ResponseWriter, *http.Request)) {
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if key == "" {
+		handle(w, r)
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, "idempotency key too long", http.StatusBadRequest)
+		return
+	}
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+
+	stored, replay, err := s.reserveIdempotencyKey(roomID, player.ID, key, scope)
+	switch {
+	case errors.Is(err, errIdempotencyInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errIdempotencyMismatch):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		s.logger.Error("reserve idempotency key", slog.String("error", err.Error()))
+		http.Error(w, "failed to process request", http.StatusInternalServerError)
+		return
+	case replay:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(stored.Status)
+		_, _ = w.Write(stored.Body)
+		return
+	}
+
+	rec := &capturingWriter{ResponseWriter: w, status: http.StatusOK}
+	handle(rec, r)
+	if rec.status >= 200 && rec.status < 300 {
+		err = s.completeIdempotencyKey(roomID, player.ID, key, rec.status, rec.body.Bytes())
+	} else {
+		err = s.releaseIdempotencyKey(roomID, player.ID, key)
+	}
+	if err != nil {
+		s.logger.Error("store idempotency key", slog.String("error", err.Error()))
+	}
+}
+
+// capturingWriter records the status and body written through it.
+type capturingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (cw *capturingWriter) WriteHeader(status int) {
+	cw.status = status
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *capturingWriter) Write(p []byte) (int, error) {
+	cw.body.Write(p)
+	return cw.ResponseWriter.Write(p)
+}
+
+// rollDiceOnce is rollDice for WebSocket commands carrying a client roll ID.
+// A repeated roll ID re-sends the original log entry, as the sender may see
+// it, to the sender instead of rolling again.
+func (s *Server) rollDiceOnce(roomID string, sender *wsConn, req diceRollRequest) error {
+	key := strings.TrimSpace(req.RollID)
+	if key == "" {
+		_, err := s.rollDice(roomID, sender.profile, req)
+		return err
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return errors.New("roll id too long")
+	}
+
+	stored, replay, err := s.reserveIdempotencyKey(roomID, sender.profile.ID, key, "RollDice")
+	if err != nil {
+		return err
+	}
+	if replay {
+		payload, err := json.Marshal(map[string]any{
+			"type":    "DiceLogEntry",
+			"payload": json.RawMessage(stored.Body),
+		})
+		if err != nil {
+			return err
+		}
+		return sender.write(0x1, payload)
+	}
+
+	entry, err := s.rollDice(roomID, sender.profile, req)
+	if err != nil {
+		if releaseErr := s.releaseIdempotencyKey(roomID, sender.profile.ID, key); releaseErr != nil {
+			s.logger.Error("release idempotency key", slog.String("error", releaseErr.Error()))
+		}
+		return err
+	}
+	body, err := json.Marshal(entry.visibleFor(sender.profile))
+	if err != nil {
+		return err
+	}
+	return s.completeIdempotencyKey(roomID, sender.profile.ID, key, http.StatusCreated, body)
+}
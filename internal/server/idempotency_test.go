@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	srv := newTestServerWithConfig(t, t.TempDir(), func(cfg *Config) {
+		cfg.LegacyDiceResults = true
+	})
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+	bob := joinRoomForTest(t, router, room, "Bob", RolePlayer)
+
+	post := func(player Player, path, key string, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	countRows := func(table string) int {
+		t.Helper()
+		var n int
+		if err := srv.db.QueryRow(`SELECT COUNT(1) FROM `+table+` WHERE room_id = ?`, room.ID).Scan(&n); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+		return n
+	}
+
+	t.Run("roll is replayed", func(t *testing.T) {
+		first := post(alice, "/dice/roll", "roll-1", map[string]string{"expression": "1d20"})
+		if first.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", first.Code, first.Body.String())
+		}
+		second := post(alice, "/dice/roll", "roll-1", map[string]string{"expression": "1d20"})
+		if second.Code != http.StatusCreated || second.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("expected replayed 201, got %d (%v)", second.Code, second.Header())
+		}
+		if first.Body.String() != second.Body.String() {
+			t.Fatalf("replay differs:\n%s\n%s", first.Body.String(), second.Body.String())
+		}
+		if n := countRows("dice_logs"); n != 1 {
+			t.Fatalf("expected one roll, got %d", n)
+		}
+
+		blind := post(alice, "/dice/roll", "roll-blind", map[string]string{"expression": "1d20", "visibility": "blind"})
+		replayed := post(alice, "/dice/roll", "roll-blind", map[string]string{"expression": "1d20", "visibility": "blind"})
+		var entry diceLogEntry
+		if blind.Code != http.StatusCreated || replayed.Header().Get("Idempotent-Replayed") != "true" ||
+			json.NewDecoder(replayed.Body).Decode(&entry) != nil || entry.ID == "" || len(entry.Results) != 0 || entry.ServerSeed != "" {
+			t.Fatalf("a replayed blind roll must not show its result: %d %+v", replayed.Code, entry)
+		}
+		if n := countRows("dice_logs"); n != 2 {
+			t.Fatalf("expected two rolls, got %d", n)
+		}
+
+		// Keys are scoped per player.
+		if w := post(bob, "/dice/roll", "roll-1", map[string]string{"expression": "1d20"}); w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("Bob must not get Alice's replay")
+		}
+	})
+
+	t.Run("key reused for another endpoint", func(t *testing.T) {
+		w := post(alice, "/images", "roll-1", map[string]string{"url": "https://example.com/map.png"})
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422, got %d", w.Code)
+		}
+	})
+
+	t.Run("image creation is replayed", func(t *testing.T) {
+		before := countRows("images")
+		first := post(alice, "/images", "image-1", map[string]string{"url": "https://example.com/a.png"})
+		second := post(alice, "/images", "image-1", map[string]string{"url": "https://example.com/a.png"})
+		if first.Code != http.StatusCreated || second.Code != http.StatusCreated {
+			t.Fatalf("expected 201 twice, got %d and %d", first.Code, second.Code)
+		}
+		if n := countRows("images"); n != before+1 {
+			t.Fatalf("expected one new image, got %d", n-before)
+		}
+	})
+
+	t.Run("failed requests can be retried", func(t *testing.T) {
+		if w := post(alice, "/dice/roll", "retry-1", map[string]string{"expression": "1d"}); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d", w.Code)
+		}
+		if w := post(alice, "/dice/roll", "retry-1", map[string]string{"expression": "1d6"}); w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("expected a fresh 201, got %d", w.Code)
+		}
+	})
+
+	t.Run("expired keys roll again", func(t *testing.T) {
+		if _, err := srv.db.Exec(`UPDATE idempotency_keys SET created_at = ?`, time.Now().UTC().Add(-48*time.Hour)); err != nil {
+			t.Fatalf("age keys: %v", err)
+		}
+		before := countRows("dice_logs")
+		if w := post(alice, "/dice/roll", "roll-1", map[string]string{"expression": "1d20"}); w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("expired key must not replay")
+		}
+		if n := countRows("dice_logs"); n != before+1 {
+			t.Fatalf("expected a new roll after expiry")
+		}
+	})
+
+	t.Run("identical legacy results are not merged", func(t *testing.T) {
+		before := countRows("dice_logs")
+		payload := map[string]any{"seed": 42, "count": 1, "results": []int{6}}
+		first := post(alice, "/dice", "", payload)
+		second := post(alice, "/dice", "", payload)
+		var a, b diceLogEntry
+		_ = json.NewDecoder(first.Body).Decode(&a)
+		_ = json.NewDecoder(second.Body).Decode(&b)
+		if a.ID == "" || a.ID == b.ID {
+			t.Fatalf("expected two distinct entries, got %q and %q", a.ID, b.ID)
+		}
+		if n := countRows("dice_logs"); n != before+2 {
+			t.Fatalf("expected two new rolls, got %d", n-before)
+		}
+	})
+}
+
+func TestWebsocketRollIDIsIdempotent(t *testing.T) {
+	app := newTestServer(t, t.TempDir())
+	router := app.Router()
+	room := createRoomForTest(t, router)
+	player := joinRoomForTest(t, router, room, "Player One", RolePlayer)
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(player.Token), nil)
+
+	message, _ := json.Marshal(map[string]any{
+		"type":    "RollDice",
+		"payload": map[string]any{"expression": "2d6", "rollId": "client-roll-1"},
+	})
+	var entries []diceLogEntry
+	for i := 0; i < 2; i++ {
+		if err := writeFrame(conn, 0x1, message); err != nil {
+			t.Fatalf("send roll: %v", err)
+		}
+		var entry diceLogEntry
+		_ = json.Unmarshal(readWSMessageForTest(t, conn, "DiceLogEntry"), &entry)
+		entries = append(entries, entry)
+	}
+	if entries[0].ID == "" || entries[0].ID != entries[1].ID {
+		t.Fatalf("expected the same entry twice, got %q and %q", entries[0].ID, entries[1].ID)
+	}
+
+	var n int
+	if err := app.db.QueryRow(`SELECT COUNT(1) FROM dice_logs WHERE room_id = ?`, room.ID).Scan(&n); err != nil {
+		t.Fatalf("count dice logs: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected one stored roll, got %d", n)
+	}
+
+	// A replayed blind roll stays hidden from the roller.
+	message, _ = json.Marshal(map[string]any{
+		"type":    "RollDice",
+		"payload": map[string]any{"expression": "1d20", "visibility": "blind", "rollId": "client-roll-2"},
+	})
+	for i := 0; i < 2; i++ {
+		if err := writeFrame(conn, 0x1, message); err != nil {
+			t.Fatalf("send roll: %v", err)
+		}
+	}
+	var blind diceLogEntry
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "DiceLogEntry"), &blind); err != nil {
+		t.Fatalf("decode replay: %v", err)
+	}
+	if blind.ID == "" || blind.Visibility != DiceVisibilityBlind || len(blind.Results) != 0 || blind.Total != 0 || blind.ServerSeed != "" {
+		t.Fatalf("a replayed blind roll must not show its result: %+v", blind)
+	}
+}
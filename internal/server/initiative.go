@@ -0,0 +1,494 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"vtrpg/internal/dice"
+)
+
+const (
+	maxInitiativeNameLength = 100
+	maxInitiativeEntries    = 100
+	defaultInitiativeDice   = "1d20"
+)
+
+var (
+	errInvalidInitiative = errors.New("invalid initiative entry")
+	// errInitiativeConflict is returned by tracker changes that cannot apply
+	// to the tracker's current state, such as advancing an empty turn order.
+	errInitiativeConflict     = errors.New("initiative conflict")
+	errInitiativeEntryMissing = errors.New("initiative entry not found")
+	errInitiativeTurn         = errors.New("not your turn")
+)
+
+// visibleTo returns the tracker as a viewer sees it: players do not get hidden
+// entries, nor which entry is current while a hidden one has the turn.
+func (t InitiativeTracker) visibleTo(includeHidden bool) InitiativeTracker {
+	if includeHidden {
+		return t
+	}
+	visible := t
+	visible.Entries = make([]InitiativeEntry, 0, len(t.Entries))
+	current := false
+	for _, entry := range t.Entries {
+		if entry.Hidden {
+			continue
+		}
+		visible.Entries = append(visible.Entries, entry)
+		current = current || entry.ID == t.CurrentID
+	}
+	if !current {
+		visible.CurrentID = ""
+	}
+	return visible
+}
+
+func (t InitiativeTracker) entryIndex(entryID string) int {
+	return slices.IndexFunc(t.Entries, func(entry InitiativeEntry) bool { return entry.ID == entryID })
+}
+
+// sortInitiative orders entries by initiative, then tiebreaker, highest
+// first. Entries without initiative go last; ties keep their order.
+func sortInitiative(entries []InitiativeEntry) {
+	slices.SortStableFunc(entries, func(a, b InitiativeEntry) int {
+		switch {
+		case a.Initiative == nil || b.Initiative == nil:
+			if a.Initiative == nil && b.Initiative == nil {
+				return 0
+			}
+			if a.Initiative == nil {
+				return 1
+			}
+			return -1
+		case *a.Initiative != *b.Initiative:
+			return cmp.Compare(*b.Initiative, *a.Initiative)
+		default:
+			return cmp.Compare(b.Tiebreaker, a.Tiebreaker)
+		}
+	})
+}
+
+// advanceInitiative moves the turn forward or back. Passing the end of the
+// order starts the next round; going back before the first turn of round 1
+// is a conflict.
+func advanceInitiative(t *InitiativeTracker, forward bool) error {
+	if len(t.Entries) == 0 {
+		return fmt.Errorf("%w: there are no entries", errInitiativeConflict)
+	}
+	i := t.entryIndex(t.CurrentID)
+	switch {
+	case forward && i < 0:
+		i = 0
+		t.Round = max(t.Round, 1)
+	case forward:
+		i++
+		if i == len(t.Entries) {
+			i = 0
+			t.Round++
+		}
+	case i < 0 || (i == 0 && t.Round <= 1):
+		return fmt.Errorf("%w: this is the first turn", errInitiativeConflict)
+	default:
+		i--
+		if i < 0 {
+			i = len(t.Entries) - 1
+			t.Round--
+		}
+	}
+	t.CurrentID = t.Entries[i].ID
+	return nil
+}
+
+// newInitiativeRNG seeds a dice RNG from the server's random source.
+func newInitiativeRNG() (dice.RNG, error) {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	return newDiceRNG(binary.BigEndian.Uint32(buf[:])), nil
+}
+
+// rollInitiative rolls every entry's dice, or with missing only the entries
+// without an initiative yet.
+func rollInitiative(t *InitiativeTracker, rng dice.RNG, missing bool) {
+	for i := range t.Entries {
+		entry := &t.Entries[i]
+		if missing && entry.Initiative != nil {
+			continue
+		}
+		expr, err := dice.Parse(entry.Dice)
+		if err != nil {
+			// Entries are validated when stored, so this is the default.
+			expr, _ = dice.Parse(defaultInitiativeDice)
+		}
+		total := dice.Evaluate(expr, rng).Total
+		entry.Initiative = &total
+	}
+}
+
+func (s *Server) getInitiative(roomID string) (InitiativeTracker, error) {
+	tracker := InitiativeTracker{RoomID: roomID, Entries: make([]InitiativeEntry, 0)}
+	err := s.db.QueryRow(`SELECT round, current_id, updated_at FROM initiative_trackers WHERE room_id = ?`, roomID).
+		Scan(&tracker.Round, &tracker.CurrentID, &tracker.UpdatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return InitiativeTracker{}, err
+	}
+	tracker.UpdatedAt = tracker.UpdatedAt.UTC()
+
+	rows, err := s.db.Query(
+		`SELECT id, name, player_id, image_id, initiative, dice, tiebreaker, hidden FROM initiative_entries WHERE room_id = ? ORDER BY position`,
+		roomID,
+	)
+	if err != nil {
+		return InitiativeTracker{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry InitiativeEntry
+		var initiative sql.NullInt64
+		if err := rows.Scan(&entry.ID, &entry.Name, &entry.PlayerID, &entry.ImageID, &initiative, &entry.Dice, &entry.Tiebreaker, &entry.Hidden); err != nil {
+			return InitiativeTracker{}, err
+		}
+		if initiative.Valid {
+			value := int(initiative.Int64)
+			entry.Initiative = &value
+		}
+		tracker.Entries = append(tracker.Entries, entry)
+	}
+	return tracker, rows.Err()
+}
+
+// saveInitiative replaces the stored tracker of a room with t.
+func (s *Server) saveInitiative(t InitiativeTracker) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(
+		`INSERT INTO initiative_trackers (room_id, round, current_id, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(room_id) DO UPDATE SET round = excluded.round, current_id = excluded.current_id, updated_at = excluded.updated_at`,
+		t.RoomID, t.Round, t.CurrentID, t.UpdatedAt,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM initiative_entries WHERE room_id = ?`, t.RoomID); err != nil {
+		return err
+	}
+	for i, entry := range t.Entries {
+		if _, err := tx.Exec(
+			`INSERT INTO initiative_entries (id, room_id, name, player_id, image_id, initiative, dice, tiebreaker, hidden, position) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			entry.ID, t.RoomID, entry.Name, entry.PlayerID, entry.ImageID, entry.Initiative, entry.Dice, entry.Tiebreaker, entry.Hidden, i,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// updateInitiative applies change to a room's tracker, stores the result and
+// broadcasts it. Changes are serialised so concurrent requests do not
+// overwrite each other.
+func (s *Server) updateInitiative(roomID string, change func(*InitiativeTracker) error) (InitiativeTracker, error) {
+	s.initiativeMu.Lock()
+	defer s.initiativeMu.Unlock()
+	tracker, err := s.getInitiative(roomID)
+	if err != nil {
+		return InitiativeTracker{}, err
+	}
+	if err := change(&tracker); err != nil {
+		return InitiativeTracker{}, err
+	}
+	tracker.UpdatedAt = time.Now().UTC()
+	if err := s.saveInitiative(tracker); err != nil {
+		return InitiativeTracker{}, err
+	}
+	s.broadcastInitiative(roomID, tracker)
+	return tracker, nil
+}
+
+// broadcastInitiative sends the full tracker to the GM and the tracker without
+// hidden entries to everyone else.
+func (s *Server) broadcastInitiative(roomID string, tracker InitiativeTracker) {
+	for _, gm := range []bool{true, false} {
+		payload, err := json.Marshal(map[string]any{
+			"type":    "InitiativeUpdate",
+			"payload": tracker.visibleTo(gm),
+		})
+		if err != nil {
+			s.logger.Error("marshal initiative", slog.String("error", err.Error()))
+			return
+		}
+		s.broadcastWhere(roomID, payload, func(profile clientProfile) bool {
+			return isGMProfile(profile) == gm
+		})
+	}
+}
+
+// initiativeEntryRequest holds the editable fields of an entry. Absent fields
+// are left unchanged.
+type initiativeEntryRequest struct {
+	Name       *string `json:"name"`
+	PlayerID   *string `json:"playerId"`
+	ImageID    *string `json:"imageId"`
+	Initiative *int    `json:"initiative"`
+	Dice       *string `json:"dice"`
+	Tiebreaker *int    `json:"tiebreaker"`
+	Hidden     *bool   `json:"hidden"`
+}
+
+// applyInitiativeEntry validates the request and copies its fields onto entry. Linked
+// players and images must belong to the room.
+func (s *Server) applyInitiativeEntry(roomID string, entry *InitiativeEntry, req initiativeEntryRequest) error {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || utf8.RuneCountInString(name) > maxInitiativeNameLength {
+			return fmt.Errorf("%w: name must be 1-%d characters", errInvalidInitiative, maxInitiativeNameLength)
+		}
+		entry.Name = name
+	}
+	if req.Dice != nil {
+		entry.Dice = defaultInitiativeDice
+		if text := strings.TrimSpace(*req.Dice); text != "" {
+			expr, err := dice.Parse(text)
+			if err != nil {
+				return fmt.Errorf("%w: invalid dice: %v", errInvalidInitiative, err)
+			}
+			entry.Dice = expr.String()
+		}
+	}
+	if req.PlayerID != nil {
+		if *req.PlayerID != "" {
+			_, found, err := s.getPlayer(roomID, *req.PlayerID)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("%w: player not found", errInvalidInitiative)
+			}
+		}
+		entry.PlayerID = *req.PlayerID
+	}
+	if req.ImageID != nil {
+		if *req.ImageID != "" {
+			var exists bool
+			if err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM images WHERE id = ? AND room_id = ?)`, *req.ImageID, roomID).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("%w: image not found", errInvalidInitiative)
+			}
+		}
+		entry.ImageID = *req.ImageID
+	}
+	if req.Initiative != nil {
+		value := *req.Initiative
+		entry.Initiative = &value
+	}
+	if req.Tiebreaker != nil {
+		entry.Tiebreaker = *req.Tiebreaker
+	}
+	if req.Hidden != nil {
+		entry.Hidden = *req.Hidden
+	}
+	return nil
+}
+
+// handleInitiative serves /rooms/{id}/initiative. Everyone can read the
+// tracker; the GM changes it, and a player may end the turn of an entry
+// linked to them with next.
+func (s *Server) handleInitiative(w http.ResponseWriter, r *http.Request, roomID string, rest []string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	isGM := player.Role == RoleGM
+
+	action, entryID := "", ""
+	if len(rest) > 0 {
+		action = rest[0]
+	}
+	if len(rest) > 1 {
+		entryID = rest[1]
+	}
+	switch {
+	case action == "" && (r.Method == http.MethodGet || r.Method == http.MethodDelete):
+	case action == "entries" && entryID == "" && r.Method == http.MethodPost:
+	case action == "entries" && entryID != "" && (r.Method == http.MethodPatch || r.Method == http.MethodDelete):
+	case (action == "roll" || action == "sort" || action == "next" || action == "previous") && len(rest) == 1 && r.Method == http.MethodPost:
+	case action != "" && action != "entries" && action != "roll" && action != "sort" && action != "next" && action != "previous",
+		action != "entries" && len(rest) > 1:
+		http.NotFound(w, r)
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		tracker, err := s.getInitiative(roomID)
+		if err != nil {
+			s.logger.Error("get initiative", slog.String("error", err.Error()))
+			http.Error(w, "failed to load initiative", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, tracker.visibleTo(isGM))
+		return
+	}
+	if !isGM && action != "next" {
+		http.Error(w, "only the GM can change the initiative tracker", http.StatusForbidden)
+		return
+	}
+
+	var change func(*InitiativeTracker) error
+	// Set by change: the entries it removed, whether a turn ended and a new
+	// round started, and whose turn ended.
+	var removed []InitiativeEntry
+	var turnEnded, newRound bool
+	var ended InitiativeEntry
+	switch action {
+	case "":
+		change = func(t *InitiativeTracker) error {
+			removed = t.Entries
+			t.Round, t.CurrentID, t.Entries = 0, "", make([]InitiativeEntry, 0)
+			return nil
+		}
+	case "entries":
+		var req initiativeEntryRequest
+		if r.Method != http.MethodDelete {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+		change = func(t *InitiativeTracker) error {
+			i := t.entryIndex(entryID)
+			switch {
+			case r.Method == http.MethodPost:
+				if len(t.Entries) >= maxInitiativeEntries {
+					return fmt.Errorf("%w: a tracker has at most %d entries", errInvalidInitiative, maxInitiativeEntries)
+				}
+				if req.Name == nil {
+					return fmt.Errorf("%w: name is required", errInvalidInitiative)
+				}
+				entry := InitiativeEntry{ID: s.newID(), Dice: defaultInitiativeDice}
+				if err := s.applyInitiativeEntry(roomID, &entry, req); err != nil {
+					return err
+				}
+				t.Entries = append(t.Entries, entry)
+				entryID = entry.ID
+			case i < 0:
+				return errInitiativeEntryMissing
+			case r.Method == http.MethodPatch:
+				return s.applyInitiativeEntry(roomID, &t.Entries[i], req)
+			default:
+				if t.CurrentID == entryID {
+					// The turn passes to the next entry without starting a new round.
+					t.CurrentID = ""
+					if next := i + 1; next < len(t.Entries) {
+						t.CurrentID = t.Entries[next].ID
+					} else if len(t.Entries) > 1 {
+						t.CurrentID = t.Entries[0].ID
+					}
+				}
+				removed = []InitiativeEntry{t.Entries[i]}
+				t.Entries = slices.Delete(t.Entries, i, i+1)
+			}
+			return nil
+		}
+	case "roll":
+		var req struct {
+			Missing bool `json:"missing"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+		rng, err := newInitiativeRNG()
+		if err != nil {
+			s.logger.Error("seed initiative", slog.String("error", err.Error()))
+			http.Error(w, "failed to roll initiative", http.StatusInternalServerError)
+			return
+		}
+		change = func(t *InitiativeTracker) error {
+			rollInitiative(t, rng, req.Missing)
+			return nil
+		}
+	case "sort":
+		change = func(t *InitiativeTracker) error {
+			sortInitiative(t.Entries)
+			return nil
+		}
+	case "next", "previous":
+		change = func(t *InitiativeTracker) error {
+			if !isGM {
+				i := t.entryIndex(t.CurrentID)
+				if i < 0 || t.Entries[i].PlayerID != player.ID {
+					return errInitiativeTurn
+				}
+			}
+			round, started := t.Round, t.CurrentID != ""
+			if i := t.entryIndex(t.CurrentID); i >= 0 {
+				ended = t.Entries[i]
+			}
+			if err := advanceInitiative(t, action == "next"); err != nil {
+				return err
+			}
+			turnEnded = started
+			newRound = started && t.Round > round
+			return nil
+		}
+	}
+
+	tracker, err := s.updateInitiative(roomID, change)
+	switch {
+	case errors.Is(err, errInvalidInitiative):
+		http.Error(w, strings.TrimPrefix(err.Error(), errInvalidInitiative.Error()+": "), http.StatusBadRequest)
+		return
+	case errors.Is(err, errInitiativeConflict):
+		http.Error(w, strings.TrimPrefix(err.Error(), errInitiativeConflict.Error()+": "), http.StatusConflict)
+		return
+	case errors.Is(err, errInitiativeEntryMissing):
+		http.NotFound(w, r)
+		return
+	case errors.Is(err, errInitiativeTurn):
+		http.Error(w, "only the GM or the current entry's player can end the turn", http.StatusForbidden)
+		return
+	case err != nil:
+		s.logger.Error("update initiative", slog.String("error", err.Error()))
+		http.Error(w, "failed to update initiative", http.StatusInternalServerError)
+		return
+	}
+	for _, entry := range removed {
+		var audience func(clientProfile) bool
+		if entry.Hidden {
+			audience = isGMProfile
+		}
+		s.deleteTargetEffects(roomID, effectTargetInitiative, entry.ID, audience)
+	}
+	// Effects only count down as turns go forward, not when combat starts.
+	if action == "next" && turnEnded {
+		s.advanceEffects(roomID, ended, newRound)
+	}
+
+	status := http.StatusOK
+	if action == "entries" && r.Method == http.MethodPost {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, tracker.visibleTo(isGM))
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSortAndAdvanceInitiative(t *testing.T) {
+	value := func(v int) *int { return &v }
+	tracker := InitiativeTracker{Entries: []InitiativeEntry{
+		{ID: "a", Initiative: value(12), Tiebreaker: 1},
+		{ID: "b"},
+		{ID: "c", Initiative: value(12), Tiebreaker: 3},
+		{ID: "d", Initiative: value(18)},
+	}}
+	sortInitiative(tracker.Entries)
+	var order []string
+	for _, entry := range tracker.Entries {
+		order = append(order, entry.ID)
+	}
+	if got := order; len(got) != 4 || got[0] != "d" || got[1] != "c" || got[2] != "a" || got[3] != "b" {
+		t.Fatalf("unexpected order: %v", got)
+	}
+
+	// Extreme values must not overflow the comparison.
+	extremes := []InitiativeEntry{{ID: "low", Initiative: value(math.MinInt)}, {ID: "high", Initiative: value(math.MaxInt)}}
+	sortInitiative(extremes)
+	if extremes[0].ID != "high" {
+		t.Fatalf("unexpected order of extreme values: %+v", extremes)
+	}
+
+	if err := advanceInitiative(&tracker, false); err == nil {
+		t.Fatal("going back before the first turn must fail")
+	}
+	for range 4 {
+		if err := advanceInitiative(&tracker, true); err != nil {
+			t.Fatalf("next: %v", err)
+		}
+	}
+	if tracker.Round != 1 || tracker.CurrentID != "b" {
+		t.Fatalf("unexpected turn: round %d, %s", tracker.Round, tracker.CurrentID)
+	}
+	_ = advanceInitiative(&tracker, true)
+	if tracker.Round != 2 || tracker.CurrentID != "d" {
+		t.Fatalf("passing the end must start round 2: round %d, %s", tracker.Round, tracker.CurrentID)
+	}
+	_ = advanceInitiative(&tracker, false)
+	if tracker.Round != 1 || tracker.CurrentID != "b" {
+		t.Fatalf("going back must return to round 1: round %d, %s", tracker.Round, tracker.CurrentID)
+	}
+}
+
+func TestInitiativeTracker(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+
+	do := func(method, path string, player Player, payload any) (InitiativeTracker, int) {
+		t.Helper()
+		var body bytes.Buffer
+		if payload != nil {
+			_ = json.NewEncoder(&body).Encode(payload)
+		}
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+"/initiative"+path, &body)
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var tracker InitiativeTracker
+		_ = json.NewDecoder(w.Body).Decode(&tracker)
+		return tracker, w.Code
+	}
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(alice.Token), nil)
+	defer conn.Close()
+	readWSMessageForTest(t, conn, "RosterUpdate")
+
+	if _, code := do(http.MethodPost, "/entries", alice, map[string]string{"name": "Alice"}); code != http.StatusForbidden {
+		t.Fatalf("players must not add entries, got %d", code)
+	}
+	if _, code := do(http.MethodPost, "/entries", gm, map[string]string{"name": "Ghost", "playerId": "nobody"}); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown player, got %d", code)
+	}
+	if _, code := do(http.MethodPost, "/entries", gm, map[string]any{"name": "Alice", "playerId": alice.ID, "dice": "1d20+2", "tiebreaker": 14}); code != http.StatusCreated {
+		t.Fatalf("add alice: %d", code)
+	}
+	tracker, code := do(http.MethodPost, "/entries", gm, map[string]any{"name": "Assassin", "hidden": true, "initiative": 30})
+	if code != http.StatusCreated || len(tracker.Entries) != 2 {
+		t.Fatalf("add hidden entry: %d %+v", code, tracker)
+	}
+	assassin := tracker.Entries[1].ID
+
+	var update InitiativeTracker
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "InitiativeUpdate"), &update); err != nil || len(update.Entries) != 1 {
+		t.Fatalf("unexpected first update: %+v %v", update, err)
+	}
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "InitiativeUpdate"), &update); err != nil || len(update.Entries) != 1 {
+		t.Fatalf("hidden entries must not be sent to players: %+v %v", update, err)
+	}
+
+	tracker, _ = do(http.MethodPost, "/roll", gm, map[string]bool{"missing": true})
+	if roll := tracker.Entries[0].Initiative; roll == nil || *roll < 3 || *roll > 22 || *tracker.Entries[1].Initiative != 30 {
+		t.Fatalf("unexpected initiative roll: %+v", tracker.Entries)
+	}
+	tracker, _ = do(http.MethodPost, "/sort", gm, nil)
+	if tracker.Entries[0].ID != assassin {
+		t.Fatalf("sort: %+v", tracker.Entries)
+	}
+
+	if _, code := do(http.MethodPost, "/next", alice, nil); code != http.StatusForbidden {
+		t.Fatalf("players must not start combat, got %d", code)
+	}
+	tracker, _ = do(http.MethodPost, "/next", gm, nil)
+	if tracker.Round != 1 || tracker.CurrentID != assassin {
+		t.Fatalf("first turn: %+v", tracker)
+	}
+	tracker, code = do(http.MethodGet, "", alice, nil)
+	if code != http.StatusOK || tracker.CurrentID != "" || len(tracker.Entries) != 1 {
+		t.Fatalf("players must not see a hidden current entry: %d %+v", code, tracker)
+	}
+	tracker, _ = do(http.MethodPost, "/next", gm, nil)
+	if tracker.CurrentID != tracker.Entries[1].ID {
+		t.Fatalf("second turn: %+v", tracker)
+	}
+	// Alice ends her own turn, which starts round 2.
+	tracker, code = do(http.MethodPost, "/next", alice, nil)
+	if code != http.StatusOK || tracker.Round != 2 || tracker.CurrentID != "" {
+		t.Fatalf("alice ends her turn: %d %+v", code, tracker)
+	}
+	if _, code := do(http.MethodPost, "/previous", alice, nil); code != http.StatusForbidden {
+		t.Fatalf("players must not go back, got %d", code)
+	}
+
+	if _, code := do(http.MethodDelete, "/entries/"+assassin, gm, nil); code != http.StatusOK {
+		t.Fatalf("delete entry: %d", code)
+	}
+	tracker, _ = do(http.MethodGet, "", gm, nil)
+	if len(tracker.Entries) != 1 || tracker.CurrentID != tracker.Entries[0].ID {
+		t.Fatalf("deleting the current entry must pass the turn on: %+v", tracker)
+	}
+	tracker, code = do(http.MethodDelete, "", gm, nil)
+	if code != http.StatusOK || tracker.Round != 0 || len(tracker.Entries) != 0 {
+		t.Fatalf("clear tracker: %d %+v", code, tracker)
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"vtrpg/internal/dice"
+)
+
+const maxMacroNameLength = 100
+
+const macroColumns = `id, room_id, player_id, name, expression, label, created_at, updated_at`
+
+func scanMacro(row rowScanner) (Macro, error) {
+	var macro Macro
+	var playerID sql.NullString
+	if err := row.Scan(&macro.ID, &macro.RoomID, &playerID, &macro.Name, &macro.Expression, &macro.Label, &macro.CreatedAt, &macro.UpdatedAt); err != nil {
+		return Macro{}, err
+	}
+	macro.PlayerID = playerID.String
+	macro.CreatedAt = macro.CreatedAt.UTC()
+	macro.UpdatedAt = macro.UpdatedAt.UTC()
+	return macro, nil
+}
+
+// macroFields validates the user-editable fields of a macro. The expression is
+// stored in canonical form.
+func macroFields(name, expression, label string) (string, string, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxMacroNameLength {
+		return "", "", "", fmt.Errorf("name must be 1-%d characters", maxMacroNameLength)
+	}
+	expr, err := dice.Parse(expression)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid dice: %w", err)
+	}
+	label, ok := normalizeDiceLabel(label)
+	if !ok {
+		return "", "", "", fmt.Errorf("label must be at most %d characters", maxDiceLabelLength)
+	}
+	return name, expr.String(), label, nil
+}
+
+// canEditMacro reports whether player may change or delete macro: players
+// manage their own macros and the GM manages the room's.
+func canEditMacro(player Player, macro Macro) bool {
+	if macro.PlayerID == "" {
+		return player.Role == RoleGM
+	}
+	return macro.PlayerID == player.ID
+}
+
+// listMacros returns the room macros and the player's own, room macros first.
+func (s *Server) listMacros(roomID, playerID string) ([]Macro, error) {
+	rows, err := s.db.Query(
+		`SELECT `+macroColumns+` FROM macros WHERE room_id = ? AND (player_id IS NULL OR player_id = ?)
+		ORDER BY player_id IS NOT NULL, name COLLATE NOCASE, id`,
+		roomID, playerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	macros := make([]Macro, 0)
+	for rows.Next() {
+		macro, err := scanMacro(rows)
+		if err != nil {
+			return nil, err
+		}
+		macros = append(macros, macro)
+	}
+	return macros, rows.Err()
+}
+
+// getMacro loads a macro the player can see.
+func (s *Server) getMacro(roomID, playerID, macroID string) (Macro, bool, error) {
+	macro, err := scanMacro(s.db.QueryRow(
+		`SELECT `+macroColumns+` FROM macros WHERE room_id = ? AND id = ? AND (player_id IS NULL OR player_id = ?)`,
+		roomID, macroID, playerID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Macro{}, false, nil
+	}
+	if err != nil {
+		return Macro{}, false, err
+	}
+	return macro, true, nil
+}
+
+func (s *Server) storeMacro(macro Macro) (Macro, error) {
+	now := time.Now().UTC()
+	macro.ID = s.newID()
+	macro.CreatedAt = now
+	macro.UpdatedAt = now
+	var playerID sql.NullString
+	if macro.PlayerID != "" {
+		playerID = sql.NullString{String: macro.PlayerID, Valid: true}
+	}
+	if _, err := s.db.Exec(
+		`INSERT INTO macros (id, room_id, player_id, name, expression, label, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		macro.ID, macro.RoomID, playerID, macro.Name, macro.Expression, macro.Label, macro.CreatedAt, macro.UpdatedAt,
+	); err != nil {
+		return Macro{}, err
+	}
+	return macro, nil
+}
+
+func (s *Server) updateMacro(macro Macro) (Macro, error) {
+	macro.UpdatedAt = time.Now().UTC()
+	if _, err := s.db.Exec(
+		`UPDATE macros SET name = ?, expression = ?, label = ?, updated_at = ? WHERE room_id = ? AND id = ?`,
+		macro.Name, macro.Expression, macro.Label, macro.UpdatedAt, macro.RoomID, macro.ID,
+	); err != nil {
+		return Macro{}, err
+	}
+	return macro, nil
+}
+
+func (s *Server) deleteMacro(roomID, macroID string) error {
+	_, err := s.db.Exec(`DELETE FROM macros WHERE room_id = ? AND id = ?`, roomID, macroID)
+	return err
+}
+
+// handleMacros serves /rooms/{id}/macros and /rooms/{id}/macros/{macroId}.
+// Every request is authenticated, since the list depends on the caller.
+func (s *Server) handleMacros(w http.ResponseWriter, r *http.Request, roomID, macroID string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+
+	if macroID == "" {
+		switch r.Method {
+		case http.MethodGet:
+			macros, err := s.listMacros(roomID, player.ID)
+			if err != nil {
+				s.logger.Error("list macros", slog.String("error", err.Error()))
+				http.Error(w, "failed to load macros", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, macros)
+		case http.MethodPost:
+			s.handleMacroCreate(w, r, roomID, player)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	macro, found, err := s.getMacro(roomID, player.ID, macroID)
+	if err != nil {
+		s.logger.Error("get macro", slog.String("error", err.Error()))
+		http.Error(w, "failed to load macro", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, macro)
+		return
+	case http.MethodPatch, http.MethodDelete:
+		if !canEditMacro(player, macro) {
+			http.Error(w, "only the GM can change room macros", http.StatusForbidden)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := s.deleteMacro(roomID, macroID); err != nil {
+			s.logger.Error("delete macro", slog.String("error", err.Error()))
+			http.Error(w, "failed to delete macro", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var payload struct {
+		Name       *string `json:"name"`
+		Expression *string `json:"expression"`
+		Label      *string `json:"label"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if payload.Name == nil && payload.Expression == nil && payload.Label == nil {
+		http.Error(w, "missing fields", http.StatusBadRequest)
+		return
+	}
+	if payload.Name != nil {
+		macro.Name = *payload.Name
+	}
+	if payload.Expression != nil {
+		macro.Expression = *payload.Expression
+	}
+	if payload.Label != nil {
+		macro.Label = *payload.Label
+	}
+	if macro.Name, macro.Expression, macro.Label, err = macroFields(macro.Name, macro.Expression, macro.Label); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	updated, err := s.updateMacro(macro)
+	if err != nil {
+		s.logger.Error("update macro", slog.String("error", err.Error()))
+		http.Error(w, "failed to update macro", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// handleMacroCreate saves a macro for the caller, or a room macro when the GM
+// sets shared.
+func (s *Server) handleMacroCreate(w http.ResponseWriter, r *http.Request, roomID string, player Player) {
+	var payload struct {
+		Name       string `json:"name"`
+		Expression string `json:"expression"`
+		Label      string `json:"label"`
+		Shared     bool   `json:"shared"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if payload.Shared && player.Role != RoleGM {
+		http.Error(w, "only the GM can create room macros", http.StatusForbidden)
+		return
+	}
+	name, expression, label, err := macroFields(payload.Name, payload.Expression, payload.Label)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	macro := Macro{RoomID: roomID, Name: name, Expression: expression, Label: label}
+	if !payload.Shared {
+		macro.PlayerID = player.ID
+	}
+	macro, err = s.storeMacro(macro)
+	if err != nil {
+		s.logger.Error("store macro", slog.String("error", err.Error()))
+		http.Error(w, "failed to save macro", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, macro)
+}
+
+// runMacroRequest is the payload of the RunMacro WebSocket command. Apart from
+// the macro, it carries the per-roll options of RollDice.
+type runMacroRequest struct {
+	MacroID    string         `json:"macroId"`
+	Visibility DiceVisibility `json:"visibility"`
+	WhisperTo  []string       `json:"whisperTo"`
+	RollID     string         `json:"rollId"`
+	ClientSeed string         `json:"clientSeed"`
+	Commitment string         `json:"commitment"`
+}
+
+// runMacro rolls a macro the sender can see through the regular dice roller.
+// The macro's label, or its name when it has none, labels the roll.
+func (s *Server) runMacro(roomID string, sender *wsConn, req runMacroRequest) error {
+	macro, found, err := s.getMacro(roomID, sender.profile.ID, req.MacroID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("unknown macro %q", req.MacroID)
+	}
+	label := macro.Label
+	if label == "" {
+		label = macro.Name
+	}
+	return s.rollDiceOnce(roomID, sender, diceRollRequest{
+		Expression: macro.Expression,
+		Visibility: req.Visibility,
+		WhisperTo:  req.WhisperTo,
+		Label:      label,
+		RollID:     req.RollID,
+		ClientSeed: req.ClientSeed,
+		Commitment: req.Commitment,
+	})
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestMacroCRUD(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+	bob := joinRoomForTest(t, router, room, "Bob", RolePlayer)
+
+	do := func(method, path string, player *Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		if payload != nil {
+			_ = json.NewEncoder(&body).Encode(payload)
+		}
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+"/macros"+path, &body)
+		if player != nil {
+			authorize(req, *player)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	create := func(player Player, payload map[string]any) Macro {
+		t.Helper()
+		w := do(http.MethodPost, "", &player, payload)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create macro: %d %s", w.Code, w.Body.String())
+		}
+		var macro Macro
+		_ = json.NewDecoder(w.Body).Decode(&macro)
+		return macro
+	}
+	list := func(player Player) []Macro {
+		t.Helper()
+		w := do(http.MethodGet, "", &player, nil)
+		var macros []Macro
+		if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&macros) != nil {
+			t.Fatalf("list macros: %d %s", w.Code, w.Body.String())
+		}
+		return macros
+	}
+
+	attack := create(alice, map[string]any{"name": " Longsword ", "expression": "1D20 + 5", "label": "Attack"})
+	if attack.Name != "Longsword" || attack.Expression != "1d20+5" || attack.PlayerID != alice.ID {
+		t.Fatalf("unexpected macro: %+v", attack)
+	}
+	initiative := create(gm, map[string]any{"name": "Initiative", "expression": "1d20", "shared": true})
+	if initiative.PlayerID != "" {
+		t.Fatalf("room macro must not belong to a player: %+v", initiative)
+	}
+
+	if macros := list(alice); len(macros) != 2 || macros[0].ID != initiative.ID || macros[1].ID != attack.ID {
+		t.Fatalf("Alice should see the room macro then hers: %+v", macros)
+	}
+	if macros := list(bob); len(macros) != 1 || macros[0].ID != initiative.ID {
+		t.Fatalf("Bob should only see the room macro: %+v", macros)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		player *Player
+		body   any
+		want   int
+	}{
+		{"unauthenticated", http.MethodGet, "", nil, nil, http.StatusUnauthorized},
+		{"bad expression", http.MethodPost, "", &alice, map[string]string{"name": "Oops", "expression": "1d"}, http.StatusBadRequest},
+		{"missing name", http.MethodPost, "", &alice, map[string]string{"expression": "1d6"}, http.StatusBadRequest},
+		{"player shares", http.MethodPost, "", &alice, map[string]any{"name": "Mine", "expression": "1d6", "shared": true}, http.StatusForbidden},
+		{"other player's macro", http.MethodPatch, "/" + attack.ID, &bob, map[string]string{"name": "Stolen"}, http.StatusNotFound},
+		{"player edits room macro", http.MethodDelete, "/" + initiative.ID, &alice, nil, http.StatusForbidden},
+		{"empty patch", http.MethodPatch, "/" + attack.ID, &alice, map[string]string{}, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := do(tc.method, tc.path, tc.player, tc.body); w.Code != tc.want {
+				t.Fatalf("expected %d, got %d: %s", tc.want, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	w := do(http.MethodPatch, "/"+attack.ID, &alice, map[string]string{"expression": "1d20+6"})
+	var updated Macro
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&updated) != nil || updated.Expression != "1d20+6" || updated.Name != "Longsword" {
+		t.Fatalf("update macro: %d %+v", w.Code, updated)
+	}
+	if w := do(http.MethodDelete, "/"+attack.ID, &alice, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete macro: %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/"+attack.ID, &alice, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected deleted macro to be gone, got %d", w.Code)
+	}
+}
+
+func TestRunMacroOverWebsocket(t *testing.T) {
+	app := newTestServer(t, t.TempDir())
+	router := app.Router()
+	room := createRoomForTest(t, router)
+	player := joinRoomForTest(t, router, room, "Player One", RolePlayer)
+	other := joinRoomForTest(t, router, room, "Player Two", RolePlayer)
+
+	macro, err := app.storeMacro(Macro{RoomID: room.ID, PlayerID: player.ID, Name: "Fireball", Expression: "8d6"})
+	if err != nil {
+		t.Fatalf("store macro: %v", err)
+	}
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(player.Token), nil)
+
+	message, _ := json.Marshal(map[string]any{
+		"type":    "RunMacro",
+		"payload": map[string]any{"macroId": macro.ID},
+	})
+	if err := writeFrame(conn, 0x1, message); err != nil {
+		t.Fatalf("send macro: %v", err)
+	}
+	var entry diceLogEntry
+	_ = json.Unmarshal(readWSMessageForTest(t, conn, "DiceLogEntry"), &entry)
+	if entry.Expression != "8d6" || entry.Label != "Fireball" || len(entry.Results) != 8 || entry.RollerID != player.ID {
+		t.Fatalf("unexpected macro roll: %+v", entry)
+	}
+
+	// Another player cannot run a private macro. Their next roll is only
+	// handled after the rejected macro, so its log entry marks that point.
+	otherConn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(other.Token), nil)
+	roll, _ := json.Marshal(map[string]any{"type": "RollDice", "payload": map[string]any{"expression": "1d4"}})
+	for _, frame := range [][]byte{message, roll} {
+		if err := writeFrame(otherConn, 0x1, frame); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	_ = readWSMessageForTest(t, otherConn, "DiceLogEntry")
+	logs, _, err := app.getDiceLogs(room.ID, clientProfile{Role: string(RoleGM)}, diceLogPage{})
+	if err != nil {
+		t.Fatalf("get dice logs: %v", err)
+	}
+	for _, log := range logs {
+		if log.RollerID == other.ID && log.Expression != "1d4" {
+			t.Fatalf("Player Two ran Player One's macro: %+v", log)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package server
 
-import "time"
+import (
+	"time"
+
+	"vtrpg/internal/dice"
+)
 
 // Role represents a user's role.
 type Role string
@@ -28,6 +32,16 @@ type Player struct {
 	CreatedAt time.Time `json:"createdAt"`
 }
 
+// DiceVisibility controls who can see a dice roll. GMs see every roll.
+type DiceVisibility string
+
+const (
+	DiceVisibilityPublic  DiceVisibility = "public"  // Everyone in the room
+	DiceVisibilityGM      DiceVisibility = "gm"      // The GM and the roller
+	DiceVisibilityBlind   DiceVisibility = "blind"   // Only the GM, not even the roller
+	DiceVisibilityWhisper DiceVisibility = "whisper" // The GM, the roller and the chosen players
+)
+
 // Theme represents a room's color theme.
 type Theme string
 
@@ -118,12 +132,56 @@ func IsValidTheme(t Theme) bool {
 
 // Room represents a shared space.
 type Room struct {
-	ID        string    `json:"id"`
-	Slug      string    `json:"slug"`
-	Name      string    `json:"name"`
-	Theme     Theme     `json:"theme"`
-	CreatedBy string    `json:"createdBy"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID            string        `json:"id"`
+	Slug          string        `json:"slug"`
+	Name          string        `json:"name"`
+	Theme         Theme         `json:"theme"`
+	CreatedBy     string        `json:"createdBy"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	DiceRetention DiceRetention `json:"diceRetention"`
+	// RuleSystem names the rule system that rolls with a spec use.
+	RuleSystem string `json:"ruleSystem"`
+	// ActiveSceneID is the scene players see; Grid is that scene's grid.
+	ActiveSceneID string `json:"activeSceneId"`
+	Grid          Grid   `json:"grid"`
+	// Vision limits what players see to the line of sight of their tokens.
+	Vision bool `json:"vision"`
+}
+
+// Scene is one of a room's maps. Images, walls, lights and fog belong to a
+// scene; players only see the room's active scene while the GM can prepare
+// the others. Background is an optional image URL drawn behind the canvas.
+type Scene struct {
+	ID         string    `json:"id"`
+	RoomID     string    `json:"roomId"`
+	Name       string    `json:"name"`
+	Background string    `json:"background"`
+	Grid       Grid      `json:"grid"`
+	Fog        bool      `json:"fog"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Grid describes how a scene's canvas is divided into cells. Hex grids are
+// either pointy-topped with offset rows (hex-row) or flat-topped with offset
+// columns (hex-column); CellSize is the distance between neighbouring cell
+// centres in canvas pixels and the offset shifts the grid's origin. When Snap
+// is set, moved images and tokens are aligned to the grid by the server.
+type Grid struct {
+	Type         string  `json:"type"`
+	CellSize     float64 `json:"cellSize"`
+	OffsetX      float64 `json:"offsetX"`
+	OffsetY      float64 `json:"offsetY"`
+	UnitsPerCell float64 `json:"unitsPerCell"`
+	Unit         string  `json:"unit"`
+	Snap         bool    `json:"snap"`
+}
+
+// DiceRetention limits how much dice history a room keeps. A zero value
+// means no limit; when both are set, either limit prunes old rolls.
+type DiceRetention struct {
+	MaxEntries int `json:"maxEntries"`
+	MaxAgeDays int `json:"maxAgeDays"`
 }
 
 type RoomActivity struct {
@@ -166,10 +224,217 @@ type SharedImage struct {
 	Position    Position  `json:"position"`
 }
 
-// DiceRollPayload represents a dice roll synchronization message.
+// DiceRollPayload represents a dice roll synchronization message. Sides is
+// the die of a legacy client roll; server rolls set DieSides instead, the
+// sides of each die aligned with Results.
 type DiceRollPayload struct {
-	Seed        uint32 `json:"seed"`
-	Count       int    `json:"count"`
-	Sides       int    `json:"sides"`
-	TriggeredBy string `json:"triggeredBy"`
+	Seed        uint32       `json:"seed"`
+	Count       int          `json:"count"`
+	Sides       int          `json:"sides"`
+	DieSides    []int        `json:"dieSides,omitempty"`
+	TriggeredBy string       `json:"triggeredBy"`
+	Results     []int        `json:"results,omitempty"`
+	Expression  string         `json:"expression,omitempty"`
+	Breakdown   *dice.Result   `json:"breakdown,omitempty"`
+	Visibility  DiceVisibility `json:"visibility,omitempty"`
+	Label       string         `json:"label,omitempty"`
+	// Faces holds the face ID of each die of a custom dice roll.
+	Faces []string `json:"faces,omitempty"`
+}
+
+// Macro is a saved dice roll. A macro with a PlayerID belongs to that player
+// and only they see it; room macros have no PlayerID, are shared with
+// everyone and are managed by the GM.
+type Macro struct {
+	ID         string    `json:"id"`
+	RoomID     string    `json:"roomId"`
+	PlayerID   string    `json:"playerId,omitempty"`
+	Name       string    `json:"name"`
+	Expression string    `json:"expression"`
+	Label      string    `json:"label,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// DiceType is a custom die defined for a room. Faces lists every side of the
+// die; faces may repeat, as the two blank sides of a Fate die do.
+type DiceType struct {
+	ID        string     `json:"id"`
+	RoomID    string     `json:"roomId"`
+	Name      string     `json:"name"`
+	Faces     []DiceFace `json:"faces"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+// RandomTable is a room's random table. A table with Dice is ranged: the dice
+// are rolled and the entry whose range holds the total is drawn. A table
+// without Dice is weighted: each entry is drawn with a chance proportional to
+// its Weight. Entry texts can reference other tables of the room by name as
+// [[Table name]]; each reference is replaced by a draw from that table.
+// GMOnly tables are hidden from players and rolled for the GM's eyes only.
+type RandomTable struct {
+	ID        string       `json:"id"`
+	RoomID    string       `json:"roomId"`
+	Name      string       `json:"name"`
+	Dice      string       `json:"dice,omitempty"`
+	Entries   []TableEntry `json:"entries"`
+	GMOnly    bool         `json:"gmOnly"`
+	CreatedAt time.Time    `json:"createdAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+// TableEntry is one row of a random table. Ranged tables use Min and Max and
+// weighted tables Weight.
+type TableEntry struct {
+	Min    int    `json:"min,omitempty"`
+	Max    int    `json:"max,omitempty"`
+	Weight int    `json:"weight,omitempty"`
+	Text   string `json:"text"`
+}
+
+// Token is a canvas image that carries game state: the player who owns it, a
+// name label, hit points, a size category and how far it sees. Its ID, URL,
+// position, size on the canvas and visibility are those of the image.
+type Token struct {
+	ID           string    `json:"id"`
+	RoomID       string    `json:"roomId"`
+	SceneID      string    `json:"sceneId"`
+	URL          string    `json:"url"`
+	X            float64   `json:"x"`
+	Y            float64   `json:"y"`
+	Width        float64   `json:"width"`
+	Height       float64   `json:"height"`
+	Hidden       bool      `json:"hidden"`
+	OwnerID      string    `json:"ownerId,omitempty"`
+	Name         string    `json:"name"`
+	HP           int       `json:"hp"`
+	MaxHP        int       `json:"maxHp"`
+	Size         string    `json:"size"`
+	VisionRadius float64   `json:"visionRadius"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Wall is a line segment on the canvas that blocks vision. A door blocks it
+// only while it is closed.
+type Wall struct {
+	ID        string    `json:"id"`
+	RoomID    string    `json:"roomId"`
+	SceneID   string    `json:"sceneId"`
+	X1        float64   `json:"x1"`
+	Y1        float64   `json:"y1"`
+	X2        float64   `json:"x2"`
+	Y2        float64   `json:"y2"`
+	Door      bool      `json:"door"`
+	Open      bool      `json:"open"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Light is a light source on the canvas. Range is in grid cells and Color is
+// a hex colour as found in map exports.
+type Light struct {
+	ID        string    `json:"id"`
+	RoomID    string    `json:"roomId"`
+	SceneID   string    `json:"sceneId"`
+	X         float64   `json:"x"`
+	Y         float64   `json:"y"`
+	Range     float64   `json:"range"`
+	Intensity float64   `json:"intensity"`
+	Color     string    `json:"color"`
+	Shadows   bool      `json:"shadows"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Vision is the area a token sees, as a polygon of [x, y] canvas points.
+type Vision struct {
+	TokenID string       `json:"tokenId"`
+	Polygon [][2]float64 `json:"polygon"`
+}
+
+// Fog is a scene's fog of war. While it is enabled, players only see the grid
+// cells in Revealed, each given as a [column, row] pair.
+type Fog struct {
+	SceneID  string   `json:"sceneId"`
+	Enabled  bool     `json:"enabled"`
+	Revealed [][2]int `json:"revealed"`
+}
+
+// InitiativeTracker is a room's turn order. Round is 0 until the first turn
+// and CurrentID is the entry whose turn it is.
+type InitiativeTracker struct {
+	RoomID    string            `json:"roomId"`
+	Round     int               `json:"round"`
+	CurrentID string            `json:"currentId,omitempty"`
+	Entries   []InitiativeEntry `json:"entries"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+// InitiativeEntry is one combatant in the turn order, optionally linked to a
+// player or a canvas image. Initiative is nil until set or rolled with Dice;
+// Tiebreaker orders entries with equal initiative. Hidden entries are only
+// shown to the GM.
+type InitiativeEntry struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	PlayerID   string `json:"playerId,omitempty"`
+	ImageID    string `json:"imageId,omitempty"`
+	Initiative *int   `json:"initiative"`
+	Dice       string `json:"dice"`
+	Tiebreaker int    `json:"tiebreaker"`
+	Hidden     bool   `json:"hidden"`
+}
+
+// Effect is a condition such as "Stunned" on a canvas image or initiative
+// entry. Remaining counts down in Unit ("rounds" or "turns") as the initiative
+// tracker advances, and the effect expires when it reaches zero.
+type Effect struct {
+	ID         string    `json:"id"`
+	RoomID     string    `json:"roomId"`
+	TargetType string    `json:"targetType"`
+	TargetID   string    `json:"targetId"`
+	Name       string    `json:"name"`
+	Source     string    `json:"source,omitempty"`
+	Unit       string    `json:"unit"`
+	Duration   int       `json:"duration"`
+	Remaining  int       `json:"remaining"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Deck is a room's deck of cards as everyone sees it: how many cards are left
+// to draw, the face-up discard pile and played cards, and how many cards each
+// player holds. The order of the draw pile and the cards in hands are never
+// part of it.
+type Deck struct {
+	ID        string         `json:"id"`
+	RoomID    string         `json:"roomId"`
+	Name      string         `json:"name"`
+	Kind      string         `json:"kind"`
+	Remaining int            `json:"remaining"`
+	Discard   []Card         `json:"discard"`
+	Table     []Card         `json:"table"`
+	Hands     map[string]int `json:"hands"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+// Card is one card of a deck. Zone is where the card is: the draw pile, a
+// hand, the table (played onto the canvas as ImageID) or the discard pile.
+// HolderID is the player holding the card, or who played it.
+type Card struct {
+	ID       string `json:"id"`
+	DeckID   string `json:"deckId"`
+	Name     string `json:"name"`
+	Code     string `json:"code,omitempty"`
+	ImageURL string `json:"imageUrl"`
+	Zone     string `json:"zone"`
+	HolderID string `json:"holderId,omitempty"`
+	ImageID  string `json:"imageId,omitempty"`
+}
+
+// DiceFace is one side of a custom die. Value counts towards the roll total
+// and Symbols towards the per-symbol totals.
+type DiceFace struct {
+	ID      string         `json:"id"`
+	Label   string         `json:"label"`
+	Value   int            `json:"value"`
+	Symbols map[string]int `json:"symbols,omitempty"`
 }
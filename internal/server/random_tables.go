@@ -0,0 +1,858 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"vtrpg/internal/dice"
+)
+
+const (
+	maxTableNameLength  = 100
+	maxTableEntries     = 1000
+	maxTableEntryLength = 1000
+	maxTableWeight      = 1000000
+	// maxTableDepth bounds how deep references are followed.
+	maxTableDepth = 5
+	// maxTableDraws and maxTableTextLength bound what a single table roll may
+	// draw, since every reference in an entry draws again.
+	maxTableDraws      = 100
+	maxTableTextLength = 10000
+	maxTableImportSize = 1 << 20
+)
+
+var errTableLoop = errors.New("table loop")
+
+// tableReferencePattern matches a [[Table name]] reference in an entry.
+var tableReferencePattern = regexp.MustCompile(`\[\[([^\[\]]+)\]\]`)
+
+const randomTableColumns = `id, room_id, name, dice, entries, gm_only, created_at, updated_at`
+
+func scanRandomTable(row rowScanner) (RandomTable, error) {
+	var table RandomTable
+	var entries string
+	if err := row.Scan(&table.ID, &table.RoomID, &table.Name, &table.Dice, &entries, &table.GMOnly, &table.CreatedAt, &table.UpdatedAt); err != nil {
+		return RandomTable{}, err
+	}
+	if err := json.Unmarshal([]byte(entries), &table.Entries); err != nil {
+		return RandomTable{}, err
+	}
+	table.CreatedAt = table.CreatedAt.UTC()
+	table.UpdatedAt = table.UpdatedAt.UTC()
+	return table, nil
+}
+
+// tableKey is how references name a table: case and surrounding space do not
+// matter.
+func tableKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// randomTableFields validates a table. The dice are stored in canonical form;
+// a ranged entry whose max is below its min covers only its min, and a
+// weighted entry without a weight has weight 1.
+func randomTableFields(name, diceExpr string, entries []TableEntry) (string, string, []TableEntry, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxTableNameLength {
+		return "", "", nil, fmt.Errorf("name must be 1-%d characters", maxTableNameLength)
+	}
+	if len(entries) == 0 || len(entries) > maxTableEntries {
+		return "", "", nil, fmt.Errorf("a table needs 1-%d entries", maxTableEntries)
+	}
+	var lo, hi int
+	if diceExpr = strings.TrimSpace(diceExpr); diceExpr != "" {
+		expr, err := dice.Parse(diceExpr)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid dice: %w", err)
+		}
+		var ok bool
+		if lo, hi, ok = expr.Bounds(); !ok {
+			return "", "", nil, errors.New("table dice must not explode")
+		}
+		diceExpr = expr.String()
+	}
+
+	cleaned := make([]TableEntry, len(entries))
+	totalWeight := 0
+	for i, entry := range entries {
+		entry.Text = strings.TrimSpace(entry.Text)
+		if entry.Text == "" || utf8.RuneCountInString(entry.Text) > maxTableEntryLength {
+			return "", "", nil, fmt.Errorf("entry %d: text must be 1-%d characters", i+1, maxTableEntryLength)
+		}
+		if diceExpr != "" {
+			entry.Weight = 0
+			if entry.Max < entry.Min {
+				entry.Max = entry.Min
+			}
+		} else {
+			entry.Min, entry.Max = 0, 0
+			if entry.Weight == 0 {
+				entry.Weight = 1
+			}
+			if entry.Weight < 0 {
+				return "", "", nil, fmt.Errorf("entry %d: weight must be positive", i+1)
+			}
+			if totalWeight += entry.Weight; totalWeight > maxTableWeight {
+				return "", "", nil, fmt.Errorf("weights must add up to at most %d", maxTableWeight)
+			}
+		}
+		cleaned[i] = entry
+	}
+
+	if diceExpr != "" {
+		ranges := make([]TableEntry, len(cleaned))
+		copy(ranges, cleaned)
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i].Min < ranges[j].Min })
+		for i := 1; i < len(ranges); i++ {
+			if ranges[i].Min <= ranges[i-1].Max {
+				return "", "", nil, fmt.Errorf("ranges %d-%d and %d-%d overlap", ranges[i-1].Min, ranges[i-1].Max, ranges[i].Min, ranges[i].Max)
+			}
+		}
+		// Every total the dice can roll must draw an entry.
+		next := lo
+		for _, entry := range ranges {
+			if entry.Min > next {
+				break
+			}
+			next = max(next, entry.Max+1)
+		}
+		if next <= hi {
+			return "", "", nil, fmt.Errorf("no entry covers a roll of %d", next)
+		}
+	}
+	return name, diceExpr, cleaned, nil
+}
+
+// tableReferences returns the keys of the tables an entry text references, in
+// order and with repeats.
+func tableReferences(text string) []string {
+	var keys []string
+	for _, match := range tableReferencePattern.FindAllStringSubmatch(text, -1) {
+		keys = append(keys, tableKey(match[1]))
+	}
+	return keys
+}
+
+// findTableLoop reports a table that references itself, directly or through
+// other tables. References to unknown tables are ignored.
+func findTableLoop(byName map[string]TableSpec) error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int, len(byName))
+	var path []string
+	var visit func(key string) error
+	visit = func(key string) error {
+		switch state[key] {
+		case visiting:
+			if path[len(path)-1] == key {
+				return fmt.Errorf("%w: table %q references itself", errTableLoop, byName[key].Name)
+			}
+			names := []string{}
+			for i := slices.Index(path, key); i < len(path); i++ {
+				names = append(names, byName[path[i]].Name)
+			}
+			return fmt.Errorf("%w: tables %s reference each other in a loop", errTableLoop, strings.Join(names, ", "))
+		case done:
+			return nil
+		}
+		state[key] = visiting
+		path = append(path, key)
+		for _, entry := range byName[key].Entries {
+			for _, ref := range tableReferences(entry.Text) {
+				if _, ok := byName[ref]; !ok {
+					continue
+				}
+				if err := visit(ref); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[key] = done
+		return nil
+	}
+	keys := make([]string, 0, len(byName))
+	for key := range byName {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := visit(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTableLoops checks that saving tables, in place of the table exceptID,
+// makes no table of the room reference itself. A loop is reported as
+// errTableLoop.
+func (s *Server) checkTableLoops(roomID, exceptID string, tables []RandomTable) error {
+	all, err := s.listRandomTables(roomID, true)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]TableSpec, len(all)+len(tables))
+	for _, table := range all {
+		if table.ID != exceptID {
+			byName[tableKey(table.Name)] = table.spec()
+		}
+	}
+	for _, table := range tables {
+		byName[tableKey(table.Name)] = table.spec()
+	}
+	return findTableLoop(byName)
+}
+
+// listRandomTables returns the room's tables; GM-only tables are included
+// only for the GM.
+func (s *Server) listRandomTables(roomID string, includeGMOnly bool) ([]RandomTable, error) {
+	rows, err := s.db.Query(
+		`SELECT `+randomTableColumns+` FROM random_tables WHERE room_id = ? AND (gm_only = 0 OR ?) ORDER BY name COLLATE NOCASE, id`,
+		roomID, includeGMOnly,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := make([]RandomTable, 0)
+	for rows.Next() {
+		table, err := scanRandomTable(rows)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+func (s *Server) getRandomTable(roomID, tableID string, includeGMOnly bool) (RandomTable, bool, error) {
+	table, err := scanRandomTable(s.db.QueryRow(
+		`SELECT `+randomTableColumns+` FROM random_tables WHERE room_id = ? AND id = ? AND (gm_only = 0 OR ?)`,
+		roomID, tableID, includeGMOnly,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return RandomTable{}, false, nil
+	}
+	if err != nil {
+		return RandomTable{}, false, err
+	}
+	return table, true, nil
+}
+
+// randomTableNameTaken reports whether another table in the room has the
+// name, ignoring case.
+func (s *Server) randomTableNameTaken(roomID, name, exceptID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM random_tables WHERE room_id = ? AND name = ? COLLATE NOCASE AND id != ?)`,
+		roomID, name, exceptID,
+	).Scan(&exists)
+	return exists, err
+}
+
+func (s *Server) storeRandomTable(table RandomTable) (RandomTable, error) {
+	entries, err := json.Marshal(table.Entries)
+	if err != nil {
+		return RandomTable{}, err
+	}
+	now := time.Now().UTC()
+	table.ID = s.newID()
+	table.CreatedAt = now
+	table.UpdatedAt = now
+	if _, err := s.db.Exec(
+		`INSERT INTO random_tables (id, room_id, name, dice, entries, gm_only, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		table.ID, table.RoomID, table.Name, table.Dice, string(entries), table.GMOnly, table.CreatedAt, table.UpdatedAt,
+	); err != nil {
+		return RandomTable{}, err
+	}
+	return table, nil
+}
+
+func (s *Server) updateRandomTable(table RandomTable) (RandomTable, error) {
+	entries, err := json.Marshal(table.Entries)
+	if err != nil {
+		return RandomTable{}, err
+	}
+	table.UpdatedAt = time.Now().UTC()
+	if _, err := s.db.Exec(
+		`UPDATE random_tables SET name = ?, dice = ?, entries = ?, gm_only = ?, updated_at = ? WHERE room_id = ? AND id = ?`,
+		table.Name, table.Dice, string(entries), table.GMOnly, table.UpdatedAt, table.RoomID, table.ID,
+	); err != nil {
+		return RandomTable{}, err
+	}
+	return table, nil
+}
+
+func (s *Server) deleteRandomTable(roomID, tableID string) error {
+	_, err := s.db.Exec(`DELETE FROM random_tables WHERE room_id = ? AND id = ?`, roomID, tableID)
+	return err
+}
+
+// handleRandomTables serves /rooms/{id}/tables, /rooms/{id}/tables/import
+// and /rooms/{id}/tables/{tableId}. Every request is authenticated, since
+// players do not see GM-only tables; only the GM changes tables.
+func (s *Server) handleRandomTables(w http.ResponseWriter, r *http.Request, roomID, tableID string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	isGM := player.Role == RoleGM
+
+	if r.Method == http.MethodGet && tableID == "" {
+		tables, err := s.listRandomTables(roomID, isGM)
+		if err != nil {
+			s.logger.Error("list random tables", slog.String("error", err.Error()))
+			http.Error(w, "failed to load tables", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, tables)
+		return
+	}
+	switch {
+	case tableID == "" && r.Method == http.MethodPost:
+	case tableID == "import" && r.Method == http.MethodPost:
+	case tableID != "" && tableID != "import" && (r.Method == http.MethodGet || r.Method == http.MethodPatch || r.Method == http.MethodDelete):
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method != http.MethodGet && !isGM {
+		http.Error(w, "only the GM can change tables", http.StatusForbidden)
+		return
+	}
+	if tableID == "import" {
+		s.handleRandomTableImport(w, r, roomID)
+		return
+	}
+
+	table := RandomTable{RoomID: roomID}
+	if tableID != "" {
+		var found bool
+		var err error
+		if table, found, err = s.getRandomTable(roomID, tableID, isGM); err != nil {
+			s.logger.Error("get random table", slog.String("error", err.Error()))
+			http.Error(w, "failed to load table", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, table)
+		return
+	case http.MethodDelete:
+		if err := s.deleteRandomTable(roomID, tableID); err != nil {
+			s.logger.Error("delete random table", slog.String("error", err.Error()))
+			http.Error(w, "failed to delete table", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var payload struct {
+		Name    *string      `json:"name"`
+		Dice    *string      `json:"dice"`
+		Entries []TableEntry `json:"entries"`
+		GMOnly  *bool        `json:"gmOnly"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if payload.Name == nil && payload.Dice == nil && payload.Entries == nil && payload.GMOnly == nil {
+		http.Error(w, "missing fields", http.StatusBadRequest)
+		return
+	}
+	if payload.Name != nil {
+		table.Name = *payload.Name
+	}
+	if payload.Dice != nil {
+		table.Dice = *payload.Dice
+	}
+	if payload.Entries != nil {
+		table.Entries = payload.Entries
+	}
+	if payload.GMOnly != nil {
+		table.GMOnly = *payload.GMOnly
+	}
+	var err error
+	if table.Name, table.Dice, table.Entries, err = randomTableFields(table.Name, table.Dice, table.Entries); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	taken, err := s.randomTableNameTaken(roomID, table.Name, tableID)
+	if err != nil {
+		s.logger.Error("check random table name", slog.String("error", err.Error()))
+		http.Error(w, "failed to save table", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "a table with that name already exists", http.StatusConflict)
+		return
+	}
+	if err := s.checkTableLoops(roomID, tableID, []RandomTable{table}); err != nil {
+		s.writeTableLoopError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if tableID == "" {
+		table, err = s.storeRandomTable(table)
+		status = http.StatusCreated
+	} else {
+		table, err = s.updateRandomTable(table)
+	}
+	if err != nil {
+		s.logger.Error("save random table", slog.String("error", err.Error()))
+		http.Error(w, "failed to save table", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, table)
+}
+
+// handleRandomTableImport creates tables from a JSON array of tables or, for
+// text/csv, one table whose name, dice and gmOnly flag come from the query.
+// Every table is validated before any is saved.
+func (s *Server) handleRandomTableImport(w http.ResponseWriter, r *http.Request, roomID string) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxTableImportSize))
+	if err != nil {
+		http.Error(w, "import too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var tables []RandomTable
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		query := r.URL.Query()
+		table := RandomTable{Name: query.Get("name"), Dice: query.Get("dice"), GMOnly: query.Get("gmOnly") == "true"}
+		if table.Entries, err = parseTableCSV(bytes.NewReader(body)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if table.Dice == "" {
+			table.Dice = defaultTableDice(table.Entries)
+		}
+		tables = []RandomTable{table}
+	case "", "application/json":
+		if err := json.Unmarshal(body, &tables); err != nil {
+			http.Error(w, "expected a JSON array of tables", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "import tables as application/json or text/csv", http.StatusUnsupportedMediaType)
+		return
+	}
+	if len(tables) == 0 {
+		http.Error(w, "no tables to import", http.StatusBadRequest)
+		return
+	}
+
+	names := make(map[string]bool, len(tables))
+	for i := range tables {
+		table := &tables[i]
+		if table.Name, table.Dice, table.Entries, err = randomTableFields(table.Name, table.Dice, table.Entries); err != nil {
+			http.Error(w, fmt.Sprintf("table %d: %s", i+1, err), http.StatusBadRequest)
+			return
+		}
+		table.RoomID = roomID
+		taken, err := s.randomTableNameTaken(roomID, table.Name, "")
+		if err != nil {
+			s.logger.Error("check random table name", slog.String("error", err.Error()))
+			http.Error(w, "failed to import tables", http.StatusInternalServerError)
+			return
+		}
+		if taken || names[tableKey(table.Name)] {
+			http.Error(w, fmt.Sprintf("a table named %q already exists", table.Name), http.StatusConflict)
+			return
+		}
+		names[tableKey(table.Name)] = true
+	}
+	if err := s.checkTableLoops(roomID, "", tables); err != nil {
+		s.writeTableLoopError(w, err)
+		return
+	}
+
+	created := make([]RandomTable, 0, len(tables))
+	for _, table := range tables {
+		stored, err := s.storeRandomTable(table)
+		if err != nil {
+			s.logger.Error("import random table", slog.String("error", err.Error()))
+			http.Error(w, "failed to import tables", http.StatusInternalServerError)
+			return
+		}
+		created = append(created, stored)
+	}
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) writeTableLoopError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errTableLoop) {
+		http.Error(w, strings.TrimPrefix(err.Error(), errTableLoop.Error()+": "), http.StatusBadRequest)
+		return
+	}
+	s.logger.Error("check random table references", slog.String("error", err.Error()))
+	http.Error(w, "failed to save tables", http.StatusInternalServerError)
+}
+
+// parseTableCSV reads table entries from a CSV with a header row. The text
+// is in a "text", "result" or "entry" column. Ranged rows have a "range" or
+// "roll" column such as "01-05", or "min" and "max" columns; weighted rows
+// have a "weight" column. Rows with no text are skipped.
+func parseTableCSV(r io.Reader) ([]TableEntry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		switch name = strings.ToLower(strings.TrimSpace(name)); name {
+		case "result", "entry":
+			name = "text"
+		case "roll":
+			name = "range"
+		}
+		if _, ok := columns[name]; !ok {
+			columns[name] = i
+		}
+	}
+	if _, ok := columns["text"]; !ok {
+		return nil, errors.New(`csv needs a "text", "result" or "entry" column`)
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var entries []TableEntry
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid csv: %w", err)
+		}
+		entry := TableEntry{Text: field(record, "text")}
+		if entry.Text == "" {
+			continue
+		}
+		if value := field(record, "range"); value != "" {
+			if entry.Min, entry.Max, err = parseTableRange(value); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		for name, target := range map[string]*int{"min": &entry.Min, "max": &entry.Max, "weight": &entry.Weight} {
+			if value := field(record, name); value != "" {
+				if *target, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("line %d: invalid %s %q", line, name, value)
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// parseTableRange parses a range such as "3", "01-05" or "96–00". As on
+// percentile tables, a bound of "00" is 100.
+func parseTableRange(value string) (int, int, error) {
+	bound := func(s string) (int, error) {
+		s = strings.TrimSpace(s)
+		if s == "00" {
+			return 100, nil
+		}
+		return strconv.Atoi(s)
+	}
+	low, high, ranged := strings.Cut(strings.ReplaceAll(value, "–", "-"), "-")
+	if !ranged {
+		high = low
+	}
+	lo, err := bound(low)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range %q", value)
+	}
+	hi, err := bound(high)
+	if err != nil || hi < lo {
+		return 0, 0, fmt.Errorf("invalid range %q", value)
+	}
+	return lo, hi, nil
+}
+
+// defaultTableDice is a single die covering the ranges of an imported table,
+// or no dice for a weighted table.
+func defaultTableDice(entries []TableEntry) string {
+	highest := 0
+	for _, entry := range entries {
+		if entry.Weight != 0 {
+			return ""
+		}
+		highest = max(highest, entry.Min, entry.Max)
+	}
+	if highest < 1 {
+		return ""
+	}
+	return fmt.Sprintf("1d%d", highest)
+}
+
+// TableSpec is one table of a table roll: the rolled table or one it
+// references, with the dice and entries it had when the roll was made.
+// References in entry text are resolved by name among the roll's tables.
+type TableSpec struct {
+	Name    string       `json:"name"`
+	Dice    string       `json:"dice,omitempty"`
+	Entries []TableEntry `json:"entries"`
+}
+
+// TableDraw is one draw made while rolling a table.
+type TableDraw struct {
+	Table string `json:"table"`
+	Roll  int    `json:"roll"`
+	Text  string `json:"text"`
+}
+
+func (t RandomTable) spec() TableSpec {
+	return TableSpec{Name: t.Name, Dice: t.Dice, Entries: t.Entries}
+}
+
+// resolveRandomTables copies the table and every table it references,
+// directly or through other tables, into a roll spec. References to unknown
+// tables, and to GM-only tables for players, stay as written. gmOnly reports
+// whether any of the tables is GM-only. Errors wrap errInvalidRoll unless a
+// lookup fails.
+func (s *Server) resolveRandomTables(roomID string, includeGMOnly bool, tableID string) ([]TableSpec, bool, error) {
+	root, found, err := s.getRandomTable(roomID, tableID, includeGMOnly)
+	if err != nil {
+		return nil, false, err
+	}
+	if !found {
+		return nil, false, fmt.Errorf("%w: unknown table %q", errInvalidRoll, tableID)
+	}
+	all, err := s.listRandomTables(roomID, includeGMOnly)
+	if err != nil {
+		return nil, false, err
+	}
+	byName := make(map[string]RandomTable, len(all))
+	for _, table := range all {
+		byName[tableKey(table.Name)] = table
+	}
+
+	specs := []TableSpec{root.spec()}
+	seen := map[string]bool{tableKey(root.Name): true}
+	gmOnly := root.GMOnly
+	for i := 0; i < len(specs); i++ {
+		for _, entry := range specs[i].Entries {
+			for _, key := range tableReferences(entry.Text) {
+				table, ok := byName[key]
+				if !ok || seen[key] {
+					continue
+				}
+				seen[key] = true
+				specs = append(specs, table.spec())
+				gmOnly = gmOnly || table.GMOnly
+			}
+		}
+	}
+	return specs, gmOnly, nil
+}
+
+const tableSystemName = "table"
+
+// tableSystem draws from random tables. The total is the roll on the first
+// table; Text is the drawn entry with references replaced by draws from the
+// referenced tables. A reroll draws again from scratch.
+type tableSystem struct{}
+
+func (tableSystem) Name() string { return tableSystemName }
+
+func (tableSystem) Validate(spec RollSpec) error {
+	if len(spec.Tables) == 0 {
+		return fmt.Errorf("%w: no table to roll", errInvalidRoll)
+	}
+	for _, table := range spec.Tables {
+		if _, _, _, err := randomTableFields(table.Name, table.Dice, table.Entries); err != nil {
+			return fmt.Errorf("%w: table %q: %s", errInvalidRoll, table.Name, err)
+		}
+	}
+	cost := tableRollCost(tableSpecsByName(spec.Tables), spec.Tables[0], 0, map[tableDepth]tableCost{})
+	if cost.draws > maxTableDraws {
+		return fmt.Errorf("%w: table %q can draw more than %d times in one roll", errInvalidRoll, spec.Tables[0].Name, maxTableDraws)
+	}
+	if cost.length > maxTableTextLength {
+		return fmt.Errorf("%w: table %q can draw more than %d characters in one roll", errInvalidRoll, spec.Tables[0].Name, maxTableTextLength)
+	}
+	return nil
+}
+
+func tableSpecsByName(tables []TableSpec) map[string]TableSpec {
+	byName := make(map[string]TableSpec, len(tables))
+	for _, table := range tables {
+		byName[tableKey(table.Name)] = table
+	}
+	return byName
+}
+
+// tableCost is the most draws and the longest text, in characters, that
+// rolling a table can take, references included. Both are capped just above
+// their limits, so a runaway table cannot overflow them.
+type tableCost struct {
+	draws, length int
+}
+
+type tableDepth struct {
+	key   string
+	depth int
+}
+
+// tableRollCost works out the worst-case cost of drawing from table at the
+// given reference depth, following references the way draw does.
+func tableRollCost(byName map[string]TableSpec, table TableSpec, depth int, memo map[tableDepth]tableCost) tableCost {
+	at := tableDepth{tableKey(table.Name), depth}
+	if cost, ok := memo[at]; ok {
+		return cost
+	}
+	worst := tableCost{draws: 1}
+	for _, entry := range table.Entries {
+		cost := tableCost{draws: 1, length: utf8.RuneCountInString(entry.Text)}
+		if depth < maxTableDepth {
+			for _, match := range tableReferencePattern.FindAllString(entry.Text, -1) {
+				nested, ok := byName[tableKey(match[2:len(match)-2])]
+				if !ok {
+					continue
+				}
+				sub := tableRollCost(byName, nested, depth+1, memo)
+				cost.draws += sub.draws
+				cost.length += sub.length - utf8.RuneCountInString(match)
+			}
+		}
+		worst.draws = max(worst.draws, min(cost.draws, maxTableDraws+1))
+		worst.length = max(worst.length, min(cost.length, maxTableTextLength+1))
+	}
+	memo[at] = worst
+	return worst
+}
+
+func (t tableSystem) Roll(spec RollSpec, rng dice.RNG) RuleResult {
+	byName := tableSpecsByName(spec.Tables)
+	result := RuleResult{Dice: []RuleDie{}}
+	result.Text = t.draw(&result, byName, spec.Tables[0], 0, rng)
+	result.Total = result.Draws[0].Roll
+	result.Notation = spec.Tables[0].Dice
+	if result.Notation == "" {
+		result.Notation = fmt.Sprintf("1d%d", result.Dice[0].Sides)
+	}
+	return result
+}
+
+// draw rolls on table, records the draw and expands the references of the
+// drawn entry.
+func (t tableSystem) draw(result *RuleResult, byName map[string]TableSpec, table TableSpec, depth int, rng dice.RNG) string {
+	var roll int
+	if table.Dice != "" {
+		// Validate has parsed the dice already.
+		expr, _ := dice.Parse(table.Dice)
+		rolled := dice.Evaluate(expr, rng)
+		for _, term := range rolled.Terms {
+			for _, die := range term.Dice {
+				result.Dice = append(result.Dice, RuleDie{Pool: table.Name, Sides: term.Sides, Value: die.Value, Dropped: die.Dropped})
+			}
+		}
+		roll = rolled.Total
+	} else {
+		total := 0
+		for _, entry := range table.Entries {
+			total += entry.Weight
+		}
+		roll = rollRuleDie(rng, total)
+		result.Dice = append(result.Dice, RuleDie{Pool: table.Name, Sides: total, Value: roll})
+	}
+
+	text := ""
+	cumulative := 0
+	for _, entry := range table.Entries {
+		cumulative += entry.Weight
+		if (table.Dice != "" && roll >= entry.Min && roll <= entry.Max) || (table.Dice == "" && roll <= cumulative) {
+			text = entry.Text
+			break
+		}
+	}
+	result.Draws = append(result.Draws, TableDraw{Table: table.Name, Roll: roll, Text: text})
+	if depth >= maxTableDepth {
+		return text
+	}
+	return tableReferencePattern.ReplaceAllStringFunc(text, func(ref string) string {
+		nested, ok := byName[tableKey(ref[2:len(ref)-2])]
+		if !ok {
+			return ref
+		}
+		return t.draw(result, byName, nested, depth+1, rng)
+	})
+}
+
+func (tableSystem) CanPush(RuleResult) error { return nil }
+
+func (t tableSystem) Push(spec RollSpec, _ RuleResult, rng dice.RNG) RuleResult {
+	result := t.Roll(spec, rng)
+	for i := range result.Dice {
+		result.Dice[i].Rerolled = true
+	}
+	result.Pushed = true
+	return result
+}
+
+// rollTableRequest is the payload of the RollTable WebSocket command. Apart
+// from the table, it carries the per-roll options of RollDice.
+type rollTableRequest struct {
+	TableID    string         `json:"tableId"`
+	Label      string         `json:"label"`
+	Visibility DiceVisibility `json:"visibility"`
+	WhisperTo  []string       `json:"whisperTo"`
+	RollID     string         `json:"rollId"`
+	ClientSeed string         `json:"clientSeed"`
+	Commitment string         `json:"commitment"`
+}
+
+// rollTable draws from a table through the regular dice roller, so the draw
+// is committed, logged and broadcast like any other roll.
+func (s *Server) rollTable(roomID string, sender *wsConn, req rollTableRequest) error {
+	if req.TableID == "" {
+		return errors.New("missing table id")
+	}
+	return s.rollDiceOnce(roomID, sender, diceRollRequest{
+		Table:      req.TableID,
+		Label:      req.Label,
+		Visibility: req.Visibility,
+		WhisperTo:  req.WhisperTo,
+		RollID:     req.RollID,
+		ClientSeed: req.ClientSeed,
+		Commitment: req.Commitment,
+	})
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTableSystemNestedDraws(t *testing.T) {
+	spec := RollSpec{Tables: []TableSpec{
+		{Name: "Encounter", Dice: "1d6", Entries: []TableEntry{
+			{Min: 1, Max: 3, Text: "Nothing"},
+			{Min: 4, Max: 6, Text: "A [[Monster]] with [[loot]]"},
+		}},
+		{Name: "Monster", Entries: []TableEntry{{Weight: 3, Text: "goblin"}, {Weight: 1, Text: "troll"}}},
+		{Name: "Loot", Entries: []TableEntry{{Weight: 1, Text: "a coin"}, {Weight: 1, Text: "a [[Loot]]"}}},
+	}}
+	system := tableSystem{}
+	if err := system.Validate(spec); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	// d6 = 5, Monster d4 = 4 (troll), Loot d2 = 2 (recurse), Loot d2 = 1.
+	rng := &sequenceRNG{values: []float64{4.5 / 6, 3.5 / 4, 1.5 / 2, 0.5 / 2}}
+	result := system.Roll(spec, rng)
+	if result.Text != "A troll with a a coin" || result.Total != 5 || len(result.Draws) != 4 || result.Notation != "1d6" {
+		t.Fatalf("unexpected draw: %+v", result)
+	}
+	if got := result.Sides(); len(got) != 4 || got[1] != 4 {
+		t.Fatalf("unexpected sides: %v", got)
+	}
+
+	// Self-references stop at the depth limit.
+	loop := RollSpec{Tables: []TableSpec{{Name: "Loop", Entries: []TableEntry{{Weight: 1, Text: "x[[loop]]"}}}}}
+	result = system.Roll(loop, &sequenceRNG{values: make([]float64, maxTableDepth+1)})
+	if result.Text != strings.Repeat("x", maxTableDepth+1)+"[[loop]]" {
+		t.Fatalf("unexpected recursion: %q", result.Text)
+	}
+
+	// Tables whose references could draw too often or too much text in one
+	// roll cannot be rolled.
+	runaway := RollSpec{Tables: []TableSpec{{Name: "A", Entries: []TableEntry{{Weight: 1, Text: strings.Repeat("[[A]]", 12)}}}}}
+	if err := system.Validate(runaway); !errors.Is(err, errInvalidRoll) || !strings.Contains(err.Error(), "draw more than") {
+		t.Fatalf("expected too many draws to be rejected, got %v", err)
+	}
+	wordy := RollSpec{Tables: []TableSpec{
+		{Name: "Story", Entries: []TableEntry{{Weight: 1, Text: strings.Repeat("[[Page]]", 11)}}},
+		{Name: "Page", Entries: []TableEntry{{Weight: 1, Text: strings.Repeat("x", maxTableEntryLength)}}},
+	}}
+	if err := system.Validate(wordy); !errors.Is(err, errInvalidRoll) || !strings.Contains(err.Error(), "characters") {
+		t.Fatalf("expected too much text to be rejected, got %v", err)
+	}
+}
+
+// sequenceRNG returns the given values in order.
+type sequenceRNG struct {
+	values []float64
+}
+
+func (s *sequenceRNG) Float64() float64 {
+	v := s.values[0]
+	s.values = s.values[1:]
+	return v
+}
+
+func TestRandomTables(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+
+	do := func(method, path string, player Player, contentType string, body []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	doJSON := func(method, path string, player Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		body, _ := json.Marshal(payload)
+		return do(method, path, player, "application/json", body)
+	}
+
+	names := map[string]any{"name": "Names", "entries": []TableEntry{{Text: "Ada"}, {Text: "Brann", Weight: 3}}}
+	if w := doJSON(http.MethodPost, "/tables", alice, names); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not create tables, got %d", w.Code)
+	}
+	overlapping := map[string]any{"name": "Bad", "dice": "1d6", "entries": []TableEntry{{Min: 1, Max: 4, Text: "a"}, {Min: 4, Max: 6, Text: "b"}}}
+	if w := doJSON(http.MethodPost, "/tables", gm, overlapping); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for overlapping ranges, got %d", w.Code)
+	}
+	gap := map[string]any{"name": "Bad", "dice": "1d6", "entries": []TableEntry{{Min: 1, Max: 3, Text: "a"}, {Min: 5, Max: 6, Text: "b"}}}
+	if w := doJSON(http.MethodPost, "/tables", gm, gap); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "roll of 4") {
+		t.Fatalf("expected 400 for ranges that miss a roll, got %d %s", w.Code, w.Body.String())
+	}
+	w := doJSON(http.MethodPost, "/tables", gm, names)
+	var namesTable RandomTable
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&namesTable) != nil || namesTable.Entries[0].Weight != 1 {
+		t.Fatalf("create table: %d %s", w.Code, w.Body.String())
+	}
+
+	csvBody := "Roll,Result\n01-60,Nothing\n61-90,[[Names]] the merchant\n91-00,Dragon\n"
+	query := url.Values{"name": {"Encounters"}, "gmOnly": {"true"}}
+	w = do(http.MethodPost, "/tables/import?"+query.Encode(), gm, "text/csv", []byte(csvBody))
+	var imported []RandomTable
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&imported) != nil || len(imported) != 1 {
+		t.Fatalf("import csv: %d %s", w.Code, w.Body.String())
+	}
+	encounters := imported[0]
+	if encounters.Dice != "1d100" || encounters.Entries[2].Min != 91 || encounters.Entries[2].Max != 100 || !encounters.GMOnly {
+		t.Fatalf("unexpected csv import: %+v", encounters)
+	}
+	jsonImport := []map[string]any{{"name": "Weather", "entries": []TableEntry{{Text: "Rain"}, {Text: "Sun"}}}}
+	if w := doJSON(http.MethodPost, "/tables/import", gm, jsonImport); w.Code != http.StatusCreated {
+		t.Fatalf("import json: %d %s", w.Code, w.Body.String())
+	}
+	if w := doJSON(http.MethodPost, "/tables/import", gm, jsonImport); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for an imported duplicate, got %d", w.Code)
+	}
+
+	var listed []RandomTable
+	w = do(http.MethodGet, "/tables", alice, "", nil)
+	if json.NewDecoder(w.Body).Decode(&listed) != nil || len(listed) != 2 {
+		t.Fatalf("players must not see GM-only tables: %s", w.Body.String())
+	}
+	if w := do(http.MethodGet, "/tables/"+encounters.ID, alice, "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a hidden table, got %d", w.Code)
+	}
+	if w := doJSON(http.MethodPost, "/dice/roll", alice, map[string]string{"table": encounters.ID}); w.Code != http.StatusBadRequest {
+		t.Fatalf("players must not roll GM-only tables, got %d", w.Code)
+	}
+
+	// Only rolls made after fetching a commitment verify.
+	doJSON(http.MethodGet, "/dice/commitment", gm, nil)
+	w = doJSON(http.MethodPost, "/dice/roll", gm, map[string]string{"table": encounters.ID})
+	var entry diceLogEntry
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&entry) != nil {
+		t.Fatalf("roll table: %d %s", w.Code, w.Body.String())
+	}
+	if entry.System != tableSystemName || entry.Label != "Encounters" || entry.Visibility != DiceVisibilityGM || entry.Rule.Text == "" {
+		t.Fatalf("unexpected table roll: %+v", entry)
+	}
+	if strings.Contains(entry.Rule.Text, "[[") || len(entry.Spec.Tables) != 2 {
+		t.Fatalf("reference was not expanded: %q %+v", entry.Rule.Text, entry.Spec)
+	}
+	w = do(http.MethodGet, "/dice/"+entry.ID+"/verify", gm, "", nil)
+	var v diceVerification
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&v) != nil || !v.Verified {
+		t.Fatalf("verify table roll: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := doJSON(http.MethodPatch, "/tables/"+namesTable.ID, gm, map[string]any{"dice": "1d2", "entries": []TableEntry{{Min: 1, Text: "Cid"}, {Min: 2, Text: "Dag"}}}); w.Code != http.StatusOK {
+		t.Fatalf("update table: %d %s", w.Code, w.Body.String())
+	}
+	// Encounters draws names, so names must not draw encounters.
+	loop := map[string]any{"entries": []TableEntry{{Min: 1, Text: "[[Encounters]]"}, {Min: 2, Text: "Dag"}}}
+	if w := doJSON(http.MethodPatch, "/tables/"+namesTable.ID, gm, loop); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "loop") {
+		t.Fatalf("expected 400 for tables referencing each other, got %d %s", w.Code, w.Body.String())
+	}
+	self := map[string]any{"name": "Mirror", "entries": []TableEntry{{Text: "a [[mirror]]"}}}
+	if w := doJSON(http.MethodPost, "/tables", gm, self); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "references itself") {
+		t.Fatalf("expected 400 for a table referencing itself, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodDelete, "/tables/"+namesTable.ID, gm, "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete table: %d", w.Code)
+	}
+}
+
+func TestRollTableOverWebsocket(t *testing.T) {
+	app := newTestServer(t, t.TempDir())
+	router := app.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	table, err := app.storeRandomTable(RandomTable{RoomID: room.ID, Name: "Weather", Entries: []TableEntry{{Text: "Rain", Weight: 1}, {Text: "Sun", Weight: 1}}})
+	if err != nil {
+		t.Fatalf("store table: %v", err)
+	}
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(gm.Token), nil)
+	defer conn.Close()
+
+	msg, _ := json.Marshal(map[string]any{"type": "RollTable", "payload": map[string]string{"tableId": table.ID}})
+	if err := writeFrame(conn, 0x1, msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var entry diceLogEntry
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "DiceLogEntry"), &entry); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if entry.Label != "Weather" || (entry.Rule.Text != "Rain" && entry.Rule.Text != "Sun") {
+		t.Fatalf("unexpected table roll: %+v", entry)
+	}
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"vtrpg/internal/dice"
+)
+
+const (
+	defaultRollRequestTimeout = 2 * time.Minute
+	maxRollRequestTimeout     = time.Hour
+)
+
+// rollRequestCommand is the payload of the GM's RollRequest WebSocket command.
+type rollRequestCommand struct {
+	PlayerIDs      []string       `json:"playerIds"`
+	Expression     string         `json:"expression"`
+	Label          string         `json:"label"`
+	Visibility     DiceVisibility `json:"visibility"`
+	TimeoutSeconds int            `json:"timeoutSeconds"`
+}
+
+// rollRequest is a GM request for a set of players to roll. Requests live in
+// memory until every target has answered or the request times out; the
+// answers themselves are ordinary dice logs carrying the request ID.
+type rollRequest struct {
+	ID          string
+	RoomID      string
+	Expression  string
+	Label       string
+	Visibility  DiceVisibility
+	RequestedBy string
+	ExpiresAt   time.Time
+	Responses   []rollRequestResponse
+	timer       *time.Timer
+}
+
+// rollRequestResponse tracks one targeted player. pending is set while their
+// answer is being rolled so a second answer cannot slip in.
+type rollRequestResponse struct {
+	PlayerID string `json:"playerId"`
+	Name     string `json:"name"`
+	Answered bool   `json:"answered"`
+	RollID   string `json:"rollId,omitempty"`
+	Total    int    `json:"total"`
+	Results  []int  `json:"results,omitempty"`
+	pending  bool
+}
+
+// rollRequestPrompt is the RollRequest message delivered to the targets.
+type rollRequestPrompt struct {
+	ID          string         `json:"id"`
+	Expression  string         `json:"expression"`
+	Label       string         `json:"label,omitempty"`
+	Visibility  DiceVisibility `json:"visibility"`
+	RequestedBy string         `json:"requestedBy"`
+	ExpiresAt   time.Time      `json:"expiresAt"`
+}
+
+// rollRequestStatus is the RollRequestStatus summary pushed to the GM.
+type rollRequestStatus struct {
+	rollRequestPrompt
+	Answered  int                   `json:"answered"`
+	Targets   int                   `json:"targets"`
+	Done      bool                  `json:"done"`
+	TimedOut  bool                  `json:"timedOut"`
+	Responses []rollRequestResponse `json:"responses"`
+}
+
+func (req *rollRequest) prompt() rollRequestPrompt {
+	return rollRequestPrompt{
+		ID:          req.ID,
+		Expression:  req.Expression,
+		Label:       req.Label,
+		Visibility:  req.Visibility,
+		RequestedBy: req.RequestedBy,
+		ExpiresAt:   req.ExpiresAt,
+	}
+}
+
+// status snapshots the request; callers hold rollRequestsMu.
+func (req *rollRequest) status() rollRequestStatus {
+	status := rollRequestStatus{
+		rollRequestPrompt: req.prompt(),
+		Targets:           len(req.Responses),
+		Responses:         slices.Clone(req.Responses),
+	}
+	for _, response := range req.Responses {
+		if response.Answered {
+			status.Answered++
+		}
+	}
+	status.Done = status.Answered == status.Targets
+	return status
+}
+
+func (req *rollRequest) response(playerID string) *rollRequestResponse {
+	for i := range req.Responses {
+		if req.Responses[i].PlayerID == playerID {
+			return &req.Responses[i]
+		}
+	}
+	return nil
+}
+
+// createRollRequest validates the GM's command, registers the request and
+// delivers it to the targeted players' sockets.
+func (s *Server) createRollRequest(roomID string, gm clientProfile, cmd rollRequestCommand) (rollRequestStatus, error) {
+	if !isGMProfile(gm) {
+		return rollRequestStatus{}, fmt.Errorf("%w: only the GM can request rolls", errInvalidRoll)
+	}
+	expr, err := dice.Parse(cmd.Expression)
+	if err != nil {
+		return rollRequestStatus{}, err
+	}
+	label, ok := normalizeDiceLabel(cmd.Label)
+	if !ok {
+		return rollRequestStatus{}, fmt.Errorf("%w: label must be at most %d characters", errInvalidRoll, maxDiceLabelLength)
+	}
+	switch cmd.Visibility {
+	case "":
+		cmd.Visibility = DiceVisibilityPublic
+	case DiceVisibilityPublic, DiceVisibilityGM, DiceVisibilityBlind:
+	default:
+		return rollRequestStatus{}, fmt.Errorf("%w: roll requests cannot use visibility %q", errInvalidRoll, cmd.Visibility)
+	}
+	timeout := defaultRollRequestTimeout
+	if cmd.TimeoutSeconds != 0 {
+		// Check the seconds before converting, so huge values cannot overflow.
+		if cmd.TimeoutSeconds < 0 || cmd.TimeoutSeconds > int(maxRollRequestTimeout/time.Second) {
+			return rollRequestStatus{}, fmt.Errorf("%w: timeout must be at most %s", errInvalidRoll, maxRollRequestTimeout)
+		}
+		timeout = time.Duration(cmd.TimeoutSeconds) * time.Second
+	}
+	if len(cmd.PlayerIDs) == 0 {
+		return rollRequestStatus{}, fmt.Errorf("%w: a roll request needs at least one player", errInvalidRoll)
+	}
+
+	req := &rollRequest{
+		ID:          s.newID(),
+		RoomID:      roomID,
+		Expression:  expr.String(),
+		Label:       label,
+		Visibility:  cmd.Visibility,
+		RequestedBy: gm.Name,
+		ExpiresAt:   time.Now().UTC().Add(timeout),
+	}
+	targets := make([]string, 0, len(cmd.PlayerIDs))
+	for _, id := range cmd.PlayerIDs {
+		player, ok, err := s.getPlayer(roomID, id)
+		if err != nil {
+			return rollRequestStatus{}, err
+		}
+		if !ok {
+			return rollRequestStatus{}, fmt.Errorf("%w: unknown player %q", errInvalidRoll, id)
+		}
+		if slices.Contains(targets, player.ID) {
+			continue
+		}
+		targets = append(targets, player.ID)
+		req.Responses = append(req.Responses, rollRequestResponse{PlayerID: player.ID, Name: player.Name})
+	}
+
+	s.rollRequestsMu.Lock()
+	s.rollRequests[req.ID] = req
+	status := req.status()
+	req.timer = time.AfterFunc(timeout, func() { s.expireRollRequest(req.ID) })
+	s.rollRequestsMu.Unlock()
+
+	payload, err := json.Marshal(map[string]any{
+		"type":    "RollRequest",
+		"payload": req.prompt(),
+	})
+	if err != nil {
+		return rollRequestStatus{}, err
+	}
+	s.broadcastWhere(roomID, payload, func(profile clientProfile) bool {
+		return slices.Contains(targets, profile.ID)
+	})
+	s.sendRollRequestStatus(roomID, status)
+	return status, nil
+}
+
+// claimRollRequest reserves the player's answer to a request and returns the
+// roll they must make. Errors wrap errInvalidRoll.
+func (s *Server) claimRollRequest(roomID, requestID, playerID string) (rollRequestPrompt, error) {
+	s.rollRequestsMu.Lock()
+	defer s.rollRequestsMu.Unlock()
+
+	req, ok := s.rollRequests[requestID]
+	if !ok || req.RoomID != roomID {
+		return rollRequestPrompt{}, fmt.Errorf("%w: roll request %q is not open", errInvalidRoll, requestID)
+	}
+	response := req.response(playerID)
+	if response == nil {
+		return rollRequestPrompt{}, fmt.Errorf("%w: roll request %q was not sent to you", errInvalidRoll, requestID)
+	}
+	if response.Answered || response.pending {
+		return rollRequestPrompt{}, fmt.Errorf("%w: roll request %q was already answered", errInvalidRoll, requestID)
+	}
+	response.pending = true
+	return req.prompt(), nil
+}
+
+// releaseRollRequest undoes claimRollRequest after a failed roll.
+func (s *Server) releaseRollRequest(requestID, playerID string) {
+	s.rollRequestsMu.Lock()
+	defer s.rollRequestsMu.Unlock()
+	if req, ok := s.rollRequests[requestID]; ok {
+		if response := req.response(playerID); response != nil {
+			response.pending = false
+		}
+	}
+}
+
+// answerRollRequest records the player's logged roll and updates the GM. The
+// request closes once every target has answered.
+func (s *Server) answerRollRequest(requestID, playerID string, entry diceLogEntry) {
+	s.rollRequestsMu.Lock()
+	req, ok := s.rollRequests[requestID]
+	if !ok {
+		// The request timed out while the answer was being rolled.
+		s.rollRequestsMu.Unlock()
+		return
+	}
+	if response := req.response(playerID); response != nil {
+		response.pending = false
+		response.Answered = true
+		response.RollID = entry.ID
+		response.Total = entry.Total
+		response.Results = entry.Results
+	}
+	status := req.status()
+	if status.Done {
+		req.timer.Stop()
+		delete(s.rollRequests, requestID)
+	}
+	s.rollRequestsMu.Unlock()
+
+	s.sendRollRequestStatus(req.RoomID, status)
+}
+
+// expireRollRequest closes a request that was not fully answered in time.
+func (s *Server) expireRollRequest(requestID string) {
+	s.rollRequestsMu.Lock()
+	req, ok := s.rollRequests[requestID]
+	if !ok {
+		s.rollRequestsMu.Unlock()
+		return
+	}
+	delete(s.rollRequests, requestID)
+	status := req.status()
+	status.TimedOut = !status.Done
+	status.Done = true
+	s.rollRequestsMu.Unlock()
+
+	s.sendRollRequestStatus(req.RoomID, status)
+}
+
+// sendRollRequestStatus pushes the status of a request to the GM's sockets.
+func (s *Server) sendRollRequestStatus(roomID string, status rollRequestStatus) {
+	payload, err := json.Marshal(map[string]any{
+		"type":    "RollRequestStatus",
+		"payload": status,
+	})
+	if err != nil {
+		s.logger.Error("marshal roll request status", slog.String("error", err.Error()))
+		return
+	}
+	s.broadcastWhere(roomID, payload, isGMProfile)
+}
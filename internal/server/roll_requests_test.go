@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRollRequests(t *testing.T) {
+	app := newTestServer(t, t.TempDir())
+	router := app.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+	bob := joinRoomForTest(t, router, room, "Bob", RolePlayer)
+	carol := joinRoomForTest(t, router, room, "Carol", RolePlayer)
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	dial := func(player Player) net.Conn {
+		return dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(player.Token), nil)
+	}
+	gmConn, aliceConn, bobConn, carolConn := dial(gm), dial(alice), dial(bob), dial(carol)
+	send := func(conn net.Conn, msgType string, payload any) {
+		t.Helper()
+		message, _ := json.Marshal(map[string]any{"type": msgType, "payload": payload})
+		if err := writeFrame(conn, 0x1, message); err != nil {
+			t.Fatalf("send %s: %v", msgType, err)
+		}
+	}
+	readStatus := func() rollRequestStatus {
+		t.Helper()
+		var status rollRequestStatus
+		_ = json.Unmarshal(readWSMessageForTest(t, gmConn, "RollRequestStatus"), &status)
+		return status
+	}
+
+	send(gmConn, "RollRequest", map[string]any{
+		"playerIds":  []string{alice.ID, bob.ID},
+		"expression": "1d20+2",
+		"label":      "Perception",
+	})
+	var prompt rollRequestPrompt
+	_ = json.Unmarshal(readWSMessageForTest(t, aliceConn, "RollRequest"), &prompt)
+	if prompt.ID == "" || prompt.Expression != "1d20+2" || prompt.Label != "Perception" || prompt.RequestedBy != "Test Creator" {
+		t.Fatalf("unexpected prompt: %+v", prompt)
+	}
+	_ = readWSMessageForTest(t, bobConn, "RollRequest")
+	if status := readStatus(); status.Targets != 2 || status.Answered != 0 || status.Done {
+		t.Fatalf("unexpected initial status: %+v", status)
+	}
+
+	// The request decides the expression, whatever the player sends.
+	send(aliceConn, "RollDice", map[string]any{"requestId": prompt.ID, "expression": "1d20+20"})
+	var entry diceLogEntry
+	_ = json.Unmarshal(readWSMessageForTest(t, aliceConn, "DiceLogEntry"), &entry)
+	if entry.RequestID != prompt.ID || entry.Expression != "1d20+2" || entry.Label != "Perception" {
+		t.Fatalf("answer not linked to the request: %+v", entry)
+	}
+	status := readStatus()
+	if status.Answered != 1 || !status.Responses[0].Answered || status.Responses[0].RollID != entry.ID || status.Responses[0].Total != entry.Total {
+		t.Fatalf("unexpected status after Alice: %+v", status)
+	}
+
+	// Carol was not asked and Alice cannot answer twice.
+	roller := clientProfile{ID: carol.ID, Name: carol.Name, Role: string(RolePlayer)}
+	if _, err := app.rollDice(room.ID, roller, diceRollRequest{RequestID: prompt.ID}); !errors.Is(err, errInvalidRoll) {
+		t.Fatalf("expected Carol's answer to be rejected, got %v", err)
+	}
+	roller = clientProfile{ID: alice.ID, Name: alice.Name, Role: string(RolePlayer)}
+	if _, err := app.rollDice(room.ID, roller, diceRollRequest{RequestID: prompt.ID}); !errors.Is(err, errInvalidRoll) {
+		t.Fatalf("expected Alice's second answer to be rejected, got %v", err)
+	}
+
+	send(bobConn, "RollDice", map[string]any{"requestId": prompt.ID})
+	if status := readStatus(); !status.Done || status.TimedOut || status.Answered != 2 {
+		t.Fatalf("expected the request to complete: %+v", status)
+	}
+	app.rollRequestsMu.Lock()
+	_, open := app.rollRequests[prompt.ID]
+	app.rollRequestsMu.Unlock()
+	if open {
+		t.Fatalf("completed request should be forgotten")
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		created, err := app.createRollRequest(room.ID, clientProfile{ID: gm.ID, Name: gm.Name, Role: string(RoleGM)}, rollRequestCommand{
+			PlayerIDs:  []string{carol.ID},
+			Expression: "1d20",
+		})
+		if err != nil {
+			t.Fatalf("create roll request: %v", err)
+		}
+		_ = readWSMessageForTest(t, carolConn, "RollRequest")
+		_ = readStatus()
+
+		app.expireRollRequest(created.ID)
+		if status := readStatus(); !status.Done || !status.TimedOut || status.Answered != 0 {
+			t.Fatalf("expected a timed out status: %+v", status)
+		}
+		roller := clientProfile{ID: carol.ID, Name: carol.Name, Role: string(RolePlayer)}
+		if _, err := app.rollDice(room.ID, roller, diceRollRequest{RequestID: created.ID}); !errors.Is(err, errInvalidRoll) {
+			t.Fatalf("expected a late answer to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		player := clientProfile{ID: alice.ID, Name: alice.Name, Role: string(RolePlayer)}
+		if _, err := app.createRollRequest(room.ID, player, rollRequestCommand{PlayerIDs: []string{bob.ID}, Expression: "1d20"}); !errors.Is(err, errInvalidRoll) {
+			t.Fatalf("players must not request rolls, got %v", err)
+		}
+		gmProfile := clientProfile{ID: gm.ID, Name: gm.Name, Role: string(RoleGM)}
+		for _, cmd := range []rollRequestCommand{
+			{Expression: "1d20"},
+			{PlayerIDs: []string{"nobody"}, Expression: "1d20"},
+			{PlayerIDs: []string{bob.ID}, Expression: "1d20", Visibility: DiceVisibilityWhisper},
+			{PlayerIDs: []string{bob.ID}, Expression: "1d20", TimeoutSeconds: 7200},
+			// As a duration, this would wrap around to about two seconds.
+			{PlayerIDs: []string{bob.ID}, Expression: "1d20", TimeoutSeconds: math.MaxInt64/1000 + 3},
+		} {
+			if _, err := app.createRollRequest(room.ID, gmProfile, cmd); !errors.Is(err, errInvalidRoll) {
+				t.Fatalf("expected %+v to be rejected, got %v", cmd, err)
+			}
+		}
+	})
+}
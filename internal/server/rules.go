@@ -0,0 +1,364 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"vtrpg/internal/dice"
+)
+
+// RollSpec describes a roll for a RuleSystem. Each system reads the fields it
+// needs: the generic system an Expression, Year Zero the Base, Skill and Gear
+// pools, roll-under a Target with Boons and Banes, custom dice the Dice and
+// random tables the Tables.
+type RollSpec struct {
+	Expression string `json:"expression,omitempty"`
+	Base       int    `json:"base,omitempty"`
+	Skill      int    `json:"skill,omitempty"`
+	Gear       int    `json:"gear,omitempty"`
+	Target     int    `json:"target,omitempty"`
+	Boons      int    `json:"boons,omitempty"`
+	Banes      int    `json:"banes,omitempty"`
+	// Dice are the custom dice of a custom dice roll.
+	Dice []CustomDice `json:"dice,omitempty"`
+	// Tables are the tables of a table roll: the rolled table first, then
+	// every table it references.
+	Tables []TableSpec `json:"tables,omitempty"`
+}
+
+// RuleDie is one die of a rule system roll. Rerolled marks a die rolled again
+// by a push; Dropped marks a die that does not count.
+type RuleDie struct {
+	Pool     string `json:"pool,omitempty"`
+	Sides    int    `json:"sides"`
+	Value    int    `json:"value"`
+	Rerolled bool   `json:"rerolled,omitempty"`
+	Dropped  bool   `json:"dropped,omitempty"`
+	// Face is the face ID rolled on a custom die.
+	Face string `json:"face,omitempty"`
+}
+
+// RuleResult is a roll as interpreted by a rule system.
+type RuleResult struct {
+	Notation      string    `json:"notation"`
+	Dice          []RuleDie `json:"dice"`
+	Total         int       `json:"total"`
+	Successes     int       `json:"successes"`
+	Complications int       `json:"complications"`
+	Outcome       string    `json:"outcome,omitempty"`
+	Pushed        bool      `json:"pushed,omitempty"`
+	// Symbols totals the symbols on the faces of custom dice.
+	Symbols map[string]int `json:"symbols,omitempty"`
+	// Text is the drawn entry of a table roll with its references expanded,
+	// and Draws lists every draw that went into it.
+	Text  string      `json:"text,omitempty"`
+	Draws []TableDraw `json:"draws,omitempty"`
+	// Breakdown is the expression breakdown of generic rolls.
+	Breakdown *dice.Result `json:"-"`
+}
+
+// Values returns the face value of every die, in roll order.
+func (r RuleResult) Values() []int {
+	values := make([]int, len(r.Dice))
+	for i, die := range r.Dice {
+		values[i] = die.Value
+	}
+	return values
+}
+
+// Sides returns the number of sides of every die, aligned with Values.
+func (r RuleResult) Sides() []int {
+	sides := make([]int, len(r.Dice))
+	for i, die := range r.Dice {
+		sides[i] = die.Sides
+	}
+	return sides
+}
+
+// Faces returns the face ID of every die, aligned with Values, or nil when no
+// die has named faces.
+func (r RuleResult) Faces() []string {
+	var faces []string
+	for i, die := range r.Dice {
+		if die.Face == "" {
+			continue
+		}
+		if faces == nil {
+			faces = make([]string, len(r.Dice))
+		}
+		faces[i] = die.Face
+	}
+	return faces
+}
+
+// RuleSystem rolls dice the way a game system does. Validate and CanPush are
+// called before any randomness is drawn, so Roll and Push cannot fail.
+type RuleSystem interface {
+	Name() string
+	// Validate reports whether spec is a roll the system can make. Errors
+	// wrap errInvalidRoll or are a *dice.SyntaxError.
+	Validate(spec RollSpec) error
+	Roll(spec RollSpec, rng dice.RNG) RuleResult
+	// CanPush reports whether a previous roll may be pushed or rerolled.
+	CanPush(previous RuleResult) error
+	Push(spec RollSpec, previous RuleResult, rng dice.RNG) RuleResult
+}
+
+const defaultRuleSystem = "generic"
+
+// ruleSystems are the systems a room can roll its specs with.
+var ruleSystems = map[string]RuleSystem{
+	"generic":   genericSystem{},
+	"yearzero":  yearZeroSystem{},
+	"rollunder": rollUnderSystem{},
+}
+
+// ruleSystemByName looks up the system that made a roll. Rolls logged before
+// rule systems existed have no system and count as generic; custom dice and
+// table rolls are made by their own systems whatever the room's system is.
+func ruleSystemByName(name string) (RuleSystem, bool) {
+	switch name {
+	case "":
+		name = defaultRuleSystem
+	case customDiceSystemName:
+		return customDiceSystem{}, true
+	case tableSystemName:
+		return tableSystem{}, true
+	}
+	system, ok := ruleSystems[name]
+	return system, ok
+}
+
+func ruleSystemNames() []string {
+	names := make([]string, 0, len(ruleSystems))
+	for name := range ruleSystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// genericSystem rolls dice expressions and sums them. A reroll rolls the
+// whole expression again.
+type genericSystem struct{}
+
+func (genericSystem) Name() string { return "generic" }
+
+func (genericSystem) Validate(spec RollSpec) error {
+	_, err := dice.Parse(spec.Expression)
+	return err
+}
+
+func (genericSystem) Roll(spec RollSpec, rng dice.RNG) RuleResult {
+	expr, err := dice.Parse(spec.Expression)
+	if err != nil {
+		return RuleResult{}
+	}
+	result := dice.Evaluate(expr, rng)
+	rolled := RuleResult{Notation: result.Expression, Total: result.Total, Breakdown: &result, Dice: []RuleDie{}}
+	for _, term := range result.Terms {
+		for _, die := range term.Dice {
+			rolled.Dice = append(rolled.Dice, RuleDie{Sides: term.Sides, Value: die.Value, Dropped: die.Dropped})
+		}
+	}
+	return rolled
+}
+
+func (genericSystem) CanPush(RuleResult) error { return nil }
+
+func (g genericSystem) Push(spec RollSpec, _ RuleResult, rng dice.RNG) RuleResult {
+	result := g.Roll(spec, rng)
+	result.Pushed = true
+	return result
+}
+
+// yearZeroSystem rolls Year Zero Engine pools of d6: every 6 is a success and
+// 1s on base and gear dice are complications (attribute and gear damage). A
+// roll can be pushed once, rerolling every die that shows neither a 6 nor a
+// 1 on a base or gear die.
+type yearZeroSystem struct{}
+
+const (
+	yearZeroBase  = "base"
+	yearZeroSkill = "skill"
+	yearZeroGear  = "gear"
+)
+
+func (yearZeroSystem) Name() string { return "yearzero" }
+
+func (yearZeroSystem) Validate(spec RollSpec) error {
+	if spec.Base < 0 || spec.Skill < 0 || spec.Gear < 0 {
+		return fmt.Errorf("%w: pools cannot be negative", errInvalidRoll)
+	}
+	if n := spec.Base + spec.Skill + spec.Gear; n < 1 || n > maxDiceCount {
+		return fmt.Errorf("%w: a pool needs 1-%d dice", errInvalidRoll, maxDiceCount)
+	}
+	return nil
+}
+
+func (y yearZeroSystem) Roll(spec RollSpec, rng dice.RNG) RuleResult {
+	result := RuleResult{Notation: yearZeroNotation(spec)}
+	for _, pool := range []struct {
+		name  string
+		count int
+	}{{yearZeroBase, spec.Base}, {yearZeroSkill, spec.Skill}, {yearZeroGear, spec.Gear}} {
+		for i := 0; i < pool.count; i++ {
+			result.Dice = append(result.Dice, RuleDie{Pool: pool.name, Sides: 6, Value: rollRuleDie(rng, 6)})
+		}
+	}
+	y.score(&result)
+	return result
+}
+
+func (yearZeroSystem) CanPush(previous RuleResult) error {
+	if previous.Pushed {
+		return fmt.Errorf("%w: a roll can only be pushed once", errInvalidRoll)
+	}
+	return nil
+}
+
+func (y yearZeroSystem) Push(_ RollSpec, previous RuleResult, rng dice.RNG) RuleResult {
+	result := RuleResult{Notation: previous.Notation, Pushed: true, Dice: make([]RuleDie, len(previous.Dice))}
+	for i, die := range previous.Dice {
+		die.Rerolled = false
+		locked := die.Value == 6 || (die.Value == 1 && die.Pool != yearZeroSkill)
+		if !locked {
+			die.Value = rollRuleDie(rng, die.Sides)
+			die.Rerolled = true
+		}
+		result.Dice[i] = die
+	}
+	y.score(&result)
+	return result
+}
+
+func (yearZeroSystem) score(result *RuleResult) {
+	result.Successes, result.Complications = 0, 0
+	for _, die := range result.Dice {
+		switch {
+		case die.Value == 6:
+			result.Successes++
+		case die.Value == 1 && die.Pool != yearZeroSkill:
+			result.Complications++
+		}
+	}
+	result.Total = result.Successes
+	result.Outcome = "failure"
+	if result.Successes > 0 {
+		result.Outcome = "success"
+	}
+}
+
+func yearZeroNotation(spec RollSpec) string {
+	var parts []string
+	for _, pool := range []struct {
+		count  int
+		suffix string
+	}{{spec.Base, "B"}, {spec.Skill, "S"}, {spec.Gear, "G"}} {
+		if pool.count > 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", pool.count, pool.suffix))
+		}
+	}
+	return strings.Join(parts, "+")
+}
+
+// rollUnderSystem rolls a d20 that must not exceed the target, as in Drakar
+// och Demoner. A 1 is a dragon (a critical success) and a 20 a demon (a
+// critical failure and a complication). Each net boon rolls an extra d20 and
+// keeps the lowest; each net bane keeps the highest. A failed roll that is
+// not a demon can be pushed once; the push always costs one complication, the
+// condition the character takes.
+type rollUnderSystem struct{}
+
+const maxRollUnderExtraDice = 5
+
+func (rollUnderSystem) Name() string { return "rollunder" }
+
+func (rollUnderSystem) Validate(spec RollSpec) error {
+	if spec.Target < 1 || spec.Target > 20 {
+		return fmt.Errorf("%w: target must be between 1 and 20", errInvalidRoll)
+	}
+	if spec.Boons < 0 || spec.Banes < 0 || spec.Boons > maxRollUnderExtraDice || spec.Banes > maxRollUnderExtraDice {
+		return fmt.Errorf("%w: boons and banes must be between 0 and %d", errInvalidRoll, maxRollUnderExtraDice)
+	}
+	return nil
+}
+
+func (r rollUnderSystem) Roll(spec RollSpec, rng dice.RNG) RuleResult {
+	result := RuleResult{Notation: rollUnderNotation(spec)}
+	net := spec.Boons - spec.Banes
+	count := 1 + max(net, -net)
+	for i := 0; i < count; i++ {
+		result.Dice = append(result.Dice, RuleDie{Sides: 20, Value: rollRuleDie(rng, 20)})
+	}
+	r.score(&result, spec)
+	return result
+}
+
+func (rollUnderSystem) CanPush(previous RuleResult) error {
+	switch {
+	case previous.Pushed:
+		return fmt.Errorf("%w: a roll can only be pushed once", errInvalidRoll)
+	case previous.Outcome == "demon":
+		return fmt.Errorf("%w: a demon cannot be pushed", errInvalidRoll)
+	case previous.Successes > 0:
+		return fmt.Errorf("%w: only failed rolls can be pushed", errInvalidRoll)
+	}
+	return nil
+}
+
+func (r rollUnderSystem) Push(spec RollSpec, _ RuleResult, rng dice.RNG) RuleResult {
+	result := r.Roll(spec, rng)
+	for i := range result.Dice {
+		result.Dice[i].Rerolled = true
+	}
+	result.Pushed = true
+	result.Complications++
+	return result
+}
+
+// score keeps the best or worst die for boons and banes and grades it.
+func (rollUnderSystem) score(result *RuleResult, spec RollSpec) {
+	kept := 0
+	for i, die := range result.Dice {
+		better := die.Value < result.Dice[kept].Value
+		if spec.Banes > spec.Boons {
+			better = die.Value > result.Dice[kept].Value
+		}
+		if better {
+			kept = i
+		}
+	}
+	for i := range result.Dice {
+		result.Dice[i].Dropped = i != kept
+	}
+
+	value := result.Dice[kept].Value
+	result.Total = value
+	switch {
+	case value == 1:
+		result.Outcome, result.Successes = "dragon", 1
+	case value == 20:
+		result.Outcome, result.Complications = "demon", 1
+	case value <= spec.Target:
+		result.Outcome, result.Successes = "success", 1
+	default:
+		result.Outcome = "failure"
+	}
+}
+
+func rollUnderNotation(spec RollSpec) string {
+	notation := fmt.Sprintf("d20<=%d", spec.Target)
+	if net := spec.Boons - spec.Banes; net > 0 {
+		notation += fmt.Sprintf(" +%d boon", net)
+	} else if net < 0 {
+		notation += fmt.Sprintf(" +%d bane", -net)
+	}
+	return notation
+}
+
+// rollRuleDie draws a die the same way dice.Evaluate does.
+func rollRuleDie(rng dice.RNG, sides int) int {
+	return min(int(rng.Float64()*float64(sides))+1, sides)
+}
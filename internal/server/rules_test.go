@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// faces is a dice.RNG that rolls the given faces on dice with the given sides.
+type faces struct {
+	sides  int
+	values []int
+}
+
+func (f *faces) Float64() float64 {
+	v := f.values[0]
+	f.values = f.values[1:]
+	return (float64(v) - 0.5) / float64(f.sides)
+}
+
+func TestYearZeroPush(t *testing.T) {
+	system := yearZeroSystem{}
+	spec := RollSpec{Base: 2, Skill: 2, Gear: 1}
+	if err := system.Validate(spec); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	rolled := system.Roll(spec, &faces{sides: 6, values: []int{6, 1, 1, 3, 4}})
+	if rolled.Notation != "2B+2S+1G" || rolled.Successes != 1 || rolled.Complications != 1 || rolled.Outcome != "success" {
+		t.Fatalf("unexpected roll: %+v", rolled)
+	}
+
+	// The base 6 and base 1 are locked; the skill 1, skill 3 and gear 4 are rerolled.
+	pushed := system.Push(spec, rolled, &faces{sides: 6, values: []int{6, 2, 1}})
+	if got := pushed.Values(); !slices.Equal(got, []int{6, 1, 6, 2, 1}) {
+		t.Fatalf("pushed values = %v", got)
+	}
+	if !pushed.Pushed || pushed.Successes != 2 || pushed.Complications != 2 || pushed.Total != 2 {
+		t.Fatalf("unexpected push: %+v", pushed)
+	}
+	if pushed.Dice[0].Rerolled || pushed.Dice[1].Rerolled || !pushed.Dice[2].Rerolled {
+		t.Fatalf("wrong dice marked as rerolled: %+v", pushed.Dice)
+	}
+	if err := system.CanPush(pushed); err == nil {
+		t.Fatal("a pushed roll must not be pushed again")
+	}
+	if err := system.Validate(RollSpec{}); err == nil {
+		t.Fatal("an empty pool must be rejected")
+	}
+}
+
+func TestRollUnderOutcomes(t *testing.T) {
+	system := rollUnderSystem{}
+	cases := []struct {
+		name    string
+		spec    RollSpec
+		faces   []int
+		total   int
+		outcome string
+		canPush bool
+	}{
+		{"success", RollSpec{Target: 12}, []int{12}, 12, "success", false},
+		{"failure", RollSpec{Target: 12}, []int{13}, 13, "failure", true},
+		{"dragon", RollSpec{Target: 5}, []int{1}, 1, "dragon", false},
+		{"demon", RollSpec{Target: 15}, []int{20}, 20, "demon", false},
+		{"boon keeps lowest", RollSpec{Target: 10, Boons: 1}, []int{15, 4}, 4, "success", false},
+		{"bane keeps highest", RollSpec{Target: 10, Banes: 2, Boons: 1}, []int{4, 15}, 15, "failure", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := system.Validate(tc.spec); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			result := system.Roll(tc.spec, &faces{sides: 20, values: tc.faces})
+			if result.Total != tc.total || result.Outcome != tc.outcome {
+				t.Fatalf("got %d %s, want %d %s", result.Total, result.Outcome, tc.total, tc.outcome)
+			}
+			if got := system.CanPush(result) == nil; got != tc.canPush {
+				t.Fatalf("CanPush = %v, want %v", got, tc.canPush)
+			}
+		})
+	}
+
+	pushed := system.Push(RollSpec{Target: 12}, RuleResult{}, &faces{sides: 20, values: []int{3}})
+	if !pushed.Pushed || pushed.Outcome != "success" || pushed.Complications != 1 {
+		t.Fatalf("a push must cost a complication: %+v", pushed)
+	}
+	if err := system.Validate(RollSpec{Target: 21}); err == nil {
+		t.Fatal("a target above 20 must be rejected")
+	}
+}
+
+func TestRoomRuleSystem(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+	bob := joinRoomForTest(t, router, room, "Bob", RolePlayer)
+
+	do := func(method, path string, player Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		_ = json.NewEncoder(&body).Encode(payload)
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, &body)
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	roll := func(player Player, payload any) (diceLogEntry, int) {
+		t.Helper()
+		w := do(http.MethodPost, "/dice/roll", player, payload)
+		var entry diceLogEntry
+		_ = json.NewDecoder(w.Body).Decode(&entry)
+		return entry, w.Code
+	}
+
+	if w := do(http.MethodPatch, "", alice, map[string]string{"theme": "nord", "ruleSystem": "yearzero"}); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"error"`) {
+		t.Fatalf("players must not change the rule system, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPatch, "", gm, map[string]string{"theme": "nord", "ruleSystem": "gurps"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown rule system, got %d", w.Code)
+	}
+	if stored, err := srv.getRoomByID(room.ID); err != nil || stored.Theme != ThemeDefault {
+		t.Fatalf("a rejected update must change nothing: %v %+v", err, stored)
+	}
+	w := do(http.MethodPatch, "", gm, map[string]string{"ruleSystem": "yearzero"})
+	var updated Room
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&updated) != nil || updated.RuleSystem != "yearzero" {
+		t.Fatalf("update rule system: %d %s", w.Code, w.Body.String())
+	}
+
+	if _, code := roll(alice, map[string]any{"spec": RollSpec{}}); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty pool, got %d", code)
+	}
+	original, code := roll(alice, map[string]any{"spec": RollSpec{Base: 3, Skill: 2}, "label": "Force", "visibility": "gm"})
+	if code != http.StatusCreated || original.System != "yearzero" || original.Rule == nil || len(original.Results) != 5 || original.Expression != "3B+2S" {
+		t.Fatalf("pool roll: %d %+v", code, original)
+	}
+
+	if _, code := roll(bob, map[string]any{"push": original.ID}); code != http.StatusBadRequest {
+		t.Fatalf("only the roller may push, got %d", code)
+	}
+	pushed, code := roll(alice, map[string]any{"push": original.ID})
+	if code != http.StatusCreated || pushed.ParentID != original.ID || !pushed.Rule.Pushed {
+		t.Fatalf("push: %d %+v", code, pushed)
+	}
+	if pushed.Label != "Force" || pushed.Visibility != DiceVisibilityGM {
+		t.Fatalf("a push must keep the original label and audience: %+v", pushed)
+	}
+	for i, die := range original.Rule.Dice {
+		if (die.Value == 6 || (die.Value == 1 && die.Pool != yearZeroSkill)) && pushed.Results[i] != die.Value {
+			t.Fatalf("locked die %d changed: %v -> %v", i, original.Results, pushed.Results)
+		}
+	}
+	if _, code := roll(alice, map[string]any{"push": pushed.ID}); code != http.StatusBadRequest {
+		t.Fatalf("a pushed roll must not be pushed again, got %d", code)
+	}
+
+	w = do(http.MethodGet, "/dice/"+pushed.ID+"/verify", alice, nil)
+	var v diceVerification
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&v) != nil || !v.Verified {
+		t.Fatalf("verify push: %d %s", w.Code, w.Body.String())
+	}
+
+	plain, code := roll(alice, map[string]any{"expression": "1d20"})
+	if code != http.StatusCreated || plain.System != "generic" || plain.Rule != nil {
+		t.Fatalf("plain expressions stay generic: %d %+v", code, plain)
+	}
+	reroll, code := roll(alice, map[string]any{"push": plain.ID})
+	if code != http.StatusCreated || reroll.ParentID != plain.ID || reroll.Expression != "1d20" {
+		t.Fatalf("generic reroll: %d %+v", code, reroll)
+	}
+}
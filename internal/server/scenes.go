@@ -0,0 +1,526 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultSceneName   = "Main"
+	maxScenesPerRoom   = 100
+	maxSceneNameLength = 100
+)
+
+var (
+	errInvalidScene   = errors.New("invalid scene")
+	errSceneMissing   = errors.New("scene not found")
+	errSceneForbidden = errors.New("only the GM can see inactive scenes")
+	errSceneLimit     = errors.New("too many scenes")
+	errSceneActive    = errors.New("the active scene cannot be deleted")
+)
+
+const (
+	sceneColumns = `sc.id, sc.room_id, sc.name, sc.background, sc.grid_type, sc.grid_cell_size, sc.grid_offset_x, sc.grid_offset_y,
+	sc.grid_units_per_cell, sc.grid_unit, sc.grid_snap, sc.fog_enabled, sc.created_at, sc.id = r.active_scene_id`
+	sceneTables = `scenes sc JOIN rooms r ON r.id = sc.room_id`
+)
+
+func scanScene(row rowScanner) (Scene, error) {
+	var scene Scene
+	if err := row.Scan(&scene.ID, &scene.RoomID, &scene.Name, &scene.Background, &scene.Grid.Type, &scene.Grid.CellSize,
+		&scene.Grid.OffsetX, &scene.Grid.OffsetY, &scene.Grid.UnitsPerCell, &scene.Grid.Unit, &scene.Grid.Snap, &scene.Fog,
+		&scene.CreatedAt, &scene.Active); err != nil {
+		return Scene{}, err
+	}
+	scene.CreatedAt = scene.CreatedAt.UTC()
+	return scene, nil
+}
+
+func (s *Server) listScenes(roomID string) ([]Scene, error) {
+	rows, err := s.db.Query(`SELECT `+sceneColumns+` FROM `+sceneTables+` WHERE sc.room_id = ? ORDER BY sc.created_at, sc.id`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	scenes := make([]Scene, 0)
+	for rows.Next() {
+		scene, err := scanScene(rows)
+		if err != nil {
+			return nil, err
+		}
+		scenes = append(scenes, scene)
+	}
+	return scenes, rows.Err()
+}
+
+func (s *Server) getScene(roomID, sceneID string) (Scene, bool, error) {
+	scene, err := scanScene(s.db.QueryRow(`SELECT `+sceneColumns+` FROM `+sceneTables+` WHERE sc.id = ? AND sc.room_id = ?`, sceneID, roomID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Scene{}, false, nil
+	}
+	if err != nil {
+		return Scene{}, false, err
+	}
+	return scene, true, nil
+}
+
+// getActiveScene returns the scene players see. A room that has none yet,
+// because it was stored without one, gets its first scene here.
+func (s *Server) getActiveScene(roomID string) (Scene, error) {
+	query := `SELECT ` + sceneColumns + ` FROM ` + sceneTables + ` WHERE r.id = ? AND sc.id = r.active_scene_id`
+	scene, err := scanScene(s.db.QueryRow(query, roomID))
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := backfillScenes(s.db); err != nil {
+			return Scene{}, err
+		}
+		scene, err = scanScene(s.db.QueryRow(query, roomID))
+	}
+	return scene, err
+}
+
+// resolveScene returns the scene a request names, or the active scene when
+// sceneID is empty. Only the GM may name an inactive scene.
+func (s *Server) resolveScene(roomID, sceneID string, isGM bool) (Scene, error) {
+	if sceneID == "" {
+		return s.getActiveScene(roomID)
+	}
+	scene, found, err := s.getScene(roomID, sceneID)
+	if err != nil {
+		return Scene{}, err
+	}
+	if !found {
+		return Scene{}, errSceneMissing
+	}
+	if !scene.Active && !isGM {
+		return Scene{}, errSceneForbidden
+	}
+	return scene, nil
+}
+
+// writeSceneError writes the response for an error of a scene lookup or
+// change and reports whether there was none.
+func (s *Server) writeSceneError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errSceneMissing):
+		http.NotFound(w, r)
+	case errors.Is(err, errSceneForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errInvalidScene):
+		http.Error(w, strings.TrimPrefix(err.Error(), errInvalidScene.Error()+": "), http.StatusBadRequest)
+	case errors.Is(err, errSceneLimit), errors.Is(err, errSceneActive):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		s.logger.Error("scene", slog.String("error", err.Error()))
+		http.Error(w, "failed to load scene", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// insertScene stores a new scene within a transaction and fails with
+// errSceneLimit when the room ends up with more than maxScenesPerRoom.
+func insertScene(tx *sql.Tx, scene Scene) error {
+	grid := scene.Grid
+	if _, err := tx.Exec(
+		`INSERT INTO scenes (id, room_id, name, background, grid_type, grid_cell_size, grid_offset_x, grid_offset_y, grid_units_per_cell,
+			grid_unit, grid_snap, fog_enabled, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		scene.ID, scene.RoomID, scene.Name, scene.Background, grid.Type, grid.CellSize, grid.OffsetX, grid.OffsetY, grid.UnitsPerCell,
+		grid.Unit, grid.Snap, scene.Fog, scene.CreatedAt,
+	); err != nil {
+		return err
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM scenes WHERE room_id = ?`, scene.RoomID).Scan(&count); err != nil {
+		return err
+	}
+	if count > maxScenesPerRoom {
+		return fmt.Errorf("%w: a room holds at most %d scenes", errSceneLimit, maxScenesPerRoom)
+	}
+	return nil
+}
+
+func (s *Server) createScene(scene Scene) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if err := insertScene(tx, scene); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateScene(db execer, scene Scene) error {
+	grid := scene.Grid
+	_, err := db.Exec(
+		`UPDATE scenes SET name = ?, background = ?, grid_type = ?, grid_cell_size = ?, grid_offset_x = ?, grid_offset_y = ?,
+		grid_units_per_cell = ?, grid_unit = ?, grid_snap = ? WHERE id = ? AND room_id = ?`,
+		scene.Name, scene.Background, grid.Type, grid.CellSize, grid.OffsetX, grid.OffsetY, grid.UnitsPerCell, grid.Unit, grid.Snap,
+		scene.ID, scene.RoomID,
+	)
+	return err
+}
+
+// deleteScene removes an inactive scene with its images, walls, lights and
+// fog. Cards on the scene's canvas go to their discard piles, and initiative
+// entries lose their link to its images.
+func (s *Server) deleteScene(roomID, sceneID string) error {
+	images, err := s.getImages(roomID, sceneID, true)
+	if err != nil {
+		return err
+	}
+	// The tracker is saved whole, so it must not change while its entries are
+	// unlinked.
+	s.initiativeMu.Lock()
+	defer s.initiativeMu.Unlock()
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	result, err := tx.Exec(
+		`DELETE FROM scenes WHERE id = ? AND room_id = ? AND id != (SELECT active_scene_id FROM rooms WHERE id = ?)`,
+		sceneID, roomID, roomID,
+	)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		if err == nil {
+			err = errSceneActive
+		}
+		return err
+	}
+	const sceneImages = `(SELECT id FROM images WHERE room_id = ? AND scene_id = ?)`
+	decks, err := sceneCardDecks(tx, roomID, sceneID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`UPDATE deck_cards SET zone = ?, holder_id = '', image_id = '', position = ? WHERE room_id = ? AND zone = ? AND image_id IN `+sceneImages,
+		cardZoneDiscard, time.Now().UnixNano(), roomID, cardZoneTable, roomID, sceneID,
+	); err != nil {
+		return err
+	}
+	unlinked, err := tx.Exec(`UPDATE initiative_entries SET image_id = '' WHERE room_id = ? AND image_id IN `+sceneImages, roomID, roomID, sceneID)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"images", "walls", "lights"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE room_id = ? AND scene_id = ?`, roomID, sceneID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.forgetSceneSight(sceneID)
+	for _, img := range images {
+		s.deleteTargetEffects(roomID, effectTargetImage, img.ID, isGMProfile)
+		s.removeUnusedUpload(img.URL)
+	}
+	for _, deckID := range decks {
+		s.broadcastDeck(roomID, deckID)
+	}
+	if n, err := unlinked.RowsAffected(); err == nil && n > 0 {
+		if tracker, err := s.getInitiative(roomID); err != nil {
+			s.logger.Error("load initiative", slog.String("room", roomID), slog.String("error", err.Error()))
+		} else {
+			s.broadcastInitiative(roomID, tracker)
+		}
+	}
+	return nil
+}
+
+// sceneCardDecks returns the decks with cards on a scene's canvas.
+func sceneCardDecks(tx *sql.Tx, roomID, sceneID string) ([]string, error) {
+	rows, err := tx.Query(
+		`SELECT DISTINCT deck_id FROM deck_cards WHERE room_id = ? AND zone = ?
+		AND image_id IN (SELECT id FROM images WHERE room_id = ? AND scene_id = ?)`,
+		roomID, cardZoneTable, roomID, sceneID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var decks []string
+	for rows.Next() {
+		var deckID string
+		if err := rows.Scan(&deckID); err != nil {
+			return nil, err
+		}
+		decks = append(decks, deckID)
+	}
+	return decks, rows.Err()
+}
+
+// sceneAudience returns which sockets may hear about a scene's contents: the
+// whole room (nil) for the active scene and only the GM for the others.
+func (s *Server) sceneAudience(roomID, sceneID string) func(clientProfile) bool {
+	active, err := s.getActiveScene(roomID)
+	if err != nil {
+		s.logger.Error("load active scene", slog.String("room", roomID), slog.String("error", err.Error()))
+		return isGMProfile
+	}
+	if sceneID != active.ID {
+		return isGMProfile
+	}
+	return nil
+}
+
+// broadcastScene sends a message about a scene to its audience.
+func (s *Server) broadcastScene(roomID, sceneID, msgType string, payload any) {
+	data, err := json.Marshal(map[string]any{
+		"type":    msgType,
+		"payload": payload,
+	})
+	if err != nil {
+		s.logger.Error("marshal scene", slog.String("error", err.Error()))
+		return
+	}
+	if audience := s.sceneAudience(roomID, sceneID); audience != nil {
+		s.broadcastWhere(roomID, data, audience)
+		return
+	}
+	s.broadcast(roomID, data)
+}
+
+// activateScene makes a scene the one players see. Every socket is sent the
+// scene with the images, tokens and fog it can see there.
+func (s *Server) activateScene(roomID string, scene Scene) error {
+	s.viewMu.Lock()
+	defer s.viewMu.Unlock()
+	if _, err := s.db.Exec(`UPDATE rooms SET active_scene_id = ? WHERE id = ?`, scene.ID, roomID); err != nil {
+		return err
+	}
+	scene.Active = true
+	view, err := s.loadPlayerView(roomID)
+	if err != nil {
+		return err
+	}
+	images, err := s.getImages(roomID, scene.ID, true)
+	if err != nil {
+		return err
+	}
+	tokens, err := s.listTokens(roomID, scene.ID, true)
+	if err != nil {
+		return err
+	}
+	fog, err := s.getFog(scene.ID)
+	if err != nil {
+		return err
+	}
+
+	s.sendSceneActivated(roomID, isGMProfile, scene, images, tokens, fog)
+	sent := make(map[string]bool)
+	for _, profile := range s.connectedPlayers(roomID) {
+		if sent[profile.ID] {
+			continue
+		}
+		sent[profile.ID] = true
+		playerID := profile.ID
+		include := func(profile clientProfile) bool { return !isGMProfile(profile) && profile.ID == playerID }
+		s.sendSceneActivated(roomID, include, scene, view.visibleImages(playerID, images), view.visibleTokens(playerID, tokens), fog)
+		if view.vision {
+			s.sendVision(roomID, playerID, view)
+		}
+	}
+	return nil
+}
+
+func (s *Server) sendSceneActivated(roomID string, include func(clientProfile) bool, scene Scene, images []imageResponse, tokens []Token, fog Fog) {
+	payload, err := json.Marshal(map[string]any{
+		"type": "SceneActivated",
+		"payload": map[string]any{
+			"scene":  scene,
+			"images": images,
+			"tokens": tokens,
+			"fog":    fog,
+		},
+	})
+	if err != nil {
+		s.logger.Error("marshal scene", slog.String("error", err.Error()))
+		return
+	}
+	s.broadcastWhere(roomID, payload, include)
+}
+
+// sceneRequest holds the fields of a scene that can be set. Absent fields are
+// left unchanged; the grid may be given in part.
+type sceneRequest struct {
+	Name       *string         `json:"name"`
+	Background *string         `json:"background"`
+	Grid       json.RawMessage `json:"grid"`
+}
+
+func (req sceneRequest) apply(scene *Scene) error {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || utf8.RuneCountInString(name) > maxSceneNameLength {
+			return fmt.Errorf("%w: name must be 1-%d characters", errInvalidScene, maxSceneNameLength)
+		}
+		scene.Name = name
+	}
+	if req.Background != nil {
+		background := strings.TrimSpace(*req.Background)
+		if background != "" && !isValidImageURL(background) && !strings.HasPrefix(background, "/uploads/") {
+			return fmt.Errorf("%w: invalid background URL", errInvalidScene)
+		}
+		scene.Background = background
+	}
+	if req.Grid != nil {
+		grid, err := parseGridUpdate(scene.Grid, req.Grid)
+		if err != nil {
+			return fmt.Errorf("%w: %s", errInvalidScene, strings.TrimPrefix(err.Error(), errInvalidGrid.Error()+": "))
+		}
+		scene.Grid = grid
+	}
+	return nil
+}
+
+// handleScenes serves /rooms/{id}/scenes. The GM manages the scenes and
+// activates one with POST /rooms/{id}/scenes/{sceneId}/activate; players only
+// see the active scene.
+func (s *Server) handleScenes(w http.ResponseWriter, r *http.Request, roomID string, parts []string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	isGM := player.Role == RoleGM
+
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			scenes, err := s.listScenes(roomID)
+			if err != nil {
+				s.logger.Error("list scenes", slog.String("error", err.Error()))
+				http.Error(w, "failed to load scenes", http.StatusInternalServerError)
+				return
+			}
+			if !isGM {
+				active := make([]Scene, 0, 1)
+				for _, scene := range scenes {
+					if scene.Active {
+						active = append(active, scene)
+					}
+				}
+				scenes = active
+			}
+			writeJSON(w, http.StatusOK, scenes)
+		case http.MethodPost:
+			if !isGM {
+				http.Error(w, "only the GM can manage scenes", http.StatusForbidden)
+				return
+			}
+			var req sceneRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			if req.Name == nil {
+				http.Error(w, "name is required", http.StatusBadRequest)
+				return
+			}
+			scene := Scene{ID: s.newID(), RoomID: roomID, Grid: defaultGrid(), CreatedAt: time.Now().UTC()}
+			if err := req.apply(&scene); err != nil {
+				s.writeSceneError(w, r, err)
+				return
+			}
+			if !s.writeSceneError(w, r, s.createScene(scene)) {
+				return
+			}
+			s.broadcastScene(roomID, scene.ID, "SceneUpdate", scene)
+			writeJSON(w, http.StatusCreated, scene)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	scene, err := s.resolveScene(roomID, parts[0], isGM)
+	if !s.writeSceneError(w, r, err) {
+		return
+	}
+	if len(parts) == 2 {
+		if parts[1] != "activate" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !isGM {
+			http.Error(w, "only the GM can switch scenes", http.StatusForbidden)
+			return
+		}
+		if err := s.activateScene(roomID, scene); err != nil {
+			s.logger.Error("activate scene", slog.String("error", err.Error()))
+			http.Error(w, "failed to activate scene", http.StatusInternalServerError)
+			return
+		}
+		scene.Active = true
+		writeJSON(w, http.StatusOK, scene)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, scene)
+		return
+	case http.MethodPatch, http.MethodDelete:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isGM {
+		http.Error(w, "only the GM can manage scenes", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if !s.writeSceneError(w, r, s.deleteScene(roomID, scene.ID)) {
+			return
+		}
+		s.broadcastScene(roomID, scene.ID, "SceneDeleted", map[string]string{"id": scene.ID})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req sceneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := req.apply(&scene); err != nil {
+		s.writeSceneError(w, r, err)
+		return
+	}
+	if scene.Active && req.Grid != nil {
+		// Revealed fog cells and vision radii follow the grid.
+		defer s.beginViewChange(roomID)()
+	}
+	if err := updateScene(s.db, scene); err != nil {
+		s.logger.Error("update scene", slog.String("error", err.Error()))
+		http.Error(w, "failed to update scene", http.StatusInternalServerError)
+		return
+	}
+	s.broadcastScene(roomID, scene.ID, "SceneUpdate", scene)
+	if scene.Active && req.Grid != nil {
+		s.broadcastGrid(roomID, scene.Grid)
+	}
+	writeJSON(w, http.StatusOK, scene)
+}
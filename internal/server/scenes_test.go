@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestScenes(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+
+	do := func(method, path string, player Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		if payload != nil {
+			_ = json.NewEncoder(&body).Encode(payload)
+		}
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, &body)
+		req.Header.Set("Content-Type", "application/json")
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	scenes := func(player Player) []Scene {
+		t.Helper()
+		var list []Scene
+		if w := do(http.MethodGet, "/scenes", player, nil); w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&list) != nil {
+			t.Fatalf("list scenes: %d %s", w.Code, w.Body.String())
+		}
+		return list
+	}
+	images := func(path string, player Player) []imageResponse {
+		t.Helper()
+		var list []imageResponse
+		if w := do(http.MethodGet, path, player, nil); w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&list) != nil {
+			t.Fatalf("list images: %d %s", w.Code, w.Body.String())
+		}
+		return list
+	}
+
+	// Every room starts with its active scene.
+	if list := scenes(alice); len(list) != 1 || list[0].ID != room.ActiveSceneID || !list[0].Active || list[0].Name != defaultSceneName {
+		t.Fatalf("unexpected scenes: %+v", list)
+	}
+	main := room.ActiveSceneID
+
+	if w := do(http.MethodPost, "/scenes", alice, map[string]string{"name": "Cave"}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a player creating a scene, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/scenes", gm, map[string]string{"name": " "}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty name, got %d", w.Code)
+	}
+	var cave Scene
+	w := do(http.MethodPost, "/scenes", gm, map[string]any{"name": "Cave", "grid": map[string]float64{"cellSize": 50}})
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&cave) != nil || cave.Active || cave.Grid.CellSize != 50 {
+		t.Fatalf("create scene: %d %+v", w.Code, cave)
+	}
+	if list := scenes(gm); len(list) != 2 {
+		t.Fatalf("the GM lists every scene: %+v", list)
+	}
+	if list := scenes(alice); len(list) != 1 || list[0].ID != main {
+		t.Fatalf("players only list the active scene: %+v", list)
+	}
+	if w := do(http.MethodGet, "/scenes/"+cave.ID, alice, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a player previewing a scene, got %d", w.Code)
+	}
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(alice.Token), nil)
+	defer conn.Close()
+	readWSMessageForTest(t, conn, "RosterUpdate")
+
+	// The GM prepares the cave in private.
+	var stalactite imageResponse
+	w = do(http.MethodPost, "/images", gm, map[string]string{"url": "https://example.com/stalactite.png", "sceneId": cave.ID})
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&stalactite) != nil || stalactite.SceneID != cave.ID {
+		t.Fatalf("create image in scene: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPost, "/images", alice, map[string]string{"url": "https://example.com/x.png", "sceneId": cave.ID}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a player adding to an inactive scene, got %d", w.Code)
+	}
+	if list := images("/images", alice); len(list) != 0 {
+		t.Fatalf("players only see the active scene: %+v", list)
+	}
+	if w := do(http.MethodGet, "/images?scene="+cave.ID, alice, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a player previewing images, got %d", w.Code)
+	}
+	if list := images("/images?scene="+cave.ID, gm); len(list) != 1 || list[0].ID != stalactite.ID {
+		t.Fatalf("the GM previews the cave: %+v", list)
+	}
+	if list := images("/images", gm); len(list) != 0 {
+		t.Fatalf("images default to the active scene: %+v", list)
+	}
+
+	// A played card and a goblin in the initiative stay behind in the main
+	// scene.
+	var deck Deck
+	_ = json.NewDecoder(do(http.MethodPost, "/decks", gm, map[string]string{"name": "Action Deck", "kind": "standard"}).Body).Decode(&deck)
+	var drawn struct {
+		Cards []Card `json:"cards"`
+	}
+	_ = json.NewDecoder(do(http.MethodPost, "/decks/"+deck.ID+"/draw", alice, map[string]int{"count": 1}).Body).Decode(&drawn)
+	if w := do(http.MethodPost, "/hand/"+drawn.Cards[0].ID+"/play", alice, map[string]float64{"x": 40, "y": 60}); w.Code != http.StatusOK {
+		t.Fatalf("play card: %d %s", w.Code, w.Body.String())
+	}
+	var goblin imageResponse
+	_ = json.NewDecoder(do(http.MethodPost, "/images", gm, map[string]string{"url": "https://example.com/goblin.png"}).Body).Decode(&goblin)
+	if w := do(http.MethodPost, "/initiative/entries", gm, map[string]string{"name": "Goblin", "imageId": goblin.ID}); w.Code != http.StatusCreated {
+		t.Fatalf("add initiative entry: %d %s", w.Code, w.Body.String())
+	}
+
+	// Players follow the GM into the cave.
+	if w := do(http.MethodPost, "/scenes/"+cave.ID+"/activate", alice, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a player switching scenes, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/scenes/"+cave.ID+"/activate", gm, nil); w.Code != http.StatusOK {
+		t.Fatalf("activate scene: %d %s", w.Code, w.Body.String())
+	}
+	var activated struct {
+		Scene  Scene           `json:"scene"`
+		Images []imageResponse `json:"images"`
+		Tokens []Token         `json:"tokens"`
+	}
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "SceneActivated"), &activated); err != nil {
+		t.Fatalf("decode SceneActivated: %v", err)
+	}
+	if activated.Scene.ID != cave.ID || !activated.Scene.Active || len(activated.Images) != 1 || activated.Images[0].ID != stalactite.ID {
+		t.Fatalf("unexpected activation: %+v", activated)
+	}
+	if list := images("/images", alice); len(list) != 1 || list[0].ID != stalactite.ID {
+		t.Fatalf("players see the new active scene: %+v", list)
+	}
+	var token Token
+	w = do(http.MethodPost, "/tokens", alice, map[string]string{"url": "https://example.com/hero.png", "name": "Hero"})
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&token) != nil || token.SceneID != cave.ID || token.Width != 50 {
+		t.Fatalf("tokens join the active scene on its grid: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := do(http.MethodDelete, "/scenes/"+cave.ID, gm, nil); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for deleting the active scene, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/scenes/"+main, gm, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete scene: %d %s", w.Code, w.Body.String())
+	}
+	if list := scenes(gm); len(list) != 1 || list[0].ID != cave.ID {
+		t.Fatalf("unexpected scenes after delete: %+v", list)
+	}
+	_ = json.NewDecoder(do(http.MethodGet, "/decks/"+deck.ID, gm, nil).Body).Decode(&deck)
+	if len(deck.Table) != 0 || len(deck.Discard) != 1 || deck.Discard[0].ImageID != "" {
+		t.Fatalf("cards on a deleted scene must be discarded: %+v", deck)
+	}
+	var tracker InitiativeTracker
+	_ = json.NewDecoder(do(http.MethodGet, "/initiative", gm, nil).Body).Decode(&tracker)
+	if len(tracker.Entries) != 1 || tracker.Entries[0].ImageID != "" {
+		t.Fatalf("initiative entries must lose images of a deleted scene: %+v", tracker)
+	}
+}
@@ -13,6 +13,7 @@ func TestImageURLValidation(t *testing.T) {
 	srv := newTestServer(t, t.TempDir())
 	router := srv.Router()
 	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
 
 	tests := []struct {
 		name       string
@@ -56,6 +57,7 @@ func TestImageURLValidation(t *testing.T) {
 			body, _ := json.Marshal(map[string]string{"url": tt.url})
 			req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/images", bytes.NewReader(body))
 			req.Header.Set("Content-Type", "application/json")
+			authorize(req, gm)
 			w := httptest.NewRecorder()
 			router.ServeHTTP(w, req)
 
@@ -70,11 +72,13 @@ func TestImagePositionValidation(t *testing.T) {
 	srv := newTestServer(t, t.TempDir())
 	router := srv.Router()
 	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
 
 	// First create an image to update
 	body, _ := json.Marshal(map[string]string{"url": "https://example.com/test.png"})
 	req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/images", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
+	authorize(req, gm)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
@@ -128,6 +132,7 @@ func TestImagePositionValidation(t *testing.T) {
 			updateBody, _ := json.Marshal(map[string]*float64{"x": tt.x, "y": tt.y})
 			updateReq := httptest.NewRequest(http.MethodPatch, "/rooms/"+room.ID+"/images/"+img.ID, bytes.NewReader(updateBody))
 			updateReq.Header.Set("Content-Type", "application/json")
+			authorize(updateReq, gm)
 			updateW := httptest.NewRecorder()
 			router.ServeHTTP(updateW, updateReq)
 
@@ -139,9 +144,12 @@ func TestImagePositionValidation(t *testing.T) {
 }
 
 func TestDiceLogValidation(t *testing.T) {
-	srv := newTestServer(t, t.TempDir())
+	srv := newTestServerWithConfig(t, t.TempDir(), func(cfg *Config) {
+		cfg.LegacyDiceResults = true
+	})
 	router := srv.Router()
 	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
 
 	tests := []struct {
 		name       string
@@ -215,6 +223,7 @@ func TestDiceLogValidation(t *testing.T) {
 			body, _ := json.Marshal(tt.payload)
 			req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/dice", bytes.NewReader(body))
 			req.Header.Set("Content-Type", "application/json")
+			authorize(req, gm)
 			w := httptest.NewRecorder()
 			router.ServeHTTP(w, req)
 
@@ -27,7 +27,10 @@ import (
 
 	"log/slog"
 	"regexp"
+	"slices"
 	"sync"
+
+	"vtrpg/internal/dice"
 )
 
 // Server wraps HTTP handlers and configuration.
@@ -41,6 +44,15 @@ type Server struct {
 	wsRooms         map[string]map[*wsConn]clientProfile
 	gmRooms         map[string]*wsConn
 	wsMu            sync.Mutex
+	rollRequests    map[string]*rollRequest
+	rollRequestsMu  sync.Mutex
+	initiativeMu    sync.Mutex
+	viewMu          sync.Mutex
+	// sights caches what the tokens of each scene see, for the version of
+	// the scene's walls in wallVersions it was cast against.
+	sights       map[string]sceneSight
+	wallVersions map[string]uint64
+	sightMu      sync.Mutex
 }
 
 // New constructs a Server with routes and middleware configured.
@@ -64,6 +76,9 @@ func New(cfg Config) (*Server, error) {
 		db:             db,
 		wsRooms:        make(map[string]map[*wsConn]clientProfile),
 		gmRooms:        make(map[string]*wsConn),
+		rollRequests:   make(map[string]*rollRequest),
+		sights:         make(map[string]sceneSight),
+		wallVersions:   make(map[string]uint64),
 	}
 	for _, origin := range cfg.AllowedOrigins {
 		if origin == "*" {
@@ -99,6 +114,7 @@ func (s *Server) routes() {
 	s.mux.HandleFunc("/rooms", s.handleRooms)
 	s.mux.HandleFunc("/rooms/slug/", s.handleRoomLookup)
 	s.mux.HandleFunc("/rooms/", s.handleRoom)
+	s.mux.HandleFunc("/cards/", s.handleCardFace)
 	s.mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(s.cfg.UploadDir))))
 	s.mux.Handle("/", s.spaHandler())
 }
@@ -190,6 +206,7 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 type imageResponse struct {
 	ID        string    `json:"id"`
 	RoomID    string    `json:"roomId"`
+	SceneID   string    `json:"sceneId"`
 	URL       string    `json:"url"`
 	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"createdAt"`
@@ -201,16 +218,72 @@ type imageResponse struct {
 }
 
 type diceLogEntry struct {
-	ID          string    `json:"id"`
-	RoomID      string    `json:"roomId"`
-	Seed        uint32    `json:"seed"`
-	Count       int       `json:"count"`
-	Results     []int     `json:"results"`
-	TriggeredBy string    `json:"triggeredBy"`
-	Timestamp   time.Time `json:"timestamp"`
+	ID          string       `json:"id"`
+	RoomID      string       `json:"roomId"`
+	Seed        uint32       `json:"seed"`
+	Count       int          `json:"count"`
+	Results     []int        `json:"results"`
+	TriggeredBy string       `json:"triggeredBy"`
+	Timestamp   time.Time    `json:"timestamp"`
+	Expression  string         `json:"expression,omitempty"`
+	Total       int            `json:"total"`
+	Breakdown   *dice.Result   `json:"breakdown,omitempty"`
+	Visibility  DiceVisibility `json:"visibility"`
+	// Recipients lists the player IDs besides the GM allowed to see a
+	// non-public roll.
+	Recipients []string `json:"recipients,omitempty"`
+	// Sides holds the number of sides of each die, aligned with Results. It
+	// is empty for rolls logged before sides were recorded.
+	Sides    []int  `json:"sides"`
+	Label    string `json:"label,omitempty"`
+	RollerID string `json:"rollerId,omitempty"`
+	// Modifier is the signed sum of the expression's constant terms.
+	Modifier int `json:"modifier"`
+	// Commitment is the SHA-256 of ServerSeed published before the roll;
+	// Seed is derived from ServerSeed and the client's ClientSeed. All three
+	// are empty for rolls made before commit-reveal.
+	Commitment string `json:"commitment,omitempty"`
+	ServerSeed string `json:"serverSeed,omitempty"`
+	ClientSeed string `json:"clientSeed,omitempty"`
+	// Committed is set when Commitment was published before the roll. A
+	// player who rolls without a pending commitment gets a seed drawn at
+	// roll time, which is reproducible but was not committed to.
+	Committed bool `json:"committed"`
+	// RequestID links a roll made in answer to a GM roll request.
+	RequestID string `json:"requestId,omitempty"`
+	// System is the rule system that made the roll. Spec and Rule hold the
+	// roll's spec and interpreted result for systems other than generic.
+	System string      `json:"system,omitempty"`
+	Spec   *RollSpec   `json:"spec,omitempty"`
+	Rule   *RuleResult `json:"rule,omitempty"`
+	// ParentID links a pushed or rerolled roll to the roll it replaces.
+	ParentID string `json:"parentId,omitempty"`
+	// Faces holds the face ID of each die of a custom dice roll, aligned
+	// with Results, which hold the faces' values.
+	Faces []string `json:"faces,omitempty"`
+}
+
+// visibleTo reports whether the connection with the given profile may see
+// the roll.
+func (e diceLogEntry) visibleTo(profile clientProfile) bool {
+	if e.Visibility == DiceVisibilityPublic || isGMProfile(profile) {
+		return true
+	}
+	return slices.Contains(e.Recipients, profile.ID)
+}
+
+// visibleFor returns the roll as the given profile may see it. A roll hidden
+// from them, such as a player's own blind roll, keeps only its ID,
+// visibility, label and timestamp.
+func (e diceLogEntry) visibleFor(profile clientProfile) diceLogEntry {
+	if e.visibleTo(profile) {
+		return e
+	}
+	return diceLogEntry{ID: e.ID, Visibility: e.Visibility, Label: e.Label, Timestamp: e.Timestamp}
 }
 
 type clientProfile struct {
+	ID   string `json:"id"`
 	Name string `json:"name"`
 	Role string `json:"role"`
 }
@@ -489,6 +562,9 @@ func (s *Server) handleRoom(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusOK, room)
 		return
 		case http.MethodPatch:
+			if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+				return
+			}
 			s.handleRoomUpdate(w, r, roomID)
 			return
 		default:
@@ -510,6 +586,160 @@ func (s *Server) handleRoom(w http.ResponseWriter, r *http.Request) {
 		}
 		s.handleRoomGM(w, r, roomID)
 		return
+	case "macros":
+		if len(parts) > 3 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		macroID := ""
+		if len(parts) == 3 {
+			macroID = parts[2]
+		}
+		s.handleMacros(w, r, roomID, macroID)
+		return
+	case "tables":
+		if len(parts) > 3 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		tableID := ""
+		if len(parts) == 3 {
+			tableID = parts[2]
+		}
+		s.handleRandomTables(w, r, roomID, tableID)
+		return
+	case "decks":
+		if len(parts) > 4 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		s.handleDecks(w, r, roomID, parts[2:])
+		return
+	case "hand":
+		if len(parts) > 4 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		s.handleHand(w, r, roomID, parts[2:])
+		return
+	case "initiative":
+		if len(parts) > 4 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		s.handleInitiative(w, r, roomID, parts[2:])
+		return
+	case "tokens":
+		if len(parts) > 3 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		tokenID := ""
+		if len(parts) == 3 {
+			tokenID = parts[2]
+		}
+		s.handleTokens(w, r, roomID, tokenID)
+		return
+	case "walls":
+		if len(parts) > 3 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		wallID := ""
+		if len(parts) == 3 {
+			wallID = parts[2]
+		}
+		s.handleWalls(w, r, roomID, wallID)
+		return
+	case "lights":
+		if len(parts) > 3 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		lightID := ""
+		if len(parts) == 3 {
+			lightID = parts[2]
+		}
+		s.handleLights(w, r, roomID, lightID)
+		return
+	case "scenes":
+		if len(parts) > 4 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		s.handleScenes(w, r, roomID, parts[2:])
+		return
+	case "imports":
+		if len(parts) != 3 || parts[2] != "uvtt" {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		s.handleUVTTImport(w, r, roomID)
+		return
+	case "vision":
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		s.handleVision(w, r, roomID)
+		return
+	case "fog":
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		s.handleFog(w, r, roomID)
+		return
+	case "effects":
+		if len(parts) > 3 {
+			http.NotFound(w, r)
+			return
+		}
+		if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+			return
+		}
+		effectID := ""
+		if len(parts) == 3 {
+			effectID = parts[2]
+		}
+		s.handleEffects(w, r, roomID, effectID)
+		return
 	case "images":
 		// continue
 	case "dice":
@@ -523,34 +753,76 @@ func (s *Server) handleRoom(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			if parts[1] == "dice" {
-				logs, err := s.getDiceLogs(roomID)
+				player, _, err := s.optionalPlayer(r, roomID)
+				if err != nil {
+					s.logger.Error("lookup player for dice logs", slog.String("error", err.Error()))
+					http.Error(w, "failed to load dice logs", http.StatusInternalServerError)
+					return
+				}
+				page, err := parseDiceLogPage(r.URL.Query())
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				viewer := clientProfile{ID: player.ID, Name: player.Name, Role: string(player.Role)}
+				logs, next, err := s.getDiceLogs(roomID, viewer, page)
 				if err != nil {
 					s.logger.Error("get dice logs", slog.String("error", err.Error()))
 					http.Error(w, "failed to load dice logs", http.StatusInternalServerError)
 					return
 				}
+				if next != "" {
+					w.Header().Set("X-Next-Cursor", next)
+				}
 				writeJSON(w, http.StatusOK, logs)
 				return
 			}
 			if parts[1] == "images" {
-				images, err := s.getImages(roomID)
+				player, _, err := s.optionalPlayer(r, roomID)
+				if err != nil {
+					s.logger.Error("lookup player for images", slog.String("error", err.Error()))
+					http.Error(w, "failed to load images", http.StatusInternalServerError)
+					return
+				}
+				// The GM previews other scenes with ?scene=.
+				scene, err := s.resolveScene(roomID, r.URL.Query().Get("scene"), player.Role == RoleGM)
+				if !s.writeSceneError(w, r, err) {
+					return
+				}
+				images, err := s.getImages(roomID, scene.ID, player.Role == RoleGM)
 				if err != nil {
 					s.logger.Error("get images", slog.String("error", err.Error()))
 					http.Error(w, "failed to load images", http.StatusInternalServerError)
 					return
 				}
+				if player.Role != RoleGM {
+					view, err := s.loadPlayerView(roomID)
+					if err != nil {
+						s.logger.Error("load player view", slog.String("error", err.Error()))
+						http.Error(w, "failed to load images", http.StatusInternalServerError)
+						return
+					}
+					images = view.visibleImages(player.ID, images)
+				}
 				writeJSON(w, http.StatusOK, images)
 				return
 			}
 			http.NotFound(w, r)
 			return
 		case http.MethodPost:
+			if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+				return
+			}
 			if parts[1] == "dice" {
-				s.handleDiceLogCreate(w, r, roomID)
+				s.withIdempotencyKey(w, r, roomID, "POST dice", func(w http.ResponseWriter, r *http.Request) {
+					s.handleDiceLogCreate(w, r, roomID)
+				})
 				return
 			}
 			if parts[1] == "images" {
-				s.handleImageCreate(w, r, roomID)
+				s.withIdempotencyKey(w, r, roomID, "POST images", func(w http.ResponseWriter, r *http.Request) {
+					s.handleImageCreate(w, r, roomID)
+				})
 				return
 			}
 			http.NotFound(w, r)
@@ -561,9 +833,64 @@ func (s *Server) handleRoom(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if len(parts) >= 3 && parts[1] == "dice" && parts[2] == "types" {
+		if len(parts) > 4 {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+				return
+			}
+		}
+		typeID := ""
+		if len(parts) == 4 {
+			typeID = parts[3]
+		}
+		s.handleDiceTypes(w, r, roomID, typeID)
+		return
+	}
+
+	if len(parts) == 3 && parts[1] == "dice" {
+		switch parts[2] {
+		case "roll":
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+				return
+			}
+			s.withIdempotencyKey(w, r, roomID, "POST dice/roll", func(w http.ResponseWriter, r *http.Request) {
+				s.handleDiceRoll(w, r, roomID)
+			})
+		case "stats":
+			s.handleDiceStats(w, r, roomID)
+		case "commitment":
+			if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+				return
+			}
+			s.handleDiceCommitment(w, r, roomID)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	if len(parts) == 4 && parts[1] == "dice" && parts[3] == "verify" {
+		s.handleDiceVerify(w, r, roomID, parts[2])
+		return
+	}
+
 	if len(parts) == 3 {
 		imageID := parts[2]
 		switch r.Method {
+		case http.MethodDelete, http.MethodPatch:
+			if r, ok = s.authenticatePlayer(w, r, roomID); !ok {
+				return
+			}
+		}
+		switch r.Method {
 		case http.MethodDelete:
 			s.handleImageDelete(w, r, roomID, imageID)
 			return
@@ -588,33 +915,119 @@ func (s *Server) handleRoomGM(w http.ResponseWriter, r *http.Request, roomID str
 	writeJSON(w, http.StatusOK, map[string]bool{"active": s.isGMActive(roomID)})
 }
 
+// handleRoomUpdate applies a partial update to a room's settings. Only the
+// fields present in the body change; retention, rule system, grid and vision
+// settings are GM-only.
 func (s *Server) handleRoomUpdate(w http.ResponseWriter, r *http.Request, roomID string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+
 	var payload struct {
-		Theme string `json:"theme"`
+		Theme         *string         `json:"theme"`
+		DiceRetention *DiceRetention  `json:"diceRetention"`
+		RuleSystem    *string         `json:"ruleSystem"`
+		Grid          json.RawMessage `json:"grid"`
+		Vision        *bool           `json:"vision"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		http.Error(w, "invalid request", http.StatusBadRequest)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	if payload.Theme == nil && payload.DiceRetention == nil && payload.RuleSystem == nil && payload.Grid == nil && payload.Vision == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "nothing to update"})
 		return
 	}
 
-	theme := Theme(strings.TrimSpace(payload.Theme))
-	if theme == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "theme is required"})
+	var theme Theme
+	if payload.Theme != nil {
+		theme = Theme(strings.TrimSpace(*payload.Theme))
+		if theme == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "theme is required"})
+			return
+		}
+		if !IsValidTheme(theme) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid theme", "validThemes": strings.Join(themeNames(), ", ")})
+			return
+		}
+	}
+	if payload.DiceRetention != nil {
+		if player.Role != RoleGM {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "only the GM can change dice retention"})
+			return
+		}
+		if payload.DiceRetention.MaxEntries < 0 || payload.DiceRetention.MaxAgeDays < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid dice retention"})
+			return
+		}
+	}
+	if payload.RuleSystem != nil {
+		if player.Role != RoleGM {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "only the GM can change the rule system"})
+			return
+		}
+		if _, ok := ruleSystems[*payload.RuleSystem]; !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid rule system", "validRuleSystems": strings.Join(ruleSystemNames(), ", ")})
+			return
+		}
+	}
+	if payload.Vision != nil && player.Role != RoleGM {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "only the GM can change vision"})
 		return
 	}
-	if !IsValidTheme(theme) {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid theme", "validThemes": strings.Join(themeNames(), ", ")})
+	var scene Scene
+	if payload.Grid != nil {
+		if player.Role != RoleGM {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "only the GM can change the grid"})
+			return
+		}
+		var err error
+		if scene, err = s.getActiveScene(roomID); err != nil {
+			s.logger.Error("load grid", slog.String("error", err.Error()), slog.String("roomId", roomID))
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update room"})
+			return
+		}
+		if scene.Grid, err = parseGridUpdate(scene.Grid, payload.Grid); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": strings.TrimPrefix(err.Error(), errInvalidGrid.Error()+": ")})
+			return
+		}
+	}
+
+	if payload.Grid != nil || payload.Vision != nil {
+		// Revealed fog cells and vision radii follow the grid, so players'
+		// views change with it.
+		defer s.beginViewChange(roomID)()
+	}
+	update := roomUpdate{
+		DiceRetention: payload.DiceRetention,
+		RuleSystem:    payload.RuleSystem,
+		Vision:        payload.Vision,
+	}
+	if payload.Theme != nil {
+		update.Theme = &theme
+	}
+	if payload.Grid != nil {
+		update.Scene = &scene
+	}
+	if err := s.updateRoom(roomID, update); err != nil {
+		s.logger.Error("update room", slog.String("error", err.Error()), slog.String("roomId", roomID))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update room"})
 		return
 	}
 
-	room, err := s.updateRoomTheme(roomID, theme)
+	room, err := s.getRoomByID(roomID)
 	if err != nil {
-		s.logger.Error("update room theme", slog.String("error", err.Error()), slog.String("roomId", roomID))
-		http.Error(w, "failed to update room", http.StatusInternalServerError)
+		s.logger.Error("load room", slog.String("error", err.Error()), slog.String("roomId", roomID))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update room"})
 		return
 	}
-
-	s.broadcastThemeChange(roomID, theme)
+	if payload.Theme != nil {
+		s.broadcastThemeChange(roomID, theme)
+	}
+	if payload.Grid != nil {
+		s.broadcastGrid(roomID, room.Grid)
+	}
 	writeJSON(w, http.StatusOK, room)
 }
 
@@ -626,11 +1039,19 @@ func themeNames() []string {
 	return names
 }
 
+// handleImageCreate adds images to the active scene or, for the GM, to the
+// scene given as sceneId.
 func (s *Server) handleImageCreate(w http.ResponseWriter, r *http.Request, roomID string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+
 	contentType := r.Header.Get("Content-Type")
 	if strings.HasPrefix(contentType, "application/json") {
 		var payload struct {
-			URL string `json:"url"`
+			URL     string `json:"url"`
+			SceneID string `json:"sceneId"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.URL == "" {
 			http.Error(w, "invalid request", http.StatusBadRequest)
@@ -641,7 +1062,11 @@ func (s *Server) handleImageCreate(w http.ResponseWriter, r *http.Request, roomI
 			http.Error(w, "invalid image URL", http.StatusBadRequest)
 			return
 		}
-		x, y, err := s.nextPosition(roomID)
+		scene, err := s.resolveScene(roomID, payload.SceneID, player.Role == RoleGM)
+		if !s.writeSceneError(w, r, err) {
+			return
+		}
+		x, y, err := s.nextPosition(scene.ID)
 		if err != nil {
 			s.logger.Error("next position", slog.String("error", err.Error()))
 			http.Error(w, "failed to store image", http.StatusInternalServerError)
@@ -650,6 +1075,7 @@ func (s *Server) handleImageCreate(w http.ResponseWriter, r *http.Request, roomI
 		img := imageResponse{
 			ID:        s.newID(),
 			RoomID:    roomID,
+			SceneID:   scene.ID,
 			URL:       payload.URL,
 			Status:    "done",
 			CreatedAt: time.Now().UTC(),
@@ -676,6 +1102,10 @@ func (s *Server) handleImageCreate(w http.ResponseWriter, r *http.Request, roomI
 		http.Error(w, "file not found in request", http.StatusBadRequest)
 		return
 	}
+	scene, err := s.resolveScene(roomID, r.FormValue("sceneId"), player.Role == RoleGM)
+	if !s.writeSceneError(w, r, err) {
+		return
+	}
 
 	uploaded := make([]imageResponse, 0)
 	var uploadedPaths []string
@@ -695,57 +1125,19 @@ func (s *Server) handleImageCreate(w http.ResponseWriter, r *http.Request, roomI
 			return
 		}
 
-		// Check if file supports seeking (required for MIME detection)
-		seeker, canSeek := file.(io.Seeker)
-		if !canSeek {
-			file.Close()
-			http.Error(w, "unable to process file", http.StatusInternalServerError)
-			return
-		}
-
-		// Validate MIME type by detecting content
-		mimeType, err := detectContentType(file, fh.Filename)
-		if err != nil {
-			file.Close()
-			http.Error(w, "unable to detect file type", http.StatusBadRequest)
-			return
-		}
-		if !isAllowedImageType(mimeType) {
-			file.Close()
-			http.Error(w, "invalid file type: only images are allowed", http.StatusBadRequest)
-			return
-		}
-
-		// Reset file pointer after reading for type detection
-		if _, err := seeker.Seek(0, 0); err != nil {
-			file.Close()
-			http.Error(w, "unable to process file", http.StatusInternalServerError)
-			return
-		}
-
-		safeName := filepath.Base(fh.Filename)
-		uniqueName := fmt.Sprintf("%s-%s", s.newID(), safeName)
-		destPath := filepath.Join(s.cfg.UploadDir, uniqueName)
-		out, err := os.Create(destPath)
+		url, destPath, err := s.saveUpload(fh.Filename, file)
+		file.Close()
 		if err != nil {
-			file.Close()
+			if errors.Is(err, errUploadUndetected) || errors.Is(err, errUploadType) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			http.Error(w, "unable to save file", http.StatusInternalServerError)
 			return
 		}
-
-		if _, err := io.Copy(out, file); err != nil {
-			out.Close()
-			file.Close()
-			_ = os.Remove(destPath)
-			http.Error(w, "unable to write file", http.StatusInternalServerError)
-			return
-		}
-		out.Close()
-		file.Close()
 		uploadedPaths = append(uploadedPaths, destPath)
 
-		url := "/uploads/" + uniqueName
-		x, y, err := s.nextPosition(roomID)
+		x, y, err := s.nextPosition(scene.ID)
 		if err != nil {
 			http.Error(w, "failed to store image", http.StatusInternalServerError)
 			return
@@ -753,6 +1145,7 @@ func (s *Server) handleImageCreate(w http.ResponseWriter, r *http.Request, roomI
 		img := imageResponse{
 			ID:        s.newID(),
 			RoomID:    roomID,
+			SceneID:   scene.ID,
 			URL:       url,
 			Status:    "done",
 			CreatedAt: time.Now().UTC(),
@@ -775,8 +1168,68 @@ func (s *Server) handleImageCreate(w http.ResponseWriter, r *http.Request, roomI
 	writeJSON(w, http.StatusCreated, uploaded)
 }
 
+var (
+	errUploadUndetected = errors.New("unable to detect file type")
+	errUploadType       = errors.New("invalid file type: only images are allowed")
+)
+
+// saveUpload checks that file is an allowed image and stores it in the upload
+// directory under a unique name. It returns the file's public URL and its
+// path on disk. Files that are not images fail with errUploadUndetected or
+// errUploadType.
+func (s *Server) saveUpload(filename string, file io.ReadSeeker) (string, string, error) {
+	mimeType, err := detectContentType(file, filename)
+	if err != nil {
+		return "", "", errUploadUndetected
+	}
+	if !isAllowedImageType(mimeType) {
+		return "", "", errUploadType
+	}
+	// Reset file pointer after reading for type detection
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+
+	uniqueName := fmt.Sprintf("%s-%s", s.newID(), filepath.Base(filename))
+	destPath := filepath.Join(s.cfg.UploadDir, uniqueName)
+	out, err := os.Create(destPath)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := io.Copy(out, file); err != nil {
+		out.Close()
+		_ = os.Remove(destPath)
+		return "", "", err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(destPath)
+		return "", "", err
+	}
+	return "/uploads/" + uniqueName, destPath, nil
+}
+
 func (s *Server) handleImageDelete(w http.ResponseWriter, r *http.Request, roomID, imageID string) {
-	img, ok, err := s.deleteImage(roomID, imageID)
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+
+	isGM := player.Role == RoleGM
+	token, isToken, err := s.getToken(roomID, imageID, isGM)
+	if err != nil {
+		s.logger.Error("get token", slog.String("error", err.Error()))
+		http.Error(w, "failed to delete image", http.StatusInternalServerError)
+		return
+	}
+	if isToken && !token.canMove(player.ID, isGM) {
+		http.Error(w, errTokenForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	if isToken {
+		// A player's token takes its sight along.
+		defer s.beginViewChange(roomID)()
+	}
+	img, ok, err := s.deleteImage(roomID, imageID, isGM)
 	if err != nil {
 		s.logger.Error("delete image", slog.String("error", err.Error()))
 		http.Error(w, "failed to delete image", http.StatusInternalServerError)
@@ -786,15 +1239,40 @@ func (s *Server) handleImageDelete(w http.ResponseWriter, r *http.Request, roomI
 		http.NotFound(w, r)
 		return
 	}
-	if strings.HasPrefix(img.URL, "/uploads/") {
-		filename := filepath.Base(img.URL)
-		_ = os.Remove(filepath.Join(s.cfg.UploadDir, filename))
+	s.removeUnusedUpload(img.URL)
+	if isToken {
+		s.tokenImageDeleted(roomID, token)
+	} else {
+		s.deleteTargetEffects(roomID, effectTargetImage, imageID, s.imageAudience(roomID, img))
 	}
-	s.broadcastImageDeleted(roomID, imageID)
+	s.broadcastImageDeleted(roomID, img)
 	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
 }
 
+// removeUnusedUpload deletes the file of an uploaded image that left the
+// canvas. A played card's face stays with its deck.
+func (s *Server) removeUnusedUpload(url string) {
+	if !strings.HasPrefix(url, "/uploads/") {
+		return
+	}
+	inDeck, err := s.cardFaceInUse(url)
+	if err != nil {
+		s.logger.Error("check card faces", slog.String("error", err.Error()))
+		return
+	}
+	if !inDeck {
+		filename := filepath.Base(url)
+		_ = os.Remove(filepath.Join(s.cfg.UploadDir, filename))
+	}
+}
+
 func (s *Server) handleImageUpdate(w http.ResponseWriter, r *http.Request, roomID, imageID string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	isGM := player.Role == RoleGM
+
 	var payload struct {
 		X      *float64 `json:"x"`
 		Y      *float64 `json:"y"`
@@ -828,7 +1306,26 @@ func (s *Server) handleImageUpdate(w http.ResponseWriter, r *http.Request, roomI
 		http.Error(w, "invalid height", http.StatusBadRequest)
 		return
 	}
-	img, ok, err := s.updateImage(roomID, imageID, payload.X, payload.Y, payload.Width, payload.Height, payload.Hidden)
+	if payload.Hidden != nil && !isGM {
+		http.Error(w, "only the GM can change image visibility", http.StatusForbidden)
+		return
+	}
+	token, isToken, err := s.getToken(roomID, imageID, isGM)
+	if err != nil {
+		s.logger.Error("get token", slog.String("error", err.Error()))
+		http.Error(w, "failed to update image", http.StatusInternalServerError)
+		return
+	}
+	if isToken {
+		// Tokens keep their owner check when moved as images.
+		req := tokenRequest{X: payload.X, Y: payload.Y, Width: payload.Width, Height: payload.Height, Hidden: payload.Hidden}
+		token, err = s.updateToken(roomID, token.ID, player.ID, isGM, req)
+		if s.writeTokenError(w, r, err) {
+			writeJSON(w, http.StatusOK, token.image())
+		}
+		return
+	}
+	img, previous, ok, err := s.updateImage(roomID, imageID, isGM, true, payload.X, payload.Y, payload.Width, payload.Height, payload.Hidden)
 	if err != nil {
 		s.logger.Error("update image", slog.String("error", err.Error()))
 		http.Error(w, "failed to update image", http.StatusInternalServerError)
@@ -839,6 +1336,9 @@ func (s *Server) handleImageUpdate(w http.ResponseWriter, r *http.Request, roomI
 		return
 	}
 	s.broadcastSharedImage(roomID, img)
+	if img.Hidden && !previous.Hidden {
+		s.broadcastImageHidden(roomID, img)
+	}
 	writeJSON(w, http.StatusOK, img)
 }
 
@@ -847,27 +1347,45 @@ func (s *Server) handleDiceLogCreate(w http.ResponseWriter, r *http.Request, roo
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	if !s.cfg.LegacyDiceResults {
+		http.Error(w, "client-supplied dice results are disabled; use POST /rooms/{id}/dice/roll", http.StatusForbidden)
+		return
+	}
 
 	var payload struct {
-		Seed        uint32     `json:"seed"`
-		Count       int        `json:"count"`
-		Results     []int      `json:"results"`
-		TriggeredBy string     `json:"triggeredBy"`
-		Timestamp   *time.Time `json:"timestamp"`
+		Seed      uint32     `json:"seed"`
+		Count     int        `json:"count"`
+		Sides     int        `json:"sides"`
+		Results   []int      `json:"results"`
+		Label     string     `json:"label"`
+		Timestamp *time.Time `json:"timestamp"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
 	// Validate dice log parameters
-	if payload.Count <= 0 || payload.Count > 1000 {
+	if payload.Count <= 0 || payload.Count > maxDiceCount {
 		http.Error(w, "invalid dice count", http.StatusBadRequest)
 		return
 	}
-	if len(payload.Results) == 0 || len(payload.Results) > 1000 {
+	if len(payload.Results) == 0 || len(payload.Results) > maxDiceCount {
 		http.Error(w, "invalid dice results", http.StatusBadRequest)
 		return
 	}
+	if payload.Sides != 0 && (payload.Sides < 2 || payload.Sides > maxDiceSides) {
+		http.Error(w, "invalid dice sides", http.StatusBadRequest)
+		return
+	}
+	label, ok := normalizeDiceLabel(payload.Label)
+	if !ok {
+		http.Error(w, "invalid dice label", http.StatusBadRequest)
+		return
+	}
 
 	ts := time.Now().UTC()
 	if payload.Timestamp != nil {
@@ -878,8 +1396,19 @@ func (s *Server) handleDiceLogCreate(w http.ResponseWriter, r *http.Request, roo
 		Seed:        payload.Seed,
 		Count:       payload.Count,
 		Results:     append([]int{}, payload.Results...),
-		TriggeredBy: strings.TrimSpace(payload.TriggeredBy),
+		TriggeredBy: player.Name,
 		Timestamp:   ts,
+		Label:       label,
+		RollerID:    player.ID,
+	}
+	for _, result := range payload.Results {
+		entry.Total += result
+		if payload.Sides != 0 {
+			entry.Sides = append(entry.Sides, payload.Sides)
+		}
+	}
+	if payload.Sides != 0 {
+		entry.Expression = fmt.Sprintf("%dd%d", len(payload.Results), payload.Sides)
 	}
 
 	stored, err := s.storeDiceLog(roomID, entry)
@@ -892,8 +1421,24 @@ func (s *Server) handleDiceLogCreate(w http.ResponseWriter, r *http.Request, roo
 	writeJSON(w, http.StatusOK, stored)
 }
 
-func (s *Server) getImages(roomID string) ([]imageResponse, error) {
-	rows, err := s.db.Query(`SELECT id, room_id, url, status, created_at, x, y, width, height, hidden FROM images WHERE room_id = ? ORDER BY created_at ASC, id ASC`, roomID)
+const imageColumns = `id, room_id, scene_id, url, status, created_at, x, y, width, height, hidden`
+
+func scanImage(row rowScanner) (imageResponse, error) {
+	var img imageResponse
+	if err := row.Scan(&img.ID, &img.RoomID, &img.SceneID, &img.URL, &img.Status, &img.CreatedAt, &img.X, &img.Y, &img.Width, &img.Height, &img.Hidden); err != nil {
+		return imageResponse{}, err
+	}
+	img.CreatedAt = img.CreatedAt.UTC()
+	return img, nil
+}
+
+// getImages lists a scene's images. Hidden images are only included for the GM.
+func (s *Server) getImages(roomID, sceneID string, includeHidden bool) ([]imageResponse, error) {
+	query := `SELECT ` + imageColumns + ` FROM images WHERE room_id = ? AND scene_id = ?`
+	if !includeHidden {
+		query += ` AND hidden = 0`
+	}
+	rows, err := s.db.Query(query+` ORDER BY created_at ASC, id ASC`, roomID, sceneID)
 	if err != nil {
 		return nil, err
 	}
@@ -901,13 +1446,10 @@ func (s *Server) getImages(roomID string) ([]imageResponse, error) {
 
 	images := make([]imageResponse, 0)
 	for rows.Next() {
-		var img imageResponse
-		var hidden int
-		if err := rows.Scan(&img.ID, &img.RoomID, &img.URL, &img.Status, &img.CreatedAt, &img.X, &img.Y, &img.Width, &img.Height, &hidden); err != nil {
+		img, err := scanImage(rows)
+		if err != nil {
 			return nil, err
 		}
-		img.CreatedAt = img.CreatedAt.UTC()
-		img.Hidden = hidden != 0
 		images = append(images, img)
 	}
 	if err := rows.Err(); err != nil {
@@ -916,34 +1458,158 @@ func (s *Server) getImages(roomID string) ([]imageResponse, error) {
 	return images, nil
 }
 
-func (s *Server) getDiceLogs(roomID string) ([]diceLogEntry, error) {
-	rows, err := s.db.Query(`SELECT id, room_id, seed, count, results, triggered_by, timestamp FROM dice_logs WHERE room_id = ? ORDER BY timestamp DESC, id DESC LIMIT 50`, roomID)
+const diceLogColumns = `id, room_id, seed, count, results, triggered_by, timestamp, expression, total, breakdown, visibility, recipients, sides, label, roller_id, modifier, server_seed, commitment, client_seed, request_id, system, spec, rule, parent_id, faces, committed`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func scanDiceLog(row rowScanner) (diceLogEntry, error) {
+	var entry diceLogEntry
+	var results string
+	var breakdown, recipients, sides, spec, rule, faces sql.NullString
+	if err := row.Scan(&entry.ID, &entry.RoomID, &entry.Seed, &entry.Count, &results, &entry.TriggeredBy, &entry.Timestamp, &entry.Expression, &entry.Total, &breakdown, &entry.Visibility, &recipients,
+		&sides, &entry.Label, &entry.RollerID, &entry.Modifier, &entry.ServerSeed, &entry.Commitment, &entry.ClientSeed, &entry.RequestID,
+		&entry.System, &spec, &rule, &entry.ParentID, &faces, &entry.Committed); err != nil {
+		return diceLogEntry{}, err
+	}
+	entry.Timestamp = entry.Timestamp.UTC()
+	if err := json.Unmarshal([]byte(results), &entry.Results); err != nil {
+		return diceLogEntry{}, err
+	}
+	if breakdown.Valid && breakdown.String != "" {
+		entry.Breakdown = &dice.Result{}
+		if err := json.Unmarshal([]byte(breakdown.String), entry.Breakdown); err != nil {
+			return diceLogEntry{}, err
+		}
+	}
+	if recipients.Valid && recipients.String != "" {
+		if err := json.Unmarshal([]byte(recipients.String), &entry.Recipients); err != nil {
+			return diceLogEntry{}, err
+		}
+	}
+	entry.Sides = []int{}
+	if sides.Valid && sides.String != "" {
+		if err := json.Unmarshal([]byte(sides.String), &entry.Sides); err != nil {
+			return diceLogEntry{}, err
+		}
+	}
+	if spec.Valid && spec.String != "" {
+		entry.Spec = &RollSpec{}
+		if err := json.Unmarshal([]byte(spec.String), entry.Spec); err != nil {
+			return diceLogEntry{}, err
+		}
+	}
+	if rule.Valid && rule.String != "" {
+		entry.Rule = &RuleResult{}
+		if err := json.Unmarshal([]byte(rule.String), entry.Rule); err != nil {
+			return diceLogEntry{}, err
+		}
+	}
+	if faces.Valid && faces.String != "" {
+		if err := json.Unmarshal([]byte(faces.String), &entry.Faces); err != nil {
+			return diceLogEntry{}, err
+		}
+	}
+	return entry, nil
+}
+
+// visibleDiceLogsQuery starts a SELECT over the room's dice logs restricted to
+// the rolls viewer may see, for callers to extend with further conditions.
+func visibleDiceLogsQuery(roomID string, viewer clientProfile) (string, []any) {
+	query := `SELECT ` + diceLogColumns + ` FROM dice_logs WHERE room_id = ?`
+	args := []any{roomID}
+	if !isGMProfile(viewer) {
+		query += ` AND (visibility = ? OR EXISTS (SELECT 1 FROM json_each(dice_logs.recipients) WHERE value = ?))`
+		args = append(args, DiceVisibilityPublic, viewer.ID)
+	}
+	return query, args
+}
+
+// getDiceLogs lists a page of the rolls in a room that viewer may see, newest
+// first. The GM sees every roll; other viewers see public rolls and those they
+// are a recipient of. The returned cursor is empty on the last page.
+func (s *Server) getDiceLogs(roomID string, viewer clientProfile, page diceLogPage) ([]diceLogEntry, string, error) {
+	query, args := visibleDiceLogsQuery(roomID, viewer)
+	if page.TriggeredBy != "" {
+		query += ` AND triggered_by = ?`
+		args = append(args, page.TriggeredBy)
+	}
+	if page.Before != nil {
+		query += ` AND (timestamp < ? OR (timestamp = ? AND id < ?))`
+		args = append(args, page.Before.Timestamp, page.Before.Timestamp, page.Before.ID)
+	}
+	limit := page.Limit
+	if limit <= 0 {
+		limit = defaultDiceLogLimit
+	}
+	// Fetch one extra row to learn whether another page follows.
+	query += ` ORDER BY timestamp DESC, id DESC LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer rows.Close()
 
 	logs := make([]diceLogEntry, 0)
 	for rows.Next() {
-		var entry diceLogEntry
-		var results string
-		if err := rows.Scan(&entry.ID, &entry.RoomID, &entry.Seed, &entry.Count, &results, &entry.TriggeredBy, &entry.Timestamp); err != nil {
-			return nil, err
-		}
-		entry.Timestamp = entry.Timestamp.UTC()
-		if err := json.Unmarshal([]byte(results), &entry.Results); err != nil {
-			return nil, err
+		entry, err := scanDiceLog(rows)
+		if err != nil {
+			return nil, "", err
 		}
 		logs = append(logs, entry)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	var next string
+	if len(logs) > limit {
+		logs = logs[:limit]
+		last := logs[len(logs)-1]
+		next = diceLogCursor{Timestamp: last.Timestamp, ID: last.ID}.String()
+	}
+	return logs, next, nil
+}
+
+// pruneDiceLogs deletes the rolls that fall outside the room's retention.
+func pruneDiceLogs(db execer, roomID string, retention DiceRetention) error {
+	if retention.MaxAgeDays > 0 {
+		cutoff := time.Now().UTC().AddDate(0, 0, -retention.MaxAgeDays)
+		if _, err := db.Exec(`DELETE FROM dice_logs WHERE room_id = ? AND timestamp < ?`, roomID, cutoff); err != nil {
+			return err
+		}
+	}
+	if retention.MaxEntries > 0 {
+		if _, err := db.Exec(
+			`DELETE FROM dice_logs WHERE id IN (
+				SELECT id FROM dice_logs WHERE room_id = ? ORDER BY timestamp DESC, id DESC LIMIT -1 OFFSET ?
+			)`,
+			roomID, retention.MaxEntries,
+		); err != nil {
+			return err
+		}
 	}
-	return logs, nil
+	return nil
 }
 
+// storeImage adds an image to a scene, by default the active one.
 func (s *Server) storeImage(roomID string, img imageResponse) (imageResponse, error) {
 	img.RoomID = roomID
+	if img.SceneID == "" {
+		scene, err := s.getActiveScene(roomID)
+		if err != nil {
+			return imageResponse{}, err
+		}
+		img.SceneID = scene.ID
+	}
 	if img.Status == "" {
 		img.Status = "done"
 	}
@@ -955,8 +1621,8 @@ func (s *Server) storeImage(roomID string, img imageResponse) (imageResponse, er
 		hidden = 1
 	}
 	_, err := s.db.Exec(
-		`INSERT INTO images (id, room_id, url, status, created_at, x, y, width, height, hidden) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		img.ID, img.RoomID, img.URL, img.Status, img.CreatedAt, img.X, img.Y, img.Width, img.Height, hidden,
+		`INSERT INTO images (`+imageColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		img.ID, img.RoomID, img.SceneID, img.URL, img.Status, img.CreatedAt, img.X, img.Y, img.Width, img.Height, hidden,
 	)
 	return img, err
 }
@@ -972,47 +1638,85 @@ func (s *Server) storeDiceLog(roomID string, entry diceLogEntry) (diceLogEntry,
 		return diceLogEntry{}, err
 	}
 
-	var existing diceLogEntry
-	var existingResults string
-	err = s.db.QueryRow(
-		`SELECT id, room_id, seed, count, results, triggered_by, timestamp FROM dice_logs WHERE room_id = ? AND seed = ? AND count = ? AND results = ? LIMIT 1`,
-		roomID, entry.Seed, entry.Count, string(resultsJSON),
-	).Scan(&existing.ID, &existing.RoomID, &existing.Seed, &existing.Count, &existingResults, &existing.TriggeredBy, &existing.Timestamp)
-	switch {
-	case err == nil:
-		if err := json.Unmarshal([]byte(existingResults), &existing.Results); err != nil {
+	var breakdown sql.NullString
+	if entry.Breakdown != nil {
+		breakdownJSON, err := json.Marshal(entry.Breakdown)
+		if err != nil {
+			return diceLogEntry{}, err
+		}
+		breakdown = sql.NullString{String: string(breakdownJSON), Valid: true}
+	}
+	if entry.Visibility == "" {
+		entry.Visibility = DiceVisibilityPublic
+	}
+	var recipients sql.NullString
+	if len(entry.Recipients) > 0 {
+		recipientsJSON, err := json.Marshal(entry.Recipients)
+		if err != nil {
 			return diceLogEntry{}, err
 		}
-		existing.Timestamp = existing.Timestamp.UTC()
-		return existing, nil
-	case !errors.Is(err, sql.ErrNoRows):
+		recipients = sql.NullString{String: string(recipientsJSON), Valid: true}
+	}
+	if entry.Sides == nil {
+		entry.Sides = []int{}
+	}
+	sidesJSON, err := json.Marshal(entry.Sides)
+	if err != nil {
 		return diceLogEntry{}, err
 	}
+	var spec, rule sql.NullString
+	if entry.Spec != nil {
+		specJSON, err := json.Marshal(entry.Spec)
+		if err != nil {
+			return diceLogEntry{}, err
+		}
+		spec = sql.NullString{String: string(specJSON), Valid: true}
+	}
+	if entry.Rule != nil {
+		ruleJSON, err := json.Marshal(entry.Rule)
+		if err != nil {
+			return diceLogEntry{}, err
+		}
+		rule = sql.NullString{String: string(ruleJSON), Valid: true}
+	}
+	var faces sql.NullString
+	if len(entry.Faces) > 0 {
+		facesJSON, err := json.Marshal(entry.Faces)
+		if err != nil {
+			return diceLogEntry{}, err
+		}
+		faces = sql.NullString{String: string(facesJSON), Valid: true}
+	}
 
 	entry.ID = s.newID()
 	if _, err := s.db.Exec(
-		`INSERT INTO dice_logs (id, room_id, seed, count, results, triggered_by, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		entry.ID, roomID, entry.Seed, entry.Count, string(resultsJSON), entry.TriggeredBy, entry.Timestamp,
+		`INSERT INTO dice_logs (id, room_id, seed, count, results, triggered_by, timestamp, expression, total, breakdown, visibility, recipients, sides, label, roller_id, modifier, server_seed, commitment, client_seed, request_id,
+			system, spec, rule, parent_id, faces, committed)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.ID, roomID, entry.Seed, entry.Count, string(resultsJSON), entry.TriggeredBy, entry.Timestamp, entry.Expression, entry.Total, breakdown, entry.Visibility, recipients,
+		string(sidesJSON), entry.Label, entry.RollerID, entry.Modifier, entry.ServerSeed, entry.Commitment, entry.ClientSeed, entry.RequestID,
+		entry.System, spec, rule, entry.ParentID, faces, entry.Committed,
 	); err != nil {
 		return diceLogEntry{}, err
 	}
 
-	// Trim to latest 50 entries
-	if _, err := s.db.Exec(
-		`DELETE FROM dice_logs WHERE id IN (
-			SELECT id FROM dice_logs WHERE room_id = ? ORDER BY timestamp DESC, id DESC LIMIT -1 OFFSET 50
-		)`,
-		roomID,
-	); err != nil {
+	var retention DiceRetention
+	if err := s.db.QueryRow(
+		`SELECT dice_retention_entries, dice_retention_days FROM rooms WHERE id = ?`, roomID,
+	).Scan(&retention.MaxEntries, &retention.MaxAgeDays); err != nil {
+		return diceLogEntry{}, err
+	}
+	if err := pruneDiceLogs(s.db, roomID, retention); err != nil {
 		return diceLogEntry{}, err
 	}
 
 	return entry, nil
 }
 
-func (s *Server) nextPosition(roomID string) (float64, float64, error) {
+// nextPosition staggers new images across a scene's canvas.
+func (s *Server) nextPosition(sceneID string) (float64, float64, error) {
 	var count int
-	if err := s.db.QueryRow(`SELECT COUNT(1) FROM images WHERE room_id = ?`, roomID).Scan(&count); err != nil {
+	if err := s.db.QueryRow(`SELECT COUNT(1) FROM images WHERE scene_id = ?`, sceneID).Scan(&count); err != nil {
 		return 0, 0, err
 	}
 	offset := float64((count % 5) * 40)
@@ -1027,40 +1731,63 @@ func (s *Server) isGMActive(roomID string) bool {
 	return ok
 }
 
-func (s *Server) deleteImage(roomID, imageID string) (imageResponse, bool, error) {
-	var img imageResponse
-	var hidden int
-	err := s.db.QueryRow(
-		`SELECT id, room_id, url, status, created_at, x, y, width, height, hidden FROM images WHERE id = ? AND room_id = ?`,
-		imageID, roomID,
-	).Scan(&img.ID, &img.RoomID, &img.URL, &img.Status, &img.CreatedAt, &img.X, &img.Y, &img.Width, &img.Height, &hidden)
+// getImage returns an image. Hidden images and those of inactive scenes are
+// treated as missing unless includeHidden is set, so players cannot probe for
+// them.
+func (s *Server) getImage(roomID, imageID string, includeHidden bool) (imageResponse, bool, error) {
+	img, err := scanImage(s.db.QueryRow(`SELECT `+imageColumns+` FROM images WHERE id = ? AND room_id = ?`, imageID, roomID))
 	if errors.Is(err, sql.ErrNoRows) {
 		return imageResponse{}, false, nil
 	}
 	if err != nil {
 		return imageResponse{}, false, err
 	}
-	img.Hidden = hidden != 0
-	if _, err := s.db.Exec(`DELETE FROM images WHERE id = ? AND room_id = ?`, imageID, roomID); err != nil {
+	if includeHidden {
+		return img, true, nil
+	}
+	withheld, err := s.withheldFromPlayers(roomID, img)
+	if err != nil || withheld {
 		return imageResponse{}, false, err
 	}
 	return img, true, nil
 }
 
-func (s *Server) updateImage(roomID, imageID string, x, y, width, height *float64, hidden *bool) (imageResponse, bool, error) {
-	var img imageResponse
-	var hiddenInt int
-	err := s.db.QueryRow(
-		`SELECT id, room_id, url, status, created_at, x, y, width, height, hidden FROM images WHERE id = ? AND room_id = ?`,
-		imageID, roomID,
-	).Scan(&img.ID, &img.RoomID, &img.URL, &img.Status, &img.CreatedAt, &img.X, &img.Y, &img.Width, &img.Height, &hiddenInt)
-	if errors.Is(err, sql.ErrNoRows) {
-		return imageResponse{}, false, nil
+// withheldFromPlayers reports whether an image is hidden or lies in an
+// inactive scene.
+func (s *Server) withheldFromPlayers(roomID string, img imageResponse) (bool, error) {
+	if img.Hidden {
+		return true, nil
 	}
+	scene, err := s.getActiveScene(roomID)
 	if err != nil {
+		return false, err
+	}
+	return img.SceneID != scene.ID, nil
+}
+
+// deleteImage removes an image. Images withheld from players are treated as
+// missing unless includeHidden is set.
+func (s *Server) deleteImage(roomID, imageID string, includeHidden bool) (imageResponse, bool, error) {
+	img, found, err := s.getImage(roomID, imageID, includeHidden)
+	if err != nil || !found {
+		return imageResponse{}, false, err
+	}
+	if _, err := s.db.Exec(`DELETE FROM images WHERE id = ? AND room_id = ?`, imageID, roomID); err != nil {
 		return imageResponse{}, false, err
 	}
-	img.Hidden = hiddenInt != 0
+	return img, true, nil
+}
+
+// updateImage applies the given changes and returns the image before and after
+// the update. Images withheld from players are treated as missing unless
+// includeHidden is set. With snap, a moved image is aligned to its scene's
+// grid if that snaps.
+func (s *Server) updateImage(roomID, imageID string, includeHidden, snap bool, x, y, width, height *float64, hidden *bool) (imageResponse, imageResponse, bool, error) {
+	img, found, err := s.getImage(roomID, imageID, includeHidden)
+	if err != nil || !found {
+		return imageResponse{}, imageResponse{}, false, err
+	}
+	previous := img
 	if x != nil {
 		img.X = *x
 	}
@@ -1076,14 +1803,23 @@ func (s *Server) updateImage(roomID, imageID string, x, y, width, height *float6
 	if hidden != nil {
 		img.Hidden = *hidden
 	}
+	if snap && (x != nil || y != nil) {
+		grid, err := s.getSceneGrid(roomID, img.SceneID)
+		if err != nil {
+			return imageResponse{}, imageResponse{}, false, err
+		}
+		if grid.Snap {
+			img.X, img.Y = grid.snap(img.X, img.Y, img.Width, img.Height)
+		}
+	}
 	hiddenValue := 0
 	if img.Hidden {
 		hiddenValue = 1
 	}
 	if _, err := s.db.Exec(`UPDATE images SET x = ?, y = ?, width = ?, height = ?, hidden = ? WHERE id = ? AND room_id = ?`, img.X, img.Y, img.Width, img.Height, hiddenValue, imageID, roomID); err != nil {
-		return imageResponse{}, false, err
+		return imageResponse{}, imageResponse{}, false, err
 	}
-	return img, true, nil
+	return img, previous, true, nil
 }
 
 func (s *Server) createRoom(name, createdBy string) (Room, error) {
@@ -1099,21 +1835,20 @@ func (s *Server) createRoom(name, createdBy string) (Room, error) {
 			return Room{}, err
 		}
 		room = Room{
-			ID:        s.newID(),
-			Slug:      slug,
-			Name:      name,
-			Theme:     ThemeDefault,
-			CreatedBy: createdBy,
-			CreatedAt: time.Now().UTC(),
-		}
-		result, err := s.db.Exec(
-			`INSERT OR IGNORE INTO rooms (id, slug, name, theme, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
-			room.ID, room.Slug, room.Name, room.Theme, room.CreatedBy, room.CreatedAt,
-		)
+			ID:            s.newID(),
+			Slug:          slug,
+			Name:          name,
+			Theme:         ThemeDefault,
+			CreatedBy:     createdBy,
+			CreatedAt:     time.Now().UTC(),
+			ActiveSceneID: s.newID(),
+			Grid:          defaultGrid(),
+		}
+		created, err := s.insertRoom(room)
 		if err != nil {
 			return Room{}, err
 		}
-		if rows, _ := result.RowsAffected(); rows > 0 {
+		if created {
 			if err := s.ensureRoomActivity(room.ID, room.CreatedAt); err != nil {
 				return Room{}, err
 			}
@@ -1124,8 +1859,58 @@ func (s *Server) createRoom(name, createdBy string) (Room, error) {
 	return Room{}, errors.New("failed to generate unique room slug")
 }
 
+// insertRoom stores a new room together with its first scene. It reports
+// false, storing nothing, when the slug is taken.
+func (s *Server) insertRoom(room Room) (bool, error) {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	result, err := tx.Exec(
+		`INSERT OR IGNORE INTO rooms (id, slug, name, theme, created_by, created_at, active_scene_id) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		room.ID, room.Slug, room.Name, room.Theme, room.CreatedBy, room.CreatedAt, room.ActiveSceneID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return false, nil
+	}
+	scene := Scene{ID: room.ActiveSceneID, RoomID: room.ID, Name: defaultSceneName, Grid: room.Grid, CreatedAt: room.CreatedAt}
+	if err := insertScene(tx, scene); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// roomColumns reads a room from roomTables. Rooms created before scenes keep
+// their own grid until they get a scene.
+const (
+	roomColumns = `r.id, r.slug, r.name, r.theme, r.created_by, r.created_at, r.dice_retention_entries, r.dice_retention_days, r.rule_system,
+	r.active_scene_id, COALESCE(sc.grid_type, r.grid_type), COALESCE(sc.grid_cell_size, r.grid_cell_size),
+	COALESCE(sc.grid_offset_x, r.grid_offset_x), COALESCE(sc.grid_offset_y, r.grid_offset_y),
+	COALESCE(sc.grid_units_per_cell, r.grid_units_per_cell), COALESCE(sc.grid_unit, r.grid_unit), COALESCE(sc.grid_snap, r.grid_snap),
+	r.vision_enabled`
+	roomTables = `rooms r LEFT JOIN scenes sc ON sc.id = r.active_scene_id`
+)
+
+func scanRoom(row rowScanner) (Room, error) {
+	var room Room
+	if err := row.Scan(&room.ID, &room.Slug, &room.Name, &room.Theme, &room.CreatedBy, &room.CreatedAt,
+		&room.DiceRetention.MaxEntries, &room.DiceRetention.MaxAgeDays, &room.RuleSystem, &room.ActiveSceneID,
+		&room.Grid.Type, &room.Grid.CellSize, &room.Grid.OffsetX, &room.Grid.OffsetY, &room.Grid.UnitsPerCell,
+		&room.Grid.Unit, &room.Grid.Snap, &room.Vision); err != nil {
+		return Room{}, err
+	}
+	room.CreatedAt = room.CreatedAt.UTC()
+	return room, nil
+}
+
 func (s *Server) listRooms() ([]Room, error) {
-	rows, err := s.db.Query(`SELECT id, slug, name, theme, created_by, created_at FROM rooms ORDER BY created_at DESC, id DESC`)
+	rows, err := s.db.Query(`SELECT ` + roomColumns + ` FROM ` + roomTables + ` ORDER BY r.created_at DESC, r.id DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -1133,11 +1918,10 @@ func (s *Server) listRooms() ([]Room, error) {
 
 	rooms := make([]Room, 0)
 	for rows.Next() {
-		var room Room
-		if err := rows.Scan(&room.ID, &room.Slug, &room.Name, &room.Theme, &room.CreatedBy, &room.CreatedAt); err != nil {
+		room, err := scanRoom(rows)
+		if err != nil {
 			return nil, err
 		}
-		room.CreatedAt = room.CreatedAt.UTC()
 		rooms = append(rooms, room)
 	}
 	if err := rows.Err(); err != nil {
@@ -1246,7 +2030,7 @@ func (s *Server) snapshotConnections() (map[string][]clientProfile, map[string]b
 }
 
 func (s *Server) calculateRoomDiskUsage(roomID string) (int64, error) {
-	rows, err := s.db.Query(`SELECT url FROM images WHERE room_id = ?`, roomID)
+	rows, err := s.db.Query(`SELECT url FROM images WHERE room_id = ? UNION SELECT image_url FROM deck_cards WHERE room_id = ?`, roomID, roomID)
 	if err != nil {
 		return 0, err
 	}
@@ -1354,36 +2138,71 @@ func (s *Server) listAdminRooms() ([]AdminRoomSummary, error) {
 }
 
 func (s *Server) getRoomBySlug(slug string) (Room, bool, error) {
-	var room Room
-	err := s.db.QueryRow(`SELECT id, slug, name, theme, created_by, created_at FROM rooms WHERE slug = ?`, slug).
-		Scan(&room.ID, &room.Slug, &room.Name, &room.Theme, &room.CreatedBy, &room.CreatedAt)
+	room, err := scanRoom(s.db.QueryRow(`SELECT `+roomColumns+` FROM `+roomTables+` WHERE r.slug = ?`, slug))
 	if errors.Is(err, sql.ErrNoRows) {
 		return Room{}, false, nil
 	}
 	if err != nil {
 		return Room{}, false, err
 	}
-	room.CreatedAt = room.CreatedAt.UTC()
 	return room, true, nil
 }
 
 func (s *Server) getRoomByID(roomID string) (Room, error) {
-	var room Room
-	err := s.db.QueryRow(`SELECT id, slug, name, theme, created_by, created_at FROM rooms WHERE id = ?`, roomID).
-		Scan(&room.ID, &room.Slug, &room.Name, &room.Theme, &room.CreatedBy, &room.CreatedAt)
-	if err != nil {
-		return Room{}, err
-	}
-	room.CreatedAt = room.CreatedAt.UTC()
-	return room, nil
+	return scanRoom(s.db.QueryRow(`SELECT `+roomColumns+` FROM `+roomTables+` WHERE r.id = ?`, roomID))
+}
+
+// roomUpdate holds the validated settings of a room update; nil fields are
+// left unchanged.
+type roomUpdate struct {
+	Theme         *Theme
+	DiceRetention *DiceRetention
+	RuleSystem    *string
+	Scene         *Scene
+	Vision        *bool
 }
 
-func (s *Server) updateRoomTheme(roomID string, theme Theme) (Room, error) {
-	_, err := s.db.Exec(`UPDATE rooms SET theme = ? WHERE id = ?`, theme, roomID)
+// updateRoom applies a room update in one transaction, pruning the dice
+// history that falls outside new retention limits.
+func (s *Server) updateRoom(roomID string, update roomUpdate) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
 	if err != nil {
-		return Room{}, err
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if update.Theme != nil {
+		if _, err := tx.Exec(`UPDATE rooms SET theme = ? WHERE id = ?`, *update.Theme, roomID); err != nil {
+			return err
+		}
+	}
+	if update.DiceRetention != nil {
+		if _, err := tx.Exec(
+			`UPDATE rooms SET dice_retention_entries = ?, dice_retention_days = ? WHERE id = ?`,
+			update.DiceRetention.MaxEntries, update.DiceRetention.MaxAgeDays, roomID,
+		); err != nil {
+			return err
+		}
+		if err := pruneDiceLogs(tx, roomID, *update.DiceRetention); err != nil {
+			return err
+		}
+	}
+	if update.RuleSystem != nil {
+		if _, err := tx.Exec(`UPDATE rooms SET rule_system = ? WHERE id = ?`, *update.RuleSystem, roomID); err != nil {
+			return err
+		}
+	}
+	if update.Scene != nil {
+		if err := updateScene(tx, *update.Scene); err != nil {
+			return err
+		}
+	}
+	if update.Vision != nil {
+		if _, err := tx.Exec(`UPDATE rooms SET vision_enabled = ? WHERE id = ?`, *update.Vision, roomID); err != nil {
+			return err
+		}
 	}
-	return s.getRoomByID(roomID)
+	return tx.Commit()
 }
 
 func (s *Server) resolveRoomID(identifier string) (string, bool, error) {
@@ -1407,7 +2226,7 @@ func (s *Server) resolveRoomID(identifier string) (string, bool, error) {
 
 func (s *Server) deleteRoom(roomID string) (bool, error) {
 	var urls []string
-	rows, err := s.db.Query(`SELECT url FROM images WHERE room_id = ?`, roomID)
+	rows, err := s.db.Query(`SELECT url FROM images WHERE room_id = ? UNION SELECT image_url FROM deck_cards WHERE room_id = ?`, roomID, roomID)
 	if err != nil {
 		return false, err
 	}
@@ -1687,35 +2506,26 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	role := strings.ToLower(r.URL.Query().Get("role"))
-	if role == "" {
-		role = string(RolePlayer)
+	player, protocol, ok, err := s.authenticateWebsocket(r)
+	if err != nil {
+		s.logger.Error("lookup player for websocket", slog.String("error", err.Error()))
+		http.Error(w, "failed to authenticate", http.StatusInternalServerError)
+		return
 	}
-	name := strings.TrimSpace(r.URL.Query().Get("name"))
-	if name == "" {
-		name = "Okänd"
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
 	}
-	profile := clientProfile{Name: name, Role: role}
+	if player.RoomID != roomID {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	profile := clientProfile{ID: player.ID, Name: player.Name, Role: string(player.Role)}
 
-	// Validate GM role: only allow if no GM is active AND user is the room creator
-	if profile.Role == string(RoleGM) {
-		if s.isGMActive(roomID) {
-			http.Error(w, "gm already active", http.StatusConflict)
-			return
-		}
-		// Check if the user is the room creator. Legacy rooms may have an
-		// unset creator, in which case we allow GM connections to maintain
-		// compatibility with the previous behaviour.
-		room, err := s.getRoomByID(roomID)
-		if err != nil {
-			s.logger.Error("get room for GM validation", slog.String("error", err.Error()))
-			http.Error(w, "failed to validate GM role", http.StatusInternalServerError)
-			return
-		}
-		if room.CreatedBy != "" && room.CreatedBy != name {
-			http.Error(w, "only the room creator can connect as GM", http.StatusForbidden)
-			return
-		}
+	// Only one GM socket may be connected to a room at a time.
+	if profile.Role == string(RoleGM) && s.isGMActive(roomID) {
+		http.Error(w, "gm already active", http.StatusConflict)
+		return
 	}
 
 	if !hasHeaderToken(r.Header.Get("Connection"), "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
@@ -1735,6 +2545,9 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 		"Connection":           {"Upgrade"},
 		"Sec-WebSocket-Accept": {accept},
 	}
+	if protocol != "" {
+		headers.Set("Sec-WebSocket-Protocol", protocol)
+	}
 	if origin != "" {
 		headers.Set("Access-Control-Allow-Origin", allowedOrigin)
 		if allowedOrigin != "*" {
@@ -1869,19 +2682,38 @@ func (s *Server) readLoop(roomID string, client *wsConn) {
 	}
 }
 
+// broadcastSharedImage pushes an image to the sockets that may see it. Players
+// who may not are told to drop a visible image, since it may have just moved
+// under fog; dropping a hidden image is left to the caller.
 func (s *Server) broadcastSharedImage(roomID string, img imageResponse) {
-	payload, err := json.Marshal(map[string]any{
-		"type":    "SharedImage",
-		"payload": img,
-	})
-	if err != nil {
-		s.logger.Error("marshal shared image", slog.String("error", err.Error()))
+	audience := s.imageAudience(roomID, img)
+	s.sendSharedImage(roomID, img, audience)
+	if audience != nil && !img.Hidden && s.sceneAudience(roomID, img.SceneID) == nil {
+		s.broadcastImageRemoved(roomID, img.ID, func(profile clientProfile) bool {
+			return !audience(profile)
+		})
+	}
+}
+
+// broadcastImageHidden tells non-GM sockets to drop an image that was just
+// hidden. Images of inactive scenes never reached them.
+func (s *Server) broadcastImageHidden(roomID string, img imageResponse) {
+	if s.sceneAudience(roomID, img.SceneID) != nil {
 		return
 	}
-	s.broadcast(roomID, payload)
+	s.broadcastImageRemoved(roomID, img.ID, func(profile clientProfile) bool {
+		return !isGMProfile(profile)
+	})
+}
+
+// broadcastImageDeleted tells everyone who may know an image to drop it.
+func (s *Server) broadcastImageDeleted(roomID string, img imageResponse) {
+	s.broadcastImageRemoved(roomID, img.ID, s.sceneAudience(roomID, img.SceneID))
 }
 
-func (s *Server) broadcastImageDeleted(roomID, imageID string) {
+// broadcastImageRemoved tells the sockets accepted by include, or the whole
+// room when include is nil, to drop an image.
+func (s *Server) broadcastImageRemoved(roomID, imageID string, include func(clientProfile) bool) {
 	payload, err := json.Marshal(map[string]any{
 		"type":    "SharedImageDeleted",
 		"payload": map[string]string{"id": imageID},
@@ -1890,7 +2722,11 @@ func (s *Server) broadcastImageDeleted(roomID, imageID string) {
 		s.logger.Error("marshal delete", slog.String("error", err.Error()))
 		return
 	}
-	s.broadcast(roomID, payload)
+	if include == nil {
+		s.broadcast(roomID, payload)
+		return
+	}
+	s.broadcastWhere(roomID, payload, include)
 }
 
 func (s *Server) broadcastThemeChange(roomID string, theme Theme) {
@@ -1923,6 +2759,36 @@ func (s *Server) broadcast(roomID string, payload []byte) {
 	}
 }
 
+// broadcastWhere sends payload to the sockets in a room whose profile matches include.
+func (s *Server) broadcastWhere(roomID string, payload []byte, include func(clientProfile) bool) {
+	s.wsMu.Lock()
+	peers := s.wsRooms[roomID]
+	conns := make([]*wsConn, 0, len(peers))
+	for c, profile := range peers {
+		if include(profile) {
+			conns = append(conns, c)
+		}
+	}
+	s.wsMu.Unlock()
+	s.logger.Info("broadcast filtered", slog.String("room", roomID), slog.Int("peers", len(conns)))
+	for _, c := range conns {
+		if err := c.write(0x1, payload); err != nil {
+			s.logger.Error("broadcast filtered", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// sendToPlayer sends payload to the sockets of one player in a room.
+func (s *Server) sendToPlayer(roomID, playerID string, payload []byte) {
+	s.broadcastWhere(roomID, payload, func(profile clientProfile) bool {
+		return profile.ID == playerID
+	})
+}
+
+func isGMProfile(profile clientProfile) bool {
+	return profile.Role == string(RoleGM)
+}
+
 func (s *Server) broadcastRoster(roomID string) {
 	s.wsMu.Lock()
 	peers := s.wsRooms[roomID]
@@ -1964,23 +2830,103 @@ func (s *Server) handleWSMessage(roomID string, sender *wsConn, data []byte) {
 	}
 
 	switch msg.Type {
-	case "DiceRoll":
-		var dicePayload DiceRollPayload
-		if err := json.Unmarshal(msg.Payload, &dicePayload); err != nil {
+	case "RollDice", "DiceRoll":
+		if msg.Type == "DiceRoll" && s.cfg.LegacyDiceResults {
+			// Legacy clients pick their own seed; relay it untouched.
+			var dicePayload DiceRollPayload
+			if err := json.Unmarshal(msg.Payload, &dicePayload); err != nil {
+				s.logger.Error("unmarshal dice roll", slog.String("error", err.Error()))
+				return
+			}
+			if sender != nil {
+				dicePayload.TriggeredBy = sender.profile.Name
+			}
+			if dicePayload.TriggeredBy == "" {
+				dicePayload.TriggeredBy = "Okänd"
+			}
+			dicePayload.Results = nil
+			dicePayload.Breakdown = nil
+			dicePayload.Visibility = ""
+			s.broadcastDiceRoll(roomID, dicePayload, nil)
+			return
+		}
+		if sender == nil {
+			return
+		}
+		var req diceRollRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
 			s.logger.Error("unmarshal dice roll", slog.String("error", err.Error()))
 			return
 		}
-		if sender != nil {
-			dicePayload.TriggeredBy = sender.profile.Name
+		if err := s.rollDiceOnce(roomID, sender, req); err != nil {
+			s.logger.Error("roll dice", slog.String("room", roomID), slog.String("error", err.Error()))
+		}
+	case "RunMacro":
+		if sender == nil {
+			return
+		}
+		var req runMacroRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			s.logger.Error("unmarshal run macro", slog.String("error", err.Error()))
+			return
+		}
+		if err := s.runMacro(roomID, sender, req); err != nil {
+			s.logger.Error("run macro", slog.String("room", roomID), slog.String("error", err.Error()))
+		}
+	case "RollTable":
+		if sender == nil {
+			return
+		}
+		var req rollTableRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			s.logger.Error("unmarshal roll table", slog.String("error", err.Error()))
+			return
+		}
+		if err := s.rollTable(roomID, sender, req); err != nil {
+			s.logger.Error("roll table", slog.String("room", roomID), slog.String("error", err.Error()))
+		}
+	case "RollRequest":
+		if sender == nil {
+			return
+		}
+		var cmd rollRequestCommand
+		if err := json.Unmarshal(msg.Payload, &cmd); err != nil {
+			s.logger.Error("unmarshal roll request", slog.String("error", err.Error()))
+			return
+		}
+		if _, err := s.createRollRequest(roomID, sender.profile, cmd); err != nil {
+			s.logger.Error("roll request", slog.String("room", roomID), slog.String("error", err.Error()))
+		}
+	case "MoveToken":
+		if sender == nil {
+			return
+		}
+		var req moveTokenRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			s.logger.Error("unmarshal move token", slog.String("error", err.Error()))
+			return
+		}
+		if err := s.moveToken(roomID, sender, req); err != nil {
+			s.logger.Error("move token", slog.String("room", roomID), slog.String("error", err.Error()))
 		}
-		if dicePayload.TriggeredBy == "" {
-			dicePayload.TriggeredBy = "Okänd"
+	case "SetFog", "RevealFog", "CoverFog":
+		if sender == nil {
+			return
+		}
+		if err := s.handleFogCommand(roomID, sender, msg.Type, msg.Payload); err != nil {
+			s.logger.Error("change fog", slog.String("room", roomID), slog.String("error", err.Error()))
+		}
+	case "RequestDiceCommitment":
+		if sender == nil {
+			return
 		}
-		s.broadcastDiceRoll(roomID, dicePayload)
+		s.sendDiceCommitment(roomID, sender.profile.ID)
 	}
 }
 
-func (s *Server) broadcastDiceRoll(roomID string, diceRoll DiceRollPayload) {
+// broadcastDiceRoll sends the roll animation to the sockets accepted by
+// audience, or to the whole room when audience is nil.
+func (s *Server) broadcastDiceRoll(roomID string, diceRoll DiceRollPayload, audience func(clientProfile) bool) {
 	payload, err := json.Marshal(map[string]any{
 		"type":    "DiceRoll",
 		"payload": diceRoll,
@@ -1997,6 +2943,10 @@ func (s *Server) broadcastDiceRoll(roomID string, diceRoll DiceRollPayload) {
 		slog.Int("sides", diceRoll.Sides),
 		slog.String("triggeredBy", diceRoll.TriggeredBy),
 	)
+	if audience != nil {
+		s.broadcastWhere(roomID, payload, audience)
+		return
+	}
 	s.broadcast(roomID, payload)
 }
 
@@ -2009,6 +2959,10 @@ func (s *Server) broadcastDiceLog(roomID string, entry diceLogEntry) {
 		s.logger.Error("marshal dice log", slog.String("error", err.Error()))
 		return
 	}
+	if entry.Visibility != DiceVisibilityPublic {
+		s.broadcastWhere(roomID, payload, entry.visibleTo)
+		return
+	}
 	s.broadcast(roomID, payload)
 }
 
@@ -257,6 +257,100 @@ func createRoomForTest(t *testing.T, router http.Handler) Room {
 	return room
 }
 
+func joinRoomForTest(t *testing.T, router http.Handler, room Room, name string, role Role) Player {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"slug": room.Slug, "name": name, "role": string(role)})
+	req := httptest.NewRequest(http.MethodPost, "/rooms/join", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 join, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Player Player `json:"player"`
+	}
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	return resp.Player
+}
+
+// dialWebsocketForTest performs a raw WebSocket handshake against serverURL and
+// returns the upgraded connection.
+func dialWebsocketForTest(t *testing.T, serverURL, path string, header http.Header) net.Conn {
+	t.Helper()
+	parsed, _ := url.Parse(serverURL)
+	conn, err := net.Dial("tcp", parsed.Host)
+	if err != nil {
+		t.Fatalf("dial server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\n", path)
+	fmt.Fprintf(conn, "Host: %s\r\n", parsed.Host)
+	fmt.Fprint(conn, "Upgrade: websocket\r\n")
+	fmt.Fprint(conn, "Connection: Upgrade\r\n")
+	fmt.Fprintf(conn, "Sec-WebSocket-Key: %s\r\n", encodedKey)
+	fmt.Fprint(conn, "Sec-WebSocket-Version: 13\r\n")
+	for name, values := range header {
+		for _, value := range values {
+			fmt.Fprintf(conn, "%s: %s\r\n", name, value)
+		}
+	}
+	fmt.Fprint(conn, "\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		t.Fatalf("handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected handshake status: %d", resp.StatusCode)
+	}
+	// Frames sent right after the handshake may already sit in the reader.
+	return bufferedConn{Conn: conn, reader: reader}
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// readWSMessageForTest returns the payload of the next message of the given type.
+func readWSMessageForTest(t *testing.T, conn net.Conn, msgType string) json.RawMessage {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		opcode, payload, err := readFrame(conn)
+		if err != nil {
+			t.Fatalf("read %s: %v", msgType, err)
+		}
+		if opcode != 0x1 {
+			continue
+		}
+		var envelope struct {
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		if err := json.Unmarshal(payload, &envelope); err != nil {
+			t.Fatalf("decode %s: %v", msgType, err)
+		}
+		if envelope.Type == msgType {
+			return envelope.Payload
+		}
+	}
+}
+
+func authorize(req *http.Request, player Player) {
+	req.Header.Set("Authorization", "Bearer "+player.Token)
+}
+
 func createLegacyRoomForTest(t *testing.T, srv *Server, name string) Room {
 	t.Helper()
 
@@ -719,10 +813,13 @@ func TestRoomAndImageLifecycle(t *testing.T) {
 		t.Fatalf("expected lookup id %s, got %s", room.ID, lookedUp.ID)
 	}
 
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+
 	// upload image via URL using slug resolution
 	imgBody, _ := json.Marshal(map[string]any{"url": "https://example.com/img.png"})
 	imgReq := httptest.NewRequest(http.MethodPost, "/rooms/"+room.Slug+"/images", bytes.NewReader(imgBody))
 	imgReq.Header.Set("Content-Type", "application/json")
+	authorize(imgReq, gm)
 	iw := httptest.NewRecorder()
 	router.ServeHTTP(iw, imgReq)
 	if iw.Code != http.StatusCreated {
@@ -861,31 +958,9 @@ func TestWebsocketBroadcast(t *testing.T) {
 	defer resp.Body.Close()
 	var room Room
 	_ = json.NewDecoder(resp.Body).Decode(&room)
+	gm := joinRoomForTest(t, app.Router(), room, "Test Creator", RoleGM)
 
-	serverURL, _ := url.Parse(srv.URL)
-	conn, err := net.Dial("tcp", serverURL.Host)
-	if err != nil {
-		t.Fatalf("dial server: %v", err)
-	}
-	t.Cleanup(func() { conn.Close() })
-
-	key := make([]byte, 16)
-	_, _ = rand.Read(key)
-	encodedKey := base64.StdEncoding.EncodeToString(key)
-	fmt.Fprintf(conn, "GET /ws/rooms/%s?name=test HTTP/1.1\r\n", room.Slug)
-	fmt.Fprintf(conn, "Host: %s\r\n", serverURL.Host)
-	fmt.Fprint(conn, "Upgrade: websocket\r\n")
-	fmt.Fprint(conn, "Connection: Upgrade\r\n")
-	fmt.Fprintf(conn, "Sec-WebSocket-Key: %s\r\n", encodedKey)
-	fmt.Fprint(conn, "Sec-WebSocket-Version: 13\r\n\r\n")
-
-	respResp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodGet})
-	if err != nil {
-		t.Fatalf("handshake response: %v", err)
-	}
-	if respResp.StatusCode != http.StatusSwitchingProtocols {
-		t.Fatalf("unexpected handshake status: %d", respResp.StatusCode)
-	}
+	conn := dialWebsocketForTest(t, srv.URL, "/ws/rooms/"+room.Slug+"?token="+url.QueryEscape(gm.Token), nil)
 
 	recvCh := make(chan SharedImage, 1)
 	errCh := make(chan error, 1)
@@ -933,6 +1008,7 @@ func TestWebsocketBroadcast(t *testing.T) {
 
 	uploadReq, _ := http.NewRequest(http.MethodPost, srv.URL+"/rooms/"+room.Slug+"/images", buf)
 	uploadReq.Header.Set("Content-Type", mw.FormDataContentType())
+	authorize(uploadReq, gm)
 
 	t.Log("sending upload request")
 	uploadResp, err := srv.Client().Do(uploadReq)
@@ -1066,9 +1142,12 @@ func TestEmptyCollectionsReturnArrays(t *testing.T) {
 		// Don't add any files, just close the writer
 		mw.Close()
 
+		gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+
 		req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/images", buf)
 		req.Header.Set("Content-Type", mw.FormDataContentType())
 		req.Header.Set("Accept", "application/json")
+		authorize(req, gm)
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
 
@@ -1090,11 +1169,13 @@ func TestImageHiddenToggle(t *testing.T) {
 	
 	// Create a room
 	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
 	
 	// Add an image via URL
 	body, _ := json.Marshal(map[string]string{"url": "https://example.com/test.png"})
 	req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/images", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
+	authorize(req, gm)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 	
@@ -1116,6 +1197,7 @@ func TestImageHiddenToggle(t *testing.T) {
 	hideBody, _ := json.Marshal(map[string]bool{"hidden": true})
 	req = httptest.NewRequest(http.MethodPatch, "/rooms/"+room.ID+"/images/"+img.ID, bytes.NewReader(hideBody))
 	req.Header.Set("Content-Type", "application/json")
+	authorize(req, gm)
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 	
@@ -1136,6 +1218,7 @@ func TestImageHiddenToggle(t *testing.T) {
 	// Fetch images and verify hidden state persisted
 	req = httptest.NewRequest(http.MethodGet, "/rooms/"+room.ID+"/images", nil)
 	req.Header.Set("Accept", "application/json")
+	authorize(req, gm)
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 	
@@ -1160,6 +1243,7 @@ func TestImageHiddenToggle(t *testing.T) {
 	showBody, _ := json.Marshal(map[string]bool{"hidden": false})
 	req = httptest.NewRequest(http.MethodPatch, "/rooms/"+room.ID+"/images/"+img.ID, bytes.NewReader(showBody))
 	req.Header.Set("Content-Type", "application/json")
+	authorize(req, gm)
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 	
@@ -1177,3 +1261,103 @@ func TestImageHiddenToggle(t *testing.T) {
 		t.Fatalf("expected image to be visible, got hidden=true")
 	}
 }
+
+func TestHiddenImagesAreWithheldFromPlayers(t *testing.T) {
+	app := newTestServer(t, t.TempDir())
+	router := app.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	player := joinRoomForTest(t, router, room, "Player One", RolePlayer)
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	gmConn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(gm.Token), nil)
+	playerConn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(player.Token), nil)
+
+	body, _ := json.Marshal(map[string]string{"url": "https://example.com/secret.png"})
+	req := httptest.NewRequest(http.MethodPost, "/rooms/"+room.ID+"/images", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	authorize(req, gm)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for image creation, got %d: %s", w.Code, w.Body.String())
+	}
+	var img imageResponse
+	_ = json.NewDecoder(w.Body).Decode(&img)
+	readWSMessageForTest(t, gmConn, "SharedImage")
+	readWSMessageForTest(t, playerConn, "SharedImage")
+
+	patchImage := func(who Player, payload any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(http.MethodPatch, "/rooms/"+room.ID+"/images/"+img.ID, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		authorize(req, who)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	listImages := func(who *Player) []imageResponse {
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+room.ID+"/images", nil)
+		req.Header.Set("Accept", "application/json")
+		if who != nil {
+			authorize(req, *who)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 listing images, got %d", w.Code)
+		}
+		var images []imageResponse
+		_ = json.NewDecoder(w.Body).Decode(&images)
+		return images
+	}
+
+	if w := patchImage(player, map[string]bool{"hidden": true}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 when a player hides an image, got %d", w.Code)
+	}
+	if w := patchImage(gm, map[string]bool{"hidden": true}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 when the GM hides an image, got %d", w.Code)
+	}
+
+	var removed map[string]string
+	_ = json.Unmarshal(readWSMessageForTest(t, playerConn, "SharedImageDeleted"), &removed)
+	if removed["id"] != img.ID {
+		t.Fatalf("expected player removal for %s, got %+v", img.ID, removed)
+	}
+	var gmCopy imageResponse
+	_ = json.Unmarshal(readWSMessageForTest(t, gmConn, "SharedImage"), &gmCopy)
+	if gmCopy.ID != img.ID || !gmCopy.Hidden {
+		t.Fatalf("expected GM to receive hidden image, got %+v", gmCopy)
+	}
+
+	if images := listImages(nil); len(images) != 0 {
+		t.Fatalf("expected anonymous read to omit hidden images, got %+v", images)
+	}
+	if images := listImages(&player); len(images) != 0 {
+		t.Fatalf("expected player read to omit hidden images, got %+v", images)
+	}
+	if images := listImages(&gm); len(images) != 1 || !images[0].Hidden {
+		t.Fatalf("expected GM read to include hidden image, got %+v", images)
+	}
+
+	if w := patchImage(player, map[string]float64{"x": 5}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 when a player moves a hidden image, got %d", w.Code)
+	}
+	delReq := httptest.NewRequest(http.MethodDelete, "/rooms/"+room.ID+"/images/"+img.ID, nil)
+	authorize(delReq, player)
+	delW := httptest.NewRecorder()
+	router.ServeHTTP(delW, delReq)
+	if delW.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 when a player deletes a hidden image, got %d", delW.Code)
+	}
+
+	if w := patchImage(gm, map[string]bool{"hidden": false}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 when the GM reveals an image, got %d", w.Code)
+	}
+	var revealed imageResponse
+	_ = json.Unmarshal(readWSMessageForTest(t, playerConn, "SharedImage"), &revealed)
+	if revealed.ID != img.ID || revealed.Hidden {
+		t.Fatalf("expected player to receive revealed image, got %+v", revealed)
+	}
+}
@@ -2,12 +2,15 @@ package server
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"path/filepath"
 	"strings"
 
 	_ "modernc.org/sqlite"
+
+	"vtrpg/internal/dice"
 )
 
 // openDatabase prepares a SQLite database at the given path and ensures the schema exists.
@@ -49,8 +52,38 @@ func initSchema(db *sql.DB) error {
 			name TEXT NOT NULL,
 			theme TEXT NOT NULL DEFAULT 'default',
 			created_by TEXT,
-			created_at TIMESTAMP NOT NULL
+			created_at TIMESTAMP NOT NULL,
+			dice_retention_entries INTEGER NOT NULL DEFAULT 0,
+			dice_retention_days INTEGER NOT NULL DEFAULT 0,
+			rule_system TEXT NOT NULL DEFAULT 'generic',
+			grid_type TEXT NOT NULL DEFAULT 'square',
+			grid_cell_size REAL NOT NULL DEFAULT 70,
+			grid_offset_x REAL NOT NULL DEFAULT 0,
+			grid_offset_y REAL NOT NULL DEFAULT 0,
+			grid_units_per_cell REAL NOT NULL DEFAULT 5,
+			grid_unit TEXT NOT NULL DEFAULT 'ft',
+			grid_snap INTEGER NOT NULL DEFAULT 0,
+			fog_enabled INTEGER NOT NULL DEFAULT 0,
+			vision_enabled INTEGER NOT NULL DEFAULT 0,
+			active_scene_id TEXT NOT NULL DEFAULT ''
 		);`,
+		`CREATE TABLE IF NOT EXISTS scenes (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			background TEXT NOT NULL DEFAULT '',
+			grid_type TEXT NOT NULL DEFAULT 'square',
+			grid_cell_size REAL NOT NULL DEFAULT 70,
+			grid_offset_x REAL NOT NULL DEFAULT 0,
+			grid_offset_y REAL NOT NULL DEFAULT 0,
+			grid_units_per_cell REAL NOT NULL DEFAULT 5,
+			grid_unit TEXT NOT NULL DEFAULT 'ft',
+			grid_snap INTEGER NOT NULL DEFAULT 0,
+			fog_enabled INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_scenes_room ON scenes(room_id, created_at);`,
 		`CREATE TABLE IF NOT EXISTS room_activity (
 			room_id TEXT PRIMARY KEY,
 			last_used_at TIMESTAMP,
@@ -78,6 +111,7 @@ func initSchema(db *sql.DB) error {
 			width REAL NOT NULL DEFAULT 0,
 			height REAL NOT NULL DEFAULT 0,
 			hidden INTEGER NOT NULL DEFAULT 0,
+			scene_id TEXT NOT NULL DEFAULT '',
 			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
 		);`,
 		`CREATE TABLE IF NOT EXISTS dice_logs (
@@ -88,8 +122,189 @@ func initSchema(db *sql.DB) error {
 			results TEXT NOT NULL,
 			triggered_by TEXT NOT NULL,
 			timestamp TIMESTAMP NOT NULL,
+			expression TEXT NOT NULL DEFAULT '',
+			total INTEGER NOT NULL DEFAULT 0,
+			breakdown TEXT,
+			visibility TEXT NOT NULL DEFAULT 'public',
+			recipients TEXT,
+			sides TEXT,
+			label TEXT NOT NULL DEFAULT '',
+			roller_id TEXT NOT NULL DEFAULT '',
+			modifier INTEGER NOT NULL DEFAULT 0,
+			server_seed TEXT NOT NULL DEFAULT '',
+			commitment TEXT NOT NULL DEFAULT '',
+			client_seed TEXT NOT NULL DEFAULT '',
+			request_id TEXT NOT NULL DEFAULT '',
+			system TEXT NOT NULL DEFAULT '',
+			spec TEXT,
+			rule TEXT,
+			parent_id TEXT NOT NULL DEFAULT '',
+			faces TEXT,
+			committed INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS dice_commitments (
+			room_id TEXT NOT NULL,
+			player_id TEXT NOT NULL,
+			server_seed TEXT NOT NULL,
+			commitment TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY(room_id, player_id),
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			room_id TEXT NOT NULL,
+			player_id TEXT NOT NULL,
+			key TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			status INTEGER NOT NULL DEFAULT 0,
+			response TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY(room_id, player_id, key),
 			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
 		);`,
+		`CREATE TABLE IF NOT EXISTS macros (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			player_id TEXT,
+			name TEXT NOT NULL,
+			expression TEXT NOT NULL,
+			label TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE,
+			FOREIGN KEY(player_id) REFERENCES players(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS dice_types (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			faces TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS random_tables (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			dice TEXT NOT NULL DEFAULT '',
+			entries TEXT NOT NULL,
+			gm_only INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS tokens (
+			image_id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			owner_id TEXT NOT NULL DEFAULT '',
+			name TEXT NOT NULL,
+			hp INTEGER NOT NULL DEFAULT 0,
+			max_hp INTEGER NOT NULL DEFAULT 0,
+			size TEXT NOT NULL DEFAULT 'medium',
+			vision_radius REAL NOT NULL DEFAULT 0,
+			FOREIGN KEY(image_id) REFERENCES images(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_tokens_room ON tokens(room_id);`,
+		`CREATE TABLE IF NOT EXISTS walls (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			x1 REAL NOT NULL,
+			y1 REAL NOT NULL,
+			x2 REAL NOT NULL,
+			y2 REAL NOT NULL,
+			door INTEGER NOT NULL DEFAULT 0,
+			open INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			scene_id TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_walls_room ON walls(room_id);`,
+		`CREATE TABLE IF NOT EXISTS lights (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			x REAL NOT NULL,
+			y REAL NOT NULL,
+			radius REAL NOT NULL,
+			intensity REAL NOT NULL DEFAULT 1,
+			color TEXT NOT NULL DEFAULT '',
+			shadows INTEGER NOT NULL DEFAULT 1,
+			created_at TIMESTAMP NOT NULL,
+			scene_id TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_lights_room ON lights(room_id);`,
+		`CREATE TABLE IF NOT EXISTS scene_fog_cells (
+			scene_id TEXT NOT NULL,
+			col INTEGER NOT NULL,
+			row INTEGER NOT NULL,
+			PRIMARY KEY(scene_id, col, row),
+			FOREIGN KEY(scene_id) REFERENCES scenes(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS initiative_trackers (
+			room_id TEXT PRIMARY KEY,
+			round INTEGER NOT NULL DEFAULT 0,
+			current_id TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS initiative_entries (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			player_id TEXT NOT NULL DEFAULT '',
+			image_id TEXT NOT NULL DEFAULT '',
+			initiative INTEGER,
+			dice TEXT NOT NULL DEFAULT '',
+			tiebreaker INTEGER NOT NULL DEFAULT 0,
+			hidden INTEGER NOT NULL DEFAULT 0,
+			position INTEGER NOT NULL,
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_initiative_entries_room ON initiative_entries(room_id, position);`,
+		`CREATE TABLE IF NOT EXISTS effects (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			target_type TEXT NOT NULL,
+			target_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			source TEXT NOT NULL DEFAULT '',
+			unit TEXT NOT NULL,
+			duration INTEGER NOT NULL,
+			remaining INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_effects_target ON effects(room_id, target_type, target_id);`,
+		`CREATE TABLE IF NOT EXISTS decks (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY(room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS deck_cards (
+			id TEXT PRIMARY KEY,
+			deck_id TEXT NOT NULL,
+			room_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			code TEXT NOT NULL DEFAULT '',
+			image_url TEXT NOT NULL,
+			zone TEXT NOT NULL DEFAULT 'draw',
+			holder_id TEXT NOT NULL DEFAULT '',
+			position INTEGER NOT NULL DEFAULT 0,
+			image_id TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY(deck_id) REFERENCES decks(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_decks_room ON decks(room_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_deck_cards_deck_zone ON deck_cards(deck_id, zone, position);`,
+		`CREATE INDEX IF NOT EXISTS idx_deck_cards_holder ON deck_cards(room_id, holder_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_random_tables_room ON random_tables(room_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_dice_types_room ON dice_types(room_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_macros_room_player ON macros(room_id, player_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON idempotency_keys(created_at);`,
 		`CREATE INDEX IF NOT EXISTS idx_dice_logs_room_timestamp ON dice_logs(room_id, timestamp DESC, id DESC);`,
 		`CREATE INDEX IF NOT EXISTS idx_images_room_created ON images(room_id, created_at);`,
 		`CREATE INDEX IF NOT EXISTS idx_players_room_created ON players(room_id, created_at DESC, id DESC);`,
@@ -102,17 +317,170 @@ func initSchema(db *sql.DB) error {
 		}
 	}
 
-	// Migration: add theme column if it doesn't exist
-	if _, err := db.Exec(`ALTER TABLE rooms ADD COLUMN theme TEXT NOT NULL DEFAULT 'default'`); err != nil {
-		// Ignore error if column already exists (SQLite returns an error for duplicate columns)
-		if err.Error() != "duplicate column name: theme" && !strings.Contains(err.Error(), "duplicate column") {
-			// Column might already exist, which is fine
+	// Migrations for databases created before a column existed. SQLite has no
+	// ADD COLUMN IF NOT EXISTS, so duplicate column errors are ignored.
+	migrations := []string{
+		`ALTER TABLE rooms ADD COLUMN theme TEXT NOT NULL DEFAULT 'default'`,
+		`ALTER TABLE rooms ADD COLUMN dice_retention_entries INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE rooms ADD COLUMN dice_retention_days INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE rooms ADD COLUMN rule_system TEXT NOT NULL DEFAULT 'generic'`,
+		`ALTER TABLE rooms ADD COLUMN grid_type TEXT NOT NULL DEFAULT 'square'`,
+		`ALTER TABLE rooms ADD COLUMN grid_cell_size REAL NOT NULL DEFAULT 70`,
+		`ALTER TABLE rooms ADD COLUMN grid_offset_x REAL NOT NULL DEFAULT 0`,
+		`ALTER TABLE rooms ADD COLUMN grid_offset_y REAL NOT NULL DEFAULT 0`,
+		`ALTER TABLE rooms ADD COLUMN grid_units_per_cell REAL NOT NULL DEFAULT 5`,
+		`ALTER TABLE rooms ADD COLUMN grid_unit TEXT NOT NULL DEFAULT 'ft'`,
+		`ALTER TABLE rooms ADD COLUMN grid_snap INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE rooms ADD COLUMN fog_enabled INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE rooms ADD COLUMN vision_enabled INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE rooms ADD COLUMN active_scene_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE images ADD COLUMN scene_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE walls ADD COLUMN scene_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE lights ADD COLUMN scene_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE dice_logs ADD COLUMN expression TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE dice_logs ADD COLUMN total INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE dice_logs ADD COLUMN breakdown TEXT`,
+		`ALTER TABLE dice_logs ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public'`,
+		`ALTER TABLE dice_logs ADD COLUMN recipients TEXT`,
+		`ALTER TABLE dice_logs ADD COLUMN sides TEXT`,
+		`ALTER TABLE dice_logs ADD COLUMN label TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE dice_logs ADD COLUMN roller_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE dice_logs ADD COLUMN modifier INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE dice_logs ADD COLUMN server_seed TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE dice_logs ADD COLUMN commitment TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE dice_logs ADD COLUMN client_seed TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE dice_logs ADD COLUMN request_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE dice_logs ADD COLUMN system TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE dice_logs ADD COLUMN spec TEXT`,
+		`ALTER TABLE dice_logs ADD COLUMN rule TEXT`,
+		`ALTER TABLE dice_logs ADD COLUMN parent_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE dice_logs ADD COLUMN faces TEXT`,
+		`ALTER TABLE dice_logs ADD COLUMN committed INTEGER NOT NULL DEFAULT 0`,
+		`CREATE INDEX IF NOT EXISTS idx_images_scene ON images(scene_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_walls_scene ON walls(scene_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_lights_scene ON lights(scene_id)`,
+	}
+	for _, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return fmt.Errorf("migrate schema: %w", err)
+		}
+	}
+
+	if err := backfillDiceLogMetadata(db); err != nil {
+		return fmt.Errorf("backfill dice logs: %w", err)
+	}
+	if err := backfillScenes(db); err != nil {
+		return fmt.Errorf("backfill scenes: %w", err)
+	}
+
+	return nil
+}
+
+// backfillDiceLogMetadata fills in the roll metadata of dice logs written
+// before it was stored. Rows still to be processed have NULL sides. Sides,
+// modifier and expression are recovered from the stored breakdown; older rows
+// without one keep an empty sides list. The roller ID is matched by name,
+// which is unique within a room.
+func backfillDiceLogMetadata(db *sql.DB) error {
+	if _, err := db.Exec(
+		`UPDATE dice_logs SET roller_id = COALESCE(
+			(SELECT id FROM players WHERE players.room_id = dice_logs.room_id AND players.name = dice_logs.triggered_by), ''
+		) WHERE sides IS NULL AND roller_id = ''`,
+	); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT id, breakdown FROM dice_logs WHERE sides IS NULL`)
+	if err != nil {
+		return err
+	}
+	type backfill struct {
+		id         string
+		sides      string
+		modifier   int
+		expression string
+	}
+	var updates []backfill
+	for rows.Next() {
+		var id string
+		var breakdown sql.NullString
+		if err := rows.Scan(&id, &breakdown); err != nil {
+			rows.Close()
+			return err
+		}
+		update := backfill{id: id, sides: "[]"}
+		var result dice.Result
+		if breakdown.Valid && breakdown.String != "" && json.Unmarshal([]byte(breakdown.String), &result) == nil {
+			sides, err := json.Marshal(result.Sides())
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			update.sides = string(sides)
+			update.modifier = result.Modifier()
+			update.expression = result.Expression
 		}
+		updates = append(updates, update)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
+	for _, update := range updates {
+		if _, err := db.Exec(
+			`UPDATE dice_logs SET sides = ?, modifier = ?, expression = CASE WHEN expression = '' THEN ? ELSE expression END WHERE id = ?`,
+			update.sides, update.modifier, update.expression, update.id,
+		); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// backfillScenes gives every room without a scene, that is every room created
+// before scenes existed, a scene holding its grid, fog, images, walls and
+// lights. The room's own grid and fog columns are only read here. Fog cells
+// of the old per-room table move to the new scene once, after which the table
+// is dropped.
+func backfillScenes(db *sql.DB) error {
+	if _, err := db.Exec(
+		`INSERT OR IGNORE INTO scenes (id, room_id, name, grid_type, grid_cell_size, grid_offset_x, grid_offset_y, grid_units_per_cell,
+			grid_unit, grid_snap, fog_enabled, created_at)
+		SELECT id || '-scene', id, ?, grid_type, grid_cell_size, grid_offset_x, grid_offset_y, grid_units_per_cell,
+			grid_unit, grid_snap, fog_enabled, created_at FROM rooms WHERE active_scene_id = ''`,
+		defaultSceneName,
+	); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		`UPDATE rooms SET active_scene_id = id || '-scene' WHERE active_scene_id = ''`,
+		`UPDATE images SET scene_id = (SELECT active_scene_id FROM rooms WHERE rooms.id = images.room_id) WHERE scene_id = ''`,
+		`UPDATE walls SET scene_id = (SELECT active_scene_id FROM rooms WHERE rooms.id = walls.room_id) WHERE scene_id = ''`,
+		`UPDATE lights SET scene_id = (SELECT active_scene_id FROM rooms WHERE rooms.id = lights.room_id) WHERE scene_id = ''`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	var legacyFog bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'fog_cells')`).Scan(&legacyFog); err != nil {
+		return err
+	}
+	if !legacyFog {
+		return nil
+	}
+	if _, err := db.Exec(
+		`INSERT OR IGNORE INTO scene_fog_cells (scene_id, col, row)
+		SELECT rooms.active_scene_id, fog_cells.col, fog_cells.row FROM fog_cells JOIN rooms ON rooms.id = fog_cells.room_id`,
+	); err != nil {
+		return err
+	}
+	_, err := db.Exec(`DROP TABLE fog_cells`)
+	return err
+}
+
 // Close releases database resources.
 func (s *Server) Close() error {
 	if s.db != nil {
@@ -0,0 +1,584 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxTokenNameLength = 100
+	maxTokenHP         = 1000000
+	maxVisionRadius    = 1000
+	defaultTokenSize   = "medium"
+	// defaultVisionRadius is how many grid cells a new token sees unless it is
+	// created with a visionRadius; 0 has to be asked for to see without limit.
+	defaultVisionRadius = 12
+)
+
+// tokenSizes maps the size categories to how many grid cells a token spans.
+var tokenSizes = map[string]float64{
+	"tiny":       0.5,
+	"small":      1,
+	"medium":     1,
+	"large":      2,
+	"huge":       3,
+	"gargantuan": 4,
+}
+
+var (
+	errInvalidToken   = errors.New("invalid token")
+	errTokenMissing   = errors.New("token not found")
+	errTokenForbidden = errors.New("token belongs to another player")
+	errTokenPlacement = errors.New("players can only place tokens where they can see")
+)
+
+const tokenColumns = `i.id, i.room_id, i.scene_id, i.url, i.x, i.y, i.width, i.height, i.hidden, t.owner_id, t.name, t.hp, t.max_hp, t.size, t.vision_radius, i.created_at`
+
+func scanToken(row rowScanner) (Token, error) {
+	var token Token
+	if err := row.Scan(&token.ID, &token.RoomID, &token.SceneID, &token.URL, &token.X, &token.Y, &token.Width, &token.Height, &token.Hidden,
+		&token.OwnerID, &token.Name, &token.HP, &token.MaxHP, &token.Size, &token.VisionRadius, &token.CreatedAt); err != nil {
+		return Token{}, err
+	}
+	token.CreatedAt = token.CreatedAt.UTC()
+	return token, nil
+}
+
+func (t Token) image() imageResponse {
+	return imageResponse{
+		ID:        t.ID,
+		RoomID:    t.RoomID,
+		SceneID:   t.SceneID,
+		URL:       t.URL,
+		Status:    "done",
+		CreatedAt: t.CreatedAt,
+		X:         t.X,
+		Y:         t.Y,
+		Width:     t.Width,
+		Height:    t.Height,
+		Hidden:    t.Hidden,
+	}
+}
+
+// canMove reports whether a player may move the token: the GM moves any token
+// and players their own.
+func (t Token) canMove(playerID string, isGM bool) bool {
+	return isGM || (t.OwnerID != "" && t.OwnerID == playerID)
+}
+
+func (s *Server) listTokens(roomID, sceneID string, includeHidden bool) ([]Token, error) {
+	query := `SELECT ` + tokenColumns + ` FROM tokens t JOIN images i ON i.id = t.image_id WHERE i.room_id = ? AND i.scene_id = ?`
+	if !includeHidden {
+		query += ` AND i.hidden = 0`
+	}
+	rows, err := s.db.Query(query+` ORDER BY i.created_at, i.id`, roomID, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]Token, 0)
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// getToken returns the token on an image. Tokens withheld from players are
+// treated as missing unless includeHidden is set.
+func (s *Server) getToken(roomID, imageID string, includeHidden bool) (Token, bool, error) {
+	token, err := scanToken(s.db.QueryRow(`SELECT `+tokenColumns+` FROM tokens t JOIN images i ON i.id = t.image_id WHERE i.id = ? AND i.room_id = ?`, imageID, roomID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, false, nil
+	}
+	if err != nil {
+		return Token{}, false, err
+	}
+	if !includeHidden {
+		withheld, err := s.withheldFromPlayers(roomID, token.image())
+		if err != nil || withheld {
+			return Token{}, false, err
+		}
+	}
+	return token, true, nil
+}
+
+func (s *Server) saveTokenState(token Token) error {
+	_, err := s.db.Exec(
+		`INSERT INTO tokens (image_id, room_id, owner_id, name, hp, max_hp, size, vision_radius) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(image_id) DO UPDATE SET owner_id = excluded.owner_id, name = excluded.name, hp = excluded.hp,
+		max_hp = excluded.max_hp, size = excluded.size, vision_radius = excluded.vision_radius`,
+		token.ID, token.RoomID, token.OwnerID, token.Name, token.HP, token.MaxHP, token.Size, token.VisionRadius,
+	)
+	return err
+}
+
+// tokenRequest holds the fields of a token that can be set. Absent fields are
+// left unchanged.
+type tokenRequest struct {
+	ImageID      string   `json:"imageId"`
+	URL          string   `json:"url"`
+	SceneID      string   `json:"sceneId"`
+	X            *float64 `json:"x"`
+	Y            *float64 `json:"y"`
+	Width        *float64 `json:"width"`
+	Height       *float64 `json:"height"`
+	Hidden       *bool    `json:"hidden"`
+	OwnerID      *string  `json:"ownerId"`
+	Name         *string  `json:"name"`
+	HP           *int     `json:"hp"`
+	MaxHP        *int     `json:"maxHp"`
+	Size         *string  `json:"size"`
+	VisionRadius *float64 `json:"visionRadius"`
+}
+
+// playerCreateFields reports whether the request only sets what a player may
+// set on a token of their own: everything but its size and vision, which the
+// GM decides.
+func (req tokenRequest) playerCreateFields() bool {
+	return req.Width == nil && req.Height == nil && req.Size == nil && req.VisionRadius == nil
+}
+
+// ownerFields reports whether the request only changes what a token's owner
+// may change: its position and hit points.
+func (req tokenRequest) ownerFields() bool {
+	return req.Width == nil && req.Height == nil && req.Hidden == nil && req.OwnerID == nil && req.Name == nil &&
+		req.MaxHP == nil && req.Size == nil && req.VisionRadius == nil
+}
+
+// applyTokenRequest validates the request and copies its fields onto token.
+// A new size resizes the token to the room's grid unless the request sets its
+// width or height, and a moved token is snapped when the grid asks for it.
+func (s *Server) applyTokenRequest(roomID string, grid Grid, token *Token, req tokenRequest) error {
+	if req.X != nil {
+		token.X = *req.X
+	}
+	if req.Y != nil {
+		token.Y = *req.Y
+	}
+	if !isValidPosition(token.X, token.Y) {
+		return fmt.Errorf("%w: invalid position", errInvalidToken)
+	}
+	if req.Name != nil {
+		token.Name = strings.TrimSpace(*req.Name)
+	}
+	if token.Name == "" || utf8.RuneCountInString(token.Name) > maxTokenNameLength {
+		return fmt.Errorf("%w: name must be 1-%d characters", errInvalidToken, maxTokenNameLength)
+	}
+	if req.OwnerID != nil {
+		if *req.OwnerID != "" {
+			_, found, err := s.getPlayer(roomID, *req.OwnerID)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("%w: owner not found", errInvalidToken)
+			}
+		}
+		token.OwnerID = *req.OwnerID
+	}
+	if req.HP != nil {
+		token.HP = *req.HP
+	}
+	if req.MaxHP != nil {
+		token.MaxHP = *req.MaxHP
+	}
+	if token.MaxHP < 0 || token.MaxHP > maxTokenHP || token.HP < -maxTokenHP || token.HP > maxTokenHP {
+		return fmt.Errorf("%w: hit points must be within %d", errInvalidToken, maxTokenHP)
+	}
+	if req.VisionRadius != nil {
+		token.VisionRadius = *req.VisionRadius
+	}
+	if token.VisionRadius < 0 || token.VisionRadius > maxVisionRadius {
+		return fmt.Errorf("%w: vision radius must be 0-%d", errInvalidToken, maxVisionRadius)
+	}
+	if req.Hidden != nil {
+		token.Hidden = *req.Hidden
+	}
+	if req.Size != nil {
+		cells, ok := tokenSizes[*req.Size]
+		if !ok {
+			return fmt.Errorf("%w: unknown size %q", errInvalidToken, *req.Size)
+		}
+		token.Size = *req.Size
+		if req.Width == nil && req.Height == nil {
+			token.Width, token.Height = cells*grid.CellSize, cells*grid.CellSize
+		}
+	}
+	if req.Width != nil {
+		token.Width = *req.Width
+	}
+	if req.Height != nil {
+		token.Height = *req.Height
+	}
+	if token.Width < 0 || token.Height < 0 || !isValidCoordinate(token.Width) || !isValidCoordinate(token.Height) {
+		return fmt.Errorf("%w: invalid size", errInvalidToken)
+	}
+	if grid.Snap && (req.X != nil || req.Y != nil) {
+		token.X, token.Y = grid.snap(token.X, token.Y, token.Width, token.Height)
+	}
+	return nil
+}
+
+// broadcastToken sends a token and its image to the sockets that may see it.
+// Hidden tokens only go to the GM; players are told to drop a token that was
+// just hidden or that they no longer see.
+func (s *Server) broadcastToken(roomID string, token Token, wasHidden bool) {
+	img := token.image()
+	audience := s.imageAudience(roomID, img)
+	s.sendSharedImage(roomID, img, audience)
+	s.sendToken(roomID, token, audience)
+	if audience == nil {
+		return
+	}
+	notAudience := func(profile clientProfile) bool { return !audience(profile) }
+	if token.Hidden && wasHidden || s.sceneAudience(roomID, token.SceneID) != nil {
+		return
+	}
+	s.broadcastImageRemoved(roomID, token.ID, notAudience)
+	s.broadcastTokenDeleted(roomID, token.ID, notAudience)
+}
+
+// sendToken sends a TokenUpdate to the sockets accepted by audience, or to the
+// whole room when audience is nil.
+func (s *Server) sendToken(roomID string, token Token, audience func(clientProfile) bool) {
+	payload, err := json.Marshal(map[string]any{
+		"type":    "TokenUpdate",
+		"payload": token,
+	})
+	if err != nil {
+		s.logger.Error("marshal token", slog.String("error", err.Error()))
+		return
+	}
+	if audience == nil {
+		s.broadcast(roomID, payload)
+		return
+	}
+	s.broadcastWhere(roomID, payload, audience)
+}
+
+func (s *Server) broadcastTokenDeleted(roomID, tokenID string, include func(clientProfile) bool) {
+	payload, err := json.Marshal(map[string]any{
+		"type":    "TokenDeleted",
+		"payload": map[string]string{"id": tokenID},
+	})
+	if err != nil {
+		s.logger.Error("marshal token delete", slog.String("error", err.Error()))
+		return
+	}
+	s.broadcastWhere(roomID, payload, include)
+}
+
+// updateToken applies a request to an existing token, stores it and
+// broadcasts the result. Players may only move their own tokens and change
+// their hit points.
+func (s *Server) updateToken(roomID, tokenID, playerID string, isGM bool, req tokenRequest) (Token, error) {
+	token, found, err := s.getToken(roomID, tokenID, isGM)
+	if err != nil {
+		return Token{}, err
+	}
+	if !found {
+		return Token{}, errTokenMissing
+	}
+	if !token.canMove(playerID, isGM) || (!isGM && !req.ownerFields()) {
+		return Token{}, errTokenForbidden
+	}
+	defer s.beginViewChange(roomID)()
+	grid, err := s.getSceneGrid(roomID, token.SceneID)
+	if err != nil {
+		return Token{}, err
+	}
+	wasHidden := token.Hidden
+	if err := s.applyTokenRequest(roomID, grid, &token, req); err != nil {
+		return Token{}, err
+	}
+	x, y, width, height, hidden := token.X, token.Y, token.Width, token.Height, token.Hidden
+	if _, _, ok, err := s.updateImage(roomID, token.ID, true, false, &x, &y, &width, &height, &hidden); err != nil || !ok {
+		if err == nil {
+			err = errTokenMissing
+		}
+		return Token{}, err
+	}
+	if err := s.saveTokenState(token); err != nil {
+		return Token{}, err
+	}
+	s.broadcastToken(roomID, token, wasHidden)
+	return token, nil
+}
+
+// handleTokens serves /rooms/{id}/tokens. Everyone can list the tokens they can
+// see. Players can create tokens they own and move them; the GM manages all.
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request, roomID, tokenID string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	isGM := player.Role == RoleGM
+
+	switch {
+	case tokenID == "" && r.Method == http.MethodGet:
+		scene, err := s.resolveScene(roomID, r.URL.Query().Get("scene"), isGM)
+		if !s.writeSceneError(w, r, err) {
+			return
+		}
+		tokens, err := s.listTokens(roomID, scene.ID, isGM)
+		if err != nil {
+			s.logger.Error("list tokens", slog.String("error", err.Error()))
+			http.Error(w, "failed to load tokens", http.StatusInternalServerError)
+			return
+		}
+		if !isGM {
+			view, err := s.loadPlayerView(roomID)
+			if err != nil {
+				s.logger.Error("load player view", slog.String("error", err.Error()))
+				http.Error(w, "failed to load tokens", http.StatusInternalServerError)
+				return
+			}
+			tokens = view.visibleTokens(player.ID, tokens)
+		}
+		writeJSON(w, http.StatusOK, tokens)
+		return
+	case tokenID == "" && r.Method == http.MethodPost:
+		s.handleTokenCreate(w, r, roomID, player)
+		return
+	case tokenID != "" && (r.Method == http.MethodGet || r.Method == http.MethodPatch || r.Method == http.MethodDelete):
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		var req tokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		token, err := s.updateToken(roomID, tokenID, player.ID, isGM, req)
+		if !s.writeTokenError(w, r, err) {
+			return
+		}
+		writeJSON(w, http.StatusOK, token)
+		return
+	}
+
+	token, found, err := s.getToken(roomID, tokenID, isGM)
+	if err != nil {
+		s.logger.Error("get token", slog.String("error", err.Error()))
+		http.Error(w, "failed to load token", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		if !isGM {
+			view, err := s.loadPlayerView(roomID)
+			if err != nil {
+				s.logger.Error("load player view", slog.String("error", err.Error()))
+				http.Error(w, "failed to load token", http.StatusInternalServerError)
+				return
+			}
+			if !view.canSee(player.ID, token.image()) {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, token)
+		return
+	}
+	if !token.canMove(player.ID, isGM) {
+		http.Error(w, errTokenForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	defer s.beginViewChange(roomID)()
+	if _, _, err := s.deleteImage(roomID, token.ID, true); err != nil {
+		s.logger.Error("delete token", slog.String("error", err.Error()))
+		http.Error(w, "failed to delete token", http.StatusInternalServerError)
+		return
+	}
+	s.removeUnusedUpload(token.URL)
+	s.tokenImageDeleted(roomID, token)
+	s.broadcastImageDeleted(roomID, token.image())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tokenImageDeleted cleans up after the image of a token was deleted.
+func (s *Server) tokenImageDeleted(roomID string, token Token) {
+	s.deleteTargetEffects(roomID, effectTargetImage, token.ID, s.imageAudience(roomID, token.image()))
+	include := func(clientProfile) bool { return true }
+	if token.Hidden || s.sceneAudience(roomID, token.SceneID) != nil {
+		include = isGMProfile
+	}
+	s.broadcastTokenDeleted(roomID, token.ID, include)
+}
+
+// checkTokenPlacement returns errTokenPlacement when a player places a new
+// token where they cannot see, so that creating a token cannot look past fog
+// or walls.
+func (s *Server) checkTokenPlacement(roomID, playerID string, token Token) error {
+	view, err := s.loadPlayerView(roomID)
+	if err != nil {
+		return err
+	}
+	if !view.placeable(playerID, token.image()) {
+		return errTokenPlacement
+	}
+	return nil
+}
+
+// writeTokenError writes the response for an error of a token change and
+// reports whether there was none.
+func (s *Server) writeTokenError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errTokenMissing):
+		http.NotFound(w, r)
+	case errors.Is(err, errTokenForbidden), errors.Is(err, errTokenPlacement):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errInvalidToken):
+		http.Error(w, strings.TrimPrefix(err.Error(), errInvalidToken.Error()+": "), http.StatusBadRequest)
+	default:
+		s.logger.Error("save token", slog.String("error", err.Error()))
+		http.Error(w, "failed to save token", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// handleTokenCreate makes a token from an existing image (imageId) or places a
+// new image by URL. Only the GM may promote an image, which could be anyone's;
+// players' tokens are always their own, never hidden, keep the default size
+// and vision, and go where the player can see.
+func (s *Server) handleTokenCreate(w http.ResponseWriter, r *http.Request, roomID string, player Player) {
+	isGM := player.Role == RoleGM
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if (req.ImageID == "") == (req.URL == "") {
+		http.Error(w, "either imageId or url is required", http.StatusBadRequest)
+		return
+	}
+	if !isGM {
+		if req.ImageID != "" {
+			http.Error(w, "only the GM can turn images into tokens", http.StatusForbidden)
+			return
+		}
+		if req.Hidden != nil || (req.OwnerID != nil && *req.OwnerID != player.ID) {
+			http.Error(w, "players can only create visible tokens of their own", http.StatusForbidden)
+			return
+		}
+		if !req.playerCreateFields() {
+			http.Error(w, "only the GM can set a token's size or vision", http.StatusForbidden)
+			return
+		}
+		req.OwnerID = &player.ID
+	}
+
+	var img imageResponse
+	sceneID := req.SceneID
+	if req.ImageID != "" {
+		if _, found, err := s.getToken(roomID, req.ImageID, true); err != nil || found {
+			if err != nil {
+				s.logger.Error("get token", slog.String("error", err.Error()))
+				http.Error(w, "failed to create token", http.StatusInternalServerError)
+				return
+			}
+			http.Error(w, "the image already is a token", http.StatusConflict)
+			return
+		}
+		var found bool
+		var err error
+		img, found, err = s.getImage(roomID, req.ImageID, isGM)
+		if err != nil {
+			s.logger.Error("get image", slog.String("error", err.Error()))
+			http.Error(w, "failed to create token", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "image not found", http.StatusBadRequest)
+			return
+		}
+		sceneID = img.SceneID
+	}
+	scene, err := s.resolveScene(roomID, sceneID, isGM)
+	if !s.writeSceneError(w, r, err) {
+		return
+	}
+
+	token := Token{
+		RoomID: roomID, SceneID: scene.ID, Size: defaultTokenSize, VisionRadius: defaultVisionRadius,
+		Width: scene.Grid.CellSize, Height: scene.Grid.CellSize,
+	}
+	if req.ImageID != "" {
+		token.ID, token.URL, token.X, token.Y, token.Hidden, token.CreatedAt = img.ID, img.URL, img.X, img.Y, img.Hidden, img.CreatedAt
+		if img.Width > 0 && img.Height > 0 {
+			token.Width, token.Height = img.Width, img.Height
+		}
+	} else {
+		if !isValidImageURL(req.URL) {
+			http.Error(w, "invalid image URL", http.StatusBadRequest)
+			return
+		}
+		x, y, err := s.nextPosition(scene.ID)
+		if err != nil {
+			s.logger.Error("next position", slog.String("error", err.Error()))
+			http.Error(w, "failed to create token", http.StatusInternalServerError)
+			return
+		}
+		token.ID, token.URL, token.X, token.Y, token.CreatedAt = s.newID(), req.URL, x, y, time.Now().UTC()
+	}
+	if err := s.applyTokenRequest(roomID, scene.Grid, &token, req); err != nil {
+		s.writeTokenError(w, r, err)
+		return
+	}
+	if !isGM {
+		if err := s.checkTokenPlacement(roomID, player.ID, token); err != nil {
+			s.writeTokenError(w, r, err)
+			return
+		}
+	}
+
+	defer s.beginViewChange(roomID)()
+	if req.ImageID != "" {
+		x, y, width, height, hidden := token.X, token.Y, token.Width, token.Height, token.Hidden
+		_, _, _, err = s.updateImage(roomID, token.ID, true, false, &x, &y, &width, &height, &hidden)
+	} else {
+		_, err = s.storeImage(roomID, token.image())
+	}
+	if err == nil {
+		err = s.saveTokenState(token)
+	}
+	if err != nil {
+		s.logger.Error("create token", slog.String("error", err.Error()))
+		http.Error(w, "failed to create token", http.StatusInternalServerError)
+		return
+	}
+	s.broadcastToken(roomID, token, true)
+	writeJSON(w, http.StatusCreated, token)
+}
+
+// moveTokenRequest is the MoveToken WebSocket command.
+type moveTokenRequest struct {
+	ID string  `json:"id"`
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+}
+
+// moveToken moves a token for a WebSocket client. Errors go to the log.
+func (s *Server) moveToken(roomID string, sender *wsConn, req moveTokenRequest) error {
+	_, err := s.updateToken(roomID, req.ID, sender.profile.ID, isGMProfile(sender.profile), tokenRequest{X: &req.X, Y: &req.Y})
+	return err
+}
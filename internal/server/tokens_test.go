@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+	bob := joinRoomForTest(t, router, room, "Bob", RolePlayer)
+
+	do := func(method, path string, player Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		if payload != nil {
+			_ = json.NewEncoder(&body).Encode(payload)
+		}
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, &body)
+		req.Header.Set("Content-Type", "application/json")
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	decodeToken := func(w *httptest.ResponseRecorder, want int) Token {
+		t.Helper()
+		var token Token
+		if w.Code != want || json.NewDecoder(w.Body).Decode(&token) != nil {
+			t.Fatalf("expected %d, got %d %s", want, w.Code, w.Body.String())
+		}
+		return token
+	}
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(bob.Token), nil)
+	defer conn.Close()
+	readWSMessageForTest(t, conn, "RosterUpdate")
+
+	ogre := decodeToken(do(http.MethodPost, "/tokens", gm, map[string]any{
+		"url": "https://example.com/ogre.png", "name": "Ogre", "hp": 59, "maxHp": 59, "size": "large", "visionRadius": 12,
+	}), http.StatusCreated)
+	if ogre.Width != 2*defaultCellSize || ogre.OwnerID != "" || ogre.VisionRadius != 12 {
+		t.Fatalf("unexpected ogre: %+v", ogre)
+	}
+	if w := do(http.MethodPost, "/tokens", gm, map[string]any{"url": "https://example.com/x.png", "name": "X", "size": "colossal"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown size, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/tokens", alice, map[string]any{"url": "https://example.com/x.png", "name": "X", "ownerId": bob.ID}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not create tokens for others, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/tokens", alice, map[string]any{"url": "https://example.com/x.png", "name": "X", "size": "gargantuan"}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not size their tokens, got %d", w.Code)
+	}
+
+	// The GM turns Alice's uploaded image into her character's token; players
+	// cannot claim images, such as the GM's monsters.
+	var img imageResponse
+	_ = json.NewDecoder(do(http.MethodPost, "/images", alice, map[string]string{"url": "https://example.com/hero.png"}).Body).Decode(&img)
+	if w := do(http.MethodPost, "/tokens", alice, map[string]any{"imageId": img.ID, "name": "Hero"}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not turn images into tokens, got %d", w.Code)
+	}
+	hero := decodeToken(do(http.MethodPost, "/tokens", gm, map[string]any{"imageId": img.ID, "name": "Hero", "hp": 12, "maxHp": 12, "ownerId": alice.ID}), http.StatusCreated)
+	if hero.ID != img.ID || hero.OwnerID != alice.ID || hero.Size != defaultTokenSize || hero.VisionRadius != defaultVisionRadius {
+		t.Fatalf("unexpected hero: %+v", hero)
+	}
+	if w := do(http.MethodPost, "/tokens", gm, map[string]any{"imageId": img.ID, "name": "Again"}); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for an image that already is a token, got %d", w.Code)
+	}
+
+	if w := do(http.MethodPatch, "/tokens/"+hero.ID, bob, map[string]float64{"x": 10}); w.Code != http.StatusForbidden {
+		t.Fatalf("bob must not move alice's token, got %d", w.Code)
+	}
+	if w := do(http.MethodPatch, "/images/"+hero.ID, bob, map[string]float64{"x": 10}); w.Code != http.StatusForbidden {
+		t.Fatalf("bob must not move alice's token as an image, got %d", w.Code)
+	}
+	if w := do(http.MethodPatch, "/tokens/"+ogre.ID, alice, map[string]float64{"x": 10}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not move GM tokens, got %d", w.Code)
+	}
+	if w := do(http.MethodPatch, "/tokens/"+hero.ID, alice, map[string]int{"maxHp": 99}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not change their max HP, got %d", w.Code)
+	}
+	moved := decodeToken(do(http.MethodPatch, "/tokens/"+hero.ID, alice, map[string]any{"x": 140, "y": 70, "hp": 7}), http.StatusOK)
+	if moved.X != 140 || moved.HP != 7 || moved.Name != "Hero" {
+		t.Fatalf("unexpected move: %+v", moved)
+	}
+	var update Token
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "TokenUpdate"), &update); err != nil {
+		t.Fatalf("decode update: %v", err)
+	}
+	for update.ID != hero.ID || update.X != 140 {
+		_ = json.Unmarshal(readWSMessageForTest(t, conn, "TokenUpdate"), &update)
+	}
+
+	// Bob's socket cannot move the hero either.
+	msg, _ := json.Marshal(map[string]any{"type": "MoveToken", "payload": moveTokenRequest{ID: hero.ID, X: 0, Y: 0}})
+	if err := writeFrame(conn, 0x1, msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := decodeToken(do(http.MethodGet, "/tokens/"+hero.ID, bob, nil), http.StatusOK); got.X != 140 {
+		t.Fatalf("bob moved alice's token over the websocket: %+v", got)
+	}
+
+	decodeToken(do(http.MethodPatch, "/tokens/"+ogre.ID, gm, map[string]bool{"hidden": true}), http.StatusOK)
+	readWSMessageForTest(t, conn, "TokenDeleted")
+	var listed []Token
+	if err := json.NewDecoder(do(http.MethodGet, "/tokens", bob, nil).Body).Decode(&listed); err != nil || len(listed) != 1 {
+		t.Fatalf("players must not see hidden tokens: %+v %v", listed, err)
+	}
+	if w := do(http.MethodGet, "/tokens/"+ogre.ID, bob, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a hidden token, got %d", w.Code)
+	}
+
+	if w := do(http.MethodDelete, "/images/"+hero.ID, bob, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("bob must not delete alice's token, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/tokens/"+hero.ID, alice, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete token: %d", w.Code)
+	}
+	var deleted struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "TokenDeleted"), &deleted); err != nil || deleted.ID != hero.ID {
+		t.Fatalf("unexpected delete: %+v %v", deleted, err)
+	}
+	if images, _ := srv.getImages(room.ID, room.ActiveSceneID, true); len(images) != 1 {
+		t.Fatalf("the token's image must go with it: %+v", images)
+	}
+}
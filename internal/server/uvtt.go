@@ -0,0 +1,384 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	maxLightsPerImport = 1000
+	maxLightColor      = 16
+	// maxMapCells is how many grid cells an imported map may span each way.
+	maxMapCells = 1000
+)
+
+var uvttImageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+	"image/bmp":  ".bmp",
+}
+
+// uvttPoint is a position in grid cells.
+type uvttPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// uvttFile is the part of a Universal VTT export (.dd2vtt, .uvtt) the import
+// reads. Positions are in grid cells from the map's top-left corner.
+type uvttFile struct {
+	Resolution struct {
+		MapOrigin     uvttPoint `json:"map_origin"`
+		MapSize       uvttPoint `json:"map_size"`
+		PixelsPerGrid float64   `json:"pixels_per_grid"`
+	} `json:"resolution"`
+	LineOfSight        [][]uvttPoint `json:"line_of_sight"`
+	ObjectsLineOfSight [][]uvttPoint `json:"objects_line_of_sight"`
+	Portals            []struct {
+		Bounds []uvttPoint `json:"bounds"`
+		Closed bool        `json:"closed"`
+	} `json:"portals"`
+	Lights []struct {
+		Position  uvttPoint `json:"position"`
+		Range     float64   `json:"range"`
+		Intensity float64   `json:"intensity"`
+		Color     string    `json:"color"`
+		Shadows   bool      `json:"shadows"`
+	} `json:"lights"`
+	Image string `json:"image"`
+}
+
+// uvttImport is the map an export places on the canvas.
+type uvttImport struct {
+	Image  imageResponse `json:"image"`
+	Walls  []Wall        `json:"walls"`
+	Lights []Light       `json:"lights"`
+}
+
+// decodeUVTT parses an export and returns its map image.
+func decodeUVTT(data []byte) (uvttFile, []byte, error) {
+	var file uvttFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return uvttFile{}, nil, fmt.Errorf("invalid map file: %w", err)
+	}
+	size := file.Resolution.MapSize
+	if !isValidPosition(size.X, size.Y) || size.X <= 0 || size.Y <= 0 || size.X > maxMapCells || size.Y > maxMapCells {
+		return uvttFile{}, nil, errors.New("invalid map size")
+	}
+	if !isValidPosition(file.Resolution.MapOrigin.X, file.Resolution.MapOrigin.Y) {
+		return uvttFile{}, nil, errors.New("invalid map origin")
+	}
+	if len(file.Lights) > maxLightsPerImport {
+		return uvttFile{}, nil, fmt.Errorf("a map may have at most %d lights", maxLightsPerImport)
+	}
+	encoded := file.Image
+	if i := strings.Index(encoded, ";base64,"); strings.HasPrefix(encoded, "data:") && i >= 0 {
+		encoded = encoded[i+len(";base64,"):]
+	}
+	image, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(image) == 0 {
+		return uvttFile{}, nil, errors.New("the map file has no valid image")
+	}
+	file.Image = ""
+	return file, image, nil
+}
+
+// place converts the export's walls, doors and lights to canvas positions on
+// the room's grid, with the map's top-left corner at the grid's origin.
+func (file uvttFile) place(grid Grid, idPrefix string, now time.Time) ([]Wall, []Light, error) {
+	origin := file.Resolution.MapOrigin
+	point := func(p uvttPoint) (float64, float64, bool) {
+		x, y := grid.OffsetX+(p.X-origin.X)*grid.CellSize, grid.OffsetY+(p.Y-origin.Y)*grid.CellSize
+		return x, y, isValidPosition(x, y)
+	}
+	walls := make([]Wall, 0)
+	addWall := func(a, b uvttPoint, door, open bool) error {
+		x1, y1, ok1 := point(a)
+		x2, y2, ok2 := point(b)
+		if !ok1 || !ok2 {
+			return errors.New("invalid wall position")
+		}
+		if x1 == x2 && y1 == y2 {
+			return nil
+		}
+		if len(walls) >= maxWallsPerScene {
+			return fmt.Errorf("a scene holds at most %d walls", maxWallsPerScene)
+		}
+		walls = append(walls, Wall{
+			ID: fmt.Sprintf("%s-w%d", idPrefix, len(walls)), X1: x1, Y1: y1, X2: x2, Y2: y2,
+			Door: door, Open: open, CreatedAt: now,
+		})
+		return nil
+	}
+	for _, line := range append(file.LineOfSight, file.ObjectsLineOfSight...) {
+		for i := 1; i < len(line); i++ {
+			if err := addWall(line[i-1], line[i], false, false); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	for _, portal := range file.Portals {
+		if len(portal.Bounds) < 2 {
+			continue
+		}
+		if err := addWall(portal.Bounds[0], portal.Bounds[1], true, !portal.Closed); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	lights := make([]Light, 0, len(file.Lights))
+	for i, l := range file.Lights {
+		x, y, ok := point(l.Position)
+		if !ok || !isValidCoordinate(l.Range) || l.Range < 0 || !isValidCoordinate(l.Intensity) {
+			return nil, nil, errors.New("invalid light")
+		}
+		if len(l.Color) > maxLightColor {
+			return nil, nil, errors.New("invalid light color")
+		}
+		lights = append(lights, Light{
+			ID: fmt.Sprintf("%s-l%d", idPrefix, i), X: x, Y: y, Range: l.Range, Intensity: l.Intensity,
+			Color: l.Color, Shadows: l.Shadows, CreatedAt: now,
+		})
+	}
+	return walls, lights, nil
+}
+
+// storeMapImport stores an imported map's image, walls and lights in one
+// transaction.
+func (s *Server) storeMapImport(roomID string, imported uvttImport) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	img := imported.Image
+	if _, err := tx.Exec(
+		`INSERT INTO images (`+imageColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		img.ID, roomID, img.SceneID, img.URL, img.Status, img.CreatedAt, img.X, img.Y, img.Width, img.Height, img.Hidden,
+	); err != nil {
+		return err
+	}
+	if err := insertWalls(tx, roomID, imported.Walls); err != nil {
+		return err
+	}
+	for _, light := range imported.Lights {
+		if _, err := tx.Exec(
+			`INSERT INTO lights (`+lightColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			light.ID, roomID, light.SceneID, light.X, light.Y, light.Range, light.Intensity, light.Color, light.Shadows, light.CreatedAt,
+		); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.wallsChanged(img.SceneID)
+	return nil
+}
+
+// handleUVTTImport serves POST /rooms/{id}/imports/uvtt. The GM sends a
+// Universal VTT export as the request body or as the multipart field "file";
+// its image is stored like an upload and sized to the scene's grid, and its
+// walls, doors and lights are added to the scene. The scene is chosen with
+// ?scene= and defaults to the active one.
+func (s *Server) handleUVTTImport(w http.ResponseWriter, r *http.Request, roomID string) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	if player.Role != RoleGM {
+		http.Error(w, "only the GM can import maps", http.StatusForbidden)
+		return
+	}
+	scene, err := s.resolveScene(roomID, r.URL.Query().Get("scene"), true)
+	if !s.writeSceneError(w, r, err) {
+		return
+	}
+
+	// The image is embedded as base64, which is a third larger.
+	limit := s.cfg.MaxUploadSize/3*4 + 1<<20
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	var body io.Reader = r.Body
+	filename := "map"
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(limit); err != nil {
+			http.Error(w, "failed to parse upload", http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "file not found in request", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+		filename = strings.TrimSuffix(filepath.Base(header.Filename), filepath.Ext(header.Filename))
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, "import too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	file, image, err := decodeUVTT(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(image)) > s.cfg.MaxUploadSize {
+		http.Error(w, "map image too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	grid := scene.Grid
+	now := time.Now().UTC()
+	imported := uvttImport{Image: imageResponse{
+		ID:        s.newID(),
+		RoomID:    roomID,
+		SceneID:   scene.ID,
+		Status:    "done",
+		CreatedAt: now,
+		X:         grid.OffsetX,
+		Y:         grid.OffsetY,
+		Width:     file.Resolution.MapSize.X * grid.CellSize,
+		Height:    file.Resolution.MapSize.Y * grid.CellSize,
+	}}
+	if imported.Walls, imported.Lights, err = file.place(grid, imported.Image.ID, now); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range imported.Walls {
+		imported.Walls[i].RoomID, imported.Walls[i].SceneID = roomID, scene.ID
+	}
+	for i := range imported.Lights {
+		imported.Lights[i].RoomID, imported.Lights[i].SceneID = roomID, scene.ID
+	}
+
+	// Uploads are named after their detected type so they are served as such.
+	ext, ok := uvttImageExtensions[http.DetectContentType(image)]
+	if !ok {
+		ext = ".png"
+	}
+	url, destPath, err := s.saveUpload(filename+ext, bytes.NewReader(image))
+	if err != nil {
+		if errors.Is(err, errUploadUndetected) || errors.Is(err, errUploadType) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.logger.Error("save map image", slog.String("error", err.Error()))
+		http.Error(w, "unable to save file", http.StatusInternalServerError)
+		return
+	}
+	imported.Image.URL = url
+
+	done := s.beginViewChange(roomID)
+	err = s.storeMapImport(roomID, imported)
+	done()
+	if err != nil {
+		_ = os.Remove(destPath)
+		if errors.Is(err, errWallLimit) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		s.logger.Error("import map", slog.String("error", err.Error()))
+		http.Error(w, "failed to import map", http.StatusInternalServerError)
+		return
+	}
+	s.broadcastSharedImage(roomID, imported.Image)
+	s.broadcastWall(roomID, "WallsImported", imported.Walls)
+	for _, light := range imported.Lights {
+		s.broadcastScene(roomID, scene.ID, "LightUpdate", light)
+	}
+	writeJSON(w, http.StatusCreated, imported)
+}
+
+const lightColumns = `id, room_id, scene_id, x, y, radius, intensity, color, shadows, created_at`
+
+func scanLight(row rowScanner) (Light, error) {
+	var light Light
+	if err := row.Scan(&light.ID, &light.RoomID, &light.SceneID, &light.X, &light.Y, &light.Range, &light.Intensity, &light.Color, &light.Shadows, &light.CreatedAt); err != nil {
+		return Light{}, err
+	}
+	light.CreatedAt = light.CreatedAt.UTC()
+	return light, nil
+}
+
+func (s *Server) listLights(roomID, sceneID string) ([]Light, error) {
+	rows, err := s.db.Query(`SELECT `+lightColumns+` FROM lights WHERE room_id = ? AND scene_id = ? ORDER BY created_at, id`, roomID, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lights := make([]Light, 0)
+	for rows.Next() {
+		light, err := scanLight(rows)
+		if err != nil {
+			return nil, err
+		}
+		lights = append(lights, light)
+	}
+	return lights, rows.Err()
+}
+
+// handleLights serves /rooms/{id}/lights. Everyone can list the lights of the
+// active scene and the GM those of any scene chosen with ?scene=; the GM
+// removes them.
+func (s *Server) handleLights(w http.ResponseWriter, r *http.Request, roomID, lightID string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	switch {
+	case lightID == "" && r.Method == http.MethodGet:
+		scene, err := s.resolveScene(roomID, r.URL.Query().Get("scene"), player.Role == RoleGM)
+		if !s.writeSceneError(w, r, err) {
+			return
+		}
+		lights, err := s.listLights(roomID, scene.ID)
+		if err != nil {
+			s.logger.Error("list lights", slog.String("error", err.Error()))
+			http.Error(w, "failed to load lights", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, lights)
+	case lightID != "" && r.Method == http.MethodDelete:
+		if player.Role != RoleGM {
+			http.Error(w, "only the GM can remove lights", http.StatusForbidden)
+			return
+		}
+		var sceneID string
+		err := s.db.QueryRow(`DELETE FROM lights WHERE id = ? AND room_id = ? RETURNING scene_id`, lightID, roomID).Scan(&sceneID)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			s.logger.Error("delete light", slog.String("error", err.Error()))
+			http.Error(w, "failed to delete light", http.StatusInternalServerError)
+			return
+		}
+		s.broadcastScene(roomID, sceneID, "LightDeleted", map[string]string{"id": lightID})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
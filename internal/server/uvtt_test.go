@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUVTTImport(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+
+	do := func(method, path string, player Player, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 8, 6))); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	file := map[string]any{
+		"format": 0.3,
+		"resolution": map[string]any{
+			"map_origin":      map[string]float64{"x": 0, "y": 0},
+			"map_size":        map[string]float64{"x": 4, "y": 3},
+			"pixels_per_grid": 2,
+		},
+		"line_of_sight": [][]map[string]float64{{{"x": 0, "y": 0}, {"x": 4, "y": 0}, {"x": 4, "y": 0}, {"x": 4, "y": 3}}},
+		"portals": []map[string]any{{
+			"position": map[string]float64{"x": 2, "y": 1.5},
+			"bounds":   []map[string]float64{{"x": 2, "y": 1}, {"x": 2, "y": 2}},
+			"closed":   true,
+		}},
+		"lights": []map[string]any{{
+			"position":  map[string]float64{"x": 1, "y": 1},
+			"range":     5,
+			"intensity": 0.8,
+			"color":     "ffeecc88",
+			"shadows":   true,
+		}},
+		"image": base64.StdEncoding.EncodeToString(picture.Bytes()),
+	}
+	body, _ := json.Marshal(file)
+
+	if w := do(http.MethodPost, "/imports/uvtt", alice, string(body)); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not import maps, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/imports/uvtt", gm, `{"resolution":{"map_size":{"x":1001,"y":3}}}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a map wider than %d cells, got %d", maxMapCells, w.Code)
+	}
+	if w := do(http.MethodPost, "/imports/uvtt", gm, `{"resolution":{"map_size":{"x":4,"y":3}},"image":"not base64!"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid image, got %d", w.Code)
+	}
+
+	w := do(http.MethodPost, "/imports/uvtt", gm, string(body))
+	var imported uvttImport
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&imported) != nil {
+		t.Fatalf("import: %d %s", w.Code, w.Body.String())
+	}
+	if img := imported.Image; img.Width != 4*defaultCellSize || img.Height != 3*defaultCellSize || !strings.HasSuffix(img.URL, ".png") {
+		t.Fatalf("the map must cover its grid cells: %+v", img)
+	}
+	live := httptest.NewServer(router)
+	defer live.Close()
+	res, err := http.Get(live.URL + imported.Image.URL)
+	if err != nil {
+		t.Fatalf("get map image: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("the map image must be served, got %d", res.StatusCode)
+	}
+
+	var walls []Wall
+	_ = json.NewDecoder(do(http.MethodGet, "/walls", gm, "").Body).Decode(&walls)
+	if len(walls) != 3 {
+		t.Fatalf("expected two walls and a door, got %+v", walls)
+	}
+	door := walls[2]
+	if !door.Door || door.Open || door.X1 != 2*defaultCellSize || door.Y1 != defaultCellSize || door.Y2 != 2*defaultCellSize {
+		t.Fatalf("unexpected door: %+v", door)
+	}
+
+	var lights []Light
+	_ = json.NewDecoder(do(http.MethodGet, "/lights", alice, "").Body).Decode(&lights)
+	if len(lights) != 1 || lights[0].X != defaultCellSize || lights[0].Range != 5 || !lights[0].Shadows {
+		t.Fatalf("unexpected lights: %+v", lights)
+	}
+	if w := do(http.MethodDelete, "/lights/"+lights[0].ID, alice, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not remove lights, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/lights/"+lights[0].ID, gm, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete light: %d", w.Code)
+	}
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"reflect"
+)
+
+// playerView decides which canvas images players can see. The GM sees every
+// image; players see visible images of the active scene that are not entirely
+// under fog and, when the room uses vision, lie within sight of one of their
+// tokens. Players always see their own tokens in the active scene.
+type playerView struct {
+	scene    string
+	grid     Grid
+	fog      bool
+	revealed map[[2]int]struct{}
+	vision   bool
+	// sight maps player IDs to what each of their tokens sees.
+	sight map[string][]Vision
+	// owners maps the image ID of every token to its owner's player ID.
+	owners map[string]string
+}
+
+// loadPlayerView reads what decides a room's player visibility. Revealed fog
+// cells, token owners and sight are only loaded while they matter.
+func (s *Server) loadPlayerView(roomID string) (playerView, error) {
+	var view playerView
+	scene, err := s.getActiveScene(roomID)
+	if err != nil {
+		return playerView{}, err
+	}
+	view.scene, view.grid, view.fog = scene.ID, scene.Grid, scene.Fog
+	if err := s.db.QueryRow(`SELECT vision_enabled FROM rooms WHERE id = ?`, roomID).Scan(&view.vision); err != nil {
+		return playerView{}, err
+	}
+	if !view.restricted() {
+		return view, nil
+	}
+	if view.fog {
+		cells, err := s.listFogCells(scene.ID)
+		if err != nil {
+			return playerView{}, err
+		}
+		view.revealed = make(map[[2]int]struct{}, len(cells))
+		for _, cell := range cells {
+			view.revealed[cell] = struct{}{}
+		}
+	}
+	tokens, err := s.listTokens(roomID, scene.ID, false)
+	if err != nil {
+		return playerView{}, err
+	}
+	view.owners = make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		view.owners[token.ID] = token.OwnerID
+	}
+	if view.vision {
+		polygons, err := s.tokenSights(roomID, scene.ID, scene.Grid, tokens)
+		if err != nil {
+			return playerView{}, err
+		}
+		view.sight = make(map[string][]Vision)
+		for _, token := range tokens {
+			if token.OwnerID == "" {
+				continue
+			}
+			view.sight[token.OwnerID] = append(view.sight[token.OwnerID], Vision{
+				TokenID: token.ID,
+				Polygon: polygons[token.ID],
+			})
+		}
+	}
+	return view, nil
+}
+
+// restricted reports whether some players may not see every visible image.
+func (v playerView) restricted() bool {
+	return v.fog || v.vision
+}
+
+// canSee reports whether a player sees an image.
+func (v playerView) canSee(playerID string, img imageResponse) bool {
+	if img.Hidden || img.SceneID != v.scene {
+		return false
+	}
+	if owner := v.owners[img.ID]; owner != "" && owner == playerID {
+		return true
+	}
+	return !v.fogged(img) && v.inSight(playerID, img)
+}
+
+// fogged reports whether an image lies entirely under fog, that is whether no
+// revealed cell touches its bounds. Images of unknown size count as a point.
+func (v playerView) fogged(img imageResponse) bool {
+	if !v.fog {
+		return false
+	}
+	for cell := range v.revealed {
+		minX, minY, maxX, maxY := v.grid.cellBounds(cell[0], cell[1])
+		if minX < img.X+img.Width && img.X < maxX && minY < img.Y+img.Height && img.Y < maxY {
+			return false
+		}
+	}
+	return true
+}
+
+// inSight reports whether one of a player's tokens sees part of an image.
+// Without vision every image is in sight.
+func (v playerView) inSight(playerID string, img imageResponse) bool {
+	if !v.vision {
+		return true
+	}
+	for _, vision := range v.sight[playerID] {
+		if rectTouchesPolygon(img.X, img.Y, img.X+img.Width, img.Y+img.Height, vision.Polygon) {
+			return true
+		}
+	}
+	return false
+}
+
+// placeable reports whether a player may put a token of theirs where img
+// lies: not entirely under fog and, once the player sees through a token,
+// within that sight.
+func (v playerView) placeable(playerID string, img imageResponse) bool {
+	if img.SceneID != v.scene {
+		return true
+	}
+	if v.fogged(img) {
+		return false
+	}
+	return len(v.sight[playerID]) == 0 || v.inSight(playerID, img)
+}
+
+// beginViewChange serializes a change to what players can see. The returned
+// function sends players what the change showed or hid and must be called
+// once the change is done, typically deferred.
+func (s *Server) beginViewChange(roomID string) func() {
+	s.viewMu.Lock()
+	before, err := s.loadPlayerView(roomID)
+	return func() {
+		defer s.viewMu.Unlock()
+		if err != nil {
+			s.logger.Error("load player view", slog.String("room", roomID), slog.String("error", err.Error()))
+			return
+		}
+		s.refreshPlayerViews(roomID, before)
+	}
+}
+
+// visibleImages filters a list of images down to those a player can see.
+func (v playerView) visibleImages(playerID string, images []imageResponse) []imageResponse {
+	visible := make([]imageResponse, 0, len(images))
+	for _, img := range images {
+		if v.canSee(playerID, img) {
+			visible = append(visible, img)
+		}
+	}
+	return visible
+}
+
+// visibleTokens filters a list of tokens down to those a player can see.
+func (v playerView) visibleTokens(playerID string, tokens []Token) []Token {
+	visible := make([]Token, 0, len(tokens))
+	for _, token := range tokens {
+		if v.canSee(playerID, token.image()) {
+			visible = append(visible, token)
+		}
+	}
+	return visible
+}
+
+// imageAudience returns which sockets may receive an image, or nil when the
+// whole room may. Hidden images, images of inactive scenes, and any image
+// while the view cannot be loaded, only go to the GM.
+func (s *Server) imageAudience(roomID string, img imageResponse) func(clientProfile) bool {
+	if img.Hidden {
+		return isGMProfile
+	}
+	view, err := s.loadPlayerView(roomID)
+	if err != nil {
+		s.logger.Error("load player view", slog.String("room", roomID), slog.String("error", err.Error()))
+		return isGMProfile
+	}
+	if img.SceneID != view.scene {
+		return isGMProfile
+	}
+	if !view.restricted() {
+		return nil
+	}
+	return func(profile clientProfile) bool {
+		return isGMProfile(profile) || view.canSee(profile.ID, img)
+	}
+}
+
+// sendSharedImage pushes an image to the sockets accepted by audience, or to
+// the whole room when audience is nil.
+func (s *Server) sendSharedImage(roomID string, img imageResponse, audience func(clientProfile) bool) {
+	payload, err := json.Marshal(map[string]any{
+		"type":    "SharedImage",
+		"payload": img,
+	})
+	if err != nil {
+		s.logger.Error("marshal shared image", slog.String("error", err.Error()))
+		return
+	}
+	if audience == nil {
+		s.broadcast(roomID, payload)
+		return
+	}
+	s.broadcastWhere(roomID, payload, audience)
+}
+
+// refreshPlayerViews sends players their new sight and the images and tokens
+// they can see since a change of the view, and drops the ones they no longer
+// see.
+func (s *Server) refreshPlayerViews(roomID string, before playerView) {
+	after, err := s.loadPlayerView(roomID)
+	if err != nil {
+		s.logger.Error("load player view", slog.String("room", roomID), slog.String("error", err.Error()))
+		return
+	}
+	if !before.restricted() && !after.restricted() {
+		return
+	}
+	images, err := s.getImages(roomID, after.scene, false)
+	if err != nil {
+		s.logger.Error("get images", slog.String("room", roomID), slog.String("error", err.Error()))
+		return
+	}
+	tokens, err := s.listTokens(roomID, after.scene, false)
+	if err != nil {
+		s.logger.Error("list tokens", slog.String("room", roomID), slog.String("error", err.Error()))
+		return
+	}
+	tokensByID := make(map[string]Token, len(tokens))
+	for _, token := range tokens {
+		tokensByID[token.ID] = token
+	}
+
+	players := s.connectedPlayers(roomID)
+	sent := make(map[string]bool)
+	for _, profile := range players {
+		if sent[profile.ID] || (before.vision == after.vision && reflect.DeepEqual(before.sight[profile.ID], after.sight[profile.ID])) {
+			continue
+		}
+		sent[profile.ID] = true
+		s.sendVision(roomID, profile.ID, after)
+	}
+
+	for _, img := range images {
+		shown, dropped := make(map[string]bool), make(map[string]bool)
+		for _, profile := range players {
+			saw, sees := before.canSee(profile.ID, img), after.canSee(profile.ID, img)
+			if sees && !saw {
+				shown[profile.ID] = true
+			} else if saw && !sees {
+				dropped[profile.ID] = true
+			}
+		}
+		token, isToken := tokensByID[img.ID]
+		if len(shown) > 0 {
+			include := func(profile clientProfile) bool { return !isGMProfile(profile) && shown[profile.ID] }
+			s.sendSharedImage(roomID, img, include)
+			if isToken {
+				s.sendToken(roomID, token, include)
+			}
+		}
+		if len(dropped) > 0 {
+			include := func(profile clientProfile) bool { return !isGMProfile(profile) && dropped[profile.ID] }
+			s.broadcastImageRemoved(roomID, img.ID, include)
+			if isToken {
+				s.broadcastTokenDeleted(roomID, token.ID, include)
+			}
+		}
+	}
+}
+
+// connectedPlayers returns the profiles of the non-GM sockets in a room. A
+// player with several sockets is listed once per socket.
+func (s *Server) connectedPlayers(roomID string) []clientProfile {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	players := make([]clientProfile, 0)
+	for _, profile := range s.wsRooms[roomID] {
+		if !isGMProfile(profile) {
+			players = append(players, profile)
+		}
+	}
+	return players
+}
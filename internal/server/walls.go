@@ -0,0 +1,533 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxWallsPerScene = 5000
+	// visionRays is how many evenly spaced rays outline a token's sight
+	// between the rays cast at wall ends.
+	visionRays = 64
+	// unlimitedVision is how far, in canvas pixels, a token with a vision
+	// radius of 0 sees.
+	unlimitedVision = 100000
+)
+
+var (
+	errInvalidWall = errors.New("invalid wall")
+	errWallLimit   = errors.New("too many walls")
+)
+
+const wallColumns = `id, room_id, scene_id, x1, y1, x2, y2, door, open, created_at`
+
+func scanWall(row rowScanner) (Wall, error) {
+	var wall Wall
+	if err := row.Scan(&wall.ID, &wall.RoomID, &wall.SceneID, &wall.X1, &wall.Y1, &wall.X2, &wall.Y2, &wall.Door, &wall.Open, &wall.CreatedAt); err != nil {
+		return Wall{}, err
+	}
+	wall.CreatedAt = wall.CreatedAt.UTC()
+	return wall, nil
+}
+
+func (s *Server) listWalls(roomID, sceneID string) ([]Wall, error) {
+	rows, err := s.db.Query(`SELECT `+wallColumns+` FROM walls WHERE room_id = ? AND scene_id = ? ORDER BY created_at, id`, roomID, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	walls := make([]Wall, 0)
+	for rows.Next() {
+		wall, err := scanWall(rows)
+		if err != nil {
+			return nil, err
+		}
+		walls = append(walls, wall)
+	}
+	return walls, rows.Err()
+}
+
+func (s *Server) getWall(roomID, wallID string) (Wall, bool, error) {
+	wall, err := scanWall(s.db.QueryRow(`SELECT `+wallColumns+` FROM walls WHERE id = ? AND room_id = ?`, wallID, roomID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Wall{}, false, nil
+	}
+	if err != nil {
+		return Wall{}, false, err
+	}
+	return wall, true, nil
+}
+
+// storeWalls inserts or replaces walls in one transaction, keeping each scene
+// within maxWallsPerScene.
+func (s *Server) storeWalls(roomID string, walls []Wall) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if err := insertWalls(tx, roomID, walls); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, wall := range walls {
+		s.wallsChanged(wall.SceneID)
+	}
+	return nil
+}
+
+// insertWalls inserts or replaces walls within a transaction and fails with
+// errWallLimit when a scene they are in ends up with more than
+// maxWallsPerScene.
+func insertWalls(tx *sql.Tx, roomID string, walls []Wall) error {
+	scenes := make(map[string]struct{})
+	for _, wall := range walls {
+		if _, err := tx.Exec(
+			`INSERT INTO walls (`+wallColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(id) DO UPDATE SET x1 = excluded.x1, y1 = excluded.y1, x2 = excluded.x2, y2 = excluded.y2,
+			door = excluded.door, open = excluded.open`,
+			wall.ID, roomID, wall.SceneID, wall.X1, wall.Y1, wall.X2, wall.Y2, wall.Door, wall.Open, wall.CreatedAt,
+		); err != nil {
+			return err
+		}
+		scenes[wall.SceneID] = struct{}{}
+	}
+	for sceneID := range scenes {
+		var count int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM walls WHERE room_id = ? AND scene_id = ?`, roomID, sceneID).Scan(&count); err != nil {
+			return err
+		}
+		if count > maxWallsPerScene {
+			return fmt.Errorf("%w: a scene holds at most %d walls", errWallLimit, maxWallsPerScene)
+		}
+	}
+	return nil
+}
+
+// wallRequest holds the fields of a wall that can be set. Absent fields are
+// left unchanged; SceneID only places a new wall and defaults to the active
+// scene.
+type wallRequest struct {
+	SceneID string   `json:"sceneId"`
+	X1      *float64 `json:"x1"`
+	Y1      *float64 `json:"y1"`
+	X2      *float64 `json:"x2"`
+	Y2      *float64 `json:"y2"`
+	Door    *bool    `json:"door"`
+	Open    *bool    `json:"open"`
+}
+
+func (req wallRequest) apply(wall *Wall) error {
+	for _, field := range []struct {
+		value *float64
+		dest  *float64
+	}{{req.X1, &wall.X1}, {req.Y1, &wall.Y1}, {req.X2, &wall.X2}, {req.Y2, &wall.Y2}} {
+		if field.value != nil {
+			*field.dest = *field.value
+		}
+	}
+	if !isValidPosition(wall.X1, wall.Y1) || !isValidPosition(wall.X2, wall.Y2) {
+		return fmt.Errorf("%w: invalid coordinates", errInvalidWall)
+	}
+	if wall.X1 == wall.X2 && wall.Y1 == wall.Y2 {
+		return fmt.Errorf("%w: a wall needs two distinct ends", errInvalidWall)
+	}
+	if req.Door != nil {
+		wall.Door = *req.Door
+	}
+	if req.Open != nil {
+		wall.Open = *req.Open
+	}
+	if wall.Open && !wall.Door {
+		return fmt.Errorf("%w: only doors can be open", errInvalidWall)
+	}
+	return nil
+}
+
+// broadcastWall sends a wall to the GM, the only one who sees walls.
+func (s *Server) broadcastWall(roomID string, msgType string, payload any) {
+	data, err := json.Marshal(map[string]any{
+		"type":    msgType,
+		"payload": payload,
+	})
+	if err != nil {
+		s.logger.Error("marshal wall", slog.String("error", err.Error()))
+		return
+	}
+	s.broadcastWhere(roomID, data, isGMProfile)
+}
+
+// handleWalls serves /rooms/{id}/walls. Walls, including opening and closing
+// doors, are managed by the GM alone; every change updates what players see.
+func (s *Server) handleWalls(w http.ResponseWriter, r *http.Request, roomID, wallID string) {
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	if player.Role != RoleGM {
+		http.Error(w, "only the GM can see and edit walls", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case wallID == "" && r.Method == http.MethodGet:
+		scene, err := s.resolveScene(roomID, r.URL.Query().Get("scene"), true)
+		if !s.writeSceneError(w, r, err) {
+			return
+		}
+		walls, err := s.listWalls(roomID, scene.ID)
+		if err != nil {
+			s.logger.Error("list walls", slog.String("error", err.Error()))
+			http.Error(w, "failed to load walls", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, walls)
+		return
+	case wallID == "" && r.Method == http.MethodPost:
+		var req wallRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if req.X1 == nil || req.Y1 == nil || req.X2 == nil || req.Y2 == nil {
+			http.Error(w, "x1, y1, x2 and y2 are required", http.StatusBadRequest)
+			return
+		}
+		scene, err := s.resolveScene(roomID, req.SceneID, true)
+		if !s.writeSceneError(w, r, err) {
+			return
+		}
+		wall := Wall{ID: s.newID(), RoomID: roomID, SceneID: scene.ID, CreatedAt: time.Now().UTC()}
+		if err := req.apply(&wall); err != nil {
+			http.Error(w, strings.TrimPrefix(err.Error(), errInvalidWall.Error()+": "), http.StatusBadRequest)
+			return
+		}
+		if !s.saveWall(w, roomID, wall) {
+			return
+		}
+		writeJSON(w, http.StatusCreated, wall)
+		return
+	case wallID != "" && (r.Method == http.MethodPatch || r.Method == http.MethodDelete):
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	wall, found, err := s.getWall(roomID, wallID)
+	if err != nil {
+		s.logger.Error("get wall", slog.String("error", err.Error()))
+		http.Error(w, "failed to load wall", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPatch {
+		var req wallRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := req.apply(&wall); err != nil {
+			http.Error(w, strings.TrimPrefix(err.Error(), errInvalidWall.Error()+": "), http.StatusBadRequest)
+			return
+		}
+		if !s.saveWall(w, roomID, wall) {
+			return
+		}
+		writeJSON(w, http.StatusOK, wall)
+		return
+	}
+
+	done := s.beginViewChange(roomID)
+	_, err = s.db.Exec(`DELETE FROM walls WHERE id = ? AND room_id = ?`, wall.ID, roomID)
+	s.wallsChanged(wall.SceneID)
+	done()
+	if err != nil {
+		s.logger.Error("delete wall", slog.String("error", err.Error()))
+		http.Error(w, "failed to delete wall", http.StatusInternalServerError)
+		return
+	}
+	s.broadcastWall(roomID, "WallDeleted", map[string]string{"id": wall.ID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveWall stores a wall, broadcasts it and writes an error response if that
+// fails.
+func (s *Server) saveWall(w http.ResponseWriter, roomID string, wall Wall) bool {
+	done := s.beginViewChange(roomID)
+	err := s.storeWalls(roomID, []Wall{wall})
+	done()
+	if errors.Is(err, errWallLimit) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		s.logger.Error("save wall", slog.String("error", err.Error()))
+		http.Error(w, "failed to save wall", http.StatusInternalServerError)
+		return false
+	}
+	s.broadcastWall(roomID, "WallUpdate", wall)
+	return true
+}
+
+// visionPayload is what a player's VisionUpdate and GET /rooms/{id}/vision
+// carry: whether vision is on and what each of their tokens sees.
+func visionPayload(enabled bool, tokens []Vision) map[string]any {
+	if tokens == nil {
+		tokens = make([]Vision, 0)
+	}
+	return map[string]any{"enabled": enabled, "tokens": tokens}
+}
+
+// sendVision sends a player the sight of their tokens.
+func (s *Server) sendVision(roomID, playerID string, view playerView) {
+	payload, err := json.Marshal(map[string]any{
+		"type":    "VisionUpdate",
+		"payload": visionPayload(view.vision, view.sight[playerID]),
+	})
+	if err != nil {
+		s.logger.Error("marshal vision", slog.String("error", err.Error()))
+		return
+	}
+	s.sendToPlayer(roomID, playerID, payload)
+}
+
+// handleVision serves GET /rooms/{id}/vision: what the player's tokens see,
+// or every player token's sight for the GM.
+func (s *Server) handleVision(w http.ResponseWriter, r *http.Request, roomID string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	player, ok := requirePlayer(w, r, roomID)
+	if !ok {
+		return
+	}
+	view, err := s.loadPlayerView(roomID)
+	if err != nil {
+		s.logger.Error("load player view", slog.String("error", err.Error()))
+		http.Error(w, "failed to load vision", http.StatusInternalServerError)
+		return
+	}
+	tokens := view.sight[player.ID]
+	if player.Role == RoleGM {
+		tokens = nil
+		for _, sight := range view.sight {
+			tokens = append(tokens, sight...)
+		}
+		sort.Slice(tokens, func(i, j int) bool { return tokens[i].TokenID < tokens[j].TokenID })
+	}
+	writeJSON(w, http.StatusOK, visionPayload(view.vision, tokens))
+}
+
+// sceneSight is what the tokens of a scene see, keyed by token ID, cast
+// against one version of the scene's walls.
+type sceneSight struct {
+	walls  uint64
+	tokens map[string]tokenSight
+}
+
+// tokenSight is a token's sight polygon and the eye it was cast from.
+type tokenSight struct {
+	x, y, radius float64
+	polygon      [][2]float64
+}
+
+// wallsChanged marks the walls of a scene as changed, so that the sight cast
+// against them is cast again. It must be called before the change's view is
+// refreshed.
+func (s *Server) wallsChanged(sceneID string) {
+	s.sightMu.Lock()
+	defer s.sightMu.Unlock()
+	s.wallVersions[sceneID]++
+	delete(s.sights, sceneID)
+}
+
+// forgetSceneSight drops what is cached about a deleted scene.
+func (s *Server) forgetSceneSight(sceneID string) {
+	s.sightMu.Lock()
+	defer s.sightMu.Unlock()
+	delete(s.wallVersions, sceneID)
+	delete(s.sights, sceneID)
+}
+
+// tokenSights returns what each player-owned token of a scene sees. Sight is
+// only cast again for tokens that moved or changed since it was cached, and
+// for every token once the scene's walls changed.
+func (s *Server) tokenSights(roomID, sceneID string, grid Grid, tokens []Token) (map[string][][2]float64, error) {
+	s.sightMu.Lock()
+	version, cached := s.wallVersions[sceneID], s.sights[sceneID]
+	s.sightMu.Unlock()
+	if cached.walls != version {
+		cached.tokens = nil
+	}
+
+	var walls []Wall
+	loaded := false
+	fresh := make(map[string]tokenSight, len(tokens))
+	polygons := make(map[string][][2]float64, len(tokens))
+	for _, token := range tokens {
+		if token.OwnerID == "" {
+			continue
+		}
+		x, y, radius := tokenEye(token, grid)
+		sight, ok := cached.tokens[token.ID]
+		if !ok || sight.x != x || sight.y != y || sight.radius != radius {
+			if !loaded {
+				all, err := s.listWalls(roomID, sceneID)
+				if err != nil {
+					return nil, err
+				}
+				walls, loaded = blockingWalls(all), true
+			}
+			sight = tokenSight{x: x, y: y, radius: radius, polygon: visionPolygon(x, y, radius, walls)}
+		}
+		fresh[token.ID] = sight
+		polygons[token.ID] = sight.polygon
+	}
+
+	s.sightMu.Lock()
+	defer s.sightMu.Unlock()
+	// Walls that changed while sight was cast make it stale; it is then
+	// returned but not kept.
+	if s.wallVersions[sceneID] == version {
+		s.sights[sceneID] = sceneSight{walls: version, tokens: fresh}
+	}
+	return polygons, nil
+}
+
+// tokenEye returns where a token sees from, its centre, and how far, its
+// vision radius in grid cells.
+func tokenEye(token Token, grid Grid) (x, y, radius float64) {
+	radius = float64(unlimitedVision)
+	if token.VisionRadius > 0 {
+		radius = token.VisionRadius * grid.CellSize
+	}
+	return token.X + token.Width/2, token.Y + token.Height/2, radius
+}
+
+// blockingWalls returns the walls that block sight: all but open doors.
+func blockingWalls(walls []Wall) []Wall {
+	blocking := make([]Wall, 0, len(walls))
+	for _, wall := range walls {
+		if !wall.Open {
+			blocking = append(blocking, wall)
+		}
+	}
+	return blocking
+}
+
+// visionPolygon casts rays from x, y to every wall end within radius, just
+// past either side of it, and at evenly spaced angles, and joins where each
+// ray first hits a wall or reaches the radius into a polygon.
+func visionPolygon(x, y, radius float64, walls []Wall) [][2]float64 {
+	const nudge = 1e-4
+	angles := make([]float64, 0, visionRays+6*len(walls))
+	for i := 0; i < visionRays; i++ {
+		angles = append(angles, -math.Pi+2*math.Pi*float64(i)/visionRays)
+	}
+	for _, wall := range walls {
+		for _, end := range [][2]float64{{wall.X1, wall.Y1}, {wall.X2, wall.Y2}} {
+			if math.Hypot(end[0]-x, end[1]-y) > radius {
+				continue
+			}
+			angle := math.Atan2(end[1]-y, end[0]-x)
+			angles = append(angles, angle-nudge, angle, angle+nudge)
+		}
+	}
+	sort.Float64s(angles)
+
+	polygon := make([][2]float64, 0, len(angles))
+	for _, angle := range angles {
+		dx, dy := math.Cos(angle), math.Sin(angle)
+		reach := radius
+		for _, wall := range walls {
+			if t, ok := rayHitsSegment(x, y, dx, dy, wall); ok && t < reach {
+				reach = t
+			}
+		}
+		polygon = append(polygon, [2]float64{x + dx*reach, y + dy*reach})
+	}
+	return polygon
+}
+
+// rayHitsSegment returns how far along the ray from x, y in direction dx, dy
+// it meets a wall.
+func rayHitsSegment(x, y, dx, dy float64, wall Wall) (float64, bool) {
+	sx, sy := wall.X2-wall.X1, wall.Y2-wall.Y1
+	denom := dx*sy - dy*sx
+	if math.Abs(denom) < 1e-12 {
+		return 0, false
+	}
+	ox, oy := wall.X1-x, wall.Y1-y
+	t := (ox*sy - oy*sx) / denom
+	u := (ox*dy - oy*dx) / denom
+	if t < 0 || u < 0 || u > 1 {
+		return 0, false
+	}
+	return t, true
+}
+
+// rectTouchesPolygon reports whether a rectangle and a polygon overlap. A
+// rectangle without area is treated as a point or a line.
+func rectTouchesPolygon(minX, minY, maxX, maxY float64, polygon [][2]float64) bool {
+	if len(polygon) < 3 {
+		return false
+	}
+	corners := [][2]float64{{minX, minY}, {maxX, minY}, {maxX, maxY}, {minX, maxY}}
+	for _, c := range corners {
+		if pointInPolygon(c[0], c[1], polygon) {
+			return true
+		}
+	}
+	for _, p := range polygon {
+		if p[0] >= minX && p[0] <= maxX && p[1] >= minY && p[1] <= maxY {
+			return true
+		}
+	}
+	for i := range polygon {
+		a, b := polygon[i], polygon[(i+1)%len(polygon)]
+		for j := range corners {
+			if segmentsIntersect(a, b, corners[j], corners[(j+1)%len(corners)]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// segmentsIntersect reports whether segments ab and cd cross or touch.
+func segmentsIntersect(a, b, c, d [2]float64) bool {
+	cross := func(o, p, q [2]float64) float64 {
+		return (p[0]-o[0])*(q[1]-o[1]) - (p[1]-o[1])*(q[0]-o[0])
+	}
+	// within reports whether q, known to be on the line through o and p, lies
+	// between them.
+	within := func(o, p, q [2]float64) bool {
+		return math.Min(o[0], p[0]) <= q[0] && q[0] <= math.Max(o[0], p[0]) &&
+			math.Min(o[1], p[1]) <= q[1] && q[1] <= math.Max(o[1], p[1])
+	}
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && within(c, d, a)) || (d2 == 0 && within(c, d, b)) ||
+		(d3 == 0 && within(a, b, c)) || (d4 == 0 && within(a, b, d))
+}
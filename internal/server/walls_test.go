@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestVisionPolygon(t *testing.T) {
+	walls := []Wall{{X1: 50, Y1: -50, X2: 50, Y2: 50}}
+	polygon := visionPolygon(0, 0, 100, walls)
+	for _, tt := range []struct {
+		x, y float64
+		seen bool
+	}{
+		{30, 0, true},
+		{80, 0, false},
+		{0, 80, true},
+		{-80, 0, true},
+		{0, 120, false},
+	} {
+		if got := pointInPolygon(tt.x, tt.y, polygon); got != tt.seen {
+			t.Errorf("point %v,%v seen = %v, want %v", tt.x, tt.y, got, tt.seen)
+		}
+	}
+	if !rectTouchesPolygon(60, 60, 200, 200, polygon) {
+		t.Error("a rectangle reaching into sight must be seen")
+	}
+	if rectTouchesPolygon(60, -10, 90, 10, polygon) {
+		t.Error("a rectangle behind the wall must not be seen")
+	}
+}
+
+func TestTokenSightsCache(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	room := createRoomForTest(t, srv.Router())
+	sceneID := room.ActiveSceneID
+	grid, err := srv.getSceneGrid(room.ID, sceneID)
+	if err != nil {
+		t.Fatalf("grid: %v", err)
+	}
+	tokens := []Token{{ID: "hero", OwnerID: "alice", Width: 50, Height: 50, VisionRadius: 12}, {ID: "ogre", Width: 100, Height: 100}}
+	sights := func() map[string][][2]float64 {
+		t.Helper()
+		polygons, err := srv.tokenSights(room.ID, sceneID, grid, tokens)
+		if err != nil {
+			t.Fatalf("sights: %v", err)
+		}
+		return polygons
+	}
+
+	first := sights()
+	if _, ok := first["ogre"]; ok || len(first["hero"]) == 0 {
+		t.Fatalf("only player tokens have sight: %v", first)
+	}
+	if again := sights(); &again["hero"][0] != &first["hero"][0] {
+		t.Fatal("sight must be reused while nothing changed")
+	}
+	if !pointInPolygon(300, 25, first["hero"]) {
+		t.Fatal("the hero must see across the empty room")
+	}
+
+	if err := srv.storeWalls(room.ID, []Wall{{ID: "wall", SceneID: sceneID, X1: 150, Y1: -500, X2: 150, Y2: 500, CreatedAt: time.Now()}}); err != nil {
+		t.Fatalf("store wall: %v", err)
+	}
+	walled := sights()
+	if pointInPolygon(300, 25, walled["hero"]) {
+		t.Fatal("sight must be cast again once the walls change")
+	}
+
+	tokens[0].X = 200
+	if moved := sights(); !pointInPolygon(300, 25, moved["hero"]) {
+		t.Fatal("sight must be cast again once the token moves")
+	}
+}
+
+func TestWallLimitPerScene(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	room := createRoomForTest(t, srv.Router())
+	now := time.Now()
+	walls := make([]Wall, maxWallsPerScene)
+	for i := range walls {
+		walls[i] = Wall{ID: fmt.Sprintf("main-%d", i), SceneID: room.ActiveSceneID, X1: float64(i), X2: float64(i), Y2: 10, CreatedAt: now}
+	}
+	if err := srv.storeWalls(room.ID, walls); err != nil {
+		t.Fatalf("fill the main scene: %v", err)
+	}
+	if err := srv.storeWalls(room.ID, []Wall{{ID: "cave", SceneID: "cave", Y2: 10, CreatedAt: now}}); err != nil {
+		t.Fatalf("a full scene must not limit another one: %v", err)
+	}
+	if err := srv.storeWalls(room.ID, []Wall{{ID: "extra", SceneID: room.ActiveSceneID, Y2: 10, CreatedAt: now}}); !errors.Is(err, errWallLimit) {
+		t.Fatalf("expected the wall limit, got %v", err)
+	}
+}
+
+func TestWallsAndVision(t *testing.T) {
+	srv := newTestServer(t, t.TempDir())
+	router := srv.Router()
+	room := createRoomForTest(t, router)
+	gm := joinRoomForTest(t, router, room, "Test Creator", RoleGM)
+	alice := joinRoomForTest(t, router, room, "Alice", RolePlayer)
+
+	do := func(method, path string, player Player, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		if payload != nil {
+			_ = json.NewEncoder(&body).Encode(payload)
+		}
+		req := httptest.NewRequest(method, "/rooms/"+room.ID+path, &body)
+		req.Header.Set("Content-Type", "application/json")
+		authorize(req, player)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	readID := func(conn net.Conn, msgType string) string {
+		t.Helper()
+		var payload struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(readWSMessageForTest(t, conn, msgType), &payload); err != nil {
+			t.Fatalf("decode %s: %v", msgType, err)
+		}
+		return payload.ID
+	}
+
+	// Alice's hero and a goblin are separated by a door.
+	var hero, goblin Token
+	_ = json.NewDecoder(do(http.MethodPost, "/tokens", alice, map[string]any{"url": "https://example.com/hero.png", "name": "Hero", "x": 0, "y": 0}).Body).Decode(&hero)
+	_ = json.NewDecoder(do(http.MethodPost, "/tokens", gm, map[string]any{"url": "https://example.com/goblin.png", "name": "Goblin", "x": 300, "y": 0}).Body).Decode(&goblin)
+	if w := do(http.MethodPost, "/walls", alice, map[string]float64{"x1": 150, "y1": -500, "x2": 150, "y2": 500}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not add walls, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/walls", gm, map[string]any{"x1": 150, "y1": 0, "x2": 150, "y2": 0}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a wall without length, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/walls", gm, map[string]any{"x1": 150, "y1": -500, "x2": 150, "y2": 500, "open": true}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an open wall, got %d", w.Code)
+	}
+	w := do(http.MethodPost, "/walls", gm, map[string]any{"x1": 150, "y1": -500, "x2": 150, "y2": 500, "door": true})
+	var door Wall
+	if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&door) != nil || !door.Door || door.Open {
+		t.Fatalf("create door: %d %s", w.Code, w.Body.String())
+	}
+
+	live := httptest.NewServer(router)
+	defer live.Close()
+	conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.ID+"?token="+url.QueryEscape(alice.Token), nil)
+	defer conn.Close()
+	readWSMessageForTest(t, conn, "RosterUpdate")
+
+	if w := do(http.MethodPatch, "", alice, map[string]bool{"vision": true}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not change vision, got %d", w.Code)
+	}
+	if w := do(http.MethodPatch, "", gm, map[string]bool{"vision": true}); w.Code != http.StatusOK {
+		t.Fatalf("enable vision: %d", w.Code)
+	}
+	var vision struct {
+		Enabled bool     `json:"enabled"`
+		Tokens  []Vision `json:"tokens"`
+	}
+	if err := json.Unmarshal(readWSMessageForTest(t, conn, "VisionUpdate"), &vision); err != nil || !vision.Enabled ||
+		len(vision.Tokens) != 1 || vision.Tokens[0].TokenID != hero.ID {
+		t.Fatalf("unexpected vision: %+v %v", vision, err)
+	}
+	if id := readID(conn, "TokenDeleted"); id != goblin.ID {
+		t.Fatalf("the goblin behind the door must be dropped, got %s", id)
+	}
+	var images []imageResponse
+	_ = json.NewDecoder(do(http.MethodGet, "/images", alice, nil).Body).Decode(&images)
+	if len(images) != 1 || images[0].ID != hero.ID {
+		t.Fatalf("players only get what their tokens see: %+v", images)
+	}
+	if w := do(http.MethodGet, "/walls", alice, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not list walls, got %d", w.Code)
+	}
+
+	// Opening the door shows the goblin; closing it hides it again.
+	if w := do(http.MethodPatch, "/walls/"+door.ID, gm, map[string]bool{"open": true}); w.Code != http.StatusOK {
+		t.Fatalf("open door: %d %s", w.Code, w.Body.String())
+	}
+	if id := readID(conn, "TokenUpdate"); id != goblin.ID {
+		t.Fatalf("expected the goblin to be shown, got %s", id)
+	}
+	do(http.MethodPatch, "/walls/"+door.ID, gm, map[string]bool{"open": false})
+	if id := readID(conn, "TokenDeleted"); id != goblin.ID {
+		t.Fatalf("expected the goblin to be dropped, got %s", id)
+	}
+
+	// New tokens cannot look past the door, nor see without limit.
+	if w := do(http.MethodPost, "/tokens", alice, map[string]any{"url": "https://example.com/scout.png", "name": "Scout", "x": 300, "y": 0}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not place tokens out of sight, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/tokens", alice, map[string]any{"url": "https://example.com/scout.png", "name": "Scout", "visionRadius": 0}); w.Code != http.StatusForbidden {
+		t.Fatalf("players must not set their tokens' vision, got %d", w.Code)
+	}
+
+	// Walking through the door lets Alice see the goblin.
+	do(http.MethodPatch, "/tokens/"+hero.ID, alice, map[string]float64{"x": 200})
+	for {
+		var token Token
+		if err := json.Unmarshal(readWSMessageForTest(t, conn, "TokenUpdate"), &token); err != nil {
+			t.Fatalf("decode token: %v", err)
+		}
+		if token.ID == goblin.ID {
+			break
+		}
+	}
+	w = do(http.MethodGet, "/vision", gm, nil)
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&vision) != nil || len(vision.Tokens) != 1 {
+		t.Fatalf("the GM sees every player token's sight: %d %+v", w.Code, vision)
+	}
+
+	if w := do(http.MethodDelete, "/walls/"+door.ID, gm, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete wall: %d", w.Code)
+	}
+	var walls []Wall
+	_ = json.NewDecoder(do(http.MethodGet, "/walls", gm, nil).Body).Decode(&walls)
+	if len(walls) != 0 {
+		t.Fatalf("expected no walls, got %+v", walls)
+	}
+}
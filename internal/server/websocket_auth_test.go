@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 )
 
-func TestWebSocketGMValidation(t *testing.T) {
+func TestWebSocketTokenAuthentication(t *testing.T) {
 	srv := newTestServer(t, t.TempDir())
 	router := srv.Router()
 
@@ -23,56 +25,112 @@ func TestWebSocketGMValidation(t *testing.T) {
 	var room Room
 	_ = json.NewDecoder(w.Body).Decode(&room)
 
-	t.Run("creator can connect as GM via WebSocket", func(t *testing.T) {
-		// Try to connect as Alice (the creator) with GM role
-		req := httptest.NewRequest("GET", fmt.Sprintf("/ws/rooms/%s?role=gm&name=Alice", room.ID), nil)
+	otherBody, _ := json.Marshal(map[string]string{"name": "Other Room", "createdBy": "Carol"})
+	otherReq := httptest.NewRequest("POST", "/rooms", bytes.NewReader(otherBody))
+	otherW := httptest.NewRecorder()
+	router.ServeHTTP(otherW, otherReq)
+	var otherRoom Room
+	_ = json.NewDecoder(otherW.Body).Decode(&otherRoom)
+
+	alice := joinRoomForTest(t, router, room, "Alice", RoleGM)
+	bob := joinRoomForTest(t, router, room, "Bob", RolePlayer)
+	carol := joinRoomForTest(t, router, otherRoom, "Carol", RoleGM)
+
+	upgradeRequest := func(target string) *http.Request {
+		req := httptest.NewRequest("GET", target, nil)
 		req.Header.Set("Connection", "Upgrade")
 		req.Header.Set("Upgrade", "websocket")
 		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
 		req.Header.Set("Sec-WebSocket-Version", "13")
+		return req
+	}
+
+	t.Run("GM token is accepted", func(t *testing.T) {
+		req := upgradeRequest(fmt.Sprintf("/ws/rooms/%s?token=%s", room.ID, url.QueryEscape(alice.Token)))
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
 
-		// httptest doesn't support hijacking, so we get 200 instead of 101
-		// But we should NOT get 403, which would mean validation failed
-		if w.Code == 403 {
-			t.Fatalf("creator should be allowed to connect as GM, got 403: %s", w.Body.String())
+		// httptest doesn't support hijacking, so we never get 101, but
+		// authentication must not reject the token
+		if w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden {
+			t.Fatalf("GM token should be accepted, got %d: %s", w.Code, w.Body.String())
 		}
 	})
 
-	t.Run("non-creator cannot connect as GM via WebSocket", func(t *testing.T) {
-		// Try to connect as Bob (not the creator) with GM role
-		req := httptest.NewRequest("GET", fmt.Sprintf("/ws/rooms/%s?role=gm&name=Bob", room.ID), nil)
-		req.Header.Set("Connection", "Upgrade")
-		req.Header.Set("Upgrade", "websocket")
-		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
-		req.Header.Set("Sec-WebSocket-Version", "13")
+	t.Run("query role and name without token are rejected", func(t *testing.T) {
+		req := upgradeRequest(fmt.Sprintf("/ws/rooms/%s?role=gm&name=Alice", room.ID))
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
 
-		// Should get 403 Forbidden
-		if w.Code != 403 {
-			t.Fatalf("expected 403 for non-creator trying to connect as GM, got %d: %s", w.Code, w.Body.String())
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 without token, got %d: %s", w.Code, w.Body.String())
 		}
-		expected := "only the room creator can connect as GM\n"
-		if w.Body.String() != expected {
-			t.Fatalf("expected error message %q, got %q", expected, w.Body.String())
+	})
+
+	t.Run("unknown token is rejected", func(t *testing.T) {
+		req := upgradeRequest(fmt.Sprintf("/ws/rooms/%s?token=bogus", room.ID))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for unknown token, got %d: %s", w.Code, w.Body.String())
 		}
 	})
 
-	t.Run("anyone can connect as player via WebSocket", func(t *testing.T) {
-		// Try to connect as Bob with player role
-		req := httptest.NewRequest("GET", fmt.Sprintf("/ws/rooms/%s?role=player&name=Bob", room.ID), nil)
-		req.Header.Set("Connection", "Upgrade")
-		req.Header.Set("Upgrade", "websocket")
-		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
-		req.Header.Set("Sec-WebSocket-Version", "13")
+	t.Run("token from another room is rejected", func(t *testing.T) {
+		req := upgradeRequest(fmt.Sprintf("/ws/rooms/%s?token=%s", room.ID, url.QueryEscape(carol.Token)))
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
 
-		// Should not get 403
-		if w.Code == 403 {
-			t.Fatalf("player should be allowed to connect, got 403: %s", w.Body.String())
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("expected 403 for token from another room, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("profile is derived from the players table", func(t *testing.T) {
+		live := httptest.NewServer(router)
+		defer live.Close()
+
+		// Bob asks to be Alice the GM; the server must ignore the query.
+		path := fmt.Sprintf("/ws/rooms/%s?role=gm&name=Alice&token=%s", room.ID, url.QueryEscape(bob.Token))
+		conn := dialWebsocketForTest(t, live.URL, path, nil)
+
+		var roster struct {
+			Users []clientProfile `json:"users"`
+		}
+		if err := json.Unmarshal(readWSMessageForTest(t, conn, "RosterUpdate"), &roster); err != nil {
+			t.Fatalf("decode roster: %v", err)
+		}
+		if len(roster.Users) != 1 {
+			t.Fatalf("expected one connected user, got %+v", roster.Users)
+		}
+		want := clientProfile{ID: bob.ID, Name: "Bob", Role: string(RolePlayer)}
+		if roster.Users[0] != want {
+			t.Fatalf("expected profile %+v, got %+v", want, roster.Users[0])
+		}
+	})
+
+	t.Run("token is accepted as a subprotocol", func(t *testing.T) {
+		live := httptest.NewServer(router)
+		defer live.Close()
+
+		header := http.Header{"Sec-WebSocket-Protocol": {bob.Token}}
+		conn := dialWebsocketForTest(t, live.URL, "/ws/rooms/"+room.Slug, header)
+
+		var roster struct {
+			Users []clientProfile `json:"users"`
+		}
+		if err := json.Unmarshal(readWSMessageForTest(t, conn, "RosterUpdate"), &roster); err != nil {
+			t.Fatalf("decode roster: %v", err)
+		}
+		found := false
+		for _, user := range roster.Users {
+			if user.ID == bob.ID {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected Bob in roster, got %+v", roster.Users)
 		}
 	})
 }
@@ -6,6 +6,12 @@ import JoinBySlug from './components/JoinBySlug.jsx';
 import AdminRooms from './components/AdminRooms.jsx';
 import './App.css';
 
+// DICE_LOG_WINDOW is how many of the latest rolls are kept as they come in;
+// older ones are paged in from the server when asked for.
+const DICE_LOG_WINDOW = 50;
+
+const emptyDiceLog = { entries: [], hasOlder: false };
+
 const RoomLoader = ({ children, onRoomNotFound }) => {
   const { roomIdentifier } = useParams();
   const navigate = useNavigate();
@@ -74,16 +80,13 @@ const useWebSocket = (roomId, user, onMessage, onError) => {
   const [socket, setSocket] = useState(null);
 
   useEffect(() => {
-    if (!roomId || !user?.role || !user?.name) {
+    if (!roomId || !user?.token) {
       setSocket(null);
       return undefined;
     }
     const protocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
-    const params = new URLSearchParams();
-    params.set('role', user.role);
-    params.set('name', user.name);
-    const query = params.toString();
-    const ws = new WebSocket(`${protocol}://${window.location.host}/ws/rooms/${roomId}?${query}`);
+    // The player token is offered as the subprotocol so it stays out of URLs and logs.
+    const ws = new WebSocket(`${protocol}://${window.location.host}/ws/rooms/${roomId}`, [user.token]);
     ws.addEventListener('open', () => {
       setSocket(ws);
     });
@@ -108,7 +111,7 @@ const useWebSocket = (roomId, user, onMessage, onError) => {
       ws.close();
       setSocket(null);
     };
-  }, [roomId, user?.role, user?.name, onMessage, onError]);
+  }, [roomId, user?.token, onMessage, onError]);
 
   return socket;
 };
@@ -123,7 +126,11 @@ const RoomRoute = ({
   diceRoll,
   onSendDiceRoll,
   diceLog,
-  onDiceResult,
+  hasOlderDiceLog,
+  rollRequests,
+  rollRequestStatuses,
+  onSendRollRequest,
+  onAnswerRollRequest,
   theme,
   onThemeChange,
 }) => {
@@ -151,13 +158,25 @@ const RoomRoute = ({
       diceRoll={diceRoll}
       onSendDiceRoll={onSendDiceRoll}
       diceLog={diceLog}
-      onDiceResult={onDiceResult}
+      hasOlderDiceLog={hasOlderDiceLog}
+      rollRequests={rollRequests}
+      rollRequestStatuses={rollRequestStatuses}
+      onSendRollRequest={onSendRollRequest}
+      onAnswerRollRequest={onAnswerRollRequest}
       theme={theme}
       onThemeChange={onThemeChange}
     />
   );
 };
 
+// newClientSeed returns 16 random bytes as hex, mixed into the server seed of
+// a roll so the server cannot choose the outcome alone.
+const newClientSeed = () => {
+  if (typeof crypto === 'undefined' || !crypto.getRandomValues) return '';
+  const bytes = crypto.getRandomValues(new Uint8Array(16));
+  return Array.from(bytes, (b) => b.toString(16).padStart(2, '0')).join('');
+};
+
 const initialSession = loadPersistedSession();
 
 const App = () => {
@@ -167,9 +186,12 @@ const App = () => {
   const [participants, setParticipants] = useState([]);
   const [connectionError, setConnectionError] = useState('');
   const [diceRoll, setDiceRoll] = useState(null);
-  const [diceLog, setDiceLog] = useState([]);
+  const [diceLog, setDiceLog] = useState(emptyDiceLog);
+  const [rollRequests, setRollRequests] = useState([]);
+  const [rollRequestStatuses, setRollRequestStatuses] = useState([]);
   const [roomTheme, setRoomTheme] = useState(() => initialSession?.theme || 'default');
   const diceChannelRef = useRef(null);
+  const diceCommitmentRef = useRef('');
 
   const navigate = useNavigate();
   const location = useLocation();
@@ -212,14 +234,18 @@ const App = () => {
   useEffect(() => {
     setConnectionError('');
     setParticipants([]);
-    setDiceLog([]);
+    setDiceLog(emptyDiceLog);
+    setRollRequests([]);
+    setRollRequestStatuses([]);
   }, [roomId, user?.id, user?.role, user?.name]);
 
+  const updateDiceLog = useCallback((entries, hasOlder) => setDiceLog({ entries, hasOlder }), []);
+
   const handleLogout = useCallback(() => {
     setSession(null);
     setSharedImages([]);
     setParticipants([]);
-    setDiceLog([]);
+    setDiceLog(emptyDiceLog);
     setConnectionError('');
     setRoomTheme('default');
     navigate('/');
@@ -255,7 +281,20 @@ const App = () => {
       setDiceRoll(payload);
       diceChannelRef.current?.postMessage({ type: 'DiceRoll', payload });
     } else if (message?.type === 'DiceLogEntry' && message.payload) {
-      setDiceLog((prev) => [message.payload, ...prev.filter((entry) => entry.id !== message.payload.id)].slice(0, 50));
+      setDiceLog((prev) => {
+        const entries = [message.payload, ...prev.entries.filter((entry) => entry.id !== message.payload.id)];
+        if (entries.length <= DICE_LOG_WINDOW) return { ...prev, entries };
+        return { entries: entries.slice(0, DICE_LOG_WINDOW), hasOlder: true };
+      });
+    } else if (message?.type === 'RollRequest' && message.payload?.id) {
+      setRollRequests((prev) => [...prev.filter((req) => req.id !== message.payload.id), message.payload]);
+    } else if (message?.type === 'RollRequestStatus' && message.payload?.id) {
+      setRollRequestStatuses((prev) => [
+        message.payload,
+        ...prev.filter((status) => status.id !== message.payload.id),
+      ].slice(0, 5));
+    } else if (message?.type === 'DiceCommitment' && message.payload?.commitment) {
+      diceCommitmentRef.current = message.payload.commitment;
     } else if (message?.type === 'ThemeChange' && message.payload?.theme) {
       setRoomTheme(message.payload.theme);
     }
@@ -263,37 +302,57 @@ const App = () => {
 
   const socket = useWebSocket(roomId, user, handleMessage, setConnectionError);
 
-  const sendDiceRoll = useCallback((seed, count, sides, triggeredBy) => {
-    const roller = triggeredBy || user?.name || 'Okänd';
-    const payload = { seed, count, sides, triggeredBy: roller };
-    diceChannelRef.current?.postMessage({ type: 'DiceRoll', payload });
+  // Ask for the commitment to the server seed of our next roll as soon as the
+  // socket opens; the server pushes a fresh one after every roll.
+  useEffect(() => {
+    if (!socket) return undefined;
+    diceCommitmentRef.current = '';
+    const requestCommitment = () => socket.send(JSON.stringify({ type: 'RequestDiceCommitment' }));
+    if (socket.readyState === WebSocket.OPEN) {
+      requestCommitment();
+      return undefined;
+    }
+    socket.addEventListener('open', requestCommitment);
+    return () => socket.removeEventListener('open', requestCommitment);
+  }, [socket]);
+
+  // The server derives the seed from its committed seed and our client seed,
+  // computes the results and broadcasts the DiceRoll animation and the
+  // DiceLogEntry back to every client.
+  const sendDiceRoll = useCallback((count, sides, expression, visibility = 'public', label = '') => {
     if (!socket || socket.readyState !== WebSocket.OPEN) return;
-    const message = JSON.stringify({ type: 'DiceRoll', payload });
+    const rollId = typeof crypto !== 'undefined' && crypto.randomUUID ? crypto.randomUUID() : undefined;
+    const roll = expression ? { expression } : { count, sides };
+    const payload = {
+      ...roll,
+      visibility,
+      label,
+      rollId,
+      clientSeed: newClientSeed(),
+      commitment: diceCommitmentRef.current || undefined,
+    };
+    const message = JSON.stringify({ type: 'RollDice', payload });
     socket.send(message);
-  }, [socket, user?.name]);
-
-  const handleDiceResult = useCallback((results) => {
-    if (!diceRoll) return;
-
-    const { seed, count, triggeredBy } = diceRoll;
-    const timestamp = new Date().toISOString();
-    const roller = triggeredBy || user?.name || 'Okänd';
-    const entry = { id: `${seed}-${timestamp}`, seed, count, results, timestamp, triggeredBy: roller };
-    setDiceLog((prev) => [entry, ...prev.filter((item) => item.id !== entry.id)].slice(0, 50));
-
-    if (roller === user?.name) {
-      fetch(`/rooms/${roomId}/dice`, {
-        method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ seed, count, results, triggeredBy: roller, timestamp }),
-      })
-        .then((response) => response.json())
-        .then((saved) => {
-          setDiceLog((prev) => [saved, ...prev.filter((item) => item.id !== saved.id && item.seed !== saved.seed)].slice(0, 50));
-        })
-        .catch(() => {});
-    }
-  }, [diceRoll, roomId, user?.name]);
+  }, [socket]);
+
+  // GM only: ask the given players to roll an expression. Their answers are
+  // summarised in RollRequestStatus messages.
+  const sendRollRequest = useCallback((playerIds, expression, label = '') => {
+    if (!socket || socket.readyState !== WebSocket.OPEN) return;
+    socket.send(JSON.stringify({ type: 'RollRequest', payload: { playerIds, expression, label } }));
+  }, [socket]);
+
+  // Answer a roll request; the server rolls the requested expression.
+  const answerRollRequest = useCallback((requestId) => {
+    if (!socket || socket.readyState !== WebSocket.OPEN) return;
+    const payload = {
+      requestId,
+      clientSeed: newClientSeed(),
+      commitment: diceCommitmentRef.current || undefined,
+    };
+    socket.send(JSON.stringify({ type: 'RollDice', payload }));
+    setRollRequests((prev) => prev.filter((req) => req.id !== requestId));
+  }, [socket]);
 
   const handleThemeChange = useCallback((newTheme) => {
     if (!roomId) return;
@@ -302,12 +361,15 @@ const App = () => {
     // Send to server
     fetch(`/rooms/${roomId}`, {
       method: 'PATCH',
-      headers: { 'Content-Type': 'application/json' },
+      headers: {
+        'Content-Type': 'application/json',
+        Authorization: `Bearer ${user?.token || ''}`,
+      },
       body: JSON.stringify({ theme: newTheme }),
     }).catch((err) => {
       console.error('Failed to update theme:', err);
     });
-  }, [roomId]);
+  }, [roomId, user?.token]);
 
   // Fetch initial room theme when room changes
   useEffect(() => {
@@ -376,25 +438,10 @@ const App = () => {
     setRoomSelection(roomIdentifier);
     setSharedImages([]);
     setParticipants([]);
-    setDiceLog([]);
+    setDiceLog(emptyDiceLog);
     setConnectionError('');
   }, []);
 
-  const handleLegacyLogin = useCallback((profile, room) => {
-    const trimmedRoom = (room || roomSelection || 'alpha').trim() || 'alpha';
-    setRoomSelection(trimmedRoom);
-    const nextSession = {
-      roomId: trimmedRoom,
-      roomSlug: trimmedRoom,
-      user: profile,
-    };
-    setSession(nextSession);
-    setConnectionError('');
-    setSharedImages([]);
-    setParticipants([]);
-    setDiceLog([]);
-  }, [roomSelection]);
-
   return (
     <div className="app-shell">
       {connectionError && session?.user && <p className="error">{connectionError}</p>}
@@ -405,7 +452,7 @@ const App = () => {
             session?.roomId ? (
               <Navigate to={`/rooms/${roomSlug || roomId}`} replace />
             ) : (
-              <Login onLogin={handleLegacyLogin} defaultRoom={roomSelection} onRoomChange={setRoomSelection} />
+              <Login onLogin={handleJoinSuccess} defaultRoom={roomSelection} onRoomChange={setRoomSelection} />
             )
           }
         />
@@ -422,12 +469,16 @@ const App = () => {
                 participants={participants}
                 images={sortedImages}
                 onImagesUpdate={setSharedImages}
-                onDiceLogUpdate={setDiceLog}
+                onDiceLogUpdate={updateDiceLog}
                 onLogout={handleLogout}
                 diceRoll={diceRoll}
                 onSendDiceRoll={sendDiceRoll}
-                diceLog={diceLog}
-                onDiceResult={handleDiceResult}
+                diceLog={diceLog.entries}
+                hasOlderDiceLog={diceLog.hasOlder}
+                rollRequests={rollRequests}
+                rollRequestStatuses={rollRequestStatuses}
+                onSendRollRequest={sendRollRequest}
+                onAnswerRollRequest={answerRollRequest}
                 theme={roomTheme}
                 onThemeChange={handleThemeChange}
               />
@@ -493,6 +493,7 @@ Canvas.propTypes = {
     seed: PropTypes.number,
     count: PropTypes.number,
     sides: PropTypes.number,
+    dieSides: PropTypes.arrayOf(PropTypes.number),
   }),
   onSendDiceRoll: PropTypes.func,
   onDiceResult: PropTypes.func,
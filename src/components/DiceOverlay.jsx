@@ -8,7 +8,6 @@ import {
   MAX_STEPS,
   MIN_ROLL_DURATION,
   MAX_ROLL_DURATION,
-  DICE_FACE_NORMALS,
   DICE_TYPES,
   DIE_SCALES,
   DIE_DENSITIES,
@@ -19,14 +18,18 @@ import {
   prepareDieMesh,
   createColliderForSides,
   mulberry32,
+  topFace,
+  faceTurn,
 } from './DiceRenderer.jsx';
 
+// STEP_SECONDS is the length of one physics step, played back as one frame.
+const STEP_SECONDS = 1 / 60;
+
 const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName, diceSettings }) => {
   const canvasRef = useRef(null);
   const rendererRef = useRef(null);
   const sceneRef = useRef(null);
   const rapierRef = useRef(null);
-  const worldRef = useRef(null);
   const channelRef = useRef(null);
   const instanceIdRef = useRef(typeof crypto !== 'undefined' && crypto.randomUUID ? crypto.randomUUID() : Math.random().toString(36).slice(2));
   const sharedWorkerRef = useRef(null);
@@ -36,9 +39,11 @@ const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName,
   const stepRef = useRef(0);
   const animationRef = useRef(null);
   const pendingRollRef = useRef(null);
-  const rollStartedAtRef = useRef(null);
   const [diceCount, setDiceCount] = useState(2);
   const [diceSides, setDiceSides] = useState(6);
+  const [expression, setExpression] = useState('');
+  const [visibility, setVisibility] = useState('public');
+  const [label, setLabel] = useState('');
   const [status, setStatus] = useState('idle');
   const [canvasDimensions, setCanvasDimensions] = useState({ width: ARENA_WIDTH, height: ARENA_HEIGHT });
   const [rollerName, setRollerName] = useState(null);
@@ -49,33 +54,7 @@ const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName,
 
   useEffect(() => {
     if (status !== 'settled' || !onDiceResult) return;
-
-    const world = worldRef.current;
-    if (!world) return;
-
-    const results = diceRef.current.map((die) => {
-      const body = world.getRigidBody(die.bodyHandle);
-      if (!body) return 0;
-
-      const rotation = body.rotation();
-      const quaternion = new THREE.Quaternion(rotation.x, rotation.y, rotation.z, rotation.w);
-
-      // Find the face normal that is most aligned with the Z-axis (up)
-      let maxDot = -Infinity;
-      let topValue = 0;
-      const faceNormals = DICE_FACE_NORMALS[die.sides] || [];
-
-      faceNormals.forEach(({ value, normal }) => {
-        const worldNormal = normal.clone().applyQuaternion(quaternion);
-        const dot = worldNormal.dot(new THREE.Vector3(0, 0, 1));
-        if (dot > maxDot) {
-          maxDot = dot;
-          topValue = value;
-        }
-      });
-      return topValue;
-    });
-
+    const results = diceRef.current.map((die) => die.value);
     if (results.length > 0) {
       onDiceResult(results);
     }
@@ -104,45 +83,18 @@ const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName,
     if (animationRef.current) cancelAnimationFrame(animationRef.current);
     if (settleTimeoutRef.current) clearTimeout(settleTimeoutRef.current);
     if (clearTimeoutRef.current) clearTimeout(clearTimeoutRef.current);
-    const world = worldRef.current;
-    if (world) {
-      // Remove all dice
-      diceRef.current.forEach((die) => {
-        const body = world.getRigidBody(die.bodyHandle);
-        if (body) world.removeRigidBody(body);
-        sceneRef.current?.remove(die.mesh);
-      });
-      // Clear the world completely for determinism
-      world.free();
-      worldRef.current = null;
-    }
+    diceRef.current.forEach((die) => sceneRef.current?.remove(die.mesh));
     diceRef.current = [];
     stepRef.current = 0;
     // Render one final frame to clear the canvas
-    const { renderer, camera } = rendererRef.current || {};
-    const scene = sceneRef.current;
-    if (renderer && camera && scene) {
-      renderer.render(scene, camera);
-    }
+    renderFrame();
   };
 
   const initializePhysics = useCallback(async () => {
-    if (rapierRef.current && worldRef.current) return;
+    if (rapierRef.current) return;
     const RAPIER = await import('@dimforge/rapier3d-compat');
     await RAPIER.init();
     rapierRef.current = RAPIER;
-    
-    const world = new RAPIER.World({ x: 0, y: 0, z: -1200 });
-    
-    // Set integration parameters explicitly for determinism
-    const integrationParameters = world.integrationParameters;
-    integrationParameters.dt = 1 / 60; // Match the timestep used in world.step()
-    integrationParameters.numSolverIterations = 4;
-    integrationParameters.numAdditionalFrictionIterations = 4;
-    integrationParameters.numInternalPgsIterations = 1;
-    
-    worldRef.current = world;
-    buildBounds(world, RAPIER);
   }, []);
 
   const randomInRange = (rng, min, max) => min + (max - min) * rng();
@@ -154,128 +106,127 @@ const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName,
     return quaternion;
   };
 
-  const seedDice = useCallback(async (seed, count, sides) => {
+  const isMoving = (body) => {
+    const linvel = body.linvel();
+    const angvel = body.angvel();
+    return (
+      Math.abs(linvel.x) > 1.6 ||
+      Math.abs(linvel.y) > 1.6 ||
+      Math.abs(angvel.x) > 0.25 ||
+      Math.abs(angvel.y) > 0.25 ||
+      Math.abs(angvel.z) > 0.25
+    );
+  };
+
+  // seedDice throws one die per entry of sides, each with its own shape, and
+  // simulates the throw to rest before anything is shown, recording every
+  // step. The overlay never decides a result: each model is then turned
+  // within its body so that the face ending up on top shows the server's
+  // result for that die. Dice without a model, such as a d100, are left out
+  // of the animation.
+  const seedDice = useCallback(async (seed, sides, results) => {
     const RAPIER = rapierRef.current;
     const scene = sceneRef.current;
     if (!RAPIER || !scene) return;
 
-    const modelEntry = diceModels[sides];
-    if (!modelEntry) {
-      setStatus('loading');
-      return;
-    }
-
     const rng = mulberry32(seed);
     teardown();
-    
+
     // Recreate world from scratch for determinism
     const world = new RAPIER.World({ x: 0, y: 0, z: -1200 });
     const integrationParameters = world.integrationParameters;
-    integrationParameters.dt = 1 / 60;
+    integrationParameters.dt = STEP_SECONDS;
     integrationParameters.numSolverIterations = 4;
     integrationParameters.numAdditionalFrictionIterations = 4;
     integrationParameters.numInternalPgsIterations = 1;
-    worldRef.current = world;
     buildBounds(world, RAPIER);
     const velMult = diceSettings?.velocityMultiplier ?? { x: 1, y: 1, z: 1 };
-    const dice = Array.from({ length: count }, () => {
-      const { mesh, geometry, vertices } = prepareDieMesh(modelEntry);
+    const dice = [];
+    sides.forEach((dieSides, index) => {
+      if (!diceModels[dieSides]) return;
+      const { mesh, vertices } = prepareDieMesh(diceModels[dieSides]);
       const rotation = randomRotation(rng);
-      return {
-        mesh,
-        geometry,
-        vertices,
-        position: {
-          x: randomInRange(rng, -ARENA_WIDTH / 2 + DIE_SIZE, ARENA_WIDTH / 2 - DIE_SIZE),
-          y: randomInRange(rng, -ARENA_HEIGHT / 2 + DIE_SIZE, ARENA_HEIGHT / 2 - DIE_SIZE),
-        },
-        velocity: {
-          x: randomInRange(rng, -600, 900) * velMult.x,
-          y: randomInRange(rng, 320, 620) * velMult.y,
-          z: randomInRange(rng, 0, 0) * velMult.z,
-        },
-        angularVelocity: {
-          x: randomInRange(rng, -10, 10),
-          y: randomInRange(rng, -10, 10),
-          z: randomInRange(rng, -10, 10),
-        },
-        rotation,
+      const x = randomInRange(rng, -ARENA_WIDTH / 2 + DIE_SIZE, ARENA_WIDTH / 2 - DIE_SIZE);
+      const y = randomInRange(rng, -ARENA_HEIGHT / 2 + DIE_SIZE, ARENA_HEIGHT / 2 - DIE_SIZE);
+      const velocity = {
+        x: randomInRange(rng, -600, 900) * velMult.x,
+        y: randomInRange(rng, 320, 620) * velMult.y,
+        z: randomInRange(rng, 0, 0) * velMult.z,
+      };
+      const angularVelocity = {
+        x: randomInRange(rng, -10, 10),
+        y: randomInRange(rng, -10, 10),
+        z: randomInRange(rng, -10, 10),
       };
-    });
 
-    const preparedDice = dice.map((die) => {
       const bodyDesc = RAPIER.RigidBodyDesc.dynamic()
-        .setTranslation(die.position.x, die.position.y, DIE_SIZE * 2)
-        .setRotation({ w: die.rotation.w, x: die.rotation.x, y: die.rotation.y, z: die.rotation.z })
+        .setTranslation(x, y, DIE_SIZE * 2)
+        .setRotation({ w: rotation.w, x: rotation.x, y: rotation.y, z: rotation.z })
         .setLinearDamping(0.48)
         .setAngularDamping(0.72)
         .setCcdEnabled(true);
-
       const body = world.createRigidBody(bodyDesc);
-      body.setLinvel(die.velocity, true);
-      body.setAngvel(die.angularVelocity, true);
-
-      const colliderDesc = createColliderForSides(RAPIER, sides, die.vertices);
-      colliderDesc.setDensity(DIE_DENSITIES[sides]);
+      body.setLinvel(velocity, true);
+      body.setAngvel(angularVelocity, true);
 
+      const colliderDesc = createColliderForSides(RAPIER, dieSides, vertices);
+      colliderDesc.setDensity(DIE_DENSITIES[dieSides]);
       world.createCollider(colliderDesc, body);
-      scene.add(die.mesh);
+      scene.add(mesh);
 
-      return { mesh: die.mesh, bodyHandle: body.handle, sides };
+      dice.push({ mesh, body, sides: dieSides, result: results?.[index], frames: [] });
     });
 
-    diceRef.current = preparedDice;
+    const minSteps = Math.ceil(MIN_ROLL_DURATION / 1000 / STEP_SECONDS);
+    const maxSteps = Math.min(MAX_STEPS, Math.floor(MAX_ROLL_DURATION / 1000 / STEP_SECONDS));
+    for (let step = 0; step < maxSteps; step += 1) {
+      world.step();
+      dice.forEach((die) => {
+        const translation = die.body.translation();
+        const rotation = die.body.rotation();
+        die.frames.push({
+          position: new THREE.Vector3(translation.x, translation.y, translation.z),
+          rotation: new THREE.Quaternion(rotation.x, rotation.y, rotation.z, rotation.w),
+        });
+      });
+      if (step + 1 >= minSteps && !dice.some((die) => isMoving(die.body))) break;
+    }
+    world.free();
+
+    diceRef.current = dice.map(({ mesh, sides: dieSides, result, frames }) => {
+      const top = frames.length > 0 ? topFace(dieSides, frames[frames.length - 1].rotation) : null;
+      return {
+        mesh,
+        frames,
+        turn: result === undefined ? new THREE.Quaternion() : faceTurn(dieSides, result, top),
+        value: result ?? top?.value ?? 0,
+      };
+    });
     stepRef.current = 0;
   }, [diceModels, diceSettings]);
 
   const renderFrame = () => {
     const { renderer, camera } = rendererRef.current || {};
     const scene = sceneRef.current;
-    const world = worldRef.current;
-    const RAPIER = rapierRef.current;
-    if (!renderer || !camera || !scene || !world || !RAPIER) return;
-
-    diceRef.current.forEach((die) => {
-      const body = world.getRigidBody(die.bodyHandle);
-      if (!body) return;
-      const translation = body.translation();
-      const rotation = body.rotation();
-      die.mesh.position.set(translation.x, translation.y, translation.z);
-      die.mesh.quaternion.set(rotation.x, rotation.y, rotation.z, rotation.w);
-    });
-
+    if (!renderer || !camera || !scene) return;
     renderer.render(scene, camera);
   };
 
+  // tick plays the recorded throw back, one simulation step per frame.
   const tick = () => {
-    const world = worldRef.current;
-    if (!world) return;
-    const deltaTime = 1 / 60; // Target 60 FPS
-    const maxSubSteps = 4;
-    world.step(null, deltaTime, maxSubSteps);
+    const step = stepRef.current;
+    let playing = false;
+    diceRef.current.forEach((die) => {
+      const frame = die.frames[Math.min(step, die.frames.length - 1)];
+      if (!frame) return;
+      playing = playing || step < die.frames.length - 1;
+      die.mesh.position.copy(frame.position);
+      die.mesh.quaternion.copy(frame.rotation).multiply(die.turn);
+    });
     renderFrame();
     stepRef.current += 1;
-    const elapsed = rollStartedAtRef.current
-      ? (typeof performance !== 'undefined' ? performance.now() : Date.now()) - rollStartedAtRef.current
-      : 0;
-    const exceededDuration = elapsed > MAX_ROLL_DURATION;
-    const pastMinimumDuration = elapsed >= MIN_ROLL_DURATION;
-
-    const stillMoving = diceRef.current.some((die) => {
-      const body = world.getRigidBody(die.bodyHandle);
-      if (!body) return false;
-      const linvel = body.linvel();
-      const angvel = body.angvel();
-      return (
-        Math.abs(linvel.x) > 1.6 ||
-        Math.abs(linvel.y) > 1.6 ||
-        Math.abs(angvel.x) > 0.25 ||
-        Math.abs(angvel.y) > 0.25 ||
-        Math.abs(angvel.z) > 0.25
-      );
-    });
 
-    if ((stepRef.current < MAX_STEPS && stillMoving && !exceededDuration) || (!pastMinimumDuration && !exceededDuration)) {
+    if (playing) {
       animationRef.current = requestAnimationFrame(tick);
     } else {
       if (settleTimeoutRef.current) {
@@ -287,10 +238,10 @@ const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName,
   };
 
   const startSimulation = useCallback(
-    async (seed, count, sides) => {
-      if (!modelsReady || !diceModels[sides]) {
+    async (seed, sides, results) => {
+      if (!modelsReady) {
         setStatus('loading');
-        pendingRollRef.current = { seed, count, sides };
+        pendingRollRef.current = { seed, sides, results };
         return;
       }
 
@@ -299,24 +250,23 @@ const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName,
       if (settleTimeoutRef.current) clearTimeout(settleTimeoutRef.current);
       settleTimeoutRef.current = setTimeout(() => setStatus('settled'), 3200);
       await initializePhysics();
-      await seedDice(seed, count, sides);
-      rollStartedAtRef.current = typeof performance !== 'undefined' ? performance.now() : Date.now();
+      await seedDice(seed, sides, results);
       animationRef.current = requestAnimationFrame(tick);
     },
-    [initializePhysics, modelsReady, seedDice, diceModels]
+    [initializePhysics, modelsReady, seedDice]
   );
 
   useEffect(() => {
     if (modelsReady && pendingRollRef.current) {
       const pending = pendingRollRef.current;
       pendingRollRef.current = null;
-      startSimulation(pending.seed, pending.count, pending.sides);
+      startSimulation(pending.seed, pending.sides, pending.results);
     }
   }, [modelsReady, startSimulation]);
 
   const postLocalRoll = useCallback(
-    (seed, count, sides) => {
-      const message = { type: 'dice-roll', seed, count, sides, room: roomKey, source: instanceIdRef.current };
+    (seed, sides, results) => {
+      const message = { type: 'dice-roll', seed, sides, results, room: roomKey, source: instanceIdRef.current };
       if (sharedWorkerRef.current) {
         sharedWorkerRef.current.postMessage(message);
       }
@@ -330,11 +280,10 @@ const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName,
   const handleIncomingRoll = useCallback(
     (data) => {
       if (!data || data.type !== 'dice-roll' || data.room !== roomKey || data.source === instanceIdRef.current) return;
-      const nextSides = data.sides || diceSides;
-      setDiceSides(nextSides);
-      startSimulation(data.seed, data.count, nextSides);
+      if (!Array.isArray(data.sides)) return;
+      startSimulation(data.seed, data.sides, data.results);
     },
-    [diceSides, roomKey, startSimulation]
+    [roomKey, startSimulation]
   );
 
   useEffect(() => {
@@ -372,7 +321,6 @@ const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName,
     return () => {
       resizeObserver.disconnect();
       teardown();
-      worldRef.current = null;
       rendererRef.current?.renderer?.dispose();
       rendererRef.current = null;
       sceneRef.current = null;
@@ -383,11 +331,13 @@ const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName,
 
   useEffect(() => {
     if (!diceRoll || !diceRoll.seed || !diceRoll.count) return;
-    const nextSides = diceRoll.sides || diceSides;
+    // Server rolls give the sides of every die; legacy rolls one kind of die.
+    const sides = diceRoll.dieSides?.length
+      ? diceRoll.dieSides
+      : Array(diceRoll.count).fill(diceRoll.sides || diceSides);
     setRollerName(diceRoll.triggeredBy || 'Okänd');
-    postLocalRoll(diceRoll.seed, diceRoll.count, nextSides);
-    if (diceRoll.sides) setDiceSides(diceRoll.sides);
-    startSimulation(diceRoll.seed, diceRoll.count, nextSides);
+    postLocalRoll(diceRoll.seed, sides, diceRoll.results);
+    startSimulation(diceRoll.seed, sides, diceRoll.results);
     // eslint-disable-next-line react-hooks/exhaustive-deps
   }, [diceRoll]);
 
@@ -430,22 +380,26 @@ const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName,
     // eslint-disable-next-line react-hooks/exhaustive-deps
   }, [channelName, handleIncomingRoll]);
 
-  const broadcastRoll = (seed, count, sides, triggeredBy) => {
-    postLocalRoll(seed, count, sides);
-    if (!onSendDiceRoll) return;
-    onSendDiceRoll(seed, count, sides, triggeredBy);
-  };
-
   const rollDice = () => {
+    if (onSendDiceRoll) {
+      // The server draws the seed and broadcasts the roll back to every client
+      // allowed to see it. Blind rolls never come back to the roller.
+      if (visibility !== 'blind') {
+        setRollerName(userName || 'Okänd');
+        setStatus('rolling');
+      }
+      onSendDiceRoll(diceCount, diceSides, expression.trim(), visibility, label.trim());
+      return;
+    }
+    setRollerName(userName || 'Okänd');
+    setStatus('rolling');
     const hasCrypto = typeof crypto !== 'undefined' && typeof crypto.getRandomValues === 'function';
     const seed = hasCrypto
       ? crypto.getRandomValues(new Uint32Array(1))[0]
       : Math.floor(Math.random() * 1_000_000_000) || Date.now();
-    const triggeredBy = userName || 'Okänd';
-    setRollerName(triggeredBy);
-    setStatus('rolling');
-    broadcastRoll(seed, diceCount, diceSides, triggeredBy);
-    startSimulation(seed, diceCount, diceSides);
+    const sides = Array(diceCount).fill(diceSides);
+    postLocalRoll(seed, sides);
+    startSimulation(seed, sides);
   };
 
   const isRollingDisabled = !modelsReady || status === 'rolling';
@@ -488,6 +442,39 @@ const DiceOverlay = ({ roomId, diceRoll, onSendDiceRoll, onDiceResult, userName,
             </button>
           ))}
         </div>
+        {onSendDiceRoll && (
+          <input
+            type="text"
+            className="dice-expression"
+            value={expression}
+            onChange={(event) => setExpression(event.target.value)}
+            placeholder="e.g. 2d6+3, 1d20 adv"
+            aria-label="dice expression"
+          />
+        )}
+        {onSendDiceRoll && (
+          <input
+            type="text"
+            className="dice-expression"
+            value={label}
+            onChange={(event) => setLabel(event.target.value)}
+            placeholder="Label"
+            maxLength={100}
+            aria-label="roll label"
+          />
+        )}
+        {onSendDiceRoll && (
+          <select
+            className="dice-visibility"
+            value={visibility}
+            onChange={(event) => setVisibility(event.target.value)}
+            aria-label="roll visibility"
+          >
+            <option value="public">Public</option>
+            <option value="gm">GM only</option>
+            <option value="blind">Blind</option>
+          </select>
+        )}
         <button
           type="button"
           className="roll-button"
@@ -511,6 +498,7 @@ DiceOverlay.propTypes = {
     seed: PropTypes.number,
     count: PropTypes.number,
     sides: PropTypes.number,
+    dieSides: PropTypes.arrayOf(PropTypes.number),
     triggeredBy: PropTypes.string,
   }),
   onSendDiceRoll: PropTypes.func,
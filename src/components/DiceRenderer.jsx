@@ -86,6 +86,67 @@ export const DICE_FACE_NORMALS = {
   ],
 };
 
+const UP = new THREE.Vector3(0, 0, 1);
+
+// topFace returns the face of a die that points up when the die is turned by
+// quaternion.
+export const topFace = (sides, quaternion) => {
+  let top = null;
+  let maxDot = -Infinity;
+  (DICE_FACE_NORMALS[sides] || []).forEach((face) => {
+    const dot = face.normal.clone().applyQuaternion(quaternion).dot(UP);
+    if (dot > maxDot) {
+      maxDot = dot;
+      top = face;
+    }
+  });
+  return top;
+};
+
+// faceBasis is an orthonormal basis with its first axis along a face normal
+// and its second towards a neighbouring face.
+const faceBasis = (normal, neighbour) => {
+  const axis = normal.clone().normalize();
+  const side = neighbour.clone().addScaledVector(axis, -neighbour.dot(axis)).normalize();
+  return new THREE.Matrix4().makeBasis(axis, side, axis.clone().cross(side));
+};
+
+// faceTurn returns the rotation, in the die's own frame, that brings the face
+// showing value to where the face toFace is. Of the rotations that do so it
+// picks the one that best maps the die onto itself, so a die turned by it
+// still rests flat where the throw left it.
+export const faceTurn = (sides, value, toFace) => {
+  const faces = DICE_FACE_NORMALS[sides] || [];
+  const from = faces.find((face) => face.value === value);
+  if (!from || !toFace || from === toFace) return new THREE.Quaternion();
+
+  let neighbour = null;
+  faces.forEach((face) => {
+    if (face !== toFace && (!neighbour || face.normal.dot(toFace.normal) > neighbour.normal.dot(toFace.normal))) {
+      neighbour = face;
+    }
+  });
+  const target = faceBasis(toFace.normal, neighbour.normal);
+  const angle = neighbour.normal.dot(toFace.normal);
+
+  let best = null;
+  let bestError = Infinity;
+  faces.forEach((face) => {
+    if (face === from || Math.abs(face.normal.dot(from.normal) - angle) > 0.05) return;
+    const turn = target.clone().multiply(faceBasis(from.normal, face.normal).transpose());
+    const error = faces.reduce((sum, { normal }) => {
+      const turned = normal.clone().transformDirection(turn);
+      return sum + 1 - Math.max(...faces.map((other) => turned.dot(other.normal)));
+    }, 0);
+    if (error < bestError) {
+      bestError = error;
+      best = turn;
+    }
+  });
+  if (!best) return new THREE.Quaternion().setFromUnitVectors(from.normal, toFace.normal);
+  return new THREE.Quaternion().setFromRotationMatrix(best);
+};
+
 export const DICE_TYPES = [4, 6, 8, 10, 12, 20];
 
 export const DIE_SCALES = {
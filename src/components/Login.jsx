@@ -52,8 +52,24 @@ const Login = ({ onLogin, defaultRoom, onRoomChange }) => {
 
     if (!gmCheckPassed) return;
 
-    onLogin({ name, role }, room);
-    onRoomChange?.(room);
+    try {
+      setSubmitting(true);
+      const response = await fetch('/rooms/join', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ slug: room, name, role }),
+      });
+      const payload = await response.json().catch(() => ({}));
+      if (!response.ok) {
+        throw new Error(payload?.error || 'Could not join room.');
+      }
+      onLogin(payload, room);
+      onRoomChange?.(payload.roomSlug || room);
+    } catch (err) {
+      setError(err.message || 'Could not join room.');
+    } finally {
+      setSubmitting(false);
+    }
   };
 
   const handleCreate = async (event) => {
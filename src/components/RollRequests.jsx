@@ -0,0 +1,143 @@
+import { useState } from 'react';
+import PropTypes from 'prop-types';
+
+const requestTitle = (req) => (req.label ? `${req.label} (${req.expression})` : req.expression);
+
+// RollRequestPrompts lists the GM's open roll requests for this player.
+export const RollRequestPrompts = ({ requests, onAnswer }) => {
+  const open = requests.filter((req) => !req.expiresAt || new Date(req.expiresAt).getTime() > Date.now());
+  if (!open.length) return null;
+  return (
+    <ul className="roll-requests">
+      {open.map((req) => (
+        <li key={req.id} className="roll-requests__item">
+          <span>
+            {req.requestedBy || 'The GM'} asks you to roll <strong>{requestTitle(req)}</strong>
+          </span>
+          <button type="button" className="primary" onClick={() => onAnswer(req.id)}>
+            Roll
+          </button>
+        </li>
+      ))}
+    </ul>
+  );
+};
+
+RollRequestPrompts.propTypes = {
+  requests: PropTypes.arrayOf(
+    PropTypes.shape({
+      id: PropTypes.string.isRequired,
+      expression: PropTypes.string,
+      label: PropTypes.string,
+      requestedBy: PropTypes.string,
+      expiresAt: PropTypes.string,
+    })
+  ).isRequired,
+  onAnswer: PropTypes.func.isRequired,
+};
+
+// RollRequestPanel lets the GM ask players to roll and follow their answers.
+export const RollRequestPanel = ({ participants, statuses, onSend }) => {
+  const [expression, setExpression] = useState('1d20');
+  const [label, setLabel] = useState('');
+  const [selected, setSelected] = useState([]);
+  // A player with several tabs open appears once per socket in the roster.
+  const players = participants.filter((participant, index) => participant.role !== 'gm'
+    && participant.id
+    && participants.findIndex((other) => other.id === participant.id) === index);
+
+  const toggle = (id) => {
+    setSelected((prev) => (prev.includes(id) ? prev.filter((p) => p !== id) : [...prev, id]));
+  };
+
+  const handleSubmit = (event) => {
+    event.preventDefault();
+    const targets = selected.length ? selected : players.map((player) => player.id);
+    if (!targets.length || !expression.trim()) return;
+    onSend(targets, expression.trim(), label.trim());
+  };
+
+  return (
+    <div className="gm-tools__section">
+      <h4>Roll Requests</h4>
+      <form className="roll-request-form" onSubmit={handleSubmit}>
+        <div className="gm-tools__row">
+          <label htmlFor="gm-request-expression">Expression</label>
+          <input
+            id="gm-request-expression"
+            type="text"
+            value={expression}
+            onChange={(e) => setExpression(e.target.value)}
+          />
+        </div>
+        <div className="gm-tools__row">
+          <label htmlFor="gm-request-label">Label</label>
+          <input
+            id="gm-request-label"
+            type="text"
+            value={label}
+            placeholder="Perception"
+            onChange={(e) => setLabel(e.target.value)}
+          />
+        </div>
+        <div className="roll-request-form__players">
+          {players.map((player) => (
+            <label key={player.id}>
+              <input type="checkbox" checked={selected.includes(player.id)} onChange={() => toggle(player.id)} />
+              {player.name}
+            </label>
+          ))}
+        </div>
+        <button type="submit" className="ghost-button" disabled={!players.length}>
+          {selected.length ? 'Request roll' : 'Request roll from everyone'}
+        </button>
+      </form>
+      {statuses.map((status) => (
+        <div key={status.id} className="gm-tools__subsection">
+          <span className="gm-tools__subsection-label">
+            {requestTitle(status)}: {status.answered}/{status.targets}
+            {status.timedOut ? ' (timed out)' : ''}
+            {status.done && !status.timedOut ? ' (done)' : ''}
+          </span>
+          <ul className="roll-request-status">
+            {status.responses.map((response) => (
+              <li key={response.playerId}>
+                {response.name}: {response.answered ? <strong>{response.total}</strong> : 'waiting…'}
+              </li>
+            ))}
+          </ul>
+        </div>
+      ))}
+    </div>
+  );
+};
+
+RollRequestPanel.propTypes = {
+  participants: PropTypes.arrayOf(
+    PropTypes.shape({
+      id: PropTypes.string,
+      name: PropTypes.string,
+      role: PropTypes.string,
+    })
+  ).isRequired,
+  statuses: PropTypes.arrayOf(
+    PropTypes.shape({
+      id: PropTypes.string.isRequired,
+      expression: PropTypes.string,
+      label: PropTypes.string,
+      answered: PropTypes.number,
+      targets: PropTypes.number,
+      done: PropTypes.bool,
+      timedOut: PropTypes.bool,
+      responses: PropTypes.arrayOf(
+        PropTypes.shape({
+          playerId: PropTypes.string,
+          name: PropTypes.string,
+          answered: PropTypes.bool,
+          total: PropTypes.number,
+        })
+      ),
+    })
+  ).isRequired,
+  onSend: PropTypes.func.isRequired,
+};
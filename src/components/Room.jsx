@@ -2,6 +2,7 @@ import { useEffect, useMemo, useState } from 'react';
 import PropTypes from 'prop-types';
 import { Link } from 'react-router-dom';
 import Canvas from './Canvas.jsx';
+import { RollRequestPanel, RollRequestPrompts } from './RollRequests.jsx';
 
 // Theme definitions with preview colors
 const THEMES = [
@@ -41,11 +42,44 @@ const THEMES = [
   { id: 'maroon', name: 'Maroon', colors: ['#1a0808', '#881337', '#be123c'] },
 ];
 
-const fetchImages = async (roomId) => {
+const authHeaders = (token, headers = {}) => (token ? { ...headers, Authorization: `Bearer ${token}` } : headers);
+
+// Idempotency keys let the server replay, rather than repeat, a retried POST.
+const newRequestId = () => (typeof crypto !== 'undefined' && crypto.randomUUID
+  ? crypto.randomUUID()
+  : `${Date.now()}-${Math.random().toString(36).slice(2)}`);
+
+// The dice history is paginated newest first; X-Next-Cursor points at the
+// next (older) page.
+// customFaceLabel finds the label of a custom die's face in the definitions
+// the roll was made with.
+const customFaceLabel = (entry, dieIndex) => {
+  const pool = entry.rule?.dice?.[dieIndex]?.pool;
+  const faces = entry.spec?.dice?.find((die) => die.name === pool)?.faces;
+  return faces?.find((face) => face.id === entry.faces[dieIndex])?.label ?? entry.faces[dieIndex];
+};
+
+// diceLogCursor encodes an entry's position in the log as the server encodes
+// X-Next-Cursor, so older rolls can be paged in after whichever entry is now
+// the oldest one kept.
+const diceLogCursor = (entry) =>
+  btoa(`${entry.timestamp}|${entry.id}`).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+
+const fetchDiceLog = async (roomId, token, before) => {
+  const query = before ? `?before=${encodeURIComponent(before)}` : '';
+  const response = await fetch(`/rooms/${roomId}/dice${query}`, {
+    headers: authHeaders(token, { 'Accept': 'application/json' }),
+  });
+  if (!response.ok) throw new Error('Failed to load dice log');
+  const log = await response.json();
+  return { log: Array.isArray(log) ? log : [], nextCursor: response.headers.get('X-Next-Cursor') || '' };
+};
+
+const fetchImages = async (roomId, token) => {
   const response = await fetch(`/rooms/${roomId}/images`, {
-    headers: {
+    headers: authHeaders(token, {
       'Accept': 'application/json',
-    },
+    }),
   });
   if (!response.ok) throw new Error('Failed to load images');
   return response.json();
@@ -63,6 +97,11 @@ const Room = ({
   diceRoll,
   onSendDiceRoll,
   diceLog,
+  hasOlderDiceLog,
+  rollRequests,
+  rollRequestStatuses,
+  onSendRollRequest,
+  onAnswerRollRequest,
   onDiceResult,
   theme,
   onThemeChange,
@@ -81,7 +120,7 @@ const Room = ({
   useEffect(() => {
     setLoading(true);
     setError('');
-    fetchImages(roomId)
+    fetchImages(roomId, user.token)
       .then((data) => {
         if (!Array.isArray(data)) {
           console.error('fetchImages returned non-array:', data);
@@ -92,26 +131,29 @@ const Room = ({
       .catch((err) => setError(err.message))
       .finally(() => setLoading(false));
     if (onDiceLogUpdate) {
-      fetch(`/rooms/${roomId}/dice`, {
-        headers: {
-          'Accept': 'application/json',
-        },
-      })
-        .then((response) => {
-          if (!response.ok) throw new Error('Failed to load dice log');
-          return response.json();
-        })
-        .then((log) => onDiceLogUpdate(Array.isArray(log) ? log : []))
+      fetchDiceLog(roomId, user.token)
+        .then(({ log, nextCursor }) => onDiceLogUpdate(log, nextCursor !== ''))
         .catch((err) => setError((prev) => prev || err.message));
     }
-  }, [roomId, onImagesUpdate, onDiceLogUpdate]);
+  }, [roomId, user.token, onImagesUpdate, onDiceLogUpdate]);
+
+  const loadOlderDiceLog = async () => {
+    if (!hasOlderDiceLog || !diceLog?.length || !onDiceLogUpdate) return;
+    try {
+      const { log, nextCursor } = await fetchDiceLog(roomId, user.token, diceLogCursor(diceLog[diceLog.length - 1]));
+      const known = new Set(diceLog.map((entry) => entry.id));
+      onDiceLogUpdate([...diceLog, ...log.filter((entry) => !known.has(entry.id))], nextCursor !== '');
+    } catch (err) {
+      setError(err.message);
+    }
+  };
 
   const persistPosition = async (imageId, position) => {
     if (!position) return;
     try {
       const response = await fetch(`/rooms/${roomId}/images/${imageId}`, {
         method: 'PATCH',
-        headers: { 'Content-Type': 'application/json' },
+        headers: authHeaders(user.token, { 'Content-Type': 'application/json' }),
         body: JSON.stringify(position),
       });
       const payload = await response.json();
@@ -131,7 +173,11 @@ const Room = ({
     try {
       const formData = new FormData();
       validFiles.forEach((file) => formData.append('file', file));
-      const response = await fetch(`/rooms/${roomId}/images`, { method: 'POST', body: formData });
+      const response = await fetch(`/rooms/${roomId}/images`, {
+        method: 'POST',
+        headers: authHeaders(user.token, { 'Idempotency-Key': newRequestId() }),
+        body: formData,
+      });
       const payload = await response.json();
       if (!response.ok) throw new Error(payload?.message || 'Upload failed');
       const uploaded = Array.isArray(payload) ? payload : [payload];
@@ -159,7 +205,7 @@ const Room = ({
       setError('');
       const response = await fetch(`/rooms/${roomId}/images`, {
         method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
+        headers: authHeaders(user.token, { 'Content-Type': 'application/json', 'Idempotency-Key': newRequestId() }),
         body: JSON.stringify({ url }),
       });
       const payload = await response.json();
@@ -185,7 +231,7 @@ const Room = ({
     try {
       const response = await fetch(`/rooms/${roomId}/images/${imageId}`, {
         method: 'PATCH',
-        headers: { 'Content-Type': 'application/json' },
+        headers: authHeaders(user.token, { 'Content-Type': 'application/json' }),
         body: JSON.stringify(size),
       });
       const payload = await response.json();
@@ -201,7 +247,10 @@ const Room = ({
     // Optimistically remove locally; rely on server DELETE success
     onImagesUpdate((prev) => prev.filter((img) => img.id !== imageId));
     try {
-      const response = await fetch(`/rooms/${roomId}/images/${imageId}`, { method: 'DELETE' });
+      const response = await fetch(`/rooms/${roomId}/images/${imageId}`, {
+        method: 'DELETE',
+        headers: authHeaders(user.token),
+      });
       if (!response.ok) throw new Error('Failed to remove image');
       // Do not refetch; keeps client state authoritative for tests and avoids duplication
     } catch (err) {
@@ -216,7 +265,7 @@ const Room = ({
     try {
       const response = await fetch(`/rooms/${roomId}/images/${imageId}`, {
         method: 'PATCH',
-        headers: { 'Content-Type': 'application/json' },
+        headers: authHeaders(user.token, { 'Content-Type': 'application/json' }),
         body: JSON.stringify({ hidden }),
       });
       const payload = await response.json();
@@ -269,6 +318,10 @@ const Room = ({
         </div>
       )}
 
+      {onAnswerRollRequest && (
+        <RollRequestPrompts requests={rollRequests || []} onAnswer={onAnswerRollRequest} />
+      )}
+
       <div className="room-main">
         <Canvas
           images={images}
@@ -330,13 +383,41 @@ const Room = ({
                   {diceLog.map((entry, index) => (
                     <li key={entry.id || `${entry.seed}-${index}`} className="log-window__item">
                       <div className="log-window__meta">
-                        <span>Roll by {entry.triggeredBy || 'Unknown'}</span>
-                        <span className="log-window__seed">Seed: {entry.seed}</span>
+                        <span>
+                          Roll by {entry.triggeredBy || 'Unknown'}
+                          {entry.visibility && entry.visibility !== 'public' ? ` (${entry.visibility})` : ''}
+                        </span>
+                        <span className="log-window__seed">
+                          Seed: {entry.seed}
+                          {entry.serverSeed && (!entry.visibility || entry.visibility === 'public') ? (
+                            <a
+                              className="log-window__verify"
+                              href={`/rooms/${roomId}/dice/${entry.id}/verify`}
+                              target="_blank"
+                              rel="noreferrer"
+                              title={`Commitment ${entry.commitment}`}
+                            >
+                              Verify
+                            </a>
+                          ) : null}
+                        </span>
                       </div>
+                      {entry.label ? <div className="log-window__label">{entry.label}</div> : null}
+                      {entry.expression ? (
+                        <div className="log-window__expression">
+                          {entry.expression} = <strong>{entry.total}</strong>
+                          {entry.rule?.symbols
+                            ? ` (${Object.entries(entry.rule.symbols).map(([symbol, count]) => `${count} ${symbol}`).join(', ')})`
+                            : null}
+                        </div>
+                      ) : null}
+                      {entry.rule?.text ? <div className="log-window__table">{entry.rule.text}</div> : null}
                       <div className="log-window__dice">
                         {entry.results.map((result, dieIndex) => (
                           <span key={`${entry.id}-${dieIndex}`} className="log-window__die">
-                            Die {dieIndex + 1}: {result}
+                            {entry.faces?.[dieIndex]
+                              ? `${entry.rule?.dice?.[dieIndex]?.pool || `Die ${dieIndex + 1}`}: ${customFaceLabel(entry, dieIndex)}`
+                              : `${entry.sides?.[dieIndex] ? `d${entry.sides[dieIndex]}` : `Die ${dieIndex + 1}`}: ${result}`}
                           </span>
                         ))}
                       </div>
@@ -346,6 +427,11 @@ const Room = ({
               ) : (
                 <p className="log-window__empty">No dice results yet.</p>
               )}
+              {hasOlderDiceLog && (
+                <button type="button" className="log-window__more" onClick={loadOlderDiceLog}>
+                  Load older rolls
+                </button>
+              )}
             </section>
           </div>
         )}
@@ -451,6 +537,14 @@ const Room = ({
                   </div>
                 </div>
 
+                {onSendRollRequest && (
+                  <RollRequestPanel
+                    participants={participants}
+                    statuses={rollRequestStatuses || []}
+                    onSend={onSendRollRequest}
+                  />
+                )}
+
                 <div className="gm-tools__section">
                   <h4>Room Theme</h4>
                   <div className="theme-selector">
@@ -549,8 +643,10 @@ Room.propTypes = {
     seed: PropTypes.number,
     count: PropTypes.number,
     sides: PropTypes.number,
+    dieSides: PropTypes.arrayOf(PropTypes.number),
   }),
   onSendDiceRoll: PropTypes.func,
+  hasOlderDiceLog: PropTypes.bool,
   diceLog: PropTypes.arrayOf(
     PropTypes.shape({
       id: PropTypes.string,
@@ -559,8 +655,24 @@ Room.propTypes = {
       results: PropTypes.arrayOf(PropTypes.number),
       triggeredBy: PropTypes.string,
       timestamp: PropTypes.string,
+      expression: PropTypes.string,
+      total: PropTypes.number,
+      visibility: PropTypes.string,
+      sides: PropTypes.arrayOf(PropTypes.number),
+      label: PropTypes.string,
+      modifier: PropTypes.number,
+      commitment: PropTypes.string,
+      serverSeed: PropTypes.string,
+      clientSeed: PropTypes.string,
+      faces: PropTypes.arrayOf(PropTypes.string),
+      spec: PropTypes.object,
+      rule: PropTypes.object,
     })
   ),
+  rollRequests: PropTypes.arrayOf(PropTypes.object),
+  rollRequestStatuses: PropTypes.arrayOf(PropTypes.object),
+  onSendRollRequest: PropTypes.func,
+  onAnswerRollRequest: PropTypes.func,
   onDiceResult: PropTypes.func,
   theme: PropTypes.string,
   onThemeChange: PropTypes.func,